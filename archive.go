@@ -0,0 +1,400 @@
+package sparsified
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"slices"
+	"sort"
+	"sync"
+)
+
+// Seekable compressed archives of sparse files.
+//
+// An archive is written front to back, so it can go to a
+// pipe, and read back from the end:
+//
+//	0             archiveHeader: magic
+//	16..          frames: each a raw deflate stream of at most
+//	              FrameSize bytes of one data extent, or the
+//	              bytes themselves if they would not compress
+//	IndexOffset   archiveFrame entries, sorted by Offset
+//	end-48        archiveFooter
+//
+// Holes are not stored at all: they are the gaps between the
+// frames in the index. Frames are compressed independently,
+// so a ReadAt needs one binary search and at most one frame
+// per FrameSize bytes read. All integers are little endian.
+
+const (
+	archiveMagic      = "SPRSARC1"
+	archiveVersion    = 1
+	archiveFrameSize  = 1 << 20
+	archiveMaxFrame   = 64 << 20 // caps the buffers a reader allocates.
+	archiveFlagStored = 1 << 0   // frame is not compressed.
+)
+
+type archiveHeader struct {
+	Magic   [8]byte
+	Version uint32
+	Pad     uint32
+}
+
+// archiveFrame is an index entry. Packed, 32 bytes.
+type archiveFrame struct {
+	Offset    uint64 // in the sparse file.
+	Length    uint32 // uncompressed.
+	CRC       uint32 // Castagnoli, of the uncompressed bytes.
+	Stored    uint64 // where the frame starts in the archive.
+	StoredLen uint32
+	Flags     uint32
+}
+
+func (f *archiveFrame) end() int64 {
+	return int64(f.Offset) + int64(f.Length)
+}
+
+type archiveFooter struct {
+	IndexOffset uint64
+	Frames      uint64
+	Size        uint64 // of the sparse file.
+	FrameSize   uint64
+	IndexCRC    uint32
+	Version     uint32
+	Magic       [8]byte
+}
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// RawToArchive writes src to dst as a seekable compressed
+// archive: each data extent of src is cut into frames of
+// Options.FrameSize bytes (1MB by default) compressed
+// independently with compress/flate, holes are kept only in
+// the index, and the index goes at the end. Smaller frames
+// make random reads cheaper, larger ones compress better.
+//
+// Like RawToVMDK it writes strictly sequentially, so dst can
+// be a pipe, and Options.ResumeAt is ignored.
+func RawToArchive(ctx context.Context, dst io.Writer, src SparseFile, opts *Options) (err error) {
+	defer func() { err = opError("archive", src.Name(), 0, 0, err) }()
+	src = withHooks(src, opts)
+	frameSize := int64(archiveFrameSize)
+	if opts != nil && opts.FrameSize > 0 {
+		frameSize = min(opts.FrameSize, archiveMaxFrame)
+	}
+	size, err := sparseSize(src)
+	if err != nil {
+		return err
+	}
+	exts, err := src.Extents()
+	if err != nil {
+		return err
+	}
+	pr := newProgress(ctx, "archive", opts, size, dataBytes(exts))
+	defer func() { err = pr.done(err) }()
+
+	w := bufio.NewWriterSize(dst, 1<<20)
+	pos := int64(0)
+	put := func(p []byte) error {
+		n, err := w.Write(p)
+		pos += int64(n)
+		return err
+	}
+	var buf bytes.Buffer
+	hdr := &archiveHeader{Version: archiveVersion}
+	copy(hdr.Magic[:], archiveMagic)
+	binary.Write(&buf, binary.LittleEndian, hdr)
+	if err = put(buf.Bytes()); err != nil {
+		return err
+	}
+
+	var index []archiveFrame
+	raw := make([]byte, frameSize)
+	zw, _ := flate.NewWriter(nil, flate.DefaultCompression)
+	for _, e := range exts {
+		if e.Hole {
+			if err = pr.hole(e.Offset, e.Length); err != nil {
+				return err
+			}
+			continue
+		}
+		for off := e.Offset; off < e.End(); off += frameSize {
+			n := min(frameSize, e.End()-off)
+			if _, err = src.ReadAt(raw[:n], off); err != nil && err != io.EOF {
+				return err
+			}
+			fr := archiveFrame{
+				Offset: uint64(off),
+				Length: uint32(n),
+				CRC:    crc32.Checksum(raw[:n], castagnoli),
+				Stored: uint64(pos),
+			}
+			buf.Reset()
+			zw.Reset(&buf)
+			zw.Write(raw[:n])
+			zw.Close()
+			stored := buf.Bytes()
+			if int64(len(stored)) >= n {
+				stored = raw[:n]
+				fr.Flags |= archiveFlagStored
+			}
+			fr.StoredLen = uint32(len(stored))
+			if err = put(stored); err != nil {
+				return err
+			}
+			index = append(index, fr)
+			if err = pr.data(off, n); err != nil {
+				return err
+			}
+		}
+	}
+
+	ft := &archiveFooter{
+		IndexOffset: uint64(pos),
+		Frames:      uint64(len(index)),
+		Size:        uint64(size),
+		FrameSize:   uint64(frameSize),
+		Version:     archiveVersion,
+	}
+	copy(ft.Magic[:], archiveMagic)
+	buf.Reset()
+	binary.Write(&buf, binary.LittleEndian, index)
+	ft.IndexCRC = crc32.Checksum(buf.Bytes(), castagnoli)
+	binary.Write(&buf, binary.LittleEndian, ft)
+	if err = put(buf.Bytes()); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+// ArchiveReader reads an archive written by RawToArchive as
+// the sparse file it holds. It is safe for concurrent use.
+type ArchiveReader struct {
+	r      io.ReaderAt
+	name   string
+	size   int64
+	frames []archiveFrame
+
+	mu     sync.Mutex
+	cached int // index of the frame in buf, or -1.
+	buf    []byte
+	zr     io.ReadCloser
+}
+
+// OpenArchive reads the index of the archive in the first n
+// bytes of r. Errors name r if it has a Name method, as an
+// *os.File does.
+func OpenArchive(r io.ReaderAt, n int64) (a *ArchiveReader, err error) {
+	name := "archive"
+	if nr, ok := r.(interface{ Name() string }); ok {
+		name = nr.Name()
+	}
+	defer func() { err = opError("archive open", name, 0, 0, err) }()
+	ft := &archiveFooter{}
+	flen := int64(binary.Size(ft))
+	if n < int64(binary.Size(archiveHeader{}))+flen {
+		return nil, fmt.Errorf("OpenArchive: too short (%v bytes) to be an archive", n)
+	}
+	if err = readLE(r, n-flen, ft); err != nil {
+		return nil, fmt.Errorf("OpenArchive: reading footer: %w", err)
+	}
+	if string(ft.Magic[:]) != archiveMagic {
+		return nil, fmt.Errorf("OpenArchive: not an archive (magic %q)", ft.Magic[:])
+	}
+	if ft.Version != archiveVersion {
+		return nil, fmt.Errorf("OpenArchive: version %v is not supported", ft.Version)
+	}
+	isize := int64(ft.Frames) * int64(binary.Size(archiveFrame{}))
+	if int64(ft.IndexOffset)+isize != n-flen || ft.Frames > uint64(n) {
+		return nil, fmt.Errorf("OpenArchive: corrupt footer: index at %v with %v frames", ft.IndexOffset, ft.Frames)
+	}
+	if ft.FrameSize == 0 || ft.FrameSize > archiveMaxFrame {
+		return nil, fmt.Errorf("OpenArchive: corrupt footer: frame size %v", ft.FrameSize)
+	}
+	raw := make([]byte, isize)
+	if _, err = r.ReadAt(raw, int64(ft.IndexOffset)); err != nil {
+		return nil, fmt.Errorf("OpenArchive: reading index: %w", err)
+	}
+	if crc32.Checksum(raw, castagnoli) != ft.IndexCRC {
+		return nil, fmt.Errorf("OpenArchive: index checksum mismatch")
+	}
+	a = &ArchiveReader{r: r, name: name, size: int64(ft.Size), frames: make([]archiveFrame, ft.Frames), cached: -1}
+	binary.Read(bytes.NewReader(raw), binary.LittleEndian, a.frames)
+	end := int64(0)
+	for i := range a.frames {
+		f := &a.frames[i]
+		if f.Length == 0 || uint64(f.Length) > ft.FrameSize || f.StoredLen > f.Length ||
+			int64(f.Offset) < end || f.end() > a.size || f.Stored+uint64(f.StoredLen) > ft.IndexOffset {
+			return nil, fmt.Errorf("OpenArchive: corrupt index entry %v: %+v", i, *f)
+		}
+		end = f.end()
+	}
+	return a, nil
+}
+
+// Size returns the apparent size of the sparse file.
+func (a *ArchiveReader) Size() int64 {
+	return a.size
+}
+
+// Extents returns the data and holes of the sparse file, as
+// SparseFile.Extents does.
+func (a *ArchiveReader) Extents() (exts []Extent, err error) {
+	off := int64(0)
+	for i := range a.frames {
+		f := &a.frames[i]
+		beg := int64(f.Offset)
+		switch {
+		case beg > off:
+			exts = append(exts, Extent{Offset: off, Length: beg - off, Hole: true})
+			fallthrough
+		case len(exts) == 0:
+			exts = append(exts, Extent{Offset: beg, Length: int64(f.Length)})
+		default:
+			exts[len(exts)-1].Length += int64(f.Length)
+		}
+		off = f.end()
+	}
+	if off < a.size {
+		exts = append(exts, Extent{Offset: off, Length: a.size - off, Hole: true})
+	}
+	return exts, nil
+}
+
+// ReadAt reads the sparse file, holes as zeros. It reads
+// and decompresses only the frames p overlaps, and checks
+// their checksums.
+func (a *ArchiveReader) ReadAt(p []byte, off int64) (n int, err error) {
+	defer func() {
+		if err != io.EOF {
+			err = opError("archive read", a.name, off, int64(len(p)), err)
+		}
+	}()
+	if off < 0 {
+		return 0, fmt.Errorf("ArchiveReader.ReadAt: negative offset %v", off)
+	}
+	if off >= a.size {
+		return 0, io.EOF
+	}
+	endx := min(off+int64(len(p)), a.size)
+	// the first frame that ends after off.
+	i := sort.Search(len(a.frames), func(i int) bool { return a.frames[i].end() > off })
+	for off < endx {
+		if i == len(a.frames) || int64(a.frames[i].Offset) >= endx {
+			clear(p[n : n+int(endx-off)])
+			n += int(endx - off)
+			break
+		}
+		f := &a.frames[i]
+		if beg := int64(f.Offset); beg > off {
+			clear(p[n : n+int(beg-off)])
+			n += int(beg - off)
+			off = beg
+		}
+		k, err := a.readFrame(i, p[n:n+int(min(f.end(), endx)-off)], off-int64(f.Offset))
+		n += k
+		if err != nil {
+			return n, err
+		}
+		off += int64(k)
+		i++
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// readFrame copies frame i, from off within it, into p.
+func (a *ArchiveReader) readFrame(i int, p []byte, off int64) (int, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.cached != i {
+		if err := a.load(i); err != nil {
+			a.cached = -1
+			return 0, err
+		}
+		a.cached = i
+	}
+	return copy(p, a.buf[off:]), nil
+}
+
+// load decompresses frame i into a.buf.
+func (a *ArchiveReader) load(i int) (err error) {
+	f := &a.frames[i]
+	stored := make([]byte, f.StoredLen)
+	if _, err = a.r.ReadAt(stored, int64(f.Stored)); err != nil {
+		return fmt.Errorf("ArchiveReader: reading frame %v: %w", i, err)
+	}
+	a.buf = slices.Grow(a.buf[:0], int(f.Length))[:f.Length]
+	if f.Flags&archiveFlagStored != 0 {
+		copy(a.buf, stored)
+	} else {
+		if a.zr == nil {
+			a.zr = flate.NewReader(bytes.NewReader(stored))
+		} else {
+			a.zr.(flate.Resetter).Reset(bytes.NewReader(stored), nil)
+		}
+		if _, err = io.ReadFull(a.zr, a.buf); err != nil {
+			return fmt.Errorf("ArchiveReader: decompressing frame %v: %w", i, err)
+		}
+	}
+	if crc32.Checksum(a.buf, castagnoli) != f.CRC {
+		return fmt.Errorf("ArchiveReader: frame %v at offset %v: checksum mismatch", i, f.Offset)
+	}
+	return nil
+}
+
+// ArchiveToRaw extracts the sparse file in src into dst, with
+// the holes it had: dst is truncated, and only the frames are
+// written, leaving any all-zero 4KB blocks in them as holes
+// too. It honours Options.ResumeAt, and stops between frames
+// if ctx is canceled, as VMDKToRaw does.
+func ArchiveToRaw(ctx context.Context, dst SparseFile, src *ArchiveReader, opts *Options) (err error) {
+	defer func() { err = opError("archive extract", dst.Name(), 0, 0, err) }()
+	dst = withHooks(dst, opts)
+	exts, err := src.Extents()
+	if err != nil {
+		return err
+	}
+	resume := resumeAt(opts)
+	if err = ensureSpace(dst, exts, resume, opts); err != nil {
+		return err
+	}
+	pr := newProgress(ctx, "archive extract", opts, src.size, dataBytes(exts))
+	defer func() { err = pr.done(err) }()
+	if resume == 0 {
+		if err = dst.Truncate(0); err != nil {
+			return err
+		}
+	}
+	if err = dst.Truncate(src.size); err != nil {
+		return err
+	}
+	pr.resume(resume)
+
+	buf := make([]byte, copyChunk)
+	for _, u := range copyUnits(exts, resume) {
+		if u.hole {
+			if err = pr.hole(u.off, u.n); err != nil {
+				return err
+			}
+			continue
+		}
+		if _, err = src.ReadAt(buf[:u.n], u.off); err != nil && err != io.EOF {
+			return err
+		}
+		if err = writeAtSparse(dst, buf[:u.n], u.off); err != nil {
+			return err
+		}
+		if err = pr.data(u.off, u.n); err != nil {
+			return err
+		}
+	}
+	return dst.Sync()
+}
@@ -0,0 +1,168 @@
+package sparsified
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestArchiveRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	sz, spans := testSpans()
+	src := makeTestSparse(t, filepath.Join(dir, "src.img"), sz, spans)
+	defer src.Close()
+	// and something compressible.
+	_, err := src.WriteAt(bytes.Repeat([]byte("compress me "), 40000), sz/2)
+	panicOn(err)
+	want := readAll(t, NewOSFile(src))
+	wantExts, err := Extents(src)
+	panicOn(err)
+
+	var arc bytes.Buffer
+	panicOn(RawToArchive(context.Background(), &arc, NewOSFile(src), &Options{FrameSize: 64 << 10}))
+	if int64(arc.Len()) >= dataBytes(wantExts) {
+		t.Fatalf("archive of %v data bytes is %v bytes", dataBytes(wantExts), arc.Len())
+	}
+
+	a, err := OpenArchive(bytes.NewReader(arc.Bytes()), int64(arc.Len()))
+	panicOn(err)
+	if a.Size() != sz {
+		t.Fatalf("size %v, want %v", a.Size(), sz)
+	}
+	exts, err := a.Extents()
+	panicOn(err)
+	if len(exts) != len(wantExts) {
+		t.Fatalf("extents %+v, want %+v", exts, wantExts)
+	}
+	for i := range exts {
+		if exts[i] != wantExts[i] {
+			t.Fatalf("extent %v is %+v, want %+v", i, exts[i], wantExts[i])
+		}
+	}
+
+	// random reads, from several goroutines, across frames
+	// and holes and off the end.
+	var wg sync.WaitGroup
+	for g := range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rng := rand.New(rand.NewSource(int64(g)))
+			for range 200 {
+				off := rng.Int63n(sz + 1000)
+				p := make([]byte, rng.Intn(300<<10))
+				n, err := a.ReadAt(p, off)
+				wantN := max(min(int64(len(p)), sz-off), 0)
+				if int64(n) != wantN || (n < len(p)) != (err == io.EOF) || (err != nil && err != io.EOF) {
+					t.Errorf("ReadAt(%v, %v) = %v, %v", len(p), off, n, err)
+					return
+				}
+				if !bytes.Equal(p[:n], want[off:off+int64(n)]) {
+					t.Errorf("ReadAt(%v, %v) read the wrong bytes", len(p), off)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	fd, err := os.Create(filepath.Join(dir, "out.img"))
+	panicOn(err)
+	defer fd.Close()
+	panicOn(ArchiveToRaw(context.Background(), NewOSFile(fd), a, nil))
+	sameContentAndHoles(t, src, fd)
+
+	// a flipped bit in a frame is caught.
+	bad := bytes.Clone(arc.Bytes())
+	bad[100] ^= 1
+	b, err := OpenArchive(bytes.NewReader(bad), int64(len(bad)))
+	panicOn(err)
+	var se *SparseOpError
+	if _, err = b.ReadAt(make([]byte, sz), 0); !errors.As(err, &se) || se.Op != "archive read" {
+		t.Fatalf("corrupt frame read back: %v", err)
+	}
+	// and in the index, straight away.
+	bad = bytes.Clone(arc.Bytes())
+	bad[len(bad)-60] ^= 1
+	if _, err = OpenArchive(bytes.NewReader(bad), int64(len(bad))); !errors.As(err, &se) || se.Op != "archive open" {
+		t.Fatalf("corrupt index opened: %v", err)
+	}
+	if _, err = OpenArchive(bytes.NewReader(want[:4096]), 4096); err == nil {
+		t.Fatalf("opened a raw image as an archive")
+	}
+}
+
+func TestArchiveEmpty(t *testing.T) {
+	m := NewMemSparseFile("empty.img", 4096)
+	panicOn(m.Truncate(1 << 30))
+	var arc bytes.Buffer
+	panicOn(RawToArchive(context.Background(), &arc, m, nil))
+	a, err := OpenArchive(bytes.NewReader(arc.Bytes()), int64(arc.Len()))
+	panicOn(err)
+	exts, err := a.Extents()
+	panicOn(err)
+	if len(exts) != 1 || !exts[0].Hole || exts[0].Length != 1<<30 {
+		t.Fatalf("extents of an empty 1GB file: %+v", exts)
+	}
+	p := []byte("not zeros")
+	if n, err := a.ReadAt(p, 1<<29); n != len(p) || err != nil || !bytes.Equal(p, make([]byte, len(p))) {
+		t.Fatalf("hole read %q, %v, %v", p, n, err)
+	}
+}
+
+// index entries that pass the checksum but would have a
+// reader allocate far more than a frame are still refused.
+func TestArchiveBadFrames(t *testing.T) {
+	m := NewMemSparseFile("frames.img", 4096)
+	_, err := m.WriteAt(bytes.Repeat([]byte("frames "), 20000), 8192)
+	panicOn(err)
+	var arc bytes.Buffer
+	panicOn(RawToArchive(context.Background(), &arc, m, &Options{FrameSize: 32 << 10}))
+
+	// reseal rewrites the footer and index of a copy of arc,
+	// with a good checksum.
+	reseal := func(edit func(ft *archiveFooter, frames []archiveFrame)) []byte {
+		b := bytes.Clone(arc.Bytes())
+		ft := &archiveFooter{}
+		flen := binary.Size(ft)
+		panicOn(binary.Read(bytes.NewReader(b[len(b)-flen:]), binary.LittleEndian, ft))
+		frames := make([]archiveFrame, ft.Frames)
+		panicOn(binary.Read(bytes.NewReader(b[ft.IndexOffset:]), binary.LittleEndian, frames))
+		edit(ft, frames)
+		var buf bytes.Buffer
+		binary.Write(&buf, binary.LittleEndian, frames)
+		ft.IndexCRC = crc32.Checksum(buf.Bytes(), castagnoli)
+		binary.Write(&buf, binary.LittleEndian, ft)
+		return append(b[:ft.IndexOffset], buf.Bytes()...)
+	}
+	for _, c := range []struct {
+		what string
+		edit func(ft *archiveFooter, frames []archiveFrame)
+	}{
+		{"no change", func(ft *archiveFooter, frames []archiveFrame) {}},
+		{"zero frame size", func(ft *archiveFooter, frames []archiveFrame) { ft.FrameSize = 0 }},
+		{"huge frame size", func(ft *archiveFooter, frames []archiveFrame) { ft.FrameSize = 1 << 32 }},
+		{"empty frame", func(ft *archiveFooter, frames []archiveFrame) { frames[0].Length = 0 }},
+		{"frame over frame size", func(ft *archiveFooter, frames []archiveFrame) {
+			ft.Size = 1 << 40
+			frames[len(frames)-1].Length = 1<<32 - 1
+		}},
+	} {
+		b := reseal(c.edit)
+		_, err := OpenArchive(bytes.NewReader(b), int64(len(b)))
+		var se *SparseOpError
+		if c.what == "no change" {
+			panicOn(err)
+		} else if !errors.As(err, &se) || se.Op != "archive open" {
+			t.Fatalf("%v: opened with %v", c.what, err)
+		}
+	}
+}
@@ -0,0 +1,330 @@
+package sparsified
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+// Checksum sidecars.
+//
+// A sidecar records a CRC32C for every data block of a
+// sparse file, so that Scrub can find bitrot later:
+//
+//	0                   sumHeader, in a 4KB block of its own
+//	4096 + 8*i          sumEntry for block i of the data file
+//
+// Holes have no entry (all zeros), so the sidecar has holes
+// wherever the data file has a run of them covering a whole
+// 4KB block of entries: 512 blocks, 2MB with 4KB blocks.
+
+const (
+	sumMagic     = "SPRSCRC1"
+	sumVersion   = 1
+	sumHeaderLen = 4096
+	sumEntryLen  = 8
+	sumFlagData  = 1 << 0
+)
+
+type sumHeader struct {
+	Magic     [8]byte
+	Version   uint32
+	BlockSize uint32
+	Size      uint64 // of the data file, when last updated.
+}
+
+type sumEntry struct {
+	CRC   uint32
+	Flags uint32
+}
+
+// BuildChecksums starts a new sidecar in side for f, with
+// one checksum per blockSize bytes (0 means 4096), and
+// records all of f. side is truncated first.
+func BuildChecksums(f, side SparseFile, blockSize int64) (err error) {
+	defer func() { err = opError("checksum", side.Name(), 0, 0, err) }()
+	if blockSize == 0 {
+		blockSize = 4096
+	}
+	if blockSize < 512 || blockSize > copyChunk || blockSize&(blockSize-1) != 0 {
+		return fmt.Errorf("BuildChecksums: block size %v is not a power of two from 512 to %v", blockSize, copyChunk)
+	}
+	hdr := &sumHeader{Version: sumVersion, BlockSize: uint32(blockSize)}
+	copy(hdr.Magic[:], sumMagic)
+	if err = side.Truncate(0); err != nil {
+		return err
+	}
+	if err = writeSumHeader(side, hdr); err != nil {
+		return err
+	}
+	size, err := sparseSize(f)
+	if err != nil {
+		return err
+	}
+	return updateChecksums(f, side, hdr, []Extent{{Offset: 0, Length: size}})
+}
+
+// UpdateChecksums records the blocks of f that ranges touch
+// in its sidecar, after they were written or punched, and the
+// current size of f. Blocks that are now holes lose their
+// entry. Call it after every write, before anything can go
+// wrong with the data; what was never recorded, Scrub reports.
+func UpdateChecksums(f, side SparseFile, ranges []Extent) (err error) {
+	defer func() { err = opError("checksum", side.Name(), 0, 0, err) }()
+	hdr, err := readSumHeader(side)
+	if err != nil {
+		return err
+	}
+	return updateChecksums(f, side, hdr, ranges)
+}
+
+func updateChecksums(f, side SparseFile, hdr *sumHeader, ranges []Extent) error {
+	bs := int64(hdr.BlockSize)
+	size, err := sparseSize(f)
+	if err != nil {
+		return err
+	}
+	exts, err := f.Extents()
+	if err != nil {
+		return err
+	}
+	nblocks := ceilDiv(size, bs)
+	data := blockRanges(onlyData(exts), bs)
+	buf := make([]byte, copyChunk)
+	ents := make([]byte, copyChunk/bs*sumEntryLen)
+	next := 0 // data[next] is the first run not before beg.
+	for _, r := range blockRanges(ranges, bs) {
+		beg, end := r.Offset, min(r.End(), nblocks)
+		for beg < end {
+			// the next data run at or after beg, or the end.
+			for next < len(data) && data[next].End() <= beg {
+				next++
+			}
+			dbeg, dend := end, end
+			if next < len(data) {
+				dbeg, dend = min(max(data[next].Offset, beg), end), min(data[next].End(), end)
+			}
+			if err = clearEntries(side, beg, dbeg); err != nil {
+				return err
+			}
+			for b := dbeg; b < dend; {
+				n := min(int64(len(ents))/sumEntryLen, dend-b)
+				off, endx := b*bs, min((b+n)*bs, size)
+				if _, err = f.ReadAt(buf[:endx-off], off); err != nil && err != io.EOF {
+					return err
+				}
+				for k := range n {
+					blk := buf[k*bs : min((k+1)*bs, endx-off)]
+					binary.LittleEndian.PutUint32(ents[k*sumEntryLen:], crc32.Checksum(blk, castagnoli))
+					binary.LittleEndian.PutUint32(ents[k*sumEntryLen+4:], sumFlagData)
+				}
+				if _, err = side.WriteAt(ents[:n*sumEntryLen], sumHeaderLen+b*sumEntryLen); err != nil {
+					return err
+				}
+				b += n
+			}
+			beg = max(dend, dbeg)
+		}
+	}
+	hdr.Size = uint64(size)
+	if err = writeSumHeader(side, hdr); err != nil {
+		return err
+	}
+	return side.Truncate(sumHeaderLen + nblocks*sumEntryLen)
+}
+
+// clearEntries removes the entries of blocks [beg, end),
+// punching out whole blocks of the sidecar.
+func clearEntries(side SparseFile, beg, end int64) error {
+	if beg >= end {
+		return nil
+	}
+	off, endx := sumHeaderLen+beg*sumEntryLen, sumHeaderLen+end*sumEntryLen
+	if size, err := sparseSize(side); err != nil {
+		return err
+	} else if endx = min(endx, size); off >= endx {
+		return nil
+	}
+	const bs = int64(len(oneZeroBlock4k))
+	for off < endx {
+		n := min(bs-off%bs, endx-off)
+		if n == bs {
+			// as many whole blocks as there are.
+			n = (endx - off) / bs * bs
+			if err := side.PunchHole(off, n); err == nil {
+				off += n
+				continue
+			}
+			n = bs
+		}
+		if _, err := side.WriteAt(oneZeroBlock4k[:n], off); err != nil {
+			return err
+		}
+		off += n
+	}
+	return nil
+}
+
+func writeSumHeader(side SparseFile, hdr *sumHeader) error {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, hdr)
+	_, err := side.WriteAt(buf.Bytes(), 0)
+	return err
+}
+
+func readSumHeader(side SparseFile) (*sumHeader, error) {
+	hdr := &sumHeader{}
+	if err := readLE(side, 0, hdr); err != nil {
+		return nil, fmt.Errorf("checksum sidecar: reading header: %w", err)
+	}
+	if string(hdr.Magic[:]) != sumMagic {
+		return nil, fmt.Errorf("checksum sidecar: bad magic %q", hdr.Magic[:])
+	}
+	if hdr.Version != sumVersion {
+		return nil, fmt.Errorf("checksum sidecar: version %v is not supported", hdr.Version)
+	}
+	if bs := hdr.BlockSize; bs < 512 || bs > copyChunk || bs&(bs-1) != 0 {
+		return nil, fmt.Errorf("checksum sidecar: corrupt header: block size %v", bs)
+	}
+	return hdr, nil
+}
+
+// ScrubReport is the result of Scrub. The block lists hold
+// the offsets of the blocks in the data file.
+type ScrubReport struct {
+	// Size is the size of the data file, and RecordedSize
+	// what the sidecar last saw.
+	Size         int64
+	RecordedSize int64
+
+	// Blocks is how many blocks were checked.
+	Blocks int64
+
+	// Corrupt blocks were data, and still are, but their
+	// checksum does not match.
+	Corrupt []int64
+
+	// NewData blocks were holes, but now hold something
+	// other than zeros. NewHoles held data, but are now
+	// holes, or past EOF.
+	NewData  []int64
+	NewHoles []int64
+}
+
+// OK says whether Scrub found nothing wrong.
+func (r *ScrubReport) OK() bool {
+	return len(r.Corrupt) == 0 && len(r.NewData) == 0 && len(r.NewHoles) == 0 &&
+		r.Size == r.RecordedSize
+}
+
+// Scrub reads every data block of f, and every block its
+// sidecar has an entry for, and checks them against the
+// sidecar. Holes, and data blocks of zeros where the sidecar
+// has none, pass: both read as zeros. A nil error with a
+// report that is not OK means the check itself went fine.
+func Scrub(ctx context.Context, f, side SparseFile, opts *Options) (rep *ScrubReport, err error) {
+	defer func() { err = opError("scrub", f.Name(), 0, 0, err) }()
+	hdr, err := readSumHeader(side)
+	if err != nil {
+		return nil, err
+	}
+	bs := int64(hdr.BlockSize)
+	rep = &ScrubReport{RecordedSize: int64(hdr.Size)}
+	if rep.Size, err = sparseSize(f); err != nil {
+		return nil, err
+	}
+	exts, err := f.Extents()
+	if err != nil {
+		return nil, err
+	}
+	sexts, err := side.Extents()
+	if err != nil {
+		return nil, err
+	}
+	// the blocks to look at: data in f, or with entries.
+	todo := onlyData(exts)
+	for _, s := range onlyData(sexts) {
+		if beg := max(s.Offset, sumHeaderLen) - sumHeaderLen; beg < s.End()-sumHeaderLen {
+			b0, b1 := beg/sumEntryLen, ceilDiv(s.End()-sumHeaderLen, sumEntryLen)
+			todo = append(todo, Extent{Offset: b0 * bs, Length: (b1 - b0) * bs})
+		}
+	}
+	// blocks are asked about in order, so a cursor will do.
+	data := blockRanges(onlyData(exts), bs)
+	next := 0
+	isData := func(b int64) bool {
+		for next < len(data) && data[next].End() <= b {
+			next++
+		}
+		return next < len(data) && b >= data[next].Offset
+	}
+	zeroSums := map[int64]uint32{}
+	zeroSum := func(n int64) uint32 {
+		if s, ok := zeroSums[n]; ok {
+			return s
+		}
+		zeroSums[n] = crc32.Checksum(make([]byte, n), castagnoli)
+		return zeroSums[n]
+	}
+
+	pr := newProgress(ctx, "scrub", opts, rep.Size, dataBytes(exts))
+	defer func() { err = pr.done(err) }()
+	nblocks := ceilDiv(rep.Size, bs)
+	buf := make([]byte, copyChunk)
+	ents := make([]byte, copyChunk/bs*sumEntryLen)
+	for _, r := range blockRanges(todo, bs) {
+		for b := r.Offset; b < r.End(); {
+			n := min(int64(len(ents))/sumEntryLen, r.End()-b)
+			m, err := side.ReadAt(ents[:n*sumEntryLen], sumHeaderLen+b*sumEntryLen)
+			if err != nil && err != io.EOF {
+				return rep, err
+			}
+			clear(ents[m:])
+			off, endx := b*bs, min((b+n)*bs, rep.Size)
+			if off < endx {
+				if _, err = f.ReadAt(buf[:endx-off], off); err != nil && err != io.EOF {
+					return rep, err
+				}
+			}
+			for k := range n {
+				at := (b + k) * bs
+				var e sumEntry
+				binary.Read(bytes.NewReader(ents[k*sumEntryLen:(k+1)*sumEntryLen]), binary.LittleEndian, &e)
+				recorded := e.Flags&sumFlagData != 0
+				if b+k >= nblocks {
+					if recorded {
+						rep.NewHoles = append(rep.NewHoles, at)
+					}
+					continue
+				}
+				blk := buf[k*bs : min((k+1)*bs, endx-off)]
+				rep.Blocks++
+				inData := isData(b + k)
+				switch {
+				case recorded && inData:
+					if crc32.Checksum(blk, castagnoli) != e.CRC {
+						rep.Corrupt = append(rep.Corrupt, at)
+					}
+				case recorded:
+					if e.CRC != zeroSum(int64(len(blk))) {
+						rep.NewHoles = append(rep.NewHoles, at)
+					}
+				case inData:
+					if !isZero(blk) {
+						rep.NewData = append(rep.NewData, at)
+					}
+				}
+			}
+			if off < endx {
+				if err = pr.data(off, endx-off); err != nil {
+					return rep, err
+				}
+			}
+			b += n
+		}
+	}
+	return rep, nil
+}
@@ -0,0 +1,77 @@
+package sparsified
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestScrub(t *testing.T) {
+	dir := t.TempDir()
+	fd, err := os.Create(filepath.Join(dir, "vol.img"))
+	panicOn(err)
+	defer fd.Close()
+	sfd, err := os.Create(filepath.Join(dir, "vol.img.crc"))
+	panicOn(err)
+	defer sfd.Close()
+	f, side := NewOSFile(fd), NewOSFile(sfd)
+
+	// data at 0 and 64MB, holes around it.
+	write := func(s string, off int64) {
+		_, err := f.WriteAt([]byte(s), off)
+		panicOn(err)
+	}
+	write("first block", 0)
+	write("at 64MB", 64<<20)
+	panicOn(f.Truncate(100 << 20))
+	panicOn(BuildChecksums(f, side, 0))
+
+	scrub := func(what string, corrupt, newData, newHoles []int64) {
+		t.Helper()
+		rep, err := Scrub(context.Background(), f, side, nil)
+		panicOn(err)
+		if !slices.Equal(rep.Corrupt, corrupt) || !slices.Equal(rep.NewData, newData) ||
+			!slices.Equal(rep.NewHoles, newHoles) {
+			t.Fatalf("%v: %+v", what, rep)
+		}
+		if ok := corrupt == nil && newData == nil && newHoles == nil; rep.OK() != ok {
+			t.Fatalf("%v: OK() is %v", what, rep.OK())
+		}
+	}
+	scrub("fresh", nil, nil, nil)
+
+	// the sidecar mirrors the holes: only the entries for the
+	// blocks at 0 and 64MB are there.
+	sexts, err := side.Extents()
+	panicOn(err)
+	if dataBytes(sexts) > 3*4096 || len(sexts) < 3 {
+		t.Fatalf("sidecar extents %+v", sexts)
+	}
+
+	// bitrot, a stray write into a hole, a lost block.
+	write("F", 3)
+	write("stray", 10<<20+100)
+	panicOn(f.PunchHole(64<<20, 4096))
+	scrub("damaged", []int64{0}, []int64{10 << 20}, []int64{64 << 20})
+
+	// recorded, they pass.
+	panicOn(UpdateChecksums(f, side, []Extent{{Offset: 0, Length: 1}, {Offset: 10<<20 + 100, Length: 5}, {Offset: 64 << 20, Length: 4096}}))
+	scrub("updated", nil, nil, nil)
+
+	// zeros written into a hole are no harm.
+	_, err = f.WriteAt(make([]byte, 8192), 20<<20)
+	panicOn(err)
+	scrub("zeros", nil, nil, nil)
+
+	// truncated under the sidecar.
+	panicOn(f.Truncate(10 << 20))
+	rep, err := Scrub(context.Background(), f, side, nil)
+	panicOn(err)
+	if rep.OK() || rep.Size != 10<<20 || rep.RecordedSize != 100<<20 || !slices.Equal(rep.NewHoles, []int64{10 << 20}) {
+		t.Fatalf("truncated: %+v", rep)
+	}
+	panicOn(UpdateChecksums(f, side, nil))
+	scrub("truncated and updated", nil, nil, nil)
+}
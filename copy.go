@@ -0,0 +1,276 @@
+package sparsified
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+// copyChunk is how much of a data extent Copy moves at once.
+const copyChunk = 1 << 20
+
+// Copy copies src to dst, preserving holes: dst is truncated
+// to zero and then to the size of src, and only the data
+// extents of src are written (all-zero 4KB blocks within them
+// are skipped too). dst is synced at the end. It returns the
+// number of data bytes copied.
+//
+// If dst is a RangeCopier, the data is copied in the kernel
+// where possible, without skipping zero blocks; unless
+// Options.Engine is EngineIOUring, see there.
+//
+// With Options.Workers > 1 the data is copied by that many
+// goroutines at once, which pays off on fast storage. The
+// result is the same byte for byte, holes included, whatever
+// the number of workers.
+//
+// If ctx is canceled, Copy stops between chunks and returns
+// ctx.Err(). dst then has the full size of src, everything
+// before the Offset of the final Progress report has been
+// copied, and everything after it is still a hole. Calling
+// Copy again with Options.ResumeAt set to that Offset
+// finishes the job.
+func Copy(ctx context.Context, dst, src SparseFile, opts *Options) (n int64, err error) {
+	defer func() { err = opError("copy", dst.Name(), 0, 0, err) }()
+	dst, src = withHooks(dst, opts), withHooks(src, opts)
+	size, err := sparseSize(src)
+	if err != nil {
+		return 0, err
+	}
+	exts, err := src.Extents()
+	if err != nil {
+		return 0, err
+	}
+	if err = ensureSpace(dst, exts, resumeAt(opts), opts); err != nil {
+		return 0, err
+	}
+	pr := newProgress(ctx, "copy", opts, size, dataBytes(exts))
+	c := &copier{dst: dst, src: src, opts: opts}
+	c.rc, _ = dst.(RangeCopier)
+	n, err = c.copyExtents(pr, size, exts, resumeAt(opts), workers(opts))
+	return n, pr.done(err)
+}
+
+func (c *copier) copyExtents(pr *progress, size int64, exts []Extent, resume int64, workers int) (n int64, err error) {
+	if resume == 0 {
+		if err = c.dst.Truncate(0); err != nil {
+			return 0, err
+		}
+	}
+	if err = c.dst.Truncate(size); err != nil {
+		return 0, err
+	}
+	pr.resume(resume)
+	units := copyUnits(exts, resume)
+	if workers > 1 {
+		n, err = c.parallel(pr, units, workers)
+	} else {
+		n, err = c.serial(pr, units)
+	}
+	if err != nil {
+		return n, err
+	}
+	return n, c.dst.Sync()
+}
+
+// copyUnit is a piece of src, at most copyChunk long,
+// that is copied in one go.
+type copyUnit struct {
+	off, n int64
+	hole   bool
+}
+
+// copyUnits splits the extents after resume into units. The
+// split depends only on the extents, so the units, and hence
+// the bytes written, are the same however many workers run.
+func copyUnits(exts []Extent, resume int64) (units []copyUnit) {
+	for _, e := range exts {
+		if e.End() <= resume {
+			continue
+		}
+		off := max(e.Offset, resume)
+		if e.Hole {
+			units = append(units, copyUnit{off: off, n: e.End() - off, hole: true})
+			continue
+		}
+		for ; off < e.End(); off += copyChunk {
+			units = append(units, copyUnit{off: off, n: min(copyChunk, e.End()-off)})
+		}
+	}
+	return
+}
+
+type copier struct {
+	dst, src SparseFile
+	opts     *Options
+	rc       RangeCopier
+	noRC     atomic.Bool // set once rc says ErrUnsupported.
+}
+
+// copy copies one data unit, in the kernel if possible. It
+// is safe to call from several goroutines, each with its own
+// buf and ring; ring is nil for the syscall engine.
+func (c *copier) copy(u copyUnit, buf []byte, ring *uring) (n int64, err error) {
+	off, endx := u.off, u.off+u.n
+	if ring != nil {
+		for ; off < endx; off += int64(len(buf)) {
+			k := min(int64(len(buf)), endx-off)
+			if err = bulkReadAt(ring, c.src, buf[:k], off); err != nil {
+				return n, err
+			}
+			if err = bulkWriteSparse(ring, c.dst, buf[:k], off); err != nil {
+				return n, err
+			}
+			n += k
+		}
+		return n, nil
+	}
+	for c.rc != nil && !c.noRC.Load() && off < endx {
+		k, err := c.rc.CopyRangeFrom(c.src, off, off, endx-off)
+		if errors.Is(err, errors.ErrUnsupported) {
+			if !c.noRC.Swap(true) {
+				optHooks(c.opts).log.Debug("sparsified: in-kernel copy unsupported, copying by hand",
+					"dst", c.dst.Name(), "err", err)
+			}
+			break
+		}
+		if err != nil {
+			return n, err
+		}
+		if k <= 0 {
+			// short; finish this unit by hand.
+			break
+		}
+		n += k
+		off += k
+	}
+	for off < endx {
+		k := min(int64(len(buf)), endx-off)
+		m, rerr := c.src.ReadAt(buf[:k], off)
+		if rerr != nil && !(rerr == io.EOF && int64(m) == k) {
+			return n, rerr
+		}
+		if err = writeAtSparse(c.dst, buf[:m], off); err != nil {
+			return n, err
+		}
+		n += int64(m)
+		off += k
+	}
+	return n, nil
+}
+
+func (c *copier) serial(pr *progress, units []copyUnit) (n int64, err error) {
+	buf := make([]byte, copyChunk)
+	ring := newBulk(c.opts, c.dst, c.src)
+	if ring != nil {
+		defer ring.close()
+	}
+	for _, u := range units {
+		if u.hole {
+			if err = pr.hole(u.off, u.n); err != nil {
+				return n, err
+			}
+			continue
+		}
+		k, err := c.copy(u, buf, ring)
+		n += k
+		if err != nil {
+			return n, err
+		}
+		if err = pr.data(u.off, u.n); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+type copyDone struct {
+	i   int
+	n   int64
+	err error
+}
+
+// parallel copies the data units with a pool of workers using
+// positional I/O. Progress only advances over the prefix of
+// units that are all done, so the reported Offset keeps its
+// meaning: units past it may or may not have been written
+// when a parallel Copy stops, and resuming rewrites them.
+func (c *copier) parallel(pr *progress, units []copyUnit, workers int) (n int64, err error) {
+	todo := make(chan int)
+	done := make(chan copyDone)
+	var wg sync.WaitGroup
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buf := make([]byte, copyChunk)
+			ring := newBulk(c.opts, c.dst, c.src)
+			if ring != nil {
+				defer ring.close()
+			}
+			for i := range todo {
+				k, err := c.copy(units[i], buf, ring)
+				done <- copyDone{i: i, n: k, err: err}
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	finished := make([]bool, len(units))
+	next := 0     // next unit to hand out.
+	prefix := 0   // units[:prefix] are done and reported.
+	inflight := 0 // handed out but not done.
+	advance := func() error {
+		for ; prefix < len(units) && (finished[prefix] || units[prefix].hole); prefix++ {
+			u := units[prefix]
+			var perr error
+			if u.hole {
+				perr = pr.hole(u.off, u.n)
+			} else {
+				perr = pr.data(u.off, u.n)
+			}
+			if perr != nil {
+				return perr
+			}
+		}
+		return nil
+	}
+	for err == nil {
+		for next < len(units) && units[next].hole {
+			next++
+		}
+		send := todo
+		if next == len(units) {
+			if inflight == 0 {
+				break
+			}
+			send = nil
+		}
+		select {
+		case send <- next:
+			next++
+			inflight++
+		case d := <-done:
+			inflight--
+			n += d.n
+			finished[d.i] = true
+			if err = d.err; err == nil {
+				err = advance()
+			}
+		}
+	}
+	close(todo)
+	// let the workers finish what they have.
+	for d := range done {
+		n += d.n
+	}
+	if err == nil {
+		err = advance()
+	}
+	return n, err
+}
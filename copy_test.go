@@ -0,0 +1,146 @@
+package sparsified
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+// genSparseLayout fills f, of the given size, with a
+// reproducible mix of data extents and holes of assorted
+// lengths, all 4KB aligned.
+func genSparseLayout(f SparseFile, size int64, seed int64) {
+	rng := rand.New(rand.NewSource(seed))
+	panicOn(f.Truncate(size))
+	buf := make([]byte, 4<<20)
+	for off := int64(0); off < size; {
+		n := min(int64(1+rng.Intn(1024))*4096, size-off)
+		if rng.Intn(2) == 0 {
+			rng.Read(buf[:n])
+			_, err := f.WriteAt(buf[:n], off)
+			panicOn(err)
+		}
+		off += n
+	}
+}
+
+func TestParallelCopyIsDeterministic(t *testing.T) {
+	fd, err := os.Create(filepath.Join(t.TempDir(), "src.img"))
+	panicOn(err)
+	defer fd.Close()
+	src := NewOSFile(fd)
+	genSparseLayout(src, 64<<20, 1)
+	want := readAll(t, src)
+	sexts, err := src.Extents()
+	panicOn(err)
+	var wantN int64
+	for _, eng := range testEngines {
+		for _, w := range []int{1, 2, 3, 8} {
+			for name, dst := range testBackends(t) {
+				n, err := Copy(context.Background(), dst, src, &Options{Workers: w, Engine: eng})
+				panicOn(err)
+				if wantN == 0 {
+					wantN = n
+				}
+				if n != wantN {
+					t.Fatalf("%v %v workers=%v: copied %v bytes, want %v", name, eng, w, n, wantN)
+				}
+				if !bytes.Equal(readAll(t, dst), want) {
+					t.Fatalf("%v %v workers=%v: content differs", name, eng, w)
+				}
+				dexts, err := dst.Extents()
+				panicOn(err)
+				if !sameExtents(sexts, dexts) {
+					t.Fatalf("%v %v workers=%v: extents differ", name, eng, w)
+				}
+			}
+		}
+	}
+}
+
+func TestParallelCopyCancelAndResume(t *testing.T) {
+	src := progressSrc()
+	dst := NewMemSparseFile("dst", 4096)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var last Progress
+	opts := &Options{
+		Workers:          4,
+		ProgressInterval: 1,
+		Progress: func(p Progress) {
+			last = p
+			if p.Offset >= 2<<20 {
+				cancel()
+			}
+		},
+	}
+	_, err := Copy(ctx, dst, src, opts)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("want context.Canceled, got %v", err)
+	}
+	want := readAll(t, src)
+	if got := readAll(t, dst); !bytes.Equal(got[:last.Offset], want[:last.Offset]) {
+		t.Fatalf("dst differs from src before the reported offset %v", last.Offset)
+	}
+	_, err = Copy(context.Background(), dst, src, &Options{Workers: 4, ResumeAt: last.Offset})
+	panicOn(err)
+	if !bytes.Equal(readAll(t, dst), want) {
+		t.Fatalf("content differs after resume")
+	}
+}
+
+// a failing worker stops the copy and its error comes back.
+func TestParallelCopyError(t *testing.T) {
+	src := NewMemSparseFile("src", 4096)
+	genSparseLayout(src, 32<<20, 2)
+	dst := NewFaultFile(NewMemSparseFile("dst", 4096), 1,
+		FaultRule{Op: OpWriteAt, After: 5, Err: syscall.EIO})
+	_, err := Copy(context.Background(), dst, src, &Options{Workers: 4})
+	if !errors.Is(err, syscall.EIO) {
+		t.Fatalf("want the injected error, got %v", err)
+	}
+}
+
+// go test -run=NONE -bench=Copy
+func BenchmarkCopy(b *testing.B) {
+	dir := b.TempDir()
+	sfd, err := os.Create(filepath.Join(dir, "src.img"))
+	panicOn(err)
+	defer sfd.Close()
+	src := NewOSFile(sfd)
+	genSparseLayout(src, 256<<20, 3)
+	exts, err := src.Extents()
+	panicOn(err)
+	data := dataBytes(exts)
+
+	for _, w := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("workers=%v", w), func(b *testing.B) {
+			dfd, err := os.Create(filepath.Join(dir, "dst.img"))
+			panicOn(err)
+			defer dfd.Close()
+			dst := NewOSFile(dfd)
+			b.SetBytes(data)
+			for b.Loop() {
+				_, err := Copy(context.Background(), dst, src, &Options{Workers: w})
+				panicOn(err)
+			}
+		})
+	}
+	b.Run("io_uring", func(b *testing.B) {
+		dfd, err := os.Create(filepath.Join(dir, "dst.img"))
+		panicOn(err)
+		defer dfd.Close()
+		dst := NewOSFile(dfd)
+		b.SetBytes(data)
+		for b.Loop() {
+			_, err := Copy(context.Background(), dst, src, &Options{Engine: EngineIOUring})
+			panicOn(err)
+		}
+	})
+}
@@ -0,0 +1,339 @@
+package sparsified
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// ErrFileChanged is returned by Defragment when the file was
+// written to while it was being copied; it is left as it was.
+var ErrFileChanged = fmt.Errorf("file changed while it was being defragmented.")
+
+// FragStats describes how fragmented the storage of a file
+// is, from the FIEMAP physical offsets of its extents.
+type FragStats struct {
+	Size int64 // apparent size.
+
+	// Allocated is the storage within EOF, including
+	// preallocated (unwritten) extents; storage past EOF
+	// is not counted at all.
+	Allocated int64
+
+	// Extents is how many extents the filesystem reports,
+	// and AvgExtent their mean length.
+	Extents   int
+	AvgExtent int64
+
+	// Discontiguities counts the extents that do not start
+	// on the device where the one before them ended: the
+	// seeks a sequential read of the file costs. Extents
+	// split only by a hole, or by the filesystem's maximum
+	// extent length, do not count. PerGiB is that per GiB
+	// of Allocated.
+	Discontiguities int
+	PerGiB          float64
+}
+
+// Fragmentation measures the fragmentation of fd. It needs
+// FIEMAP; elsewhere the error matches ErrNotSupported.
+func Fragmentation(fd *os.File) (st FragStats, err error) {
+	defer func() { err = opError("fragmentation", fd.Name(), 0, 0, err) }()
+	return fragmentation(defaultHooks(), fd)
+}
+
+func fragmentation(h hooks, fd *os.File) (st FragStats, err error) {
+	fi, err := fd.Stat()
+	if err != nil {
+		return st, err
+	}
+	st.Size = fi.Size()
+	aexts, err := allocatedExtents(h, fd, true)
+	if err != nil {
+		return st, err
+	}
+	eof := ceilDiv(st.Size, statBlockSize(fi)) * statBlockSize(fi)
+	var prev AllocExtent
+	for _, e := range aexts {
+		if e.Logical >= eof {
+			break
+		}
+		st.Extents++
+		st.Allocated += min(e.End(), eof) - e.Logical
+		// physical 0 is unknown (inline data, say): no seek.
+		if st.Extents > 1 && e.Physical != 0 && prev.Physical != 0 && !follows(prev, e) {
+			st.Discontiguities++
+		}
+		prev = e
+	}
+	if st.Extents > 0 {
+		st.AvgExtent = st.Allocated / int64(st.Extents)
+	}
+	if st.Allocated > 0 {
+		st.PerGiB = float64(st.Discontiguities) / (float64(st.Allocated) / (1 << 30))
+	}
+	return st, nil
+}
+
+// DefragOptions tunes Defragment.
+type DefragOptions struct {
+	// Options are for the copying: Progress, Engine,
+	// Logger, Trace and SpaceMargin apply.
+	Options
+
+	// MinPerGiB leaves files with fewer discontiguities
+	// per GiB than this alone. 0 rewrites any file with
+	// a discontiguity at all.
+	MinPerGiB float64
+
+	// InPlace rewrites the fragmented ranges of the file
+	// itself, one Chunk at a time, rather than copying the
+	// whole file to a temporary one next to it and renaming
+	// that over it. It needs no room for a second copy and
+	// keeps the inode, but see Defragment for the risks.
+	InPlace bool
+
+	// Chunk is the most InPlace reads into memory and
+	// rewrites at once; it defaults to 64MB.
+	Chunk int64
+}
+
+// DefragResult says what Defragment did.
+type DefragResult struct {
+	Before, After FragStats
+
+	// Rewritten is the data bytes moved to new storage,
+	// 0 if the file was left alone.
+	Rewritten int64
+}
+
+// Defragment rewrites the data of the file at path into
+// freshly preallocated storage, which the filesystem can
+// then hand out in long contiguous runs, and keeps the
+// holes where they are. Files no more fragmented than
+// opts.MinPerGiB are left alone, and so is the original
+// whenever the rewrite would not have fewer discontiguities.
+//
+// By default the data is copied to a temporary file in the
+// same directory, which is renamed over the original: safe
+// against crashes, and against readers, who keep the old
+// copy while they have it open. If the file's size or
+// modification time change during the copy, Defragment gives
+// up with ErrFileChanged; writers holding it open across the
+// rename would write to the old copy, though, so stop them
+// first. The copy gets the original's permissions but not
+// its owner, xattrs or hard links.
+//
+// opts.InPlace instead, for each chunk of data whose storage
+// is discontiguous, reads it into memory, punches it out,
+// preallocates it again and writes it back. That needs
+// FIEMAP. A failure along the way writes the chunk back from
+// memory, but a crash in between loses it, as does anyone
+// else writing it meanwhile. The filesystem may also
+// hand the same freed blocks straight back.
+func Defragment(path string, opts *DefragOptions) (res DefragResult, err error) {
+	defer func() { err = opError("defrag", path, 0, 0, err) }()
+	if opts == nil {
+		opts = &DefragOptions{}
+	}
+	if opts.InPlace {
+		return defragInPlace(path, opts)
+	}
+	h := optHooks(&opts.Options)
+	src, err := os.Open(path)
+	if err != nil {
+		return res, err
+	}
+	defer src.Close()
+	fi, err := src.Stat()
+	if err != nil {
+		return res, err
+	}
+	if res.Before, err = fragmentation(h, src); err != nil || !fragmented(res.Before, opts) {
+		res.After = res.Before
+		return res, err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".defrag-*")
+	if err != nil {
+		return res, err
+	}
+	defer func() {
+		if tmp != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+	}()
+	if err = tmp.Chmod(fi.Mode().Perm()); err != nil {
+		return res, err
+	}
+
+	dst, from := withHooks(NewOSFile(tmp), &opts.Options), withHooks(NewOSFile(src), &opts.Options)
+	exts, err := from.Extents()
+	if err != nil {
+		return res, err
+	}
+	if err = ensureSpace(dst, exts, 0, &opts.Options); err != nil {
+		return res, err
+	}
+	// one extent after another, from the front, so that the
+	// allocator lays them out end to end.
+	for _, e := range exts {
+		if !e.Hole {
+			if _, err = preallocate(h, tmp, e.Offset, e.Length, true); err != nil {
+				return res, err
+			}
+		}
+	}
+	if err = dst.Truncate(fi.Size()); err != nil {
+		return res, err
+	}
+	// no copy_file_range: it might share the old storage
+	// rather than copy it.
+	c := &copier{dst: dst, src: from, opts: &opts.Options}
+	pr := newProgress(context.Background(), "defrag", &opts.Options, fi.Size(), dataBytes(exts))
+	res.Rewritten, err = c.serial(pr, copyUnits(exts, 0))
+	if err = pr.done(err); err != nil {
+		return res, err
+	}
+	if err = tmp.Sync(); err != nil {
+		return res, err
+	}
+	if res.After, err = fragmentation(h, tmp); err != nil {
+		return res, err
+	}
+	if res.After.Discontiguities >= res.Before.Discontiguities {
+		h.log.Debug("sparsified: defragmenting did not help", "path", path,
+			"before", res.Before.Discontiguities, "after", res.After.Discontiguities)
+		res.After, res.Rewritten = res.Before, 0
+		return res, nil
+	}
+	now, err := os.Stat(path)
+	if err != nil {
+		return res, err
+	}
+	if now.Size() != fi.Size() || !now.ModTime().Equal(fi.ModTime()) || !os.SameFile(now, fi) {
+		return res, ErrFileChanged
+	}
+	if err = os.Rename(tmp.Name(), path); err != nil {
+		return res, err
+	}
+	tmp.Close()
+	tmp = nil
+	return res, nil
+}
+
+// follows says whether e lies on the device where prev
+// ends, or where it would end had it run on through the
+// hole between them.
+func follows(prev, e AllocExtent) bool {
+	return e.Physical == prev.Physical+prev.Length ||
+		e.Physical == prev.Physical+e.Logical-prev.Logical
+}
+
+// fragmented says whether st is worth defragmenting.
+func fragmented(st FragStats, opts *DefragOptions) bool {
+	return st.Discontiguities > 0 && st.PerGiB >= opts.MinPerGiB
+}
+
+func defragInPlace(path string, opts *DefragOptions) (res DefragResult, err error) {
+	h := optHooks(&opts.Options)
+	fd, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return res, err
+	}
+	defer fd.Close()
+	if res.Before, err = fragmentation(h, fd); err != nil || !fragmented(res.Before, opts) {
+		res.After = res.Before
+		return res, err
+	}
+	chunk := opts.Chunk
+	if chunk <= 0 {
+		chunk = 64 << 20
+	}
+	f := withHooks(NewOSFile(fd), &opts.Options)
+	exts, err := f.Extents()
+	if err != nil {
+		return res, err
+	}
+	// rewriting a chunk moves only its own extents, so one
+	// map does for the whole pass.
+	aexts, err := allocatedExtents(h, fd, true)
+	if err != nil {
+		return res, err
+	}
+	pr := newProgress(context.Background(), "defrag", &opts.Options, res.Before.Size, dataBytes(exts))
+	defer func() { err = pr.done(err) }()
+	var buf []byte
+	for _, e := range exts {
+		if e.Hole {
+			if err = pr.hole(e.Offset, e.Length); err != nil {
+				return res, err
+			}
+			continue
+		}
+		for off := e.Offset; off < e.End(); off += chunk {
+			n := min(chunk, e.End()-off)
+			if discontiguousIn(aexts, off, off+n) {
+				if buf == nil {
+					buf = make([]byte, min(chunk, res.Before.Size))
+				}
+				if err = rewriteRange(f, buf[:n], off); err != nil {
+					return res, err
+				}
+				res.Rewritten += n
+			}
+			if err = pr.data(off, n); err != nil {
+				return res, err
+			}
+		}
+	}
+	res.After, err = fragmentation(h, fd)
+	return res, err
+}
+
+// discontiguousIn says whether the storage of [off, endx)
+// is in more than one physical piece.
+func discontiguousIn(aexts []AllocExtent, off, endx int64) bool {
+	var prev AllocExtent
+	seen := false
+	for _, e := range aexts {
+		if e.End() <= off || e.Logical >= endx {
+			continue
+		}
+		if seen && !follows(prev, e) {
+			return true
+		}
+		seen, prev = true, e
+	}
+	return false
+}
+
+// rewriteRange moves len(buf) bytes at off of f to new
+// storage: read, punch, preallocate, write back, sync. Once
+// the chunk is punched out it lives only in buf, so any
+// failure from then on writes it back before returning.
+func rewriteRange(f SparseFile, buf []byte, off int64) (err error) {
+	if _, err = f.ReadAt(buf, off); err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			if _, werr := f.WriteAt(buf, off); werr == nil {
+				f.Sync()
+			}
+		}
+	}()
+	if err = f.PunchHole(off, int64(len(buf))); err != nil {
+		return err
+	}
+	if al, ok := f.(Allocator); ok {
+		if _, err = al.Allocate(off, int64(len(buf))); err != nil {
+			return err
+		}
+	}
+	if _, err = f.WriteAt(buf, off); err != nil {
+		return err
+	}
+	return f.Sync()
+}
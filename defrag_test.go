@@ -0,0 +1,171 @@
+package sparsified
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+// fragmentedFile writes path and a second file turn about,
+// a piece at a time, syncing and closing each time: while
+// they are small, ext4 gives both blocks from one shared
+// pool, so their first blocks interleave. path gets a hole
+// in the middle.
+func fragmentedFile(t *testing.T, path string) {
+	rng := rand.New(rand.NewSource(42))
+	piece := make([]byte, 16<<10)
+	for i := range 64 {
+		if i >= 8 && i < 16 {
+			continue
+		}
+		rng.Read(piece)
+		for _, p := range []string{path, path + ".other"} {
+			fd, err := os.OpenFile(p, os.O_RDWR|os.O_CREATE, 0644)
+			panicOn(err)
+			_, err = fd.WriteAt(piece, int64(i)*int64(len(piece)))
+			panicOn(err)
+			panicOn(fd.Sync())
+			panicOn(fd.Close())
+		}
+	}
+}
+
+func TestDefragment(t *testing.T) {
+	dir := t.TempDir()
+	for _, inPlace := range []bool{false, true} {
+		path := filepath.Join(dir, fmt.Sprintf("frag-%v.img", inPlace))
+		fragmentedFile(t, path)
+		fd, err := os.Open(path)
+		panicOn(err)
+		want := readAll(t, NewOSFile(fd))
+		wantExts, err := Extents(fd)
+		panicOn(err)
+		st, err := Fragmentation(fd)
+		fd.Close()
+		if errors.Is(err, ErrNotSupported) {
+			t.Skipf("no FIEMAP: %v", err)
+		}
+		panicOn(err)
+		if st.Discontiguities == 0 {
+			t.Skipf("could not fragment a file here: %+v", st)
+		}
+		if st.Size != 1<<20 || st.Allocated != 56*16<<10 || st.Extents < 2 || st.PerGiB <= 0 {
+			t.Fatalf("stats %+v", st)
+		}
+
+		// a high enough bar leaves it alone.
+		res, err := Defragment(path, &DefragOptions{MinPerGiB: st.PerGiB * 2, InPlace: inPlace})
+		panicOn(err)
+		if res.Rewritten != 0 || res.After != res.Before {
+			t.Fatalf("inPlace %v: defragmented anyway: %+v", inPlace, res)
+		}
+
+		res, err = Defragment(path, &DefragOptions{InPlace: inPlace, Chunk: 256 << 10})
+		panicOn(err)
+		if res.Before != st || res.After.Discontiguities > res.Before.Discontiguities ||
+			res.Rewritten > 0 && res.After.Discontiguities == res.Before.Discontiguities {
+			t.Fatalf("inPlace %v: %+v", inPlace, res)
+		}
+		t.Logf("inPlace %v: %v -> %v discontiguities, %v bytes rewritten",
+			inPlace, res.Before.Discontiguities, res.After.Discontiguities, res.Rewritten)
+
+		fd, err = os.Open(path)
+		panicOn(err)
+		if !bytes.Equal(readAll(t, NewOSFile(fd)), want) {
+			t.Fatalf("inPlace %v: content changed", inPlace)
+		}
+		if res.Rewritten > 0 {
+			exts, err := Extents(fd)
+			panicOn(err)
+			if len(exts) != len(wantExts) || exts[0] != wantExts[0] {
+				t.Fatalf("inPlace %v: holes moved: %+v, want %+v", inPlace, exts, wantExts)
+			}
+		}
+		fd.Close()
+		if left, _ := filepath.Glob(filepath.Join(dir, ".frag-*.defrag-*")); len(left) != 0 {
+			t.Fatalf("temporary files left: %v", left)
+		}
+	}
+}
+
+// InPlace rewrites a whole Chunk at a time, even one larger
+// than the units Copy works in.
+func TestDefragInPlaceChunk(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "big.img")
+	rng := rand.New(rand.NewSource(43))
+	piece := make([]byte, 64<<10)
+	for i := range 48 {
+		rng.Read(piece)
+		for _, p := range []string{path, path + ".other"} {
+			fd, err := os.OpenFile(p, os.O_RDWR|os.O_CREATE, 0644)
+			panicOn(err)
+			_, err = fd.WriteAt(piece, int64(i)*int64(len(piece)))
+			panicOn(err)
+			panicOn(fd.Sync())
+			panicOn(fd.Close())
+		}
+	}
+	fd, err := os.Open(path)
+	panicOn(err)
+	want := readAll(t, NewOSFile(fd))
+	st, err := Fragmentation(fd)
+	fd.Close()
+	if errors.Is(err, ErrNotSupported) {
+		t.Skipf("no FIEMAP: %v", err)
+	}
+	panicOn(err)
+	if st.Discontiguities == 0 {
+		t.Skipf("could not fragment a file here: %+v", st)
+	}
+
+	var punches []TraceEvent
+	opts := &DefragOptions{InPlace: true, Chunk: 4 << 20}
+	opts.Trace = func(ev TraceEvent) {
+		if ev.Op == "punchhole" {
+			punches = append(punches, ev)
+		}
+	}
+	res, err := Defragment(path, opts)
+	panicOn(err)
+	if res.Rewritten != 3<<20 || len(punches) != 1 || punches[0].Offset != 0 || punches[0].Length != 3<<20 {
+		t.Fatalf("rewrote %v bytes in %+v", res.Rewritten, punches)
+	}
+	fd, err = os.Open(path)
+	panicOn(err)
+	defer fd.Close()
+	if !bytes.Equal(readAll(t, NewOSFile(fd)), want) {
+		t.Fatalf("content changed")
+	}
+}
+
+func TestRewriteRangeFailure(t *testing.T) {
+	dir := t.TempDir()
+	want := make([]byte, 256<<10)
+	rand.New(rand.NewSource(7)).Read(want)
+	rules := []FaultRule{
+		{Op: OpAllocate, Err: syscall.ENOSPC},
+		{Op: OpAllocate, Short: 4096},
+		{Op: OpWriteAt, Err: syscall.EIO, Times: 1},
+		{Op: OpWriteAt, Short: 8192, Times: 1},
+	}
+	for i, rule := range rules {
+		fd, err := os.Create(filepath.Join(dir, fmt.Sprintf("f%v.img", i)))
+		panicOn(err)
+		_, err = fd.WriteAt(want, 0)
+		panicOn(err)
+		ff := NewFaultFile(NewOSFile(fd), 1, rule)
+		err = rewriteRange(ff, make([]byte, 128<<10), 64<<10)
+		if err == nil || len(ff.Hits()) != 1 {
+			t.Fatalf("rule %+v: err %v, hits %+v", rule, err, ff.Hits())
+		}
+		if !bytes.Equal(readAll(t, NewOSFile(fd)), want) {
+			t.Fatalf("rule %+v: the chunk was lost", rule)
+		}
+		fd.Close()
+	}
+}
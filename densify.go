@@ -0,0 +1,116 @@
+package sparsified
+
+import "syscall"
+
+// DensifyMode says how Densify fills holes.
+type DensifyMode int
+
+const (
+	// DensifyZeroRange allocates the holes with fallocate(2)
+	// (mode 0, no KEEP_SIZE), leaving unwritten extents: the
+	// blocks are reserved and read back as zeros, but nothing
+	// is written, so it is fast. The file must be an Allocator,
+	// such as an *OSFile. On Darwin, where F_PREALLOCATE only
+	// works at the end of the file, holes inside it get zeros
+	// written instead; see Preallocate.
+	DensifyZeroRange DensifyMode = iota
+
+	// DensifyWriteZeros writes zeros over the holes, then
+	// syncs, for filesystems or tools that treat unwritten
+	// extents as holes. It works on any SparseFile.
+	DensifyWriteZeros
+)
+
+func (m DensifyMode) String() string {
+	switch m {
+	case DensifyZeroRange:
+		return "zero-range"
+	case DensifyWriteZeros:
+		return "write-zeros"
+	}
+	return "unknown"
+}
+
+// Densify allocates every hole in [off, off+length) of f, so
+// that later writes there cannot fail with ENOSPC. It is the
+// inverse of PunchHole and Sparsify: the content and size do
+// not change, and the range is clipped to the file size. A
+// length of 0 means through EOF.
+//
+// It returns the bytes of storage newly consumed, measured
+// from st_blocks where f has them (so it includes any
+// metadata blocks), and otherwise the hole bytes filled.
+func Densify(f SparseFile, off, length int64, mode DensifyMode) (consumed int64, err error) {
+	defer func() { err = opError("densify", f.Name(), off, length, err) }()
+	if off < 0 || length < 0 {
+		return 0, syscall.EINVAL
+	}
+	var al Allocator
+	if mode == DensifyZeroRange {
+		var ok bool
+		if al, ok = f.(Allocator); !ok {
+			return 0, ErrNotSupported
+		}
+	}
+	size, err := sparseSize(f)
+	if err != nil {
+		return 0, err
+	}
+	endx := size
+	if length > 0 {
+		endx = min(off+length, size)
+	}
+	before, measured := storageOf(f)
+	exts, err := f.Extents()
+	if err != nil {
+		return 0, err
+	}
+	var filled int64
+	var zeros []byte
+	defer func() {
+		if after, ok := storageOf(f); ok && measured {
+			consumed = max(after-before, 0)
+		} else {
+			consumed = filled
+		}
+	}()
+	for _, e := range exts {
+		beg, end := max(e.Offset, off), min(e.End(), endx)
+		if !e.Hole || beg >= end {
+			continue
+		}
+		if al != nil {
+			if _, err = al.Allocate(beg, end-beg); err != nil {
+				return
+			}
+			filled += end - beg
+			continue
+		}
+		if zeros == nil {
+			zeros = make([]byte, min(copyChunk, endx-off))
+		}
+		for beg < end {
+			n := min(int64(len(zeros)), end-beg)
+			if _, err = f.WriteAt(zeros[:n], beg); err != nil {
+				return
+			}
+			beg += n
+			filled += n
+		}
+	}
+	if al == nil && filled > 0 {
+		// delayed allocation: make it real before we measure.
+		err = f.Sync()
+	}
+	return
+}
+
+// storageOf returns the bytes of storage behind f, if
+// the platform tells us.
+func storageOf(f SparseFile) (n int64, ok bool) {
+	fi, err := f.Stat()
+	if err != nil || fi.Sys() == nil {
+		return 0, false
+	}
+	return statAllocated(fi), true
+}
@@ -0,0 +1,67 @@
+package sparsified
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDensify(t *testing.T) {
+	dir := t.TempDir()
+	for _, mode := range []DensifyMode{DensifyZeroRange, DensifyWriteZeros} {
+		fd, err := os.Create(filepath.Join(dir, mode.String()+".img"))
+		panicOn(err)
+		defer fd.Close()
+		f := NewOSFile(fd)
+		_, err = f.WriteAt(bytes.Repeat([]byte("data"), 1024), 0)
+		panicOn(err)
+		_, err = f.WriteAt(bytes.Repeat([]byte("tail"), 1024), 2<<20-4096)
+		panicOn(err)
+		want := readAll(t, f)
+		if before, _ := storageOf(f); before > 64<<10 {
+			t.Skipf("no holes here: %v bytes allocated", before)
+		}
+
+		// just the first 1MB.
+		got, err := Densify(f, 0, 1<<20, mode)
+		if errors.Is(err, ErrNotSupported) {
+			t.Skipf("%v: %v", mode, err)
+		}
+		panicOn(err)
+		if got < 1<<20-4096 || got > 1<<20+64<<10 {
+			t.Fatalf("%v: first MB consumed %v", mode, got)
+		}
+
+		// then the rest, and again, which finds nothing to do.
+		got, err = Densify(f, 0, 0, mode)
+		panicOn(err)
+		if got < 1<<20-4096 || got > 1<<20+64<<10 {
+			t.Fatalf("%v: rest consumed %v", mode, got)
+		}
+		if got, err = Densify(f, 0, 0, mode); err != nil || got != 0 {
+			t.Fatalf("%v: densifying twice consumed %v, err %v", mode, got, err)
+		}
+		if !bytes.Equal(readAll(t, f), want) {
+			t.Fatalf("%v: content changed", mode)
+		}
+	}
+
+	m := NewMemSparseFile("mem.img", 4096)
+	_, err := m.WriteAt([]byte("x"), 100<<10)
+	panicOn(err)
+	if _, err = Densify(m, 0, 0, DensifyZeroRange); !errors.Is(err, ErrNotSupported) {
+		t.Fatalf("zero-range on a MemSparseFile: %v", err)
+	}
+	got, err := Densify(m, 8192, 8192, DensifyWriteZeros)
+	panicOn(err)
+	exts, err := m.Extents()
+	panicOn(err)
+	if got != 8192 || len(exts) != 4 || exts[1] != (Extent{Offset: 8192, Length: 8192}) {
+		t.Fatalf("write-zeros on a MemSparseFile: consumed %v, extents %+v", got, exts)
+	}
+	if _, err = Densify(m, -1, 0, DensifyWriteZeros); err == nil {
+		t.Fatalf("negative offset accepted")
+	}
+}
@@ -0,0 +1,188 @@
+package sparsified
+
+import (
+	"io"
+	"os"
+	"syscall"
+)
+
+// EmulatedFile is a SparseFile over an ordinary *os.File
+// that does all of the sparse operations in userspace, so
+// it works on any filesystem (FAT, NFS, overlayfs, ZFS
+// without collapse range, ...). The price is I/O:
+//
+//   - PunchHole writes zeros over the range.
+//   - CollapseRange and InsertRange move the tail of the
+//     file with read/write, then truncate.
+//   - Extents reports the kernel's holes, and additionally
+//     any all-zero block inside the data as a hole. A punched
+//     range therefore still reads back as a hole, even though
+//     the filesystem allocated the zeros.
+//
+// Alignment and EOF rules are the same as for the kernel
+// (see MemSparseFile), with BlockSize as the block size,
+// so code tested against an EmulatedFile behaves the same
+// on ext4 or XFS.
+type EmulatedFile struct {
+	*os.File
+	BlockSize int64
+}
+
+// NewEmulatedFile wraps fd. A blockSize <= 0 means 4096.
+func NewEmulatedFile(fd *os.File, blockSize int64) *EmulatedFile {
+	if blockSize <= 0 {
+		blockSize = 4096
+	}
+	return &EmulatedFile{File: fd, BlockSize: blockSize}
+}
+
+// opErr is the error a failed operation returns; size is the
+// file size where that explains an EINVAL, or -1.
+func (f *EmulatedFile) opErr(op string, off, length int64, errno syscall.Errno, size int64) error {
+	return errnoError(op, f.Name(), off, length, errno, size, f.BlockSize)
+}
+
+// Extents scans the data extents of the file for zero blocks,
+// and reports those as holes too.
+func (f *EmulatedFile) Extents() (exts []Extent, err error) {
+	defer func() { err = opError("extents", f.Name(), 0, 0, err) }()
+	kexts, err := Extents(f.File)
+	if err != nil {
+		return nil, err
+	}
+	add := func(beg, endx int64, hole bool) {
+		if k := len(exts) - 1; k >= 0 && exts[k].Hole == hole {
+			exts[k].Length = endx - exts[k].Offset
+			return
+		}
+		exts = append(exts, Extent{Offset: beg, Length: endx - beg, Hole: hole})
+	}
+	bs := f.BlockSize
+	buf := make([]byte, bs)
+	for _, e := range kexts {
+		if e.Hole {
+			add(e.Offset, e.End(), true)
+			continue
+		}
+		for off := e.Offset; off < e.End(); {
+			// stay on block boundaries of the file.
+			n := min(bs-off%bs, e.End()-off)
+			m, rerr := f.ReadAt(buf[:n], off)
+			if rerr != nil && !(rerr == io.EOF && int64(m) == n) {
+				return nil, rerr
+			}
+			add(off, off+n, isZero(buf[:n]))
+			off += n
+		}
+	}
+	return
+}
+
+// PunchHole writes zeros over [off, off+length),
+// clipped to the file size, which never changes.
+func (f *EmulatedFile) PunchHole(off, length int64) (err error) {
+	defer func() { err = opError("punchhole", f.Name(), off, length, err) }()
+	if off < 0 || length <= 0 {
+		return f.opErr("punchhole", off, length, syscall.EINVAL, -1)
+	}
+	size, err := fileSizeFromFile(f.File)
+	if err != nil {
+		return err
+	}
+	return f.writeZeros(off, min(off+length, size))
+}
+
+func (f *EmulatedFile) writeZeros(beg, endx int64) error {
+	for beg < endx {
+		n := min(int64(len(oneZeroBlock4k)), endx-beg)
+		if _, err := f.WriteAt(oneZeroBlock4k[:n], beg); err != nil {
+			return err
+		}
+		beg += n
+	}
+	return nil
+}
+
+// ZeroRange writes zeros over [off, off+length),
+// extending the file if the range goes past EOF.
+func (f *EmulatedFile) ZeroRange(off, length int64) (err error) {
+	defer func() { err = opError("zerorange", f.Name(), off, length, err) }()
+	if off < 0 || length <= 0 {
+		return f.opErr("zerorange", off, length, syscall.EINVAL, -1)
+	}
+	size, err := fileSizeFromFile(f.File)
+	if err != nil {
+		return err
+	}
+	if err = f.writeZeros(off, min(off+length, size)); err != nil {
+		return err
+	}
+	if off+length > size {
+		return f.Truncate(off + length)
+	}
+	return nil
+}
+
+// CollapseRange removes [off, off+length) by copying the
+// tail of the file down, then truncating.
+func (f *EmulatedFile) CollapseRange(off, length int64) (err error) {
+	defer func() { err = opError("collapserange", f.Name(), off, length, err) }()
+	bs := f.BlockSize
+	if off < 0 || length <= 0 || off%bs != 0 || length%bs != 0 {
+		return f.opErr("collapserange", off, length, syscall.EINVAL, -1)
+	}
+	size, err := fileSizeFromFile(f.File)
+	if err != nil {
+		return err
+	}
+	if off+length >= size {
+		return f.opErr("collapserange", off, length, syscall.EINVAL, size)
+	}
+	// moving down, so copy front to back.
+	buf := make([]byte, copyChunk)
+	for from := off + length; from < size; {
+		n := min(int64(len(buf)), size-from)
+		if _, err := f.ReadAt(buf[:n], from); err != nil && err != io.EOF {
+			return err
+		}
+		if _, err := f.WriteAt(buf[:n], from-length); err != nil {
+			return err
+		}
+		from += n
+	}
+	return f.Truncate(size - length)
+}
+
+// InsertRange inserts length zero bytes at off by
+// growing the file and copying the tail up.
+func (f *EmulatedFile) InsertRange(off, length int64) (err error) {
+	defer func() { err = opError("insertrange", f.Name(), off, length, err) }()
+	bs := f.BlockSize
+	if off < 0 || length <= 0 || off%bs != 0 || length%bs != 0 {
+		return f.opErr("insertrange", off, length, syscall.EINVAL, -1)
+	}
+	size, err := fileSizeFromFile(f.File)
+	if err != nil {
+		return err
+	}
+	if off >= size {
+		return f.opErr("insertrange", off, length, syscall.EINVAL, size)
+	}
+	if err = f.Truncate(size + length); err != nil {
+		return err
+	}
+	// moving up, so copy back to front.
+	buf := make([]byte, copyChunk)
+	for endx := size; endx > off; {
+		n := min(int64(len(buf)), endx-off)
+		from := endx - n
+		if _, err := f.ReadAt(buf[:n], from); err != nil && err != io.EOF {
+			return err
+		}
+		if _, err := f.WriteAt(buf[:n], from+length); err != nil {
+			return err
+		}
+		endx = from
+	}
+	return f.writeZeros(off, min(off+length, size))
+}
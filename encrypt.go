@@ -0,0 +1,605 @@
+package sparsified
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// Hole-preserving encryption.
+//
+// An EncryptedFile keeps a sparse file encrypted, block by
+// block, in another SparseFile:
+//
+//	0               encHeader, in a block of its own
+//	bs              the rekey journal, encJournal bytes: a hole
+//	                except while Rekey is running
+//	bs+encJournal   block i of the plain file, at +i*bs
+//
+// Blocks are encrypted with XTS-AES (IEEE 1619, the disk
+// encryption mode), with the block index as the tweak. XTS
+// keeps the length, so each block lands where it was and the
+// holes stay holes; the price is that the layout leaks, as
+// does which blocks changed between two copies. It does not
+// authenticate: tampering goes undetected, but garbles a whole
+// 16 bytes at least.
+//
+// Holes are never encrypted. Writing a block of zeros punches
+// it out, and reading, any 16 byte unit of ciphertext that is
+// all zeros reads as zeros: no key encrypts anything to that,
+// bar a 2^-128 chance.
+
+const (
+	encMagic   = "SPRSENC1"
+	encVersion = 1
+	encJournal = copyChunk
+	encUnit    = aes.BlockSize
+)
+
+// ErrWrongKey is returned by OpenEncryptedFile and Rekey when
+// a key does not match the one the file was encrypted with.
+var ErrWrongKey = fmt.Errorf("wrong key for the encrypted file.")
+
+// ErrRekeyPending is returned by OpenEncryptedFile while a
+// Rekey is unfinished; call Rekey again to finish it.
+var ErrRekeyPending = fmt.Errorf("key rotation is unfinished; resume it with Rekey.")
+
+type encHeader struct {
+	Magic     [8]byte
+	Version   uint32
+	BlockSize uint32
+	Size      uint64
+	Salt      [16]byte
+
+	// KeyCheck is an HMAC of Salt with the key, to tell a
+	// wrong key from a right one. NextKeyCheck is that of the
+	// new key while Rekey runs.
+	KeyCheck     [16]byte
+	NextKeyCheck [16]byte
+
+	// Blocks before RekeyAt are under the new key. Journal,
+	// if not 0, is how many bytes of old ciphertext from
+	// RekeyAt on are saved in the journal.
+	RekeyAt uint64
+	Journal uint64
+}
+
+func (h *encHeader) rekeying() bool {
+	return h.NextKeyCheck != [16]byte{}
+}
+
+// EncryptedFile is a SparseFile whose blocks are stored
+// encrypted in another one. It is safe for concurrent use by
+// writers of different blocks. CollapseRange and InsertRange
+// would change block indexes, and hence their encryption, so
+// they return an error matching ErrNotSupported.
+type EncryptedFile struct {
+	f    SparseFile
+	bs   int64
+	base int64 // where block 0 is stored in f.
+	x    *xts
+
+	mu  sync.Mutex
+	hdr encHeader
+}
+
+var _ SparseFile = &EncryptedFile{}
+
+// NewEncryptedFile starts a new, empty, encrypted file in f,
+// truncating f. The key is 32 bytes for XTS-AES-128 or 64
+// for XTS-AES-256, made of two different halves. blockSize is
+// the unit of encryption, and of holes: a power of two from
+// 512 bytes to 1MB, and 0 means 4096. Use the filesystem block
+// size or a multiple of it, or holes in f will not line up.
+func NewEncryptedFile(f SparseFile, key []byte, blockSize int64) (e *EncryptedFile, err error) {
+	defer func() { err = opError("encrypt", f.Name(), 0, 0, err) }()
+	if blockSize == 0 {
+		blockSize = 4096
+	}
+	if blockSize < 512 || blockSize > encJournal || blockSize&(blockSize-1) != 0 {
+		return nil, fmt.Errorf("NewEncryptedFile: block size %v is not a power of two from 512 to %v", blockSize, encJournal)
+	}
+	x, err := newXTS(key)
+	if err != nil {
+		return nil, err
+	}
+	e = &EncryptedFile{f: f, bs: blockSize, base: blockSize + encJournal, x: x}
+	e.hdr = encHeader{Version: encVersion, BlockSize: uint32(blockSize)}
+	copy(e.hdr.Magic[:], encMagic)
+	if _, err = rand.Read(e.hdr.Salt[:]); err != nil {
+		return nil, err
+	}
+	e.hdr.KeyCheck = keyCheck(key, e.hdr.Salt)
+	if err = f.Truncate(0); err != nil {
+		return nil, err
+	}
+	if err = f.Truncate(e.base); err != nil {
+		return nil, err
+	}
+	return e, e.writeHeader()
+}
+
+// OpenEncryptedFile opens the encrypted file in f with key.
+func OpenEncryptedFile(f SparseFile, key []byte) (e *EncryptedFile, err error) {
+	defer func() { err = opError("decrypt", f.Name(), 0, 0, err) }()
+	e, err = openEncrypted(f, key)
+	if err == nil && e.hdr.rekeying() {
+		return nil, ErrRekeyPending
+	}
+	return e, err
+}
+
+func openEncrypted(f SparseFile, key []byte) (e *EncryptedFile, err error) {
+	e = &EncryptedFile{f: f}
+	if err = readLE(f, 0, &e.hdr); err != nil {
+		return nil, fmt.Errorf("OpenEncryptedFile: reading header: %w", err)
+	}
+	if string(e.hdr.Magic[:]) != encMagic {
+		return nil, fmt.Errorf("OpenEncryptedFile: not an encrypted file (magic %q)", e.hdr.Magic[:])
+	}
+	if e.hdr.Version != encVersion {
+		return nil, fmt.Errorf("OpenEncryptedFile: version %v is not supported", e.hdr.Version)
+	}
+	e.bs = int64(e.hdr.BlockSize)
+	if e.bs < 512 || e.bs > encJournal || e.bs&(e.bs-1) != 0 {
+		return nil, fmt.Errorf("OpenEncryptedFile: corrupt header: block size %v", e.bs)
+	}
+	e.base = e.bs + encJournal
+	if check := keyCheck(key, e.hdr.Salt); !hmac.Equal(e.hdr.KeyCheck[:], check[:]) {
+		return nil, ErrWrongKey
+	}
+	e.x, err = newXTS(key)
+	return e, err
+}
+
+func (e *EncryptedFile) writeHeader() error {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, &e.hdr)
+	_, err := e.f.WriteAt(buf.Bytes(), 0)
+	return err
+}
+
+// keyCheck returns the first half of HMAC-SHA256(key, salt).
+func keyCheck(key []byte, salt [16]byte) (sum [16]byte) {
+	m := hmac.New(sha256.New, key)
+	m.Write([]byte(encMagic))
+	m.Write(salt[:])
+	copy(sum[:], m.Sum(nil))
+	return
+}
+
+// Size returns the size of the plain file.
+func (e *EncryptedFile) Size() int64 {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return int64(e.hdr.Size)
+}
+
+// Name returns the name of the underlying file.
+func (e *EncryptedFile) Name() string {
+	return e.f.Name()
+}
+
+// storedLen is how many bytes of block i are stored, for a
+// file of the given size: its length, rounded up to the XTS
+// unit.
+func (e *EncryptedFile) storedLen(i, size int64) int64 {
+	return ceilDiv(max(min(e.bs, size-i*e.bs), 0), encUnit) * encUnit
+}
+
+// readBlock decrypts block i into pt, which is e.bs long.
+func (e *EncryptedFile) readBlock(x *xts, i, size int64, pt, ct []byte) error {
+	n := e.storedLen(i, size)
+	m, err := e.f.ReadAt(ct[:n], e.base+i*e.bs)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	clear(ct[m:])
+	x.decrypt(pt, ct, uint64(i))
+	return nil
+}
+
+// writeBlock encrypts the first n bytes of block i from pt,
+// or punches the block out if they are all zeros.
+func (e *EncryptedFile) writeBlock(x *xts, i, n int64, pt, ct []byte) error {
+	stored := ceilDiv(n, encUnit) * encUnit
+	clear(pt[n:stored])
+	if isZero(pt[:n]) {
+		if err := e.f.PunchHole(e.base+i*e.bs, stored); err == nil {
+			return nil
+		}
+		// the punch is an optimization; zeros do as well.
+		clear(ct[:stored])
+	} else {
+		x.encrypt(ct[:stored], pt[:stored], uint64(i))
+	}
+	_, err := e.f.WriteAt(ct[:stored], e.base+i*e.bs)
+	return err
+}
+
+// ReadAt decrypts, reading holes as zeros.
+func (e *EncryptedFile) ReadAt(p []byte, off int64) (n int, err error) {
+	if off < 0 {
+		return 0, opError("readat", e.Name(), off, int64(len(p)), os.ErrInvalid)
+	}
+	size := e.Size()
+	endx := min(off+int64(len(p)), size)
+	pt, ct := make([]byte, e.bs), make([]byte, e.bs)
+	for off < endx {
+		i, bo := off/e.bs, off%e.bs
+		if err = e.readBlock(e.x, i, size, pt, ct); err != nil {
+			return n, err
+		}
+		k := copy(p[n:n+int(min(e.bs-bo, endx-off))], pt[bo:])
+		n += k
+		off += int64(k)
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// WriteAt encrypts p into the blocks it covers, reading and
+// rewriting any it only partly covers.
+func (e *EncryptedFile) WriteAt(p []byte, off int64) (n int, err error) {
+	if off < 0 {
+		return 0, opError("writeat", e.Name(), off, int64(len(p)), os.ErrInvalid)
+	}
+	endx := off + int64(len(p))
+	size, err := e.grow(endx)
+	if err != nil {
+		return 0, err
+	}
+	pt, ct := make([]byte, e.bs), make([]byte, e.bs)
+	for off < endx {
+		i, bo := off/e.bs, off%e.bs
+		k := min(e.bs-bo, endx-off)
+		blen := min(e.bs, size-i*e.bs)
+		if bo != 0 || k != blen {
+			if err = e.readBlock(e.x, i, size, pt, ct); err != nil {
+				return n, err
+			}
+		}
+		copy(pt[bo:], p[n:n+int(k)])
+		if err = e.writeBlock(e.x, i, blen, pt, ct); err != nil {
+			return n, err
+		}
+		n += int(k)
+		off += k
+	}
+	return n, nil
+}
+
+// grow extends the file to at least size, and returns the
+// size it then has.
+func (e *EncryptedFile) grow(size int64) (int64, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if size <= int64(e.hdr.Size) {
+		return int64(e.hdr.Size), nil
+	}
+	return size, e.setSize(size)
+}
+
+// setSize records size in the header and sizes f to hold it.
+// The caller holds e.mu.
+func (e *EncryptedFile) setSize(size int64) error {
+	e.hdr.Size = uint64(size)
+	if err := e.writeHeader(); err != nil {
+		return err
+	}
+	return e.f.Truncate(e.base + ceilDiv(size, encUnit)*encUnit)
+}
+
+// Truncate changes the size of the plain file. Shrinking
+// into the middle of a block rewrites that block, so that
+// growing again reads zeros past the old end.
+func (e *EncryptedFile) Truncate(size int64) (err error) {
+	defer func() { err = opError("truncate", e.Name(), size, 0, err) }()
+	if size < 0 {
+		return os.ErrInvalid
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	old := int64(e.hdr.Size)
+	if i := size / e.bs; size < old && size%e.bs != 0 {
+		pt, ct := make([]byte, e.bs), make([]byte, e.bs)
+		if err = e.readBlock(e.x, i, old, pt, ct); err != nil {
+			return err
+		}
+		if err = e.writeBlock(e.x, i, size%e.bs, pt, ct); err != nil {
+			return err
+		}
+	}
+	return e.setSize(size)
+}
+
+// Extents returns the hole map of f, moved down to where
+// the blocks are in the plain file.
+func (e *EncryptedFile) Extents() (exts []Extent, err error) {
+	size := e.Size()
+	under, err := e.f.Extents()
+	if err != nil {
+		return nil, err
+	}
+	add := func(x Extent) {
+		if k := len(exts) - 1; k >= 0 && exts[k].Hole == x.Hole {
+			exts[k].Length = x.End() - exts[k].Offset
+			return
+		}
+		exts = append(exts, x)
+	}
+	for _, u := range under {
+		beg, end := max(u.Offset-e.base, 0), min(u.End()-e.base, size)
+		if beg < end {
+			add(Extent{Offset: beg, Length: end - beg, Hole: u.Hole})
+		}
+	}
+	end := int64(0)
+	if len(exts) > 0 {
+		end = exts[len(exts)-1].End()
+	}
+	if end < size {
+		add(Extent{Offset: end, Length: size - end, Hole: true})
+	}
+	return exts, nil
+}
+
+// PunchHole punches out the whole blocks in the range, and
+// writes zeros over the rest.
+func (e *EncryptedFile) PunchHole(off, length int64) (err error) {
+	defer func() { err = opError("punchhole", e.Name(), off, length, err) }()
+	if off < 0 || length <= 0 {
+		return os.ErrInvalid
+	}
+	size := e.Size()
+	endx := min(off+length, size)
+	first, last := ceilDiv(off, e.bs), endx/e.bs
+	if endx == size {
+		last = ceilDiv(size, e.bs)
+	}
+	zeroOut := func(beg, end int64) error {
+		for beg < end {
+			n := min(end-beg, int64(len(oneZeroBlock4k)))
+			if _, err := e.WriteAt(oneZeroBlock4k[:n], beg); err != nil {
+				return err
+			}
+			beg += n
+		}
+		return nil
+	}
+	if first >= last {
+		return zeroOut(off, endx)
+	}
+	if err = zeroOut(off, first*e.bs); err != nil {
+		return err
+	}
+	stored := min(last*e.bs, ceilDiv(size, encUnit)*encUnit) - first*e.bs
+	if err = e.f.PunchHole(e.base+first*e.bs, stored); err != nil {
+		return err
+	}
+	return zeroOut(min(last*e.bs, endx), endx)
+}
+
+func (e *EncryptedFile) CollapseRange(off, length int64) error {
+	return opError("collapserange", e.Name(), off, length, ErrNotSupported)
+}
+
+func (e *EncryptedFile) InsertRange(off, length int64) error {
+	return opError("insertrange", e.Name(), off, length, ErrNotSupported)
+}
+
+func (e *EncryptedFile) Sync() error {
+	return e.f.Sync()
+}
+
+// Stat returns the FileInfo of the underlying file, but with
+// the size of the plain one.
+func (e *EncryptedFile) Stat() (os.FileInfo, error) {
+	fi, err := e.f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return &sizedFileInfo{FileInfo: fi, size: e.Size()}, nil
+}
+
+// sizedFileInfo is a FileInfo with the size of another file.
+type sizedFileInfo struct {
+	os.FileInfo
+	size int64
+}
+
+func (fi *sizedFileInfo) Size() int64 { return fi.size }
+
+// Rekey re-encrypts the encrypted file in f from oldKey to
+// newKey, in place. Only data blocks are read and written;
+// holes are left alone.
+//
+// Each chunk of ciphertext is copied to a journal before it
+// is rewritten, so that Rekey survives crashes and canceled
+// contexts: until it finishes, OpenEncryptedFile fails with
+// ErrRekeyPending, and calling Rekey again with the same two
+// keys picks up where it stopped.
+func Rekey(ctx context.Context, f SparseFile, oldKey, newKey []byte, opts *Options) (err error) {
+	defer func() { err = opError("rekey", f.Name(), 0, 0, err) }()
+	e, err := openEncrypted(f, oldKey)
+	if err != nil {
+		return err
+	}
+	next, err := newXTS(newKey)
+	if err != nil {
+		return err
+	}
+	h := &e.hdr
+	nextCheck := keyCheck(newKey, h.Salt)
+	switch {
+	case !h.rekeying():
+		h.NextKeyCheck, h.RekeyAt, h.Journal = nextCheck, 0, 0
+		if err = e.commit(); err != nil {
+			return err
+		}
+	case h.NextKeyCheck != nextCheck:
+		return ErrWrongKey
+	case h.Journal > 0:
+		// put back what the interrupted chunk was.
+		buf := make([]byte, h.Journal)
+		if _, err = f.ReadAt(buf, e.bs); err != nil {
+			return err
+		}
+		if _, err = f.WriteAt(buf, e.base+int64(h.RekeyAt)*e.bs); err != nil {
+			return err
+		}
+		if err = f.Sync(); err != nil {
+			return err
+		}
+	}
+
+	size := int64(h.Size)
+	exts, err := e.Extents()
+	if err != nil {
+		return err
+	}
+	pr := newProgress(ctx, "rekey", opts, size, dataBytes(exts))
+	defer func() { err = pr.done(err) }()
+	resume := int64(h.RekeyAt) * e.bs
+	pr.resume(resume)
+	buf, pt := make([]byte, encJournal), make([]byte, e.bs)
+	for _, x := range exts {
+		if x.End() <= resume {
+			continue
+		}
+		if x.Hole {
+			if err = pr.hole(max(x.Offset, resume), x.End()-max(x.Offset, resume)); err != nil {
+				return err
+			}
+			continue
+		}
+		// whole blocks, a journal full at a time.
+		for off := max(x.Offset, resume) / e.bs * e.bs; off < x.End(); off += encJournal {
+			n := min(encJournal, ceilDiv(x.End(), e.bs)*e.bs-off)
+			if err = e.rekeyChunk(next, off, n, size, buf, pt); err != nil {
+				return err
+			}
+			if err = pr.data(max(off, x.Offset), min(off+n, x.End())-max(off, x.Offset)); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err = f.PunchHole(e.bs, encJournal); err != nil {
+		optHooks(opts).log.Debug("sparsified: could not punch out the rekey journal", "path", f.Name(), "err", err)
+	}
+	h.KeyCheck, h.NextKeyCheck, h.RekeyAt, h.Journal = nextCheck, [16]byte{}, 0, 0
+	return e.commit()
+}
+
+// rekeyChunk re-encrypts the n bytes of blocks at off, which
+// is block aligned: journal, rewrite, then record the blocks
+// as done.
+func (e *EncryptedFile) rekeyChunk(next *xts, off, n, size int64, buf, pt []byte) error {
+	stored := min(off+n, ceilDiv(size, encUnit)*encUnit) - off
+	ct := buf[:stored]
+	if m, err := e.f.ReadAt(ct, e.base+off); err != nil && err != io.EOF {
+		return err
+	} else {
+		clear(ct[m:])
+	}
+	if _, err := e.f.WriteAt(ct, e.bs); err != nil {
+		return err
+	}
+	if err := e.f.Sync(); err != nil {
+		return err
+	}
+	e.hdr.RekeyAt, e.hdr.Journal = uint64(off/e.bs), uint64(stored)
+	if err := e.commit(); err != nil {
+		return err
+	}
+	for b := int64(0); b < stored; b += e.bs {
+		blk := ct[b:min(b+e.bs, stored)]
+		if isZero(blk) {
+			continue
+		}
+		i := uint64((off + b) / e.bs)
+		e.x.decrypt(pt[:len(blk)], blk, i)
+		next.encrypt(blk, pt[:len(blk)], i)
+	}
+	if _, err := e.f.WriteAt(ct, e.base+off); err != nil {
+		return err
+	}
+	e.hdr.RekeyAt, e.hdr.Journal = uint64((off+n)/e.bs), 0
+	return e.commit()
+}
+
+// commit writes the header and syncs.
+func (e *EncryptedFile) commit() error {
+	if err := e.writeHeader(); err != nil {
+		return err
+	}
+	return e.f.Sync()
+}
+
+// xts is XTS-AES, as in IEEE 1619 and NIST SP 800-38E, for
+// data units that are a multiple of 16 bytes long.
+type xts struct {
+	k1, k2 cipher.Block
+}
+
+func newXTS(key []byte) (*xts, error) {
+	if len(key) != 32 && len(key) != 64 {
+		return nil, fmt.Errorf("XTS key is %v bytes, not 32 or 64", len(key))
+	}
+	half := len(key) / 2
+	if subtle.ConstantTimeCompare(key[:half], key[half:]) == 1 {
+		return nil, fmt.Errorf("XTS key halves must differ")
+	}
+	k1, _ := aes.NewCipher(key[:half])
+	k2, _ := aes.NewCipher(key[half:])
+	return &xts{k1: k1, k2: k2}, nil
+}
+
+func (x *xts) encrypt(dst, src []byte, unit uint64) {
+	x.crypt(dst, src, unit, true)
+}
+
+// decrypt decrypts src into dst, except that all-zero units
+// of src decrypt to zeros.
+func (x *xts) decrypt(dst, src []byte, unit uint64) {
+	x.crypt(dst, src, unit, false)
+}
+
+func (x *xts) crypt(dst, src []byte, unit uint64, encrypt bool) {
+	var t [encUnit]byte
+	binary.LittleEndian.PutUint64(t[:], unit)
+	x.k2.Encrypt(t[:], t[:])
+	for j := 0; j < len(src); j += encUnit {
+		d, s := dst[j:j+encUnit], src[j:j+encUnit]
+		if !encrypt && isZero(s) {
+			clear(d)
+		} else {
+			subtle.XORBytes(d, s, t[:])
+			if encrypt {
+				x.k1.Encrypt(d, d)
+			} else {
+				x.k1.Decrypt(d, d)
+			}
+			subtle.XORBytes(d, d, t[:])
+		}
+		// t *= alpha in GF(2^128), little endian.
+		carry := t[15] >> 7
+		for k := 15; k > 0; k-- {
+			t[k] = t[k]<<1 | t[k-1]>>7
+		}
+		t[0] = t[0]<<1 ^ carry*0x87
+	}
+}
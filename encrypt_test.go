@@ -0,0 +1,208 @@
+package sparsified
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"encoding/hex"
+	"errors"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestXTSVectors(t *testing.T) {
+	// IEEE 1619-2007, annex B, vectors 1 to 3.
+	for i, v := range []struct {
+		k1, k2, pt, ct string
+		unit           uint64
+	}{
+		{"00000000000000000000000000000000", "00000000000000000000000000000000",
+			"0000000000000000000000000000000000000000000000000000000000000000",
+			"917cf69ebd68b2ec9b9fe9a3eadda692cd43d2f59598ed858c02c2652fbf922e", 0},
+		{"11111111111111111111111111111111", "22222222222222222222222222222222",
+			"4444444444444444444444444444444444444444444444444444444444444444",
+			"c454185e6a16936e39334038acef838bfb186fff7480adc4289382ecd6d394f0", 0x3333333333},
+		{"fffefdfcfbfaf9f8f7f6f5f4f3f2f1f0", "22222222222222222222222222222222",
+			"4444444444444444444444444444444444444444444444444444444444444444",
+			"af85336b597afc1a900b2eb21ec949d292df4c047e0b21532186a5971a227a89", 0x3333333333},
+	} {
+		k1, _ := hex.DecodeString(v.k1)
+		k2, _ := hex.DecodeString(v.k2)
+		pt, _ := hex.DecodeString(v.pt)
+		want, _ := hex.DecodeString(v.ct)
+		b1, _ := aes.NewCipher(k1)
+		b2, _ := aes.NewCipher(k2)
+		x := &xts{k1: b1, k2: b2}
+		got := make([]byte, len(pt))
+		x.encrypt(got, pt, v.unit)
+		if !bytes.Equal(got, want) {
+			t.Fatalf("vector %v: got %x, want %x", i+1, got, want)
+		}
+		x.decrypt(got, got, v.unit)
+		if !bytes.Equal(got, pt) {
+			t.Fatalf("vector %v: decrypted to %x", i+1, got)
+		}
+	}
+}
+
+func testKey(seed int64) []byte {
+	key := make([]byte, 64)
+	rand.New(rand.NewSource(seed)).Read(key)
+	return key
+}
+
+func TestEncryptedFile(t *testing.T) {
+	dir := t.TempDir()
+	sz, spans := testSpans()
+	src := makeTestSparse(t, filepath.Join(dir, "src.img"), sz, spans)
+	defer src.Close()
+	srcExts, err := Extents(src)
+	panicOn(err)
+	ufd, err := os.Create(filepath.Join(dir, "enc.img"))
+	panicOn(err)
+	defer ufd.Close()
+
+	key := testKey(1)
+	enc, err := NewEncryptedFile(NewOSFile(ufd), key, 0)
+	panicOn(err)
+	_, err = Copy(context.Background(), enc, NewOSFile(src), nil)
+	panicOn(err)
+
+	// the holes are still there, and nothing is in the clear.
+	exts, err := enc.Extents()
+	panicOn(err)
+	if len(exts) != len(srcExts) {
+		t.Fatalf("extents %+v, want %+v", exts, srcExts)
+	}
+	for i := range exts {
+		if exts[i] != srcExts[i] {
+			t.Fatalf("extent %v is %+v, want %+v", i, exts[i], srcExts[i])
+		}
+	}
+	raw := readAll(t, NewOSFile(ufd))
+	plain := readAll(t, NewOSFile(src))
+	if bytes.Contains(raw, plain[3<<20+5:3<<20+5+64]) {
+		t.Fatalf("plain text in the encrypted file")
+	}
+
+	// reopen, and decrypt with Copy.
+	if _, err = OpenEncryptedFile(NewOSFile(ufd), testKey(2)); !errors.Is(err, ErrWrongKey) {
+		t.Fatalf("wrong key: %v", err)
+	}
+	enc, err = OpenEncryptedFile(NewOSFile(ufd), key)
+	panicOn(err)
+	out, err := os.Create(filepath.Join(dir, "out.img"))
+	panicOn(err)
+	defer out.Close()
+	_, err = Copy(context.Background(), NewOSFile(out), enc, nil)
+	panicOn(err)
+	sameContentAndHoles(t, src, out)
+	if _, err = enc.Extents(); err != nil || enc.CollapseRange(0, 4096) == nil {
+		t.Fatalf("collapse on an encrypted file worked")
+	}
+}
+
+// TestEncryptedFileModel checks unaligned writes, punches and
+// truncates against a MemSparseFile doing the same.
+func TestEncryptedFileModel(t *testing.T) {
+	rng := rand.New(rand.NewSource(3))
+	model := NewMemSparseFile("model", 4096)
+	enc, err := NewEncryptedFile(NewMemSparseFile("under", 4096), testKey(1), 4096)
+	panicOn(err)
+	for step := range 300 {
+		off := rng.Int63n(64 << 10)
+		n := rng.Int63n(10000) + 1
+		switch rng.Intn(4) {
+		case 0, 1:
+			p := make([]byte, n)
+			rng.Read(p)
+			if rng.Intn(3) == 0 {
+				clear(p)
+			}
+			_, err = model.WriteAt(p, off)
+			panicOn(err)
+			_, err = enc.WriteAt(p, off)
+			panicOn(err)
+		case 2:
+			if off < model.Size() {
+				panicOn(model.PunchHole(off, n))
+				panicOn(enc.PunchHole(off, n))
+			}
+		case 3:
+			panicOn(model.Truncate(off))
+			panicOn(enc.Truncate(off))
+		}
+		if enc.Size() != model.Size() {
+			t.Fatalf("step %v: size %v, want %v", step, enc.Size(), model.Size())
+		}
+		if !bytes.Equal(readAll(t, enc), readAll(t, model)) {
+			t.Fatalf("step %v: content differs", step)
+		}
+	}
+}
+
+func TestRekey(t *testing.T) {
+	rng := rand.New(rand.NewSource(4))
+	plain := NewMemSparseFile("plain", 4096)
+	for _, off := range []int64{0, 1 << 20, 3<<20 + 100, 5 << 20} {
+		p := make([]byte, 1<<20)
+		rng.Read(p)
+		_, err := plain.WriteAt(p, off)
+		panicOn(err)
+	}
+	panicOn(plain.PunchHole(1<<20+8192, 8192))
+	want := readAll(t, plain)
+	under := NewMemSparseFile("under", 4096)
+	oldKey, newKey := testKey(1), testKey(2)
+	enc, err := NewEncryptedFile(under, oldKey, 0)
+	panicOn(err)
+	_, err = Copy(context.Background(), enc, plain, nil)
+	panicOn(err)
+	wantExts, err := enc.Extents()
+	panicOn(err)
+
+	// crash halfway through rewriting the second chunk.
+	ff := NewFaultFile(under, 1, FaultRule{Op: OpWriteAt, Offset: enc.base + 1<<20 + 4096, Length: 1,
+		Short: 4096, Err: syscall.EIO, Times: 1})
+	if err = Rekey(context.Background(), ff, oldKey, newKey, nil); !errors.Is(err, syscall.EIO) {
+		t.Fatalf("rekey through the fault: %v", err)
+	}
+	if h := ff.Hits(); len(h) != 1 || h[0].Offset != enc.base+1<<20 {
+		t.Fatalf("fault hits %+v", h)
+	}
+	if _, err = OpenEncryptedFile(under, oldKey); !errors.Is(err, ErrRekeyPending) {
+		t.Fatalf("open halfway through: %v", err)
+	}
+	if err = Rekey(context.Background(), under, oldKey, testKey(3), nil); !errors.Is(err, ErrWrongKey) {
+		t.Fatalf("resumed with another new key: %v", err)
+	}
+
+	// and again, canceled after the first chunk.
+	ctx, cancel := context.WithCancel(context.Background())
+	err = Rekey(ctx, under, oldKey, newKey, &Options{ProgressInterval: 1, Progress: func(p Progress) {
+		if p.Offset > 1<<20 {
+			cancel()
+		}
+	}})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("canceled rekey: %v", err)
+	}
+
+	panicOn(Rekey(context.Background(), under, oldKey, newKey, nil))
+	if _, err = OpenEncryptedFile(under, oldKey); !errors.Is(err, ErrWrongKey) {
+		t.Fatalf("old key after rekey: %v", err)
+	}
+	enc, err = OpenEncryptedFile(under, newKey)
+	panicOn(err)
+	if !bytes.Equal(readAll(t, enc), want) {
+		t.Fatalf("content changed by rekey")
+	}
+	exts, err := enc.Extents()
+	panicOn(err)
+	if len(exts) != len(wantExts) {
+		t.Fatalf("rekey moved holes: %+v, want %+v", exts, wantExts)
+	}
+}
@@ -0,0 +1,132 @@
+package sparsified
+
+import "fmt"
+
+// Engine selects how Copy, Hash and Sparsify do their
+// bulk I/O. See Options.Engine.
+type Engine int
+
+const (
+	// EngineSyscall does one pread, pwrite, fallocate or
+	// copy_file_range per chunk. It is the default, and
+	// works on any SparseFile.
+	EngineSyscall Engine = iota
+
+	// EngineIOUring batches the reads, writes and hole
+	// punches of each chunk through an io_uring (Linux 5.6
+	// and later), saving most of the syscalls. It only
+	// applies when every file involved is an *OSFile; it
+	// skips copy_file_range, since the point is to keep
+	// the I/O in the ring. Where io_uring is missing, or
+	// disabled by seccomp or the io_uring_disabled sysctl,
+	// the operation quietly uses EngineSyscall instead.
+	EngineIOUring
+)
+
+func (e Engine) String() string {
+	switch e {
+	case EngineSyscall:
+		return "syscall"
+	case EngineIOUring:
+		return "io_uring"
+	}
+	return fmt.Sprintf("Engine(%d)", int(e))
+}
+
+// bulkSeg is the size of each read or write in a batch.
+const bulkSeg = 64 << 10
+
+type bulkKind int
+
+const (
+	bulkRead bulkKind = iota
+	bulkWrite
+	bulkPunch
+)
+
+func (k bulkKind) String() string {
+	return [...]string{"read", "write", "punchhole"}[k]
+}
+
+// bulkOp is one operation of a batch. For bulkPunch,
+// n is the length; for the others, len(buf).
+type bulkOp struct {
+	kind bulkKind
+	fd   int
+	name string
+	buf  []byte
+	off  int64
+	n    int64
+	res  int32
+}
+
+// newBulk returns a ring to do the I/O on files with, or nil
+// when the syscall engine is to be used: because opts asks for
+// it, a file is not an *OSFile, or io_uring is unavailable.
+func newBulk(opts *Options, files ...SparseFile) *uring {
+	if opts == nil || opts.Engine != EngineIOUring {
+		return nil
+	}
+	for _, f := range files {
+		if _, ok := f.(*OSFile); !ok {
+			return nil
+		}
+	}
+	h := files[0].(*OSFile).hooks()
+	r, err := newURing()
+	if err != nil {
+		h.log.Debug("sparsified: io_uring unavailable, using syscalls", "err", err)
+		return nil
+	}
+	r.h = h
+	return r
+}
+
+func bulkFile(f SparseFile) (fd int, name string) {
+	o := f.(*OSFile)
+	return int(o.Fd()), o.Name()
+}
+
+// bulkReadAt fills buf from f at off, in bulkSeg reads
+// submitted together. Past EOF buf reads as zeros.
+func bulkReadAt(r *uring, f SparseFile, buf []byte, off int64) error {
+	fd, name := bulkFile(f)
+	var ops []bulkOp
+	for o := 0; o < len(buf); o += bulkSeg {
+		seg := buf[o:min(o+bulkSeg, len(buf))]
+		ops = append(ops, bulkOp{kind: bulkRead, fd: fd, name: name, buf: seg, off: off + int64(o)})
+	}
+	return r.do(ops)
+}
+
+// bulkWriteSparse is writeAtSparse done as one batch: every
+// run of non-zero 4KB blocks of buf becomes one write.
+func bulkWriteSparse(r *uring, f SparseFile, buf []byte, off int64) error {
+	fd, name := bulkFile(f)
+	const bs = int64(len(oneZeroBlock4k))
+	var ops []bulkOp
+	for i := int64(0); i < int64(len(buf)); {
+		n := min(bs-(off+i)%bs, int64(len(buf))-i)
+		if isZero(buf[i : i+n]) {
+			i += n
+			continue
+		}
+		if k := len(ops) - 1; k >= 0 && ops[k].off+int64(len(ops[k].buf)) == off+i && len(ops[k].buf) < bulkSeg {
+			ops[k].buf = buf[ops[k].off-off : i+n]
+		} else {
+			ops = append(ops, bulkOp{kind: bulkWrite, fd: fd, name: name, buf: buf[i : i+n], off: off + i})
+		}
+		i += n
+	}
+	return r.do(ops)
+}
+
+// bulkPunchHoles punches the given [off, off+n) ranges of f.
+func bulkPunchHoles(r *uring, f SparseFile, holes []Extent) error {
+	fd, name := bulkFile(f)
+	ops := make([]bulkOp, len(holes))
+	for i, h := range holes {
+		ops[i] = bulkOp{kind: bulkPunch, fd: fd, name: name, off: h.Offset, n: h.Length}
+	}
+	return r.do(ops)
+}
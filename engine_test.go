@@ -0,0 +1,58 @@
+package sparsified
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// the bulk paths are tested with both engines; where io_uring
+// is not available EngineIOUring exercises the fallback.
+var testEngines = []Engine{EngineSyscall, EngineIOUring}
+
+func TestURingBulkOps(t *testing.T) {
+	r, err := newURing()
+	if err != nil {
+		t.Skipf("no io_uring here: %v", err)
+	}
+	defer r.close()
+
+	fd, err := os.Create(filepath.Join(t.TempDir(), "ring.img"))
+	panicOn(err)
+	defer fd.Close()
+	f := NewOSFile(fd)
+	panicOn(f.Truncate(1 << 20))
+
+	// 200 ops, more than one batch of uringEntries.
+	buf := make([]byte, 200*4096)
+	for i := range buf {
+		buf[i] = byte(i/4096) | 1
+	}
+	panicOn(bulkWriteSparse(r, f, buf, 0))
+	got := make([]byte, len(buf))
+	panicOn(bulkReadAt(r, f, got, 0))
+	if !bytes.Equal(got, buf) {
+		t.Fatalf("read back differs from what was written")
+	}
+
+	panicOn(bulkPunchHoles(r, f, []Extent{{Offset: 4096, Length: 4096}, {Offset: 64 << 10, Length: 64 << 10}}))
+	exts, err := f.Extents()
+	panicOn(err)
+	var holes []Extent
+	for _, e := range exts {
+		if e.Hole && e.Offset < int64(len(buf)) {
+			holes = append(holes, e)
+		}
+	}
+	if len(holes) != 2 || holes[0] != (Extent{Offset: 4096, Length: 4096, Hole: true}) ||
+		holes[1] != (Extent{Offset: 64 << 10, Length: 64 << 10, Hole: true}) {
+		t.Fatalf("holes after punching: %+v", holes)
+	}
+
+	// errors from the ring come back as *os.PathError.
+	bad := []bulkOp{{kind: bulkRead, fd: -1, name: "bad", buf: got[:10]}}
+	if err := r.do(bad); err == nil {
+		t.Fatalf("read from fd -1 succeeded")
+	}
+}
@@ -0,0 +1,132 @@
+package sparsified
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+)
+
+// ErrNotSupported means the platform or filesystem cannot
+// do the operation. It wraps errors.ErrUnsupported, so
+// checking for either works.
+var ErrNotSupported = fmt.Errorf("operation not supported: %w", errors.ErrUnsupported)
+
+// ErrUnaligned means the offset or length was not a multiple
+// of the filesystem block size, for an operation that needs
+// that (collapse and insert range, say).
+var ErrUnaligned = fmt.Errorf("offset or length not aligned to the block size.")
+
+// ErrBeyondEOF means the range reached or passed the end of
+// file where it may not, as for collapse range, or started
+// past it, as for insert range.
+var ErrBeyondEOF = fmt.Errorf("range reaches past the end of file.")
+
+// SparseOpError is the error the sparse operations of this
+// package return. It records the operation, the file and
+// range it was applied to, and the errno behind the failure,
+// if there was one.
+//
+// Use errors.Is to test for ErrFileTooLarge (EFBIG),
+// ErrShortAlloc (ENOSPC, or a short preallocation),
+// ErrNotSupported (EOPNOTSUPP and friends), ErrUnaligned
+// and ErrBeyondEOF (both EINVAL, told apart by looking at
+// the file). The errno itself matches too, as does anything
+// Err wraps.
+type SparseOpError struct {
+	Op     string
+	Path   string
+	Offset int64
+	Length int64
+
+	// Errno is zero if the failure did not come from
+	// (or, for MemSparseFile, imitate) a syscall.
+	Errno syscall.Errno
+
+	Err error
+
+	// reason is what EINVAL meant here, when we could tell:
+	// ErrUnaligned or ErrBeyondEOF.
+	reason error
+}
+
+func (e *SparseOpError) Error() string {
+	if e.Offset == 0 && e.Length == 0 {
+		return fmt.Sprintf("%v %v: %v", e.Op, e.Path, e.Err)
+	}
+	return fmt.Sprintf("%v %v [%v, +%v): %v", e.Op, e.Path, e.Offset, e.Length, e.Err)
+}
+
+func (e *SparseOpError) Unwrap() error { return e.Err }
+
+// Is maps the errno to our sentinel errors.
+func (e *SparseOpError) Is(target error) bool {
+	switch target {
+	case ErrFileTooLarge:
+		return e.Errno == syscall.EFBIG
+	case ErrShortAlloc:
+		return e.Errno == syscall.ENOSPC
+	case ErrNotSupported, errors.ErrUnsupported:
+		return notSupported(e.Errno)
+	case ErrUnaligned, ErrBeyondEOF:
+		return e.Errno == syscall.EINVAL && e.reason == target
+	}
+	return false
+}
+
+func notSupported(errno syscall.Errno) bool {
+	// not a switch: ENOTSUP and EOPNOTSUPP are the same on Linux.
+	return errno == syscall.EOPNOTSUPP || errno == syscall.ENOTSUP ||
+		errno == syscall.ENOSYS || errno == syscall.ENOTTY || errno == syscall.EXDEV
+}
+
+// opError wraps err as a *SparseOpError, picking out its
+// errno. An err that already has one in its chain is returned
+// as is, so the innermost (most specific) operation is the one
+// errors.As finds. A nil err gives nil.
+func opError(op, path string, off, length int64, err error) error {
+	if err == nil {
+		return nil
+	}
+	var se *SparseOpError
+	if errors.As(err, &se) {
+		return err
+	}
+	e := &SparseOpError{Op: op, Path: path, Offset: off, Length: length, Err: err}
+	errors.As(err, &e.Errno)
+	return e
+}
+
+// errnoError is opError for a failed range operation that
+// returned EINVAL (or anything else) directly: for EINVAL,
+// size and blockSize say whether it was the range passing EOF
+// or being unaligned. Pass size < 0 if it is unknown.
+func errnoError(op, path string, off, length int64, errno syscall.Errno, size, blockSize int64) *SparseOpError {
+	e := &SparseOpError{Op: op, Path: path, Offset: off, Length: length, Errno: errno, Err: errno}
+	if errno == syscall.EINVAL {
+		e.reason = einvalReason(op, off, length, size, blockSize)
+	}
+	return e
+}
+
+// einvalReason guesses why op failed with EINVAL.
+func einvalReason(op string, off, length, size, blockSize int64) error {
+	if off < 0 || length <= 0 {
+		return nil
+	}
+	if size >= 0 {
+		switch op {
+		case "collapserange":
+			if off+length >= size {
+				return ErrBeyondEOF
+			}
+		case "insertrange":
+			if off >= size {
+				return ErrBeyondEOF
+			}
+		}
+	}
+	if blockSize > 0 && (off%blockSize != 0 || length%blockSize != 0) {
+		return ErrUnaligned
+	}
+	return nil
+}
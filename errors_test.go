@@ -0,0 +1,123 @@
+package sparsified
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+// every backend should fail the same way, and the errors
+// should map onto our sentinels by errno.
+func TestSparseOpErrors(t *testing.T) {
+	for name, f := range testBackends(t) {
+		_, err := f.WriteAt(make([]byte, 64<<10), 0)
+		panicOn(err)
+
+		err = f.CollapseRange(4096, 60<<10)
+		if errors.Is(err, ErrNotSupported) {
+			t.Logf("%v: no collapse range here: %v", name, err)
+			continue
+		}
+		var se *SparseOpError
+		if !errors.As(err, &se) {
+			t.Fatalf("%v: collapse to EOF gave %T %v, want *SparseOpError", name, err, err)
+		}
+		if se.Op != "collapserange" || se.Offset != 4096 || se.Length != 60<<10 || se.Errno != syscall.EINVAL {
+			t.Fatalf("%v: collapse to EOF: %+v", name, se)
+		}
+		if !errors.Is(err, ErrBeyondEOF) || errors.Is(err, ErrUnaligned) || !errors.Is(err, syscall.EINVAL) {
+			t.Fatalf("%v: collapse to EOF: %v does not match ErrBeyondEOF alone", name, err)
+		}
+
+		err = f.InsertRange(100, 4096)
+		if !errors.Is(err, ErrUnaligned) || errors.Is(err, ErrBeyondEOF) {
+			t.Fatalf("%v: unaligned insert: %v does not match ErrUnaligned alone", name, err)
+		}
+		err = f.InsertRange(64<<10, 4096)
+		if !errors.Is(err, ErrBeyondEOF) {
+			t.Fatalf("%v: insert at EOF: %v does not match ErrBeyondEOF", name, err)
+		}
+		if err = f.PunchHole(-1, 10); !errors.As(err, &se) || se.Errno != syscall.EINVAL {
+			t.Fatalf("%v: punch at -1: %v", name, err)
+		}
+	}
+
+	m := NewMemSparseFile("big.img", 4096)
+	_, err := m.WriteAt([]byte("x"), 8191)
+	panicOn(err)
+	if err = m.InsertRange(0, maxMemFileSize/4096*4096); !errors.Is(err, ErrFileTooLarge) {
+		t.Fatalf("huge insert: %v does not match ErrFileTooLarge", err)
+	}
+}
+
+func TestSparseOpErrorIs(t *testing.T) {
+	for _, c := range []struct {
+		errno syscall.Errno
+		want  []error
+		not   []error
+	}{
+		{syscall.EFBIG, []error{ErrFileTooLarge}, []error{ErrShortAlloc, ErrNotSupported}},
+		{syscall.ENOSPC, []error{ErrShortAlloc}, []error{ErrFileTooLarge, ErrNotSupported}},
+		{syscall.EOPNOTSUPP, []error{ErrNotSupported, errors.ErrUnsupported}, []error{ErrShortAlloc}},
+		{syscall.EIO, nil, []error{ErrFileTooLarge, ErrShortAlloc, ErrNotSupported, ErrUnaligned, ErrBeyondEOF}},
+	} {
+		ff := NewFaultFile(NewMemSparseFile("fault.img", 4096), 1, FaultRule{Op: OpPunchHole, Err: c.errno})
+		err := ff.PunchHole(0, 4096)
+		var se *SparseOpError
+		if !errors.As(err, &se) || se.Errno != c.errno || se.Path != "fault.img" {
+			t.Fatalf("%v: got %#v", c.errno, err)
+		}
+		for _, target := range c.want {
+			if !errors.Is(err, target) {
+				t.Fatalf("%v: %v does not match %v", c.errno, err, target)
+			}
+		}
+		for _, target := range c.not {
+			if errors.Is(err, target) {
+				t.Fatalf("%v: %v matches %v", c.errno, err, target)
+			}
+		}
+	}
+
+	// a short allocation with no errno is ErrShortAlloc too.
+	ff := NewFaultFile(testBackends(t)["os"], 1, FaultRule{Op: OpAllocate, Short: 4096})
+	_, err := ff.Allocate(0, 8192)
+	if errors.Is(err, ErrNotSupported) {
+		t.Skipf("no preallocation here: %v", err)
+	}
+	var se *SparseOpError
+	if !errors.As(err, &se) || !errors.Is(err, ErrShortAlloc) || se.Length != 8192 {
+		t.Fatalf("short Allocate: %v", err)
+	}
+}
+
+// plain I/O on an OSFile fails with a *SparseOpError too,
+// except for ReadAt's io.EOF.
+func TestOSFileIOErrors(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ro.img")
+	panicOn(os.WriteFile(path, []byte("read only"), 0644))
+	fd, err := os.Open(path)
+	panicOn(err)
+	f := NewOSFile(fd)
+	if _, err = f.ReadAt(make([]byte, 100), 0); err != io.EOF {
+		t.Fatalf("short read: %#v, want a bare io.EOF", err)
+	}
+	var se *SparseOpError
+	if _, err = f.WriteAt([]byte("x"), 4); !errors.As(err, &se) || se.Op != "writeat" || se.Path != path ||
+		se.Offset != 4 || se.Length != 1 || se.Errno != syscall.EBADF {
+		t.Fatalf("write to a read only file: %#v", err)
+	}
+	if err = f.Truncate(0); !errors.As(err, &se) || se.Op != "truncate" || !errors.Is(err, syscall.EINVAL) {
+		t.Fatalf("truncate of a read only file: %#v", err)
+	}
+	fd.Close()
+	if _, err = f.ReadAt(make([]byte, 1), 0); !errors.As(err, &se) || se.Op != "readat" || !errors.Is(err, os.ErrClosed) {
+		t.Fatalf("read of a closed file: %#v", err)
+	}
+	if err = f.Sync(); !errors.As(err, &se) || se.Op != "sync" || !errors.Is(err, os.ErrClosed) {
+		t.Fatalf("sync of a closed file: %#v", err)
+	}
+}
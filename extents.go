@@ -0,0 +1,136 @@
+package sparsified
+
+import (
+	"io"
+	"os"
+)
+
+// Extent is one contiguous run of a file: either
+// data, or a hole that reads back as zeros and
+// occupies no blocks on disk.
+type Extent struct {
+	Offset int64
+	Length int64
+	Hole   bool
+}
+
+// End returns the offset just past the extent.
+func (e Extent) End() int64 {
+	return e.Offset + e.Length
+}
+
+// Extents returns the hole map of fd: the data and hole
+// extents, in file order, covering [0, size) with no gaps.
+// Adjacent extents always alternate between data and hole.
+//
+// We use lseek(2) with SEEK_DATA and SEEK_HOLE rather than FIEMAP,
+// per the README notes. On filesystems without SEEK_HOLE support
+// the kernel reports the whole file as one data extent, which is
+// still a correct (if pessimistic) answer.
+//
+// The file position of fd is left where we found it.
+func Extents(fd *os.File) (exts []Extent, err error) {
+	return extents(defaultHooks(), fd)
+}
+
+func extents(h hooks, fd *os.File) (exts []Extent, err error) {
+	defer func() { err = opError("extents", fd.Name(), 0, 0, err) }()
+	sz, err := fileSizeFromFile(fd)
+	if err != nil {
+		return nil, err
+	}
+	return extentsIn(h, fd, 0, sz)
+}
+
+// extentsIn returns the extents of fd within [off, sz), sz
+// being at most the size. The file position of fd is left
+// where we found it.
+func extentsIn(h hooks, fd *os.File, off, sz int64) (exts []Extent, err error) {
+	cur, err := fd.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Seek(cur, io.SeekStart)
+
+	pos := off
+	for pos < sz {
+		var beg, endx int64
+		beg, err = seekData(h, fd, pos)
+		if err != nil {
+			return nil, err
+		}
+		if beg >= sz {
+			// no more data, the rest is a hole.
+			exts = append(exts, Extent{Offset: pos, Length: sz - pos, Hole: true})
+			break
+		}
+		if beg > pos {
+			exts = append(exts, Extent{Offset: pos, Length: beg - pos, Hole: true})
+		}
+		endx, err = seekHole(h, fd, beg)
+		if err != nil {
+			return nil, err
+		}
+		if endx > sz {
+			endx = sz
+		}
+		exts = append(exts, Extent{Offset: beg, Length: endx - beg})
+		pos = endx
+	}
+	return
+}
+
+// DataExtents returns just the data extents of fd.
+func DataExtents(fd *os.File) (data []Extent, err error) {
+	exts, err := Extents(fd)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range exts {
+		if !e.Hole {
+			data = append(data, e)
+		}
+	}
+	return
+}
+
+// isZero returns true if b is all zero bytes.
+func isZero(b []byte) bool {
+	for len(b) >= len(oneZeroBlock4k) {
+		if string(b[:len(oneZeroBlock4k)]) != string(oneZeroBlock4k[:]) {
+			return false
+		}
+		b = b[len(oneZeroBlock4k):]
+	}
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// writeAtSparse writes buf to fd at off, but skips any
+// 4KB block (aligned to the file, not to buf) that is
+// entirely zero, so that those blocks stay holes. The
+// caller must ensure the destination range is already
+// a hole (e.g. freshly truncated), otherwise stale
+// data would show through the skipped blocks.
+func writeAtSparse(fd io.WriterAt, buf []byte, off int64) (err error) {
+	const bs = int64(len(oneZeroBlock4k))
+	for len(buf) > 0 {
+		n := bs - off%bs
+		if n > int64(len(buf)) {
+			n = int64(len(buf))
+		}
+		if !isZero(buf[:n]) {
+			_, err = fd.WriteAt(buf[:n], off)
+			if err != nil {
+				return
+			}
+		}
+		buf = buf[n:]
+		off += n
+	}
+	return
+}
@@ -0,0 +1,34 @@
+//go:build linux || darwin
+
+package sparsified
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// seekData returns the offset of the first data at or
+// after off, or the file size if there is none.
+func seekData(h hooks, fd *os.File, off int64) (int64, error) {
+	pos, err := h.do("seekdata", fd, off, 0, func() (int64, error) {
+		return unix.Seek(int(fd.Fd()), off, unix.SEEK_DATA)
+	})
+	if err == unix.ENXIO {
+		// no data past off.
+		return fileSizeFromFile(fd)
+	}
+	return pos, err
+}
+
+// seekHole returns the offset of the first hole at or
+// after off. The end of file counts as a hole.
+func seekHole(h hooks, fd *os.File, off int64) (int64, error) {
+	pos, err := h.do("seekhole", fd, off, 0, func() (int64, error) {
+		return unix.Seek(int(fd.Fd()), off, unix.SEEK_HOLE)
+	})
+	if err == unix.ENXIO {
+		return fileSizeFromFile(fd)
+	}
+	return pos, err
+}
@@ -0,0 +1,294 @@
+package sparsified
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"sync"
+)
+
+// FaultOp names a SparseFile operation that
+// a FaultFile can be told to fail.
+type FaultOp string
+
+const (
+	OpReadAt        FaultOp = "readat"
+	OpWriteAt       FaultOp = "writeat"
+	OpTruncate      FaultOp = "truncate"
+	OpExtents       FaultOp = "extents"
+	OpPunchHole     FaultOp = "punchhole"
+	OpCollapseRange FaultOp = "collapserange"
+	OpInsertRange   FaultOp = "insertrange"
+	OpSync          FaultOp = "sync"
+	OpStat          FaultOp = "stat"
+	OpCopyRange     FaultOp = "copyrange"
+	OpAllocate      FaultOp = "allocate"
+)
+
+// FaultRule says when, and how, a FaultFile operation fails.
+//
+// A rule matches a call to Op whose byte range overlaps
+// [Offset, Offset+Length). A zero Length matches any range,
+// and is the only way to match Sync, Stat and Extents, which
+// have none. For Truncate the range is the single byte at the
+// new size.
+//
+// Of the matching calls, the first After are let through, then
+// each fires with probability Prob (0 means always), at most
+// Times times (0 means no limit).
+type FaultRule struct {
+	Op     FaultOp
+	Offset int64
+	Length int64
+
+	// Err is returned when the rule fires, typically a
+	// syscall.Errno such as EIO, ENOSPC or EOPNOTSUPP.
+	Err error
+
+	// Short, if > 0, lets the call move only this many bytes
+	// before failing; calls no longer than Short do not match.
+	// ReadAt then returns Err, or io.ErrUnexpectedEOF; WriteAt
+	// returns Err, or io.ErrShortWrite; Allocate returns Err,
+	// or ErrShortAlloc. CopyRange returns the short count with
+	// a nil Err, as copy_file_range(2) legitimately does.
+	Short int64
+
+	Prob  float64
+	After int
+	Times int
+}
+
+// FaultHit records one fault that fired.
+type FaultHit struct {
+	Op     FaultOp
+	Offset int64
+	Length int64
+	Err    error
+	Short  int64
+}
+
+// FaultFile wraps a SparseFile and injects failures
+// according to its rules, so that tests can drive every
+// error path of the code using it. Given the same seed,
+// rules, and sequence of calls, it fires the same faults.
+//
+// FaultFile passes RangeCopier and Allocator through when
+// the wrapped file implements them, and otherwise
+// reports ErrNotSupported for them.
+type FaultFile struct {
+	SparseFile
+
+	mu    sync.Mutex
+	rng   *rand.Rand
+	rules []*faultRule
+	hits  []FaultHit
+}
+
+type faultRule struct {
+	FaultRule
+	seen  int
+	fired int
+}
+
+// NewFaultFile wraps f with the given rules.
+func NewFaultFile(f SparseFile, seed int64, rules ...FaultRule) *FaultFile {
+	ff := &FaultFile{
+		SparseFile: f,
+		rng:        rand.New(rand.NewSource(seed)),
+	}
+	for _, r := range rules {
+		ff.rules = append(ff.rules, &faultRule{FaultRule: r})
+	}
+	return ff
+}
+
+// AddRule adds a rule; rules are checked in the order added.
+func (ff *FaultFile) AddRule(r FaultRule) {
+	ff.mu.Lock()
+	defer ff.mu.Unlock()
+	ff.rules = append(ff.rules, &faultRule{FaultRule: r})
+}
+
+// Hits returns the faults fired so far.
+func (ff *FaultFile) Hits() []FaultHit {
+	ff.mu.Lock()
+	defer ff.mu.Unlock()
+	return append([]FaultHit(nil), ff.hits...)
+}
+
+// check returns the first rule that fires for this call, or nil.
+func (ff *FaultFile) check(op FaultOp, off, length int64) *FaultRule {
+	ff.mu.Lock()
+	defer ff.mu.Unlock()
+	for _, r := range ff.rules {
+		if r.Op != op {
+			continue
+		}
+		if r.Length > 0 && !(off < r.Offset+r.Length && r.Offset < off+max(length, 1)) {
+			continue
+		}
+		if r.Short > 0 && length <= r.Short {
+			// nothing to cut short.
+			continue
+		}
+		r.seen++
+		if r.seen <= r.After {
+			continue
+		}
+		if r.Times > 0 && r.fired >= r.Times {
+			continue
+		}
+		if r.Prob > 0 && ff.rng.Float64() >= r.Prob {
+			continue
+		}
+		r.fired++
+		ff.hits = append(ff.hits, FaultHit{Op: op, Offset: off, Length: length, Err: r.Err, Short: r.Short})
+		rule := r.FaultRule
+		return &rule
+	}
+	return nil
+}
+
+func (ff *FaultFile) fail(op FaultOp, r *FaultRule, off, length int64) error {
+	err := r.Err
+	if err == nil {
+		err = fmt.Errorf("injected %v fault", op)
+	}
+	return opError(string(op), ff.Name(), off, length, err)
+}
+
+// shortErr is what a short transfer returns when the
+// rule did not say otherwise.
+func (ff *FaultFile) shortErr(op FaultOp, r *FaultRule, dflt error, off, length int64) error {
+	if r.Err == nil {
+		return dflt
+	}
+	return ff.fail(op, r, off, length)
+}
+
+func (ff *FaultFile) ReadAt(p []byte, off int64) (int, error) {
+	r := ff.check(OpReadAt, off, int64(len(p)))
+	if r == nil {
+		return ff.SparseFile.ReadAt(p, off)
+	}
+	if r.Short <= 0 {
+		return 0, ff.fail(OpReadAt, r, off, int64(len(p)))
+	}
+	n, err := ff.SparseFile.ReadAt(p[:r.Short], off)
+	if err != nil {
+		return n, err
+	}
+	return n, ff.shortErr(OpReadAt, r, io.ErrUnexpectedEOF, off, int64(len(p)))
+}
+
+func (ff *FaultFile) WriteAt(p []byte, off int64) (int, error) {
+	r := ff.check(OpWriteAt, off, int64(len(p)))
+	if r == nil {
+		return ff.SparseFile.WriteAt(p, off)
+	}
+	if r.Short <= 0 {
+		return 0, ff.fail(OpWriteAt, r, off, int64(len(p)))
+	}
+	n, err := ff.SparseFile.WriteAt(p[:r.Short], off)
+	if err != nil {
+		return n, err
+	}
+	return n, ff.shortErr(OpWriteAt, r, io.ErrShortWrite, off, int64(len(p)))
+}
+
+func (ff *FaultFile) Truncate(size int64) error {
+	if r := ff.check(OpTruncate, size, 1); r != nil {
+		return ff.fail(OpTruncate, r, size, 0)
+	}
+	return ff.SparseFile.Truncate(size)
+}
+
+func (ff *FaultFile) Extents() ([]Extent, error) {
+	if r := ff.check(OpExtents, 0, 0); r != nil {
+		return nil, ff.fail(OpExtents, r, 0, 0)
+	}
+	return ff.SparseFile.Extents()
+}
+
+func (ff *FaultFile) PunchHole(off, length int64) error {
+	if r := ff.check(OpPunchHole, off, length); r != nil {
+		return ff.fail(OpPunchHole, r, off, length)
+	}
+	return ff.SparseFile.PunchHole(off, length)
+}
+
+func (ff *FaultFile) CollapseRange(off, length int64) error {
+	if r := ff.check(OpCollapseRange, off, length); r != nil {
+		return ff.fail(OpCollapseRange, r, off, length)
+	}
+	return ff.SparseFile.CollapseRange(off, length)
+}
+
+func (ff *FaultFile) InsertRange(off, length int64) error {
+	if r := ff.check(OpInsertRange, off, length); r != nil {
+		return ff.fail(OpInsertRange, r, off, length)
+	}
+	return ff.SparseFile.InsertRange(off, length)
+}
+
+func (ff *FaultFile) Sync() error {
+	if r := ff.check(OpSync, 0, 0); r != nil {
+		return ff.fail(OpSync, r, 0, 0)
+	}
+	return ff.SparseFile.Sync()
+}
+
+func (ff *FaultFile) Stat() (os.FileInfo, error) {
+	if r := ff.check(OpStat, 0, 0); r != nil {
+		return nil, ff.fail(OpStat, r, 0, 0)
+	}
+	return ff.SparseFile.Stat()
+}
+
+// CopyRangeFrom implements RangeCopier. A Short rule makes
+// it return fewer bytes than asked, with no error.
+func (ff *FaultFile) CopyRangeFrom(src SparseFile, srcOff, dstOff, n int64) (int64, error) {
+	rc, ok := ff.SparseFile.(RangeCopier)
+	if !ok {
+		return 0, opError(string(OpCopyRange), ff.Name(), dstOff, n, ErrNotSupported)
+	}
+	r := ff.check(OpCopyRange, dstOff, n)
+	if r == nil {
+		return rc.CopyRangeFrom(src, srcOff, dstOff, n)
+	}
+	if r.Short <= 0 {
+		return 0, ff.fail(OpCopyRange, r, dstOff, n)
+	}
+	k, err := rc.CopyRangeFrom(src, srcOff, dstOff, r.Short)
+	if err != nil {
+		return k, err
+	}
+	if r.Err != nil {
+		return k, ff.fail(OpCopyRange, r, dstOff, n)
+	}
+	return k, nil
+}
+
+// Allocate implements Allocator. A Short rule simulates
+// the partial allocation that fallocate(2) and F_PREALLOCATE
+// can make.
+func (ff *FaultFile) Allocate(off, length int64) (int64, error) {
+	al, ok := ff.SparseFile.(Allocator)
+	if !ok {
+		return 0, opError(string(OpAllocate), ff.Name(), off, length, ErrNotSupported)
+	}
+	r := ff.check(OpAllocate, off, length)
+	if r == nil {
+		return al.Allocate(off, length)
+	}
+	if r.Short <= 0 {
+		return 0, ff.fail(OpAllocate, r, off, length)
+	}
+	got, err := al.Allocate(off, r.Short)
+	if err != nil {
+		return got, err
+	}
+	short := opError(string(OpAllocate), ff.Name(), off, length, ErrShortAlloc)
+	return got, ff.shortErr(OpAllocate, r, short, off, length)
+}
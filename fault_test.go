@@ -0,0 +1,137 @@
+package sparsified
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"syscall"
+	"testing"
+)
+
+func newTestOSFile(t *testing.T, name string) *OSFile {
+	fd, err := os.Create(filepath.Join(t.TempDir(), name))
+	panicOn(err)
+	t.Cleanup(func() { fd.Close() })
+	return NewOSFile(fd)
+}
+
+// a 1MB source with two data extents.
+func newFaultTestSrc(t *testing.T) *OSFile {
+	src := newTestOSFile(t, "src.img")
+	panicOn(src.Truncate(1 << 20))
+	_, err := src.WriteAt(bytes.Repeat([]byte("a"), 8192), 4096)
+	panicOn(err)
+	_, err = src.WriteAt(bytes.Repeat([]byte("b"), 4096), 512<<10)
+	panicOn(err)
+	return src
+}
+
+func TestFaultFileCopyErrorPaths(t *testing.T) {
+	// so that Copy falls back to WriteAt.
+	noCopyRange := FaultRule{Op: OpCopyRange, Err: errors.ErrUnsupported}
+	cases := []struct {
+		name    string
+		onSrc   bool
+		rules   []FaultRule
+		wantErr error
+	}{
+		{"src stat EIO", true, []FaultRule{{Op: OpStat, Err: syscall.EIO}}, syscall.EIO},
+		{"src extents EIO", true, []FaultRule{{Op: OpExtents, Err: syscall.EIO}}, syscall.EIO},
+		{"src read EIO in 2nd extent", true, []FaultRule{{Op: OpReadAt, Offset: 512 << 10, Length: 1, Err: syscall.EIO}}, syscall.EIO},
+		{"dst truncate EIO", false, []FaultRule{{Op: OpTruncate, Err: syscall.EIO}}, syscall.EIO},
+		{"dst write ENOSPC", false, []FaultRule{noCopyRange, {Op: OpWriteAt, Err: syscall.ENOSPC}}, syscall.ENOSPC},
+		{"dst short write", false, []FaultRule{noCopyRange, {Op: OpWriteAt, Short: 100}}, io.ErrShortWrite},
+		{"dst sync EIO", false, []FaultRule{{Op: OpSync, Err: syscall.EIO}}, syscall.EIO},
+		{"dst copy_file_range EIO", false, []FaultRule{{Op: OpCopyRange, Err: syscall.EIO}}, syscall.EIO},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var src, dst SparseFile = newFaultTestSrc(t), newTestOSFile(t, "dst.img")
+			if c.onSrc {
+				src = NewFaultFile(src, 1, c.rules...)
+			} else {
+				dst = NewFaultFile(dst, 1, c.rules...)
+			}
+			_, err := Copy(context.Background(), dst, src, nil)
+			if !errors.Is(err, c.wantErr) {
+				t.Fatalf("want %v, got %v", c.wantErr, err)
+			}
+		})
+	}
+}
+
+// short or unsupported copy_file_range is not an error:
+// Copy must finish the job by hand.
+func TestFaultFileCopyRangeRecovers(t *testing.T) {
+	for _, rule := range []FaultRule{
+		{Op: OpCopyRange, Short: 100},
+		{Op: OpCopyRange, Short: 1, Times: 1},
+		{Op: OpCopyRange, Err: errors.ErrUnsupported},
+	} {
+		src := newFaultTestSrc(t)
+		dst := NewFaultFile(newTestOSFile(t, "dst.img"), 1, rule)
+		_, err := Copy(context.Background(), dst, src, nil)
+		panicOn(err)
+		if len(dst.Hits()) == 0 {
+			t.Fatalf("rule %+v never fired", rule)
+		}
+		if !bytes.Equal(readAll(t, dst), readAll(t, src)) {
+			t.Fatalf("rule %+v: content differs after Copy", rule)
+		}
+	}
+}
+
+func TestFaultFileImageErrorPaths(t *testing.T) {
+	src := newFaultTestSrc(t)
+	var img bytes.Buffer
+	err := RawToVMDK(context.Background(), &img, NewFaultFile(src, 1, FaultRule{Op: OpReadAt, Err: syscall.EIO}), nil)
+	if !errors.Is(err, syscall.EIO) {
+		t.Fatalf("RawToVMDK: want EIO, got %v", err)
+	}
+	img.Reset()
+	panicOn(RawToVMDK(context.Background(), &img, src, nil))
+
+	dst := NewFaultFile(NewMemSparseFile("dst", 0), 1,
+		FaultRule{Op: OpWriteAt, Offset: 512 << 10, Length: 4096, Err: syscall.ENOSPC})
+	err = VMDKToRaw(context.Background(), dst, bytes.NewReader(img.Bytes()), nil)
+	if !errors.Is(err, syscall.ENOSPC) {
+		t.Fatalf("VMDKToRaw: want ENOSPC, got %v", err)
+	}
+}
+
+func TestFaultFileShortAlloc(t *testing.T) {
+	f := NewFaultFile(newTestOSFile(t, "alloc.img"), 1, FaultRule{Op: OpAllocate, Short: 4096})
+	got, err := f.Allocate(0, 1<<20)
+	if !errors.Is(err, ErrShortAlloc) {
+		t.Fatalf("want ErrShortAlloc, got %v", err)
+	}
+	if got != 4096 {
+		t.Fatalf("want 4096 allocated, got %v", got)
+	}
+}
+
+// the same seed fires the same faults.
+func TestFaultFileDeterministic(t *testing.T) {
+	run := func(seed int64) []FaultHit {
+		f := NewFaultFile(NewMemSparseFile("m", 0), seed,
+			FaultRule{Op: OpWriteAt, Err: syscall.EIO, Prob: 0.3})
+		for i := range 200 {
+			f.WriteAt([]byte{1}, int64(i)*4096)
+		}
+		return f.Hits()
+	}
+	a, b := run(42), run(42)
+	if len(a) == 0 || len(a) == 200 {
+		t.Fatalf("Prob 0.3 fired %v of 200 times", len(a))
+	}
+	if !reflect.DeepEqual(a, b) {
+		t.Fatalf("same seed, different faults")
+	}
+	if reflect.DeepEqual(a, run(43)) {
+		t.Fatalf("different seed, same faults")
+	}
+}
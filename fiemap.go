@@ -0,0 +1,58 @@
+package sparsified
+
+import (
+	"errors"
+	"os"
+)
+
+// AllocExtent is one extent of storage allocated to a file,
+// as reported by the FIEMAP ioctl. Unlike the Extents from
+// SEEK_DATA/SEEK_HOLE, these can lie past EOF, which is
+// where speculative and KEEP_SIZE preallocation lives.
+type AllocExtent struct {
+	Logical  int64 // offset in the file.
+	Physical int64 // offset on the device, 0 if unknown.
+	Length   int64
+
+	// Unwritten extents are allocated but read as zeros,
+	// as left by fallocate(2).
+	Unwritten bool
+
+	// Flags are the raw FIEMAP_EXTENT_* flags.
+	Flags uint32
+}
+
+func (e AllocExtent) End() int64 {
+	return e.Logical + e.Length
+}
+
+// postEOF returns how many bytes of storage fd has beyond
+// its size (rounded up to the block size blksz). Where
+// FIEMAP is missing it estimates, from the allocated size
+// less the data extents, and exact is false. sync is as for
+// allocatedExtents.
+func postEOF(fd *os.File, size, allocated, blksz int64, sync bool) (n int64, exact bool, err error) {
+	eof := ceilDiv(size, blksz) * blksz
+	aexts, err := allocatedExtents(defaultHooks(), fd, sync)
+	if err == nil {
+		for _, e := range aexts {
+			if e.End() > eof {
+				n += e.End() - max(e.Logical, eof)
+			}
+		}
+		return n, true, nil
+	}
+	if !errors.Is(err, errors.ErrUnsupported) {
+		return 0, false, err
+	}
+	data, err := DataExtents(fd)
+	if err != nil {
+		return 0, false, err
+	}
+	n = allocated
+	for _, e := range data {
+		beg := e.Offset / blksz * blksz
+		n -= ceilDiv(e.End(), blksz)*blksz - beg
+	}
+	return max(n, 0), false, nil
+}
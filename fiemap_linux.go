@@ -0,0 +1,101 @@
+//go:build linux
+
+package sparsified
+
+import (
+	"os"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	fsIocFiemap = 0xC020660B
+
+	fiemapFlagSync = 0x1
+
+	fiemapExtentLast      = 0x1
+	fiemapExtentUnwritten = 0x800
+	fiemapExtentsPerCall  = 128
+	fiemapMaxLength       = ^uint64(0)
+)
+
+type fiemapHeader struct {
+	Start         uint64
+	Length        uint64
+	Flags         uint32
+	MappedExtents uint32
+	ExtentCount   uint32
+	Reserved      uint32
+}
+
+type fiemapExtent struct {
+	Logical    uint64
+	Physical   uint64
+	Length     uint64
+	Reserved64 [2]uint64
+	Flags      uint32
+	Reserved   [3]uint32
+}
+
+type fiemapBuf struct {
+	fiemapHeader
+	Extents [fiemapExtentsPerCall]fiemapExtent
+}
+
+// AllocatedExtents returns the allocated extents of fd,
+// including any past EOF, using the FIEMAP ioctl with
+// FIEMAP_FLAG_SYNC so that delayed allocations show up.
+// Filesystems without FIEMAP (tmpfs, for one) give a
+// *SparseOpError matching ErrNotSupported.
+func AllocatedExtents(fd *os.File) (exts []AllocExtent, err error) {
+	return allocatedExtents(defaultHooks(), fd, true)
+}
+
+// allocatedExtents without sync leaves dirty pages alone, for
+// callers that look often, or that look at the delayed
+// allocations themselves; those may then be missing.
+func allocatedExtents(h hooks, fd *os.File, sync bool) (exts []AllocExtent, err error) {
+	var fm fiemapBuf
+	var flags uint32
+	if sync {
+		flags = fiemapFlagSync
+	}
+	start := uint64(0)
+	for {
+		fm.fiemapHeader = fiemapHeader{
+			Start:       start,
+			Length:      fiemapMaxLength - start,
+			Flags:       flags,
+			ExtentCount: fiemapExtentsPerCall,
+		}
+		_, err = h.do("fiemap", fd, int64(start), 0, func() (int64, error) {
+			_, _, errno := unix.Syscall(unix.SYS_IOCTL, fd.Fd(), fsIocFiemap, uintptr(unsafe.Pointer(&fm)))
+			if errno != 0 {
+				return 0, errno
+			}
+			return int64(fm.MappedExtents), nil
+		})
+		if err != nil {
+			// EOPNOTSUPP and ENOTTY match ErrNotSupported.
+			return nil, errnoError("fiemap", fd.Name(), 0, 0, err.(unix.Errno), -1, 0)
+		}
+		if fm.MappedExtents == 0 {
+			return
+		}
+		for _, e := range fm.Extents[:fm.MappedExtents] {
+			exts = append(exts, AllocExtent{
+				Logical:   int64(e.Logical),
+				Physical:  int64(e.Physical),
+				Length:    int64(e.Length),
+				Unwritten: e.Flags&fiemapExtentUnwritten != 0,
+				Flags:     e.Flags,
+			})
+			if e.Flags&fiemapExtentLast != 0 {
+				return
+			}
+		}
+		last := fm.Extents[fm.MappedExtents-1]
+		start = last.Logical + last.Length
+	}
+}
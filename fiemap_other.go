@@ -0,0 +1,17 @@
+//go:build !linux
+
+package sparsified
+
+import (
+	"os"
+)
+
+// AllocatedExtents needs the Linux FIEMAP ioctl; elsewhere
+// it returns an error matching ErrNotSupported.
+func AllocatedExtents(fd *os.File) ([]AllocExtent, error) {
+	return allocatedExtents(defaultHooks(), fd, true)
+}
+
+func allocatedExtents(h hooks, fd *os.File, sync bool) ([]AllocExtent, error) {
+	return nil, opError("fiemap", fd.Name(), 0, 0, ErrNotSupported)
+}
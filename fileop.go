@@ -17,6 +17,9 @@ const linux_FALLOC_FL_COLLAPSE_RANGE = 8
 const linux_FALLOC_FL_PUNCH_HOLE = 2 // linux
 const darwin_F_PUNCHHOLE = 99        // from sys/fcntl.h:319
 
+// a block of zeros, handy for filling and comparing.
+var oneZeroBlock4k [4096]byte
+
 var ErrShortAlloc = fmt.Errorf("smaller extent than requested was allocated.")
 
 // allocated probably zero in this case, especially since
@@ -26,6 +29,7 @@ var ErrFileTooLarge = fmt.Errorf("extent requested was too large.")
 // if file already exists we return nil, error.
 // otherwise fd refers to an apparent nblock * 4KB but actual 0 byte file.
 func CreateSparseFile(path string, nblock int) (fd *os.File, err error) {
+	defer func() { err = opError("create", path, 0, 0, err) }()
 
 	if nblock < 1 {
 		return nil, fmt.Errorf("nblock must be >= 1; not %v", nblock)
@@ -62,12 +66,16 @@ func CreateSparseFile(path string, nblock int) (fd *os.File, err error) {
 	length := int64(4096)
 	var got int64
 	got, err = fallocate(fd, FALLOC_FL_PUNCH_HOLE, offset, length)
-	panicOn(err)
+	if err != nil {
+		fd.Close()
+		return nil, err
+	}
 	_ = got
 	return
 }
 
 func IsSparseFile(fd *os.File) (isSparse bool, err error) {
+	defer func() { err = opError("issparse", fd.Name(), 0, 0, err) }()
 
 	fi, err := fd.Stat()
 	if err != nil {
@@ -77,7 +85,7 @@ func IsSparseFile(fd *os.File) (isSparse bool, err error) {
 	stat := fi.Sys().(*syscall.Stat_t)
 	apparent := stat.Size
 	actual := stat.Blocks * 512 // lies: int64(stat.Blksize), says 4096.
-	vv("fi = '%#v'; apparent = '%v'; actual = '%v'", fi, apparent, actual)
+	defaultHooks().log.Debug("sparsified: IsSparseFile", "path", fd.Name(), "apparent", apparent, "actual", actual)
 
 	// are there are other ways to be sparse?
 	// Just having multiple extents does not matter.
@@ -231,6 +231,10 @@ var fcntl64Syscall uintptr = unix.SYS_FCNTL
 // should be (hopefully!) similar, according to the
 // StackOverflow suggestion above/what Mozilla does to "fake it".
 func fallocate(fd *os.File, mode uint32, off int64, length int64) (allocated int64, err error) {
+	return darwinFallocate(defaultHooks(), fd, mode, off, length)
+}
+
+func darwinFallocate(h hooks, fd *os.File, mode uint32, off int64, length int64) (allocated int64, err error) {
 
 	if mode == FALLOC_FL_INSERT_RANGE {
 
@@ -244,20 +248,21 @@ func fallocate(fd *os.File, mode uint32, off int64, length int64) (allocated int
 		}
 
 		// nice: avoids needing unsafe locally, and cgo, so build is fast.
-		err = unix.FcntlFstore(fd.Fd(), int(unix.F_PREALLOCATE), store)
-
-		allocated = int64(store.Bytesalloc)
+		allocated, err = h.do("preallocate", fd, off, length, func() (int64, error) {
+			err := unix.FcntlFstore(fd.Fd(), int(unix.F_PREALLOCATE), store)
+			return int64(store.Bytesalloc), err
+		})
 		// 0x1b == 27
 		// 0x1b on too big => 'file too large'.
-		vv("err = '%v'/'%#v'; allocated='%v'; length=%v", err, err, allocated, length)
+		h.log.Debug("sparsified: F_PREALLOCATE", "path", fd.Name(),
+			"length", length, "allocated", allocated, "err", err)
 		if err != nil {
-			if err.Error() == "file too large" {
-				err = ErrFileTooLarge
-				return
-			}
+			// EFBIG matches ErrFileTooLarge.
+			err = opError("insertrange", fd.Name(), off, length, err)
+			return
 		}
 		if allocated < length {
-			err = ErrShortAlloc
+			err = opError("insertrange", fd.Name(), off, length, ErrShortAlloc)
 		}
 		return
 	} else if mode == FALLOC_FL_PUNCH_HOLE {
@@ -287,15 +292,21 @@ func fallocate(fd *os.File, mode uint32, off int64, length int64) (allocated int
 
 		// this seems to work! see du -h on the file,
 		// and use Stat().Sys().(*syscall.Stat_t).Blocks to get actual blocks in use.
-		_, _, errno := unix.Syscall(fcntl64Syscall,
-			uintptr(fd.Fd()), uintptr(darwin_F_PUNCHHOLE), uintptr(unsafe.Pointer(punch)))
-		if errno != 0 {
-			vv("errno = '%v'", errno)
-			if errno.Error() == "result too large" {
-				err = ErrFileTooLarge
-				return
+		_, err = h.do("punchhole", fd, off, length, func() (int64, error) {
+			_, _, errno := unix.Syscall(fcntl64Syscall,
+				uintptr(fd.Fd()), uintptr(darwin_F_PUNCHHOLE), uintptr(unsafe.Pointer(punch)))
+			if errno != 0 {
+				return 0, errno
+			}
+			return 0, nil
+		})
+		if err != nil {
+			errno := err.(unix.Errno)
+			// ERANGE is what Darwin says for a range too large.
+			if errno == unix.ERANGE {
+				errno = unix.EFBIG
 			}
-			err = errno
+			err = errnoError("punchhole", fd.Name(), off, length, errno, -1, 0)
 			return
 		}
 	} else {
@@ -446,3 +457,75 @@ Most importantly, APFS supports two key operations for finding file extents:
 FSCTL_FIOSEEKHOLE: Finds the next hole after a given offset
 FSCTL_FIOSEEKDATA: Finds the next data region after a given offset
 */
+
+// OSFile range operations. Darwin can punch holes,
+// but has no collapse or insert range.
+
+func osPunchHole(h hooks, fd *os.File, off, length int64) error {
+	_, err := darwinFallocate(h, fd, FALLOC_FL_PUNCH_HOLE, off, length)
+	return err
+}
+
+func osZeroRange(h hooks, fd *os.File, off, length int64) error {
+	return opError("zerorange", fd.Name(), off, length, ErrNotSupported)
+}
+
+func osCollapseRange(h hooks, fd *os.File, off, length int64) error {
+	return opError("collapserange", fd.Name(), off, length, ErrNotSupported)
+}
+
+func osInsertRange(h hooks, fd *os.File, off, length int64) error {
+	return opError("insertrange", fd.Name(), off, length, ErrNotSupported)
+}
+
+func osCopyRange(h hooks, dst, src *os.File, srcOff, dstOff, n int64) (int64, error) {
+	return 0, opError("copyrange", dst.Name(), dstOff, n, ErrNotSupported)
+}
+
+// osPreallocate gives Preallocate the Linux semantics on
+// Darwin. F_PREALLOCATE can only add storage at the physical
+// end of the file, so the part of the range past EOF is done
+// that way, and holes inside the file are filled with zeros.
+// Without keepSize the file is then extended over the range.
+func osPreallocate(h hooks, fd *os.File, off, length int64, keepSize bool) error {
+	size, err := fileSizeFromFile(fd)
+	if err != nil {
+		return err
+	}
+	endx := off + length
+	if off < size {
+		if err = fillHoles(h, fd, off, min(endx, size)); err != nil {
+			return err
+		}
+	}
+	if endx <= size {
+		return nil
+	}
+	store := &unix.Fstore_t{
+		Flags:   unix.F_ALLOCATEALL | F_ALLOCATEPERSIST,
+		Posmode: unix.F_PEOFPOSMODE,
+		Length:  endx - size,
+	}
+	fstore := func() (int64, error) {
+		err := unix.FcntlFstore(fd.Fd(), int(unix.F_PREALLOCATE), store)
+		return int64(store.Bytesalloc), err
+	}
+	_, err = h.do("preallocate", fd, size, store.Length, fstore)
+	if err != nil && err != unix.EFBIG {
+		// too fragmented to get it all at once;
+		// take what we can, Preallocate will measure.
+		h.log.Debug("sparsified: F_ALLOCATEALL failed, retrying without", "path", fd.Name(), "err", err)
+		store.Flags = F_ALLOCATEPERSIST
+		_, err = h.do("preallocate", fd, size, store.Length, fstore)
+	}
+	if err != nil {
+		return opError("fallocate", fd.Name(), off, length, err)
+	}
+	if !keepSize {
+		_, err = h.do("truncate", fd, endx, 0, func() (int64, error) {
+			return 0, fd.Truncate(endx)
+		})
+		return err
+	}
+	return nil
+}
@@ -125,40 +125,36 @@ func fallocate(file *os.File, mode uint32, offset int64, length int64) (allocate
 	if mode == FALLOC_FL_PUNCH_HOLE {
 		mode |= unix.FALLOC_FL_KEEP_SIZE
 	}
+	if mode&^unix.FALLOC_FL_KEEP_SIZE == 0 {
+		// plain preallocation: the kernel does not tell us
+		// how much it allocated, so Preallocate measures it.
+		return preallocate(defaultHooks(), file, offset, length, mode&unix.FALLOC_FL_KEEP_SIZE != 0)
+	}
 
-	var preSz, postSz int64
-	preSz, err = fileSizeFromFile(file)
-	panicOn(err)
-
-	intfd := int(file.Fd())
-
-	err = unix.Fallocate(intfd, mode, offset, length)
-	vv("unix.Fallocate() returned err = '%v'", err) // "file too large"
-
-	// TODO: TEST this assumption! can we get a less-than full allocation and err==nil?
-	// The unix.Fallocate on linux hides the return value from us,
-	// (see ~/go/pkg/mod/golang.org/x/sys@v0.31.0/unix/zsyscall_linux_amd64.go ),
-	// so we might need to reimplement this ourselves to get at it.
+	// the other modes operate on the whole range, or fail;
+	// EFBIG comes back as a *SparseOpError matching ErrFileTooLarge.
+	err = osFallocate(defaultHooks(), file, fallocateOp(mode), mode, offset, length)
 	if err == nil {
-
-		postSz, err = fileSizeFromFile(file)
-		panicOn(err)
-		vv("preSz = %v; postSz = %v", preSz, postSz)
-
-		allocated = int64(length)
-		return
-	}
-	if err.Error() == "file too large" {
-		err = errFileTooLarge
-		return
-	}
-	if allocated < length {
-		err = errShortAlloc
+		allocated = length
 	}
-	// unknown error, just pass to caller.
 	return
 }
 
+// fallocateOp names mode for errors.
+func fallocateOp(mode uint32) string {
+	switch {
+	case mode&unix.FALLOC_FL_PUNCH_HOLE != 0:
+		return "punchhole"
+	case mode&unix.FALLOC_FL_ZERO_RANGE != 0:
+		return "zerorange"
+	case mode&linux_FALLOC_FL_COLLAPSE_RANGE != 0:
+		return "collapserange"
+	case mode&FALLOC_FL_INSERT_RANGE != 0:
+		return "insertrange"
+	}
+	return "fallocate"
+}
+
 // before writing new stuff into the extent, we got:
 /*
 	jaten@rog ~/go/src/github.com/glycerine/yogadb $ xfs_info /mnt/a
@@ -174,3 +170,69 @@ func fallocate(file *os.File, mode uint32, offset int64, length int64) (allocate
 	realtime =none                   extsz=4096   blocks=0, rtextents=0
 
 */
+
+// OSFile range operations. We call unix.Fallocate directly
+// so the caller sees the real errno (EINVAL for misaligned
+// ranges, EOPNOTSUPP when the filesystem cannot do it).
+
+func osPunchHole(h hooks, fd *os.File, off, length int64) error {
+	return osFallocate(h, fd, "punchhole", unix.FALLOC_FL_PUNCH_HOLE|unix.FALLOC_FL_KEEP_SIZE, off, length)
+}
+
+func osZeroRange(h hooks, fd *os.File, off, length int64) error {
+	return osFallocate(h, fd, "zerorange", unix.FALLOC_FL_ZERO_RANGE, off, length)
+}
+
+func osCollapseRange(h hooks, fd *os.File, off, length int64) error {
+	return osFallocate(h, fd, "collapserange", linux_FALLOC_FL_COLLAPSE_RANGE, off, length)
+}
+
+func osInsertRange(h hooks, fd *os.File, off, length int64) error {
+	return osFallocate(h, fd, "insertrange", FALLOC_FL_INSERT_RANGE, off, length)
+}
+
+func osFallocate(h hooks, fd *os.File, op string, mode uint32, off, length int64) error {
+	_, err := h.do(op, fd, off, length, func() (int64, error) {
+		return 0, unix.Fallocate(int(fd.Fd()), mode, off, length)
+	})
+	if err == nil {
+		return nil
+	}
+	errno, ok := err.(unix.Errno)
+	if !ok {
+		return opError(op, fd.Name(), off, length, err)
+	}
+	size, blksz := int64(-1), int64(0)
+	if errno == unix.EINVAL {
+		// look at the file to tell why.
+		if fi, serr := fd.Stat(); serr == nil {
+			size, blksz = fi.Size(), statBlockSize(fi)
+		}
+	}
+	return errnoError(op, fd.Name(), off, length, errno, size, blksz)
+}
+
+// osCopyRange copies within the kernel with copy_file_range(2).
+// Like the syscall, it may copy less than n.
+func osCopyRange(h hooks, dst, src *os.File, srcOff, dstOff, n int64) (int64, error) {
+	k, err := h.do("copyrange", dst, dstOff, n, func() (int64, error) {
+		k, err := unix.CopyFileRange(int(src.Fd()), &srcOff, int(dst.Fd()), &dstOff, int(n), 0)
+		return int64(k), err
+	})
+	if err != nil {
+		// EXDEV, ENOSYS and EOPNOTSUPP match ErrNotSupported,
+		// which tells Copy to fall back to read and write.
+		return k, opError("copyrange", dst.Name(), dstOff, n, err)
+	}
+	return k, nil
+}
+
+// osPreallocate is fallocate(2) with mode 0, or
+// FALLOC_FL_KEEP_SIZE; Preallocate measures the result.
+func osPreallocate(h hooks, fd *os.File, off, length int64, keepSize bool) error {
+	mode := uint32(0)
+	if keepSize {
+		mode = unix.FALLOC_FL_KEEP_SIZE
+	}
+	return osFallocate(h, fd, "fallocate", mode, off, length)
+}
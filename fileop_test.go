@@ -1,15 +1,16 @@
 package sparsified
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
 	"syscall"
 	"testing"
 	//"golang.org/x/sys/unix"
 )
 
-var oneZeroBlock4k [4096]byte
-
 // path is just for reporting if intfd > 0 is given.
 // Otherwise it is opened and the fd returned.
 func insertRange(path string, fd *os.File, offset int64, length int64) (file *os.File, got int64, err error) {
@@ -74,7 +75,7 @@ func TestFallocateInsertRangeTooBig(t *testing.T) {
 	if err == nil {
 		panic(fmt.Sprintf("oh no. asked for 4 exabytes, got back: '%v' without an error??", got))
 	}
-	if err != ErrFileTooLarge {
+	if !errors.Is(err, ErrFileTooLarge) {
 		panic(fmt.Sprintf("wanted errFileTooLarge; got error '%v'", err))
 	}
 	fmt.Printf("asked for length='%v', got='%v'. wrote to path '%v'. all done.\n", length, got, path)
@@ -153,71 +154,45 @@ just change the offset to next keyframe value to match the proper alignment.
 
 func TestCollapseRange(t *testing.T) {
 
-	path := "out.db"
 	// note: file must be writable! so Open() does not suffice!
-	//fd, err = os.OpenFile(path, os.O_RDWR, 0666)
-
-	fd, err := os.Create(path)
+	fd, err := os.Create(filepath.Join(t.TempDir(), "collapse.db"))
 	panicOn(err)
 	defer fd.Close()
 
-	// does file need to be non-empty? yep. hmm... would be nice if that was not the case.
-	var nw int
-	nw, err = fd.Write(oneZeroBlock4k[:])
-	if err != nil {
-		return
+	// three blocks, 1s, 2s and 3s; collapse out the 2s.
+	var want []byte
+	for i := range 3 {
+		blk := bytes.Repeat([]byte{byte(i + 1)}, 4096)
+		_, err = fd.Write(blk)
+		panicOn(err)
+		if i != 1 {
+			want = append(want, blk...)
+		}
 	}
-	if nw != len(oneZeroBlock4k) {
-		panic(fmt.Errorf("could not write one 4096 zero page"+
-			" to new path '%v': '%v'", path, err))
+	err = NewOSFile(fd).CollapseRange(4096, 4096)
+	if errors.Is(err, ErrNotSupported) {
+		t.Skipf("no collapse range here: %v", err)
 	}
-
-	var sz, postsz int64
-	sz, err = fileSizeFromFile(fd)
 	panicOn(err)
-	vv("starting file sz is '%v'", sz)
-
-	//panicOn(err)
-	intfd := int(fd.Fd())
-	vv("got intfd = '%v'", intfd)
-
-	offset := int64(0)
-	// too biiiig!!!
-	//length := int64(4096) << 50 // 4 exa bytes // xfs_info says bsize and extsz are 4096
-	//length := int64(64 << 20) // 64MB? yep, Apple Filesystem will happily give us this.
-	length := int64(4096)
-
-	vv("length = '%v'", length)
-	// unix.FALLOC_FL_COLLAPSE_RANGE = 8
-	//vv("unix.FALLOC_FL_COLLAPSE_RANGE = %v", unix.FALLOC_FL_COLLAPSE_RANGE)
-	var got int64
-	//got, err = fallocate(fd, FALLOC_FL_COLLAPSE_RANGE, offset, length)
-	got, err = fallocate(fd, FALLOC_FL_PUNCH_HOLE, offset, length)
-	vv("fallocate(FALLOC_FL_PUNCH_HOLE) err was '%v'; got = '%v'", err, got)
-	if err == nil {
-		//panic(fmt.Sprintf("oh no. asked for 4 exabytes, got back: '%v' without an error??", got))
-	}
-	if err == ErrShortAlloc {
 
+	sz, err := fileSizeFromFile(fd)
+	panicOn(err)
+	if sz != 8192 {
+		t.Fatalf("size after collapse %v, want 8192", sz)
 	}
-	vv("got: '%v'; err = '%v'", got, err) // "smaller extent than requested was allocated."
-	if err != ErrFileTooLarge {
-		//panic(fmt.Sprintf("wanted errFileTooLarge; got error '%v'", err))
+	got := make([]byte, sz)
+	_, err = fd.ReadAt(got, 0)
+	panicOn(err)
+	if !bytes.Equal(got, want) {
+		t.Fatalf("the blocks after the collapsed one did not move down")
 	}
-	//fmt.Printf("asked for length='%v', got='%v'. wrote to path '%v'. all done.\n", length, got, path)
 
-	fi, err := fd.Stat()
-	panicOn(err)
-	vv("fi = '%#v'", fi)
-	postsz = fi.Sys().(*syscall.Stat_t).Blocks * 512
-	vv("ending file postsz is '%v'", postsz)
-	// same size still, but blocks were deallocated.
-	//$ stat out.db
-	//  File: out.db
-	//  Size: 4096      	Blocks: 0          IO Block: 4096   regular file
-
-	if postsz != 0 {
-		panic("why not 0 size file after hole punching?")
+	// the range must be block aligned, and end before EOF.
+	if err = NewOSFile(fd).CollapseRange(100, 4096); !errors.Is(err, syscall.EINVAL) {
+		t.Fatalf("unaligned collapse: %v", err)
+	}
+	if err = NewOSFile(fd).CollapseRange(4096, 8192); !errors.Is(err, syscall.EINVAL) {
+		t.Fatalf("collapse to EOF: %v", err)
 	}
 }
 
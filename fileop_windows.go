@@ -2,6 +2,10 @@
 
 package sparsified
 
+import (
+	"os"
+)
+
 /*
 (Windows not implemented yet)
 
@@ -39,3 +43,38 @@ https://codeberg.org/da/sparseseek/src/branch/main/sparseseek.c
 
  -- https://www.ctrl.blog/entry/sparse-files.html
 */
+
+// Until we wire up FSCTL_QUERY_ALLOCATED_RANGES, report
+// the whole file as data; that is correct, just not sparse.
+
+func seekData(h hooks, fd *os.File, off int64) (int64, error) {
+	return off, nil
+}
+
+func seekHole(h hooks, fd *os.File, off int64) (int64, error) {
+	return fileSizeFromFile(fd)
+}
+
+func osPunchHole(h hooks, fd *os.File, off, length int64) error {
+	return opError("punchhole", fd.Name(), off, length, ErrNotSupported)
+}
+
+func osZeroRange(h hooks, fd *os.File, off, length int64) error {
+	return opError("zerorange", fd.Name(), off, length, ErrNotSupported)
+}
+
+func osCollapseRange(h hooks, fd *os.File, off, length int64) error {
+	return opError("collapserange", fd.Name(), off, length, ErrNotSupported)
+}
+
+func osInsertRange(h hooks, fd *os.File, off, length int64) error {
+	return opError("insertrange", fd.Name(), off, length, ErrNotSupported)
+}
+
+func osCopyRange(h hooks, dst, src *os.File, srcOff, dstOff, n int64) (int64, error) {
+	return 0, opError("copyrange", dst.Name(), dstOff, n, ErrNotSupported)
+}
+
+func osPreallocate(h hooks, fd *os.File, off, length int64, keepSize bool) error {
+	return opError("fallocate", fd.Name(), off, length, ErrNotSupported)
+}
@@ -56,7 +56,9 @@ func isWritable(path string) bool {
 		return true
 	}
 	fileInfo, err := os.Stat(path)
-	panicOn(err)
+	if err != nil {
+		return false
+	}
 
 	// Get the file's mode (permission bits)
 	mode := fileInfo.Mode()
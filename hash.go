@@ -0,0 +1,72 @@
+package sparsified
+
+import (
+	"context"
+	"crypto/sha256"
+	"io"
+)
+
+// Hash returns the SHA-256 of the content of f, holes
+// included as the zeros they read as; that is, the same
+// digest sha256sum(1) prints for the file. Holes are hashed
+// from a zero buffer without any I/O.
+//
+// If ctx is canceled, Hash returns ctx.Err(); f is
+// never modified.
+func Hash(ctx context.Context, f SparseFile, opts *Options) (sum []byte, err error) {
+	defer func() { err = opError("hash", f.Name(), 0, 0, err) }()
+	f = withHooks(f, opts)
+	size, err := sparseSize(f)
+	if err != nil {
+		return nil, err
+	}
+	exts, err := f.Extents()
+	if err != nil {
+		return nil, err
+	}
+	pr := newProgress(ctx, "hash", opts, size, dataBytes(exts))
+	ring := newBulk(opts, f)
+	if ring != nil {
+		defer ring.close()
+	}
+	sum, err = hashExtents(pr, f, exts, ring)
+	return sum, pr.done(err)
+}
+
+func hashExtents(pr *progress, f SparseFile, exts []Extent, ring *uring) (sum []byte, err error) {
+	h := sha256.New()
+	buf := make([]byte, copyChunk)
+	zeros := make([]byte, copyChunk)
+	for _, e := range exts {
+		for off := e.Offset; off < e.End(); {
+			k := min(int64(len(buf)), e.End()-off)
+			if e.Hole {
+				h.Write(zeros[:k])
+				err = pr.hole(off, k)
+			} else {
+				if err = readChunk(f, buf[:k], off, ring); err != nil {
+					return nil, err
+				}
+				h.Write(buf[:k])
+				err = pr.data(off, k)
+			}
+			if err != nil {
+				return nil, err
+			}
+			off += k
+		}
+	}
+	return h.Sum(nil), nil
+}
+
+// readChunk fills p from f at off, through ring if not nil.
+func readChunk(f SparseFile, p []byte, off int64, ring *uring) error {
+	if ring != nil {
+		return bulkReadAt(ring, f, p, off)
+	}
+	m, err := f.ReadAt(p, off)
+	if err != nil && !(err == io.EOF && m == len(p)) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,267 @@
+package sparsified
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// ErrSourceChanged is returned by FetchSparse when the file
+// being fetched changed during the fetch, or since the one
+// an interrupted fetch was resuming.
+var ErrSourceChanged = fmt.Errorf("the file changed on the server during the transfer.")
+
+// ErrChecksum is returned by FetchSparse when a range did
+// not arrive as the server sent it.
+var ErrChecksum = fmt.Errorf("checksum mismatch on received data.")
+
+// sumTrailer carries the CRC32C of the body of a response,
+// as 8 hex digits, in an HTTP trailer, if the request asked
+// for it with sumRequest.
+const (
+	sumTrailer = "X-Sparse-Crc32c"
+	sumRequest = "X-Sparse-Want-Crc32c"
+)
+
+// SparseManifest is what an HTTPHandler serves for the
+// extent map query, as JSON.
+type SparseManifest struct {
+	Size    int64    `json:"size"`
+	ETag    string   `json:"etag"`
+	Extents []Extent `json:"extents"`
+}
+
+// HTTPHandler serves a sparse file over HTTP. GET and HEAD
+// serve the content, with Range requests, and conditional
+// requests against an ETag made from the size and
+// modification time. With the query parameter "extents" it
+// serves instead a SparseManifest, from which a client such
+// as FetchSparse can ask for the data ranges only.
+//
+// A GET with the header X-Sparse-Want-Crc32c gets its body
+// chunked, and followed by a trailer with its CRC32C, which
+// means reading it through user space. Otherwise, on Linux,
+// an *OSFile goes from the page cache to the socket with
+// sendfile(2), as http.ServeFile does.
+type HTTPHandler struct {
+	f    SparseFile
+	opts *Options
+}
+
+// NewHTTPHandler returns a handler serving f. Only the
+// Logger and Trace of opts are used.
+func NewHTTPHandler(f SparseFile, opts *Options) *HTTPHandler {
+	return &HTTPHandler{f: withHooks(f, opts), opts: opts}
+}
+
+func (h *HTTPHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	fi, err := h.f.Stat()
+	if err != nil {
+		h.fail(w, err)
+		return
+	}
+	etag := fmt.Sprintf(`"%x-%x"`, fi.Size(), fi.ModTime().UnixNano())
+	w.Header().Set("ETag", etag)
+
+	if r.URL.Query().Has("extents") {
+		exts, err := h.f.Extents()
+		if err != nil {
+			h.fail(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-cache")
+		if r.Method == http.MethodGet {
+			json.NewEncoder(w).Encode(&SparseManifest{Size: fi.Size(), ETag: etag, Extents: exts})
+		}
+		return
+	}
+	if r.Method == http.MethodHead || r.Header.Get(sumRequest) == "" {
+		h.serveContent(w, r, fi)
+		return
+	}
+	content := io.NewSectionReader(h.f, 0, fi.Size())
+	w.Header().Set("Trailer", sumTrailer)
+	cw := &crcWriter{ResponseWriter: w}
+	http.ServeContent(cw, r, fi.Name(), fi.ModTime(), content)
+	w.Header().Set(sumTrailer, fmt.Sprintf("%08x", cw.crc))
+}
+
+// serveContent serves the content without a checksum. net/http
+// sends an *os.File with sendfile(2), but from its file
+// position, so an *OSFile is opened again for each request.
+func (h *HTTPHandler) serveContent(w http.ResponseWriter, r *http.Request, fi os.FileInfo) {
+	var content io.ReadSeeker = io.NewSectionReader(h.f, 0, fi.Size())
+	if o, ok := h.f.(*OSFile); ok {
+		if fd, err := reopenFile(o.File); err == nil {
+			defer fd.Close()
+			content = fd
+		}
+	}
+	http.ServeContent(w, r, fi.Name(), fi.ModTime(), content)
+}
+
+func (h *HTTPHandler) fail(w http.ResponseWriter, err error) {
+	optHooks(h.opts).log.Debug("sparsified: http request failed", "path", h.f.Name(), "err", err)
+	http.Error(w, err.Error(), http.StatusInternalServerError)
+}
+
+// crcWriter sums the body as it goes out.
+type crcWriter struct {
+	http.ResponseWriter
+	crc uint32
+}
+
+// WriteHeader drops the Content-Length, as net/http sends no
+// trailers without chunked encoding. Content-Range still
+// gives the length of a range.
+func (c *crcWriter) WriteHeader(code int) {
+	c.Header().Del("Content-Length")
+	c.ResponseWriter.WriteHeader(code)
+}
+
+func (c *crcWriter) Write(p []byte) (int, error) {
+	n, err := c.ResponseWriter.Write(p)
+	c.crc = crc32.Update(c.crc, castagnoli, p[:n])
+	return n, err
+}
+
+// FetchSparse downloads the file an HTTPHandler serves at
+// rawURL into dst, keeping it sparse: it fetches the extent
+// map, then only the data ranges, a Range request each, so
+// holes never cross the network. Each range is checked
+// against the server's checksum before it is written. client
+// nil means http.DefaultClient.
+//
+// It returns the ETag of the file fetched. An interrupted
+// fetch resumes like Copy, with Options.ResumeAt; pass the
+// ETag back too, and a file changed in between fails with
+// ErrSourceChanged instead of mixing old and new. etag ""
+// takes the file as it is.
+func FetchSparse(ctx context.Context, dst SparseFile, client *http.Client, rawURL, etag string, opts *Options) (gotETag string, err error) {
+	defer func() { err = opError("fetch", dst.Name(), 0, 0, err) }()
+	dst = withHooks(dst, opts)
+	if client == nil {
+		client = http.DefaultClient
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", err
+	}
+	q := u.Query()
+	q.Set("extents", "")
+	mu := *u
+	mu.RawQuery = q.Encode()
+	var m SparseManifest
+	err = httpGet(ctx, client, mu.String(), nil, func(resp *http.Response) error {
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("FetchSparse: extent map: %v", resp.Status)
+		}
+		return json.NewDecoder(resp.Body).Decode(&m)
+	})
+	if err != nil {
+		return "", err
+	}
+	if etag != "" && m.ETag != etag {
+		return m.ETag, ErrSourceChanged
+	}
+
+	resume := resumeAt(opts)
+	if err = ensureSpace(dst, m.Extents, resume, opts); err != nil {
+		return m.ETag, err
+	}
+	pr := newProgress(ctx, "fetch", opts, m.Size, dataBytes(m.Extents))
+	defer func() { err = pr.done(err) }()
+	if resume == 0 {
+		if err = dst.Truncate(0); err != nil {
+			return m.ETag, err
+		}
+	}
+	if err = dst.Truncate(m.Size); err != nil {
+		return m.ETag, err
+	}
+	pr.resume(resume)
+
+	buf := make([]byte, copyChunk)
+	for _, cu := range copyUnits(m.Extents, resume) {
+		if cu.hole {
+			if err = pr.hole(cu.off, cu.n); err != nil {
+				return m.ETag, err
+			}
+			continue
+		}
+		p := buf[:cu.n]
+		hdr := http.Header{
+			"Range":    {fmt.Sprintf("bytes=%d-%d", cu.off, cu.off+cu.n-1)},
+			"If-Match": {m.ETag},
+			sumRequest: {"1"},
+		}
+		err = httpGet(ctx, client, rawURL, hdr, func(resp *http.Response) error {
+			switch resp.StatusCode {
+			case http.StatusPartialContent:
+			case http.StatusPreconditionFailed:
+				return ErrSourceChanged
+			default:
+				return fmt.Errorf("FetchSparse: range at %v: %v", cu.off, resp.Status)
+			}
+			if cr := resp.Header.Get("Content-Range"); !strings.HasPrefix(cr, fmt.Sprintf("bytes %d-%d/", cu.off, cu.off+cu.n-1)) {
+				return fmt.Errorf("FetchSparse: asked for %v bytes at %v, got Content-Range %q", cu.n, cu.off, cr)
+			}
+			if _, err := io.ReadFull(resp.Body, p); err != nil {
+				return err
+			}
+			// the trailer is there once the body is read out.
+			if _, err := io.Copy(io.Discard, resp.Body); err != nil {
+				return err
+			}
+			sum, err := strconv.ParseUint(resp.Trailer.Get(sumTrailer), 16, 32)
+			if err != nil {
+				return fmt.Errorf("FetchSparse: range at %v: no checksum trailer", cu.off)
+			}
+			if uint32(sum) != crc32.Checksum(p, castagnoli) {
+				return ErrChecksum
+			}
+			return nil
+		})
+		if err != nil {
+			return m.ETag, err
+		}
+		if err = writeAtSparse(dst, p, cu.off); err != nil {
+			return m.ETag, err
+		}
+		if err = pr.data(cu.off, cu.n); err != nil {
+			return m.ETag, err
+		}
+	}
+	return m.ETag, dst.Sync()
+}
+
+// httpGet does a GET with hdr, and hands the response to
+// read before closing its body.
+func httpGet(ctx context.Context, client *http.Client, rawURL string, hdr http.Header, read func(*http.Response) error) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return err
+	}
+	for k, v := range hdr {
+		req.Header[k] = v
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return read(resp)
+}
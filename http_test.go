@@ -0,0 +1,94 @@
+package sparsified
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+)
+
+// corruptWriter flips a bit of every body it passes on.
+type corruptWriter struct {
+	http.ResponseWriter
+}
+
+func (c corruptWriter) Write(p []byte) (int, error) {
+	q := append([]byte(nil), p...)
+	if len(q) > 0 {
+		q[0] ^= 1
+	}
+	return c.ResponseWriter.Write(q)
+}
+
+func TestFetchSparse(t *testing.T) {
+	dir := t.TempDir()
+	sz, spans := testSpans()
+	src := makeTestSparse(t, filepath.Join(dir, "src.img"), sz, spans)
+	defer src.Close()
+	srcExts, err := Extents(src)
+	panicOn(err)
+
+	var served atomic.Int64 // bytes of content asked for.
+	var corrupt atomic.Bool
+	h := NewHTTPHandler(NewOSFile(src), nil)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Has("extents") {
+			h.ServeHTTP(w, r)
+			return
+		}
+		if r.Header.Get("Range") == "" {
+			t.Errorf("whole file asked for")
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, r)
+		served.Add(int64(rec.Body.Len()))
+		if corrupt.Load() {
+			w = corruptWriter{w}
+		}
+		h.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+
+	out, err := os.Create(filepath.Join(dir, "out.img"))
+	panicOn(err)
+	defer out.Close()
+	dst := NewOSFile(out)
+	etag, err := FetchSparse(context.Background(), dst, nil, ts.URL+"/src.img", "", nil)
+	panicOn(err)
+	sameContentAndHoles(t, src, out)
+	if served.Load() != dataBytes(srcExts) {
+		t.Fatalf("fetched %v bytes for %v of data", served.Load(), dataBytes(srcExts))
+	}
+
+	// interrupted after the first range, then resumed.
+	ctx, cancel := context.WithCancel(context.Background())
+	var last Progress
+	_, err = FetchSparse(ctx, dst, nil, ts.URL, etag, &Options{ProgressInterval: 1, Progress: func(p Progress) {
+		last = p
+		if p.Data > 0 {
+			cancel()
+		}
+	}})
+	if !errors.Is(err, context.Canceled) || last.Offset >= sz {
+		t.Fatalf("canceled fetch: %v at %v", err, last.Offset)
+	}
+	_, err = FetchSparse(context.Background(), dst, nil, ts.URL, etag, &Options{ResumeAt: last.Offset})
+	panicOn(err)
+	sameContentAndHoles(t, src, out)
+
+	// damage on the way, and a changed source, are caught.
+	corrupt.Store(true)
+	if _, err = FetchSparse(context.Background(), dst, nil, ts.URL, "", nil); !errors.Is(err, ErrChecksum) {
+		t.Fatalf("corrupted fetch: %v", err)
+	}
+	corrupt.Store(false)
+	_, err = src.WriteAt([]byte("more"), sz)
+	panicOn(err)
+	if _, err = FetchSparse(context.Background(), dst, nil, ts.URL, etag, &Options{ResumeAt: 4096}); !errors.Is(err, ErrSourceChanged) {
+		t.Fatalf("resume on a changed file: %v", err)
+	}
+}
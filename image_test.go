@@ -0,0 +1,191 @@
+package sparsified
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// makeTestSparse creates a sparse file of apparent size sz
+// at path, with random data written at each of the offsets
+// in spans (offset -> length). Everything else is a hole.
+func makeTestSparse(t *testing.T, path string, sz int64, spans map[int64]int) *os.File {
+	t.Helper()
+	fd, err := os.Create(path)
+	panicOn(err)
+	panicOn(fd.Truncate(sz))
+	rng := rand.New(rand.NewSource(int64(len(spans))))
+	for off, n := range spans {
+		buf := make([]byte, n)
+		for i := range buf {
+			buf[i] = byte(rng.Intn(255) + 1) // never zero.
+		}
+		_, err = fd.WriteAt(buf, off)
+		panicOn(err)
+	}
+	return fd
+}
+
+// sameContentAndHoles checks that got reads the same as
+// want, and that every hole in want is still a hole in got.
+func sameContentAndHoles(t *testing.T, want, got *os.File) {
+	t.Helper()
+	wsz, err := fileSizeFromFile(want)
+	panicOn(err)
+	gsz, err := fileSizeFromFile(got)
+	panicOn(err)
+	if wsz != gsz {
+		t.Fatalf("size mismatch: want %v, got %v", wsz, gsz)
+	}
+	a, err := io.ReadAll(io.NewSectionReader(want, 0, wsz))
+	panicOn(err)
+	b, err := io.ReadAll(io.NewSectionReader(got, 0, gsz))
+	panicOn(err)
+	if !bytes.Equal(a, b) {
+		t.Fatalf("content mismatch")
+	}
+	wexts, err := Extents(want)
+	panicOn(err)
+	gdata, err := DataExtents(got)
+	panicOn(err)
+	holes := 0
+	for _, h := range wexts {
+		if !h.Hole {
+			continue
+		}
+		holes++
+		for _, d := range gdata {
+			if d.Offset < h.End() && h.Offset < d.End() {
+				t.Fatalf("hole %+v in original is data %+v after round trip", h, d)
+			}
+		}
+	}
+	if holes == 0 {
+		t.Fatalf("original has no holes; filesystem does not support them?")
+	}
+}
+
+func testSpans() (sz int64, spans map[int64]int) {
+	sz = 9<<20 + 4096*3
+	spans = map[int64]int{
+		0:             4096,
+		64 << 10:      100, // partial block inside one grain.
+		(3 << 20) + 5: 70000,
+		8 << 20:       4096 * 2,
+		sz - 10:       10, // the tail.
+	}
+	return
+}
+
+func TestVMDKRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	sz, spans := testSpans()
+	raw := makeTestSparse(t, filepath.Join(dir, "raw.img"), sz, spans)
+	defer raw.Close()
+
+	img, err := os.Create(filepath.Join(dir, "disk.vmdk"))
+	panicOn(err)
+	defer img.Close()
+	panicOn(RawToVMDK(context.Background(), img, NewOSFile(raw), nil))
+
+	// only grains with data should be stored.
+	isz, err := fileSizeFromFile(img)
+	panicOn(err)
+	if isz > 1<<20 {
+		t.Fatalf("vmdk image is %v bytes; holes were allocated", isz)
+	}
+
+	back, err := os.Create(filepath.Join(dir, "back.img"))
+	panicOn(err)
+	defer back.Close()
+	panicOn(VMDKToRaw(context.Background(), NewOSFile(back), img, nil))
+	sameContentAndHoles(t, raw, back)
+}
+
+func TestVHDRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	sz, spans := testSpans()
+	raw := makeTestSparse(t, filepath.Join(dir, "raw.img"), sz, spans)
+	defer raw.Close()
+
+	img, err := os.Create(filepath.Join(dir, "disk.vhd"))
+	panicOn(err)
+	defer img.Close()
+	panicOn(RawToVHD(context.Background(), img, NewOSFile(raw), nil))
+
+	// 3 of the 5 blocks have data.
+	isz, err := fileSizeFromFile(img)
+	panicOn(err)
+	if isz > 4*vhdBlockSize {
+		t.Fatalf("vhd image is %v bytes; holes were allocated", isz)
+	}
+
+	back, err := os.Create(filepath.Join(dir, "back.img"))
+	panicOn(err)
+	defer back.Close()
+	var last Progress
+	panicOn(VHDToRaw(context.Background(), NewOSFile(back), img, &Options{Progress: func(p Progress) { last = p }}))
+	sameContentAndHoles(t, raw, back)
+	if !last.Done || last.TotalData == 0 || last.Data != last.TotalData || last.Data+last.Holes != last.Size {
+		t.Fatalf("final progress %+v", last)
+	}
+}
+
+// corruptImage makes an image of the test file with export,
+// then checks that import rejects each corruption of it,
+// rather than panicking or allocating what it claims.
+func corruptImage(t *testing.T, export func(context.Context, io.Writer, SparseFile, *Options) error,
+	imp func(context.Context, SparseFile, io.ReaderAt, *Options) error, corrupt map[string]func(img []byte)) {
+
+	t.Helper()
+	dir := t.TempDir()
+	sz, spans := testSpans()
+	raw := makeTestSparse(t, filepath.Join(dir, "raw.img"), sz, spans)
+	defer raw.Close()
+	var good bytes.Buffer
+	panicOn(export(context.Background(), &good, NewOSFile(raw), nil))
+	for name, f := range corrupt {
+		img := bytes.Clone(good.Bytes())
+		f(img)
+		if err := imp(context.Background(), NewMemSparseFile("back", 4096), bytes.NewReader(img), nil); err == nil {
+			t.Fatalf("%v: imported", name)
+		}
+	}
+}
+
+func TestVMDKCorruptHeader(t *testing.T) {
+	le := binary.LittleEndian
+	corruptImage(t, RawToVMDK, VMDKToRaw, map[string]func([]byte){
+		"capacity overflows":   func(b []byte) { le.PutUint64(b[12:], 1<<62) },
+		"capacity too big":     func(b []byte) { le.PutUint64(b[12:], 1<<40) },
+		"huge grains":          func(b []byte) { le.PutUint64(b[20:], 1<<40) },
+		"huge descriptor":      func(b []byte) { le.PutUint64(b[36:], 1<<50) },
+		"huge grain tables":    func(b []byte) { le.PutUint32(b[44:], 1<<31) },
+		"directory past EOF":   func(b []byte) { le.PutUint64(b[56:], 1<<60) },
+		"grain table past EOF": func(b []byte) { le.PutUint32(b[(1+vmdkDescSectors)*vmdkSector:], 1<<31) },
+	})
+}
+
+func TestVHDCorruptHeader(t *testing.T) {
+	be := binary.BigEndian
+	// setSize changes the footer's disk size, and its checksum.
+	setSize := func(b []byte, size uint64) {
+		be.PutUint64(b[48:], size)
+		be.PutUint32(b[64:], 0)
+		be.PutUint32(b[64:], vhdChecksum(b[:vhdSector]))
+	}
+	const dh = vhdHeaderOffset
+	corruptImage(t, RawToVHD, VHDToRaw, map[string]func([]byte){
+		"BAT past EOF":        func(b []byte) { be.PutUint64(b[dh+16:], 1<<63) },
+		"BAT too small":       func(b []byte) { be.PutUint32(b[dh+28:], 1) },
+		"huge blocks":         func(b []byte) { be.PutUint32(b[dh+32:], 0xFFFFFE00) },
+		"unaligned blocks":    func(b []byte) { be.PutUint32(b[dh+32:], 1000) },
+		"disk size too big":   func(b []byte) { setSize(b, 1<<63) },
+		"BAT bigger than EOF": func(b []byte) { setSize(b, 1<<52); be.PutUint32(b[dh+28:], 0xFFFFFFFF) },
+	})
+}
@@ -0,0 +1,427 @@
+package sparsified
+
+import (
+	"io"
+	"sort"
+	"sync"
+	"syscall"
+)
+
+// whence values for Seek, as on Linux. Darwin swaps
+// them, but MemSparseFile is ours so we pick.
+const (
+	SEEK_DATA = 3
+	SEEK_HOLE = 4
+)
+
+// MemSparseFile is a sparse file held in memory. Only
+// blocks that have been written are stored; everything
+// else is a hole and reads back as zeros.
+//
+// It follows the Linux (ext4/XFS) semantics at block
+// granularity, so it can stand in for a real file in tests
+// and serve as the reference model for one:
+//
+//   - PunchHole and ZeroRange zero partial blocks and free
+//     whole blocks, keeping (resp. extending) the size.
+//   - CollapseRange and InsertRange require block aligned
+//     offset and length, and return EINVAL otherwise, or if
+//     the range reaches EOF (collapse) or starts at or past
+//     EOF (insert).
+//   - Seek supports SEEK_DATA and SEEK_HOLE, returning ENXIO
+//     at or past EOF. EOF counts as a hole.
+//
+// MemSparseFile is safe for concurrent use.
+type MemSparseFile struct {
+	mu     sync.Mutex
+	name   string
+	bs     int64
+	size   int64
+	pos    int64
+	blocks []memBlock // sorted by idx; each len(data) == bs.
+}
+
+type memBlock struct {
+	idx  int64
+	data []byte
+}
+
+// maxMemFileSize matches the usual s_maxbytes; InsertRange
+// past it fails with EFBIG, like the kernel.
+const maxMemFileSize = 1<<63 - 1
+
+// NewMemSparseFile returns an empty MemSparseFile with
+// the given block size. A blockSize <= 0 means 4096.
+// The name is only used in errors.
+func NewMemSparseFile(name string, blockSize int64) *MemSparseFile {
+	if blockSize <= 0 {
+		blockSize = 4096
+	}
+	return &MemSparseFile{name: name, bs: blockSize}
+}
+
+// Name returns the name given to NewMemSparseFile.
+func (m *MemSparseFile) Name() string {
+	return m.name
+}
+
+// BlockSize returns the allocation granularity.
+func (m *MemSparseFile) BlockSize() int64 {
+	return m.bs
+}
+
+// Size returns the apparent size.
+func (m *MemSparseFile) Size() int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.size
+}
+
+// Allocated returns the number of bytes held in blocks,
+// the analog of st_blocks * 512.
+func (m *MemSparseFile) Allocated() int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return int64(len(m.blocks)) * m.bs
+}
+
+// find returns the position in m.blocks of the first
+// block with index >= idx.
+func (m *MemSparseFile) find(idx int64) int {
+	return sort.Search(len(m.blocks), func(i int) bool {
+		return m.blocks[i].idx >= idx
+	})
+}
+
+// get returns block idx, or nil if it is a hole.
+func (m *MemSparseFile) get(idx int64) []byte {
+	i := m.find(idx)
+	if i < len(m.blocks) && m.blocks[i].idx == idx {
+		return m.blocks[i].data
+	}
+	return nil
+}
+
+// alloc returns block idx, allocating it if need be.
+func (m *MemSparseFile) alloc(idx int64) []byte {
+	i := m.find(idx)
+	if i < len(m.blocks) && m.blocks[i].idx == idx {
+		return m.blocks[i].data
+	}
+	b := memBlock{idx: idx, data: make([]byte, m.bs)}
+	m.blocks = append(m.blocks, memBlock{})
+	copy(m.blocks[i+1:], m.blocks[i:])
+	m.blocks[i] = b
+	return b.data
+}
+
+// drop frees the blocks with index in [beg, endx).
+func (m *MemSparseFile) drop(beg, endx int64) {
+	i := m.find(beg)
+	j := m.find(endx)
+	m.blocks = append(m.blocks[:i], m.blocks[j:]...)
+}
+
+// zero zeroes [off, off+n) inside a single block, if allocated.
+func (m *MemSparseFile) zero(off, n int64) {
+	if b := m.get(off / m.bs); b != nil {
+		o := off % m.bs
+		clear(b[o : o+n])
+	}
+}
+
+// ReadAt implements io.ReaderAt. Like *os.File, it
+// returns io.EOF when it reads short because of EOF.
+func (m *MemSparseFile) ReadAt(p []byte, off int64) (n int, err error) {
+	if off < 0 {
+		return 0, m.opErr("readat", off, int64(len(p)), syscall.EINVAL, -1)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.readAt(p, off)
+}
+
+func (m *MemSparseFile) readAt(p []byte, off int64) (n int, err error) {
+	if off >= m.size {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > m.size-off {
+		p = p[:m.size-off]
+		err = io.EOF
+	}
+	for len(p) > 0 {
+		o := off % m.bs
+		k := copy(p, make0(m.get(off/m.bs), m.bs)[o:])
+		p = p[k:]
+		off += int64(k)
+		n += k
+	}
+	return
+}
+
+// make0 returns b, or a zero block when b is a hole.
+func make0(b []byte, bs int64) []byte {
+	if b != nil {
+		return b
+	}
+	if bs <= int64(len(oneZeroBlock4k)) {
+		return oneZeroBlock4k[:bs]
+	}
+	return make([]byte, bs)
+}
+
+// WriteAt implements io.WriterAt, extending the file if needed.
+func (m *MemSparseFile) WriteAt(p []byte, off int64) (n int, err error) {
+	if off < 0 {
+		return 0, m.opErr("writeat", off, int64(len(p)), syscall.EINVAL, -1)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.writeAt(p, off)
+}
+
+func (m *MemSparseFile) writeAt(p []byte, off int64) (n int, err error) {
+	for len(p) > 0 {
+		o := off % m.bs
+		k := copy(m.alloc(off / m.bs)[o:], p)
+		p = p[k:]
+		off += int64(k)
+		n += k
+	}
+	if n > 0 && off > m.size {
+		m.size = off
+	}
+	return
+}
+
+// Read implements io.Reader at the current position.
+func (m *MemSparseFile) Read(p []byte) (n int, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(p) == 0 {
+		return 0, nil
+	}
+	n, err = m.readAt(p, m.pos)
+	m.pos += int64(n)
+	if n > 0 {
+		err = nil
+	}
+	return
+}
+
+// Write implements io.Writer at the current position.
+func (m *MemSparseFile) Write(p []byte) (n int, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n, err = m.writeAt(p, m.pos)
+	m.pos += int64(n)
+	return
+}
+
+// Seek implements io.Seeker, plus SEEK_DATA and SEEK_HOLE.
+func (m *MemSparseFile) Seek(offset int64, whence int) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var pos int64
+	switch whence {
+	case io.SeekStart:
+		pos = offset
+	case io.SeekCurrent:
+		pos = m.pos + offset
+	case io.SeekEnd:
+		pos = m.size + offset
+	case SEEK_DATA, SEEK_HOLE:
+		if offset < 0 {
+			return 0, m.opErr("seek", offset, 0, syscall.EINVAL, -1)
+		}
+		if offset >= m.size {
+			return 0, m.opErr("seek", offset, 0, syscall.ENXIO, -1)
+		}
+		if whence == SEEK_DATA {
+			i := m.find(offset / m.bs)
+			if i == len(m.blocks) || m.blocks[i].idx*m.bs >= m.size {
+				return 0, m.opErr("seek", offset, 0, syscall.ENXIO, -1)
+			}
+			pos = max(offset, m.blocks[i].idx*m.bs)
+		} else {
+			pos = m.nextHole(offset)
+		}
+	default:
+		return 0, m.opErr("seek", offset, 0, syscall.EINVAL, -1)
+	}
+	if pos < 0 {
+		return 0, m.opErr("seek", offset, 0, syscall.EINVAL, -1)
+	}
+	m.pos = pos
+	return pos, nil
+}
+
+// nextHole returns the first hole offset at or after off,
+// where EOF counts as a hole.
+func (m *MemSparseFile) nextHole(off int64) int64 {
+	idx := off / m.bs
+	for i := m.find(idx); i < len(m.blocks) && m.blocks[i].idx == idx; i++ {
+		idx++
+	}
+	return min(max(off, idx*m.bs), m.size)
+}
+
+// Truncate changes the size. Shrinking frees the blocks
+// past the new EOF and zeroes the tail of the last block,
+// so growing again reads zeros, as with ftruncate(2).
+func (m *MemSparseFile) Truncate(size int64) error {
+	if size < 0 {
+		return m.opErr("truncate", size, 0, syscall.EINVAL, -1)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if size < m.size {
+		m.drop(ceilDiv(size, m.bs), maxMemFileSize/m.bs+1)
+		if o := size % m.bs; o != 0 {
+			m.zero(size, m.bs-o)
+		}
+	}
+	m.size = size
+	return nil
+}
+
+// PunchHole deallocates [off, off+length), as fallocate(2) with
+// FALLOC_FL_PUNCH_HOLE|FALLOC_FL_KEEP_SIZE: whole blocks are
+// freed, partial blocks at either end are zeroed, and the
+// size never changes.
+func (m *MemSparseFile) PunchHole(off, length int64) error {
+	if off < 0 || length <= 0 {
+		return m.opErr("punchhole", off, length, syscall.EINVAL, -1)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	endx := off + length
+	if endx > m.size {
+		// a punch past EOF frees the partial last
+		// block too, as ext4 and XFS do.
+		endx = ceilDiv(m.size, m.bs) * m.bs
+	}
+	m.punch(off, endx)
+	return nil
+}
+
+// punch frees the whole blocks in [beg, endx) and zeroes
+// the partial ones.
+func (m *MemSparseFile) punch(beg, endx int64) {
+	if beg >= endx {
+		return
+	}
+	first := ceilDiv(beg, m.bs) // first whole block.
+	last := endx / m.bs         // one past the last whole block.
+	if first > last {
+		// all inside a single block.
+		m.zero(beg, endx-beg)
+		return
+	}
+	if beg < first*m.bs {
+		m.zero(beg, first*m.bs-beg)
+	}
+	if endx > last*m.bs {
+		m.zero(last*m.bs, endx-last*m.bs)
+	}
+	m.drop(first, last)
+}
+
+// ZeroRange zeroes [off, off+length), as fallocate(2) with
+// FALLOC_FL_ZERO_RANGE and no KEEP_SIZE: the file is extended
+// if the range goes past EOF. Whole blocks become holes,
+// which matches what SEEK_HOLE reports for the unwritten
+// extents ext4 and XFS create here.
+func (m *MemSparseFile) ZeroRange(off, length int64) error {
+	if off < 0 || length <= 0 {
+		return m.opErr("zerorange", off, length, syscall.EINVAL, -1)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.punch(off, min(off+length, m.size))
+	if off+length > m.size {
+		m.size = off + length
+	}
+	return nil
+}
+
+// CollapseRange removes [off, off+length) from the file,
+// shifting everything after it down, as fallocate(2) with
+// FALLOC_FL_COLLAPSE_RANGE. The file shrinks by length.
+func (m *MemSparseFile) CollapseRange(off, length int64) error {
+	if off < 0 || length <= 0 || off%m.bs != 0 || length%m.bs != 0 {
+		return m.opErr("collapserange", off, length, syscall.EINVAL, -1)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if off+length >= m.size {
+		// the kernel says: use ftruncate instead.
+		return m.opErr("collapserange", off, length, syscall.EINVAL, m.size)
+	}
+	beg := off / m.bs
+	n := length / m.bs
+	m.drop(beg, beg+n)
+	for i := m.find(beg); i < len(m.blocks); i++ {
+		m.blocks[i].idx -= n
+	}
+	m.size -= length
+	return nil
+}
+
+// InsertRange inserts a hole of length bytes at off, shifting
+// everything from off onward up, as fallocate(2) with
+// FALLOC_FL_INSERT_RANGE. The file grows by length.
+func (m *MemSparseFile) InsertRange(off, length int64) error {
+	if off < 0 || length <= 0 || off%m.bs != 0 || length%m.bs != 0 {
+		return m.opErr("insertrange", off, length, syscall.EINVAL, -1)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if off >= m.size {
+		return m.opErr("insertrange", off, length, syscall.EINVAL, m.size)
+	}
+	if length > maxMemFileSize-m.size {
+		return m.opErr("insertrange", off, length, syscall.EFBIG, m.size)
+	}
+	n := length / m.bs
+	for i := m.find(off / m.bs); i < len(m.blocks); i++ {
+		m.blocks[i].idx += n
+	}
+	m.size += length
+	return nil
+}
+
+// Extents returns the hole map, in the same form as the
+// package level Extents does for an *os.File.
+func (m *MemSparseFile) Extents() (exts []Extent, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	add := func(beg, endx int64, hole bool) {
+		if beg >= endx {
+			return
+		}
+		if k := len(exts) - 1; k >= 0 && exts[k].Hole == hole {
+			exts[k].Length = endx - exts[k].Offset
+			return
+		}
+		exts = append(exts, Extent{Offset: beg, Length: endx - beg, Hole: hole})
+	}
+	var pos int64
+	for _, b := range m.blocks {
+		beg := b.idx * m.bs
+		if beg >= m.size {
+			break
+		}
+		add(pos, beg, true)
+		pos = min(beg+m.bs, m.size)
+		add(beg, pos, false)
+	}
+	add(pos, m.size, true)
+	return
+}
+
+// opErr is the error a failed operation returns; size is the
+// file size where that explains an EINVAL, or -1.
+func (m *MemSparseFile) opErr(op string, off, length int64, errno syscall.Errno, size int64) error {
+	return errnoError(op, m.name, off, length, errno, size, m.bs)
+}
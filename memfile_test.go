@@ -0,0 +1,134 @@
+package sparsified
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"reflect"
+	"syscall"
+	"testing"
+)
+
+func TestMemSparseFileSeekDataHole(t *testing.T) {
+	const bs = 4096
+	m := NewMemSparseFile("mem", bs)
+	panicOn(m.Truncate(8 * bs))
+	_, err := m.WriteAt([]byte("hello"), 2*bs+10)
+	panicOn(err)
+	_, err = m.WriteAt(bytes.Repeat([]byte{7}, 2*bs), 5*bs)
+	panicOn(err)
+
+	seek := func(off int64, whence int) int64 {
+		pos, err := m.Seek(off, whence)
+		panicOn(err)
+		return pos
+	}
+	if got := seek(0, SEEK_DATA); got != 2*bs {
+		t.Fatalf("SEEK_DATA from 0: got %v", got)
+	}
+	if got := seek(2*bs+100, SEEK_DATA); got != 2*bs+100 {
+		t.Fatalf("SEEK_DATA inside data should stay put: got %v", got)
+	}
+	if got := seek(2*bs, SEEK_HOLE); got != 3*bs {
+		t.Fatalf("SEEK_HOLE from 2*bs: got %v", got)
+	}
+	if got := seek(5*bs, SEEK_HOLE); got != 7*bs {
+		t.Fatalf("SEEK_HOLE from 5*bs: got %v", got)
+	}
+	if _, err := m.Seek(7*bs, SEEK_DATA); !errors.Is(err, syscall.ENXIO) {
+		t.Fatalf("SEEK_DATA past the last data: want ENXIO, got %v", err)
+	}
+	if _, err := m.Seek(8*bs, SEEK_HOLE); !errors.Is(err, syscall.ENXIO) {
+		t.Fatalf("SEEK_HOLE at EOF: want ENXIO, got %v", err)
+	}
+
+	exts, err := m.Extents()
+	panicOn(err)
+	want := []Extent{
+		{Offset: 0, Length: 2 * bs, Hole: true},
+		{Offset: 2 * bs, Length: bs},
+		{Offset: 3 * bs, Length: 2 * bs, Hole: true},
+		{Offset: 5 * bs, Length: 2 * bs},
+		{Offset: 7 * bs, Length: bs, Hole: true},
+	}
+	if !reflect.DeepEqual(exts, want) {
+		t.Fatalf("extents: want %+v\n got %+v", want, exts)
+	}
+	if m.Allocated() != 3*bs {
+		t.Fatalf("allocated: want %v, got %v", 3*bs, m.Allocated())
+	}
+}
+
+func TestMemSparseFileRangeOps(t *testing.T) {
+	const bs = 16
+	m := NewMemSparseFile("mem", bs)
+	all := func() []byte {
+		b, err := io.ReadAll(io.NewSectionReader(m, 0, m.Size()))
+		panicOn(err)
+		return b
+	}
+	// 6 blocks: "aaaa...", "bbbb...", ..., "ffff..."
+	var want []byte
+	for c := byte('a'); c <= 'f'; c++ {
+		want = append(want, bytes.Repeat([]byte{c}, bs)...)
+	}
+	_, err := m.WriteAt(want, 0)
+	panicOn(err)
+
+	// punch straddling blocks b..d: b is zeroed at the tail,
+	// c is freed, d is zeroed at the head.
+	panicOn(m.PunchHole(bs+8, 2*bs))
+	copy(want[bs+8:3*bs+8], make([]byte, 2*bs))
+	if !bytes.Equal(all(), want) {
+		t.Fatalf("after punch:\n%q\nwant\n%q", all(), want)
+	}
+	if m.Allocated() != 5*bs {
+		t.Fatalf("punch should free exactly one block; allocated = %v", m.Allocated())
+	}
+	if m.Size() != 6*bs {
+		t.Fatalf("punch must keep the size; got %v", m.Size())
+	}
+
+	// collapse away blocks b and c.
+	panicOn(m.CollapseRange(bs, 2*bs))
+	want = append(want[:bs], want[3*bs:]...)
+	if !bytes.Equal(all(), want) {
+		t.Fatalf("after collapse:\n%q\nwant\n%q", all(), want)
+	}
+
+	// insert a hole block before the last block.
+	panicOn(m.InsertRange(3*bs, bs))
+	want = append(want[:3*bs], append(make([]byte, bs), want[3*bs:]...)...)
+	if !bytes.Equal(all(), want) {
+		t.Fatalf("after insert:\n%q\nwant\n%q", all(), want)
+	}
+
+	// zero range past EOF extends the file.
+	panicOn(m.ZeroRange(5*bs-4, 8))
+	copy(want[5*bs-4:], make([]byte, 4))
+	want = append(want, make([]byte, 4)...)
+	if !bytes.Equal(all(), want) {
+		t.Fatalf("after zero range:\n%q\nwant\n%q", all(), want)
+	}
+
+	// the kernel's EINVAL cases.
+	for _, err := range []error{
+		m.CollapseRange(1, bs),
+		m.CollapseRange(0, bs+1),
+		m.CollapseRange(bs, m.Size()), // reaches EOF.
+		m.InsertRange(bs, 3),
+		m.InsertRange(6*bs, bs), // at/after EOF.
+	} {
+		if !errors.Is(err, syscall.EINVAL) {
+			t.Fatalf("want EINVAL, got %v", err)
+		}
+	}
+
+	// truncate down then up reads zeros in the tail.
+	panicOn(m.Truncate(bs + 3))
+	panicOn(m.Truncate(2 * bs))
+	want = append(want[:bs+3], make([]byte, bs-3)...)
+	if !bytes.Equal(all(), want) {
+		t.Fatalf("after truncate:\n%q\nwant\n%q", all(), want)
+	}
+}
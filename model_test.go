@@ -0,0 +1,256 @@
+package sparsified
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// Model based testing of the range operations: the same
+// random sequence of operations is applied to a real file
+// on the test filesystem, and to a MemSparseFile as the
+// reference model. After every step the content must be
+// identical, and every block the model says is data must
+// be data in the real file too. The real file may have
+// more data than the model (preallocation, or coarser hole
+// granularity), but never less.
+
+const modelBS = 4096
+
+const maxRangeOps = 64
+
+type rangeOpKind int
+
+const (
+	opWrite rangeOpKind = iota
+	opPunch
+	opZero
+	opCollapse
+	opInsert
+	opTruncate
+	numRangeOpKinds
+)
+
+var rangeOpNames = []string{"write", "punch", "zero", "collapse", "insert", "truncate"}
+
+type rangeOp struct {
+	kind   rangeOpKind
+	off    int64
+	length int64
+	fill   byte
+}
+
+func (op rangeOp) String() string {
+	return fmt.Sprintf("%v(off=%v, len=%v, fill=%v)", rangeOpNames[op.kind], op.off, op.length, op.fill)
+}
+
+// decodeOps turns fuzzer bytes into operations, 4 bytes
+// each. Offsets stay within 32 blocks and lengths within
+// 8 blocks so that ops interact. Write, punch, zero and
+// truncate get sub-block offsets; collapse and insert are
+// usually aligned, but not always, to exercise EINVAL.
+// Now and then a write is empty, which must not grow the
+// file even past its end. At most maxRangeOps are decoded, to bound each run.
+func decodeOps(b []byte) (ops []rangeOp) {
+	for ; len(b) >= 4 && len(ops) < maxRangeOps; b = b[4:] {
+		op := rangeOp{
+			kind: rangeOpKind(b[0] % byte(numRangeOpKinds)),
+			fill: b[3] | 1, // never zero, so data is data.
+		}
+		blk := int64(b[1] % 32)
+		nblk := int64(b[2]%8) + 1
+		sub := int64(b[1]/32) * 509 // 0..7 odd-ish sub-block offsets.
+		switch op.kind {
+		case opCollapse, opInsert:
+			op.off = blk * modelBS
+			op.length = nblk * modelBS
+			if b[3]%8 == 0 {
+				op.off += sub + 1
+			}
+		default:
+			op.off = blk*modelBS + sub
+			op.length = nblk*modelBS - int64(b[2]/8)*97
+			if op.kind == opWrite && b[2] >= 0xf8 {
+				op.length = 0
+			}
+		}
+		ops = append(ops, op)
+	}
+	return
+}
+
+func applyRangeOp(f SparseFile, op rangeOp) (err error) {
+	switch op.kind {
+	case opWrite:
+		_, err = f.WriteAt(bytes.Repeat([]byte{op.fill}, int(op.length)), op.off)
+	case opPunch:
+		err = f.PunchHole(op.off, op.length)
+	case opZero:
+		err = f.(ZeroRanger).ZeroRange(op.off, op.length)
+	case opCollapse:
+		err = f.CollapseRange(op.off, op.length)
+	case opInsert:
+		err = f.InsertRange(op.off, op.length)
+	case opTruncate:
+		err = f.Truncate(op.off)
+	}
+	return
+}
+
+// runRangeOps applies ops to a fresh real file in dir and to
+// the model, returning a description of the first divergence.
+// Ops the test filesystem cannot do at all (collapse and
+// insert on tmpfs, say) are left out, from the model too.
+func runRangeOps(dir string, ops []rangeOp) error {
+	fd, err := os.CreateTemp(dir, "model-*.img")
+	panicOn(err)
+	defer os.Remove(fd.Name())
+	defer fd.Close()
+	onDisk := NewOSFile(fd)
+	model := NewMemSparseFile("model", modelBS)
+
+	for i, op := range ops {
+		rerr := applyRangeOp(onDisk, op)
+		if errors.Is(rerr, syscall.EOPNOTSUPP) || errors.Is(rerr, errors.ErrUnsupported) {
+			continue
+		}
+		merr := applyRangeOp(model, op)
+		if (rerr == nil) != (merr == nil) ||
+			errors.Is(rerr, syscall.EINVAL) != errors.Is(merr, syscall.EINVAL) {
+			return fmt.Errorf("step %v %v: real err = %v, model err = %v", i, op, rerr, merr)
+		}
+		if err := compareToModel(onDisk, model); err != nil {
+			return fmt.Errorf("step %v %v: %v", i, op, err)
+		}
+	}
+	return nil
+}
+
+func compareToModel(onDisk *OSFile, model *MemSparseFile) error {
+	rsz, err := sparseSize(onDisk)
+	panicOn(err)
+	if rsz != model.Size() {
+		return fmt.Errorf("size: real %v, model %v", rsz, model.Size())
+	}
+	a := make([]byte, rsz)
+	b := make([]byte, rsz)
+	onDisk.ReadAt(a, 0)
+	model.ReadAt(b, 0)
+	if !bytes.Equal(a, b) {
+		i := 0
+		for a[i] == b[i] {
+			i++
+		}
+		return fmt.Errorf("content differs first at offset %v: real %v, model %v", i, a[i], b[i])
+	}
+	rexts, err := onDisk.Extents()
+	panicOn(err)
+	mexts, err := model.Extents()
+	panicOn(err)
+	for _, m := range onlyData(mexts) {
+		for _, r := range rexts {
+			if r.Hole && r.Offset < m.End() && m.Offset < r.End() {
+				return fmt.Errorf("model data %+v is a hole %+v in the real file", m, r)
+			}
+		}
+	}
+	return nil
+}
+
+// shrinkRangeOps reduces a failing sequence to a (locally)
+// minimal one that still fails: first by dropping ops, then
+// by simplifying each remaining op.
+func shrinkRangeOps(ops []rangeOp, fails func([]rangeOp) bool) []rangeOp {
+	for changed := true; changed; {
+		changed = false
+		for i := 0; i < len(ops); i++ {
+			try := append(append([]rangeOp(nil), ops[:i]...), ops[i+1:]...)
+			if fails(try) {
+				ops = try
+				changed = true
+				i--
+			}
+		}
+		for i := range ops {
+			for _, simpler := range simplerRangeOps(ops[i]) {
+				try := append([]rangeOp(nil), ops...)
+				try[i] = simpler
+				if fails(try) {
+					ops = try
+					changed = true
+					break
+				}
+			}
+		}
+	}
+	return ops
+}
+
+func simplerRangeOps(op rangeOp) (s []rangeOp) {
+	if op.length > modelBS {
+		o := op
+		o.length = modelBS
+		s = append(s, o)
+	}
+	if op.off%modelBS != 0 {
+		o := op
+		o.off -= op.off % modelBS
+		s = append(s, o)
+	}
+	if op.off >= modelBS {
+		o := op
+		o.off -= modelBS
+		s = append(s, o)
+	}
+	return
+}
+
+func formatRangeOps(ops []rangeOp) string {
+	var parts []string
+	for _, op := range ops {
+		parts = append(parts, op.String())
+	}
+	return strings.Join(parts, "\n\t")
+}
+
+func checkRangeOps(t *testing.T, ops []rangeOp) {
+	t.Helper()
+	dir := t.TempDir()
+	if err := runRangeOps(dir, ops); err != nil {
+		minimal := shrinkRangeOps(ops, func(try []rangeOp) bool {
+			return runRangeOps(dir, try) != nil
+		})
+		t.Fatalf("%v\nminimal reproducer (%v ops):\n\t%v\nfails with: %v",
+			err, len(minimal), formatRangeOps(minimal), runRangeOps(dir, minimal))
+	}
+}
+
+func TestRangeOpsMatchModel(t *testing.T) {
+	n := 200
+	if testing.Short() {
+		n = 20
+	}
+	for seed := range n {
+		rng := rand.New(rand.NewSource(int64(seed)))
+		b := make([]byte, 4*(1+rng.Intn(30)))
+		rng.Read(b)
+		checkRangeOps(t, decodeOps(b))
+	}
+}
+
+// go test -fuzz=FuzzRangeOps
+func FuzzRangeOps(f *testing.F) {
+	f.Add([]byte{0, 1, 2, 0xAB, 1, 1, 0, 0})            // write, punch
+	f.Add([]byte{0, 0, 7, 3, 3, 2, 1, 8, 4, 1, 1, 8})   // write, collapse, insert
+	f.Add([]byte{0, 5, 3, 1, 2, 70, 2, 1, 5, 40, 0, 0}) // write, zero, truncate
+	f.Add([]byte{0, 3, 1, 9, 3, 1, 1, 0, 4, 100, 1, 0}) // unaligned collapse, insert
+	f.Add([]byte{0, 1, 2, 5, 0, 31, 0xff, 7})           // write, empty write past EOF
+	f.Fuzz(func(t *testing.T, b []byte) {
+		checkRangeOps(t, decodeOps(b))
+	})
+}
@@ -0,0 +1,690 @@
+package sparsified
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"syscall"
+)
+
+// NBD, the network block device protocol
+// (https://github.com/NetworkBlockDevice/nbd/blob/master/doc/proto.md),
+// fixed newstyle handshake only. Everything on the wire is
+// big-endian.
+
+const (
+	nbdMagic      = 0x4e42444d41474943 // "NBDMAGIC"
+	nbdOptMagic   = 0x49484156454f5054 // "IHAVEOPT"
+	nbdRepMagic   = 0x0003e889045565a9
+	nbdReqMagic   = 0x25609513
+	nbdSimpleRep  = 0x67446698
+	nbdStructRep  = 0x668e33ef
+	nbdMaxOptData = 64 << 10
+	nbdMaxPayload = 32 << 20
+
+	// handshake flags, and client flags.
+	nbdFlagFixedNewstyle = 1 << 0
+	nbdFlagNoZeroes      = 1 << 1
+
+	// transmission flags.
+	nbdFlagHasFlags        = 1 << 0
+	nbdFlagReadOnly        = 1 << 1
+	nbdFlagSendFlush       = 1 << 2
+	nbdFlagSendFUA         = 1 << 3
+	nbdFlagSendTrim        = 1 << 5
+	nbdFlagSendWriteZeroes = 1 << 6
+
+	// options.
+	nbdOptExportName      = 1
+	nbdOptAbort           = 2
+	nbdOptList            = 3
+	nbdOptInfo            = 6
+	nbdOptGo              = 7
+	nbdOptStructuredReply = 8
+	nbdOptListMetaContext = 9
+	nbdOptSetMetaContext  = 10
+
+	// option replies.
+	nbdRepAck         = 1
+	nbdRepServer      = 2
+	nbdRepInfo        = 3
+	nbdRepMetaContext = 4
+	nbdRepErrUnsup    = 1<<31 + 1
+	nbdRepErrInvalid  = 1<<31 + 3
+	nbdRepErrUnknown  = 1<<31 + 6
+
+	nbdInfoExport    = 0
+	nbdInfoBlockSize = 3
+
+	// commands, and their flags.
+	nbdCmdRead        = 0
+	nbdCmdWrite       = 1
+	nbdCmdDisc        = 2
+	nbdCmdFlush       = 3
+	nbdCmdTrim        = 4
+	nbdCmdWriteZeroes = 6
+	nbdCmdBlockStatus = 7
+
+	nbdCmdFlagFUA    = 1 << 0
+	nbdCmdFlagNoHole = 1 << 1
+	nbdCmdFlagReqOne = 1 << 3
+
+	// structured reply chunks.
+	nbdReplyFlagDone       = 1 << 0
+	nbdReplyTypeNone       = 0
+	nbdReplyTypeOffsetData = 1
+	nbdReplyTypeOffsetHole = 2
+	nbdReplyTypeBlockStat  = 5
+	nbdReplyTypeError      = 1<<15 + 1
+
+	// the one metadata context: base:allocation, whose
+	// descriptors say hole (and so zero) or data.
+	nbdAllocContext = "base:allocation"
+	nbdAllocID      = 1
+	nbdStateHole    = 1 << 0
+	nbdStateZero    = 1 << 1
+)
+
+// nbdRequest is the header of a transmission request.
+type nbdRequest struct {
+	Magic  uint32
+	Flags  uint16
+	Type   uint16
+	Cookie uint64
+	Offset uint64
+	Length uint32
+}
+
+// NBDServer serves SparseFiles as network block devices, to
+// nbd-client, qemu and the like, keeping them sparse: TRIM
+// punches holes, WRITE_ZEROES punches them too unless the
+// client asks for allocated zeros, READ sends holes as hole
+// chunks when structured replies are on, and BLOCK_STATUS in
+// the base:allocation context reports holes from the extent
+// map. On Linux, data goes from an *OSFile to the socket with
+// sendfile(2).
+//
+// Each connection handles its requests one at a time, in
+// order. Export files before serving them.
+type NBDServer struct {
+	opts *Options
+
+	mu      sync.Mutex
+	exports map[string]*nbdExport
+}
+
+type nbdExport struct {
+	f        SparseFile
+	readOnly bool
+}
+
+// NewNBDServer returns a server with no exports. Only the
+// Logger and Trace of opts are used.
+func NewNBDServer(opts *Options) *NBDServer {
+	return &NBDServer{opts: opts, exports: map[string]*nbdExport{}}
+}
+
+// Export makes f available under name, which may be "", the
+// default export. The size of the device is the size of f
+// when the client connects.
+func (s *NBDServer) Export(name string, f SparseFile, readOnly bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.exports[name] = &nbdExport{f: withHooks(f, s.opts), readOnly: readOnly}
+}
+
+func (s *NBDServer) export(name string) *nbdExport {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.exports[name]
+}
+
+// Serve accepts connections on l and serves each on its own
+// goroutine, until ctx is done or Accept fails. It closes l,
+// and every connection, before it returns.
+func (s *NBDServer) Serve(ctx context.Context, l net.Listener) error {
+	return serveListener(ctx, l, "nbd", s.opts, s.ServeConn)
+}
+
+// ServeConn runs the handshake and then the requests of one
+// client on c, until the client disconnects or ctx is done.
+// It closes c. A clean disconnect returns nil.
+func (s *NBDServer) ServeConn(ctx context.Context, c net.Conn) error {
+	defer c.Close()
+	stop := context.AfterFunc(ctx, func() { c.Close() })
+	defer stop()
+	n := &nbdConn{s: s, conn: c, r: bufio.NewReader(c), w: bufio.NewWriter(c)}
+	err := n.handshake()
+	if err == nil && n.exp != nil {
+		err = n.transmit()
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if errors.Is(err, io.EOF) {
+		// the client went away between requests.
+		return nil
+	}
+	return err
+}
+
+type nbdConn struct {
+	s    *NBDServer
+	conn net.Conn
+	r    *bufio.Reader
+	w    *bufio.Writer
+
+	noZeroes   bool
+	structured bool
+	allocMeta  bool // base:allocation was set.
+
+	exp  *nbdExport
+	size int64
+}
+
+func (n *nbdConn) put(vs ...any) error {
+	for _, v := range vs {
+		if err := binary.Write(n.w, binary.BigEndian, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (n *nbdConn) get(vs ...any) error {
+	for _, v := range vs {
+		if err := binary.Read(n.r, binary.BigEndian, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// handshake negotiates options until the client picks an
+// export, with NBD_OPT_EXPORT_NAME or NBD_OPT_GO, or aborts,
+// leaving n.exp nil.
+func (n *nbdConn) handshake() error {
+	if err := n.put(uint64(nbdMagic), uint64(nbdOptMagic), uint16(nbdFlagFixedNewstyle|nbdFlagNoZeroes)); err != nil {
+		return err
+	}
+	if err := n.w.Flush(); err != nil {
+		return err
+	}
+	var cflags uint32
+	if err := n.get(&cflags); err != nil {
+		return err
+	}
+	if cflags&nbdFlagFixedNewstyle == 0 {
+		return fmt.Errorf("nbd: client does not do the fixed newstyle handshake (flags %#x)", cflags)
+	}
+	n.noZeroes = cflags&nbdFlagNoZeroes != 0
+	for {
+		var magic uint64
+		var opt, length uint32
+		if err := n.get(&magic, &opt, &length); err != nil {
+			return err
+		}
+		if magic != nbdOptMagic {
+			return fmt.Errorf("nbd: bad option magic %#x", magic)
+		}
+		if length > nbdMaxOptData {
+			return fmt.Errorf("nbd: option %v has %v bytes of data", opt, length)
+		}
+		data := make([]byte, length)
+		if _, err := io.ReadFull(n.r, data); err != nil {
+			return err
+		}
+		done, err := n.option(opt, data)
+		if err != nil {
+			return err
+		}
+		if err = n.w.Flush(); err != nil || done {
+			return err
+		}
+	}
+}
+
+// optReply sends one reply to option opt.
+func (n *nbdConn) optReply(opt, typ uint32, data ...[]byte) error {
+	length := 0
+	for _, d := range data {
+		length += len(d)
+	}
+	if err := n.put(uint64(nbdRepMagic), opt, typ, uint32(length)); err != nil {
+		return err
+	}
+	for _, d := range data {
+		if _, err := n.w.Write(d); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// option handles one option; done means the handshake is over.
+func (n *nbdConn) option(opt uint32, data []byte) (done bool, err error) {
+	switch opt {
+	case nbdOptExportName:
+		// no way to refuse but to hang up.
+		if err = n.pick(string(data)); err != nil {
+			return true, err
+		}
+		if err = n.put(uint64(n.size), n.flags()); err != nil {
+			return true, err
+		}
+		if !n.noZeroes {
+			_, err = n.w.Write(make([]byte, 124))
+		}
+		return true, err
+
+	case nbdOptAbort:
+		return true, n.optReply(opt, nbdRepAck)
+
+	case nbdOptList:
+		if len(data) != 0 {
+			return false, n.optReply(opt, nbdRepErrInvalid)
+		}
+		n.s.mu.Lock()
+		names := make([]string, 0, len(n.s.exports))
+		for name := range n.s.exports {
+			names = append(names, name)
+		}
+		n.s.mu.Unlock()
+		sort.Strings(names)
+		for _, name := range names {
+			if err = n.optReply(opt, nbdRepServer, binary.BigEndian.AppendUint32(nil, uint32(len(name))), []byte(name)); err != nil {
+				return false, err
+			}
+		}
+		return false, n.optReply(opt, nbdRepAck)
+
+	case nbdOptInfo, nbdOptGo:
+		name, ok := nbdString(&data)
+		if !ok || len(data) < 2 || len(data) != 2+2*int(binary.BigEndian.Uint16(data)) {
+			return false, n.optReply(opt, nbdRepErrInvalid)
+		}
+		exp := n.s.export(name)
+		if exp == nil {
+			return false, n.optReply(opt, nbdRepErrUnknown, []byte("no such export"))
+		}
+		size, err := sparseSize(exp.f)
+		if err != nil {
+			return false, n.optReply(opt, nbdRepErrInvalid, []byte(err.Error()))
+		}
+		n.exp, n.size = exp, size
+		info := binary.BigEndian.AppendUint16(nil, nbdInfoExport)
+		info = binary.BigEndian.AppendUint64(info, uint64(n.size))
+		info = binary.BigEndian.AppendUint16(info, n.flags())
+		bsz := binary.BigEndian.AppendUint16(nil, nbdInfoBlockSize)
+		for _, v := range []uint32{1, 4096, nbdMaxPayload} {
+			bsz = binary.BigEndian.AppendUint32(bsz, v)
+		}
+		if err = n.optReply(opt, nbdRepInfo, info); err != nil {
+			return false, err
+		}
+		if err = n.optReply(opt, nbdRepInfo, bsz); err != nil {
+			return false, err
+		}
+		if opt == nbdOptInfo {
+			n.exp = nil
+		}
+		return opt == nbdOptGo, n.optReply(opt, nbdRepAck)
+
+	case nbdOptStructuredReply:
+		if len(data) != 0 {
+			return false, n.optReply(opt, nbdRepErrInvalid)
+		}
+		n.structured = true
+		return false, n.optReply(opt, nbdRepAck)
+
+	case nbdOptListMetaContext, nbdOptSetMetaContext:
+		set := opt == nbdOptSetMetaContext
+		name, ok := nbdString(&data)
+		if !ok || len(data) < 4 {
+			return false, n.optReply(opt, nbdRepErrInvalid)
+		}
+		if set && !n.structured {
+			return false, n.optReply(opt, nbdRepErrInvalid, []byte("structured replies are needed first"))
+		}
+		if n.s.export(name) == nil {
+			return false, n.optReply(opt, nbdRepErrUnknown, []byte("no such export"))
+		}
+		nq := binary.BigEndian.Uint32(data)
+		data = data[4:]
+		match := !set && nq == 0 // listing everything.
+		for range nq {
+			q, ok := nbdString(&data)
+			if !ok {
+				return false, n.optReply(opt, nbdRepErrInvalid)
+			}
+			match = match || q == nbdAllocContext || (!set && q == "base:")
+		}
+		if len(data) != 0 {
+			return false, n.optReply(opt, nbdRepErrInvalid)
+		}
+		if set {
+			n.allocMeta = match
+		}
+		if match {
+			if err = n.optReply(opt, nbdRepMetaContext, binary.BigEndian.AppendUint32(nil, nbdAllocID), []byte(nbdAllocContext)); err != nil {
+				return false, err
+			}
+		}
+		return false, n.optReply(opt, nbdRepAck)
+	}
+	return false, n.optReply(opt, nbdRepErrUnsup)
+}
+
+// nbdString takes a 32-bit length and that many bytes off
+// the front of *data.
+func nbdString(data *[]byte) (s string, ok bool) {
+	d := *data
+	if len(d) < 4 || uint64(len(d)-4) < uint64(binary.BigEndian.Uint32(d)) {
+		return "", false
+	}
+	k := 4 + int(binary.BigEndian.Uint32(d))
+	*data = d[k:]
+	return string(d[4:k]), true
+}
+
+// pick selects the export name for transmission.
+func (n *nbdConn) pick(name string) (err error) {
+	exp := n.s.export(name)
+	if exp == nil {
+		return fmt.Errorf("nbd: no export named %q", name)
+	}
+	n.exp = exp
+	n.size, err = sparseSize(exp.f)
+	return err
+}
+
+func (n *nbdConn) flags() uint16 {
+	if n.exp.readOnly {
+		return nbdFlagHasFlags | nbdFlagReadOnly | nbdFlagSendFlush
+	}
+	return nbdFlagHasFlags | nbdFlagSendFlush | nbdFlagSendFUA | nbdFlagSendTrim | nbdFlagSendWriteZeroes
+}
+
+// transmit serves requests until NBD_CMD_DISC. Errors from
+// the file go back to the client; only errors on the
+// connection end it.
+func (n *nbdConn) transmit() error {
+	var buf []byte
+	for {
+		var req nbdRequest
+		if err := n.get(&req); err != nil {
+			return err
+		}
+		if req.Magic != nbdReqMagic {
+			return fmt.Errorf("nbd: bad request magic %#x", req.Magic)
+		}
+		if req.Type == nbdCmdDisc {
+			return n.exp.f.Sync()
+		}
+		if req.Type == nbdCmdWrite {
+			if req.Length > nbdMaxPayload {
+				// drop the payload and carry on.
+				if _, err := io.CopyN(io.Discard, n.r, int64(req.Length)); err != nil {
+					return err
+				}
+				if err := n.simpleReply(req.Cookie, syscall.EINVAL); err != nil {
+					return err
+				}
+				continue
+			}
+			if cap(buf) < int(req.Length) {
+				buf = make([]byte, req.Length)
+			}
+			buf = buf[:req.Length]
+			if _, err := io.ReadFull(n.r, buf); err != nil {
+				return err
+			}
+		}
+		if err := n.request(&req, buf); err != nil {
+			return err
+		}
+		if err := n.w.Flush(); err != nil {
+			return err
+		}
+	}
+}
+
+// request carries out one request and replies to it.
+func (n *nbdConn) request(req *nbdRequest, payload []byte) error {
+	f := n.exp.f
+	off, length := int64(req.Offset), int64(req.Length)
+	inBounds := req.Offset <= uint64(n.size) && off+length <= n.size
+	writes := req.Type == nbdCmdWrite || req.Type == nbdCmdTrim || req.Type == nbdCmdWriteZeroes
+	var err error
+	switch {
+	case writes && n.exp.readOnly:
+		err = syscall.EPERM
+	case writes && !inBounds:
+		err = syscall.ENOSPC
+	case !inBounds && req.Type != nbdCmdFlush:
+		err = syscall.EINVAL
+	}
+	if err != nil {
+		return n.errorReply(req, err)
+	}
+
+	switch req.Type {
+	case nbdCmdRead:
+		if length > nbdMaxPayload {
+			return n.errorReply(req, syscall.EINVAL)
+		}
+		return n.read(req, off, length)
+	case nbdCmdBlockStatus:
+		if !n.allocMeta {
+			return n.errorReply(req, syscall.EINVAL)
+		}
+		return n.blockStatus(req, off, length)
+	case nbdCmdWrite:
+		_, err = f.WriteAt(payload, off)
+	case nbdCmdFlush:
+		err = f.Sync()
+	case nbdCmdTrim:
+		if length > 0 {
+			// a trim is only advice.
+			if err = f.PunchHole(off, length); errors.Is(err, ErrNotSupported) {
+				err = nil
+			}
+		}
+	case nbdCmdWriteZeroes:
+		if length > 0 {
+			err = n.writeZeroes(off, length, req.Flags&nbdCmdFlagNoHole != 0)
+		}
+	default:
+		err = syscall.EINVAL
+	}
+	if err == nil && req.Flags&nbdCmdFlagFUA != 0 && writes {
+		err = f.Sync()
+	}
+	return n.errorReply(req, err)
+}
+
+// writeZeroes zeros a range: by punching it out, unless
+// noHole asks for the zeros to stay allocated; failing that
+// with FALLOC_FL_ZERO_RANGE; failing that, by writing them.
+func (n *nbdConn) writeZeroes(off, length int64, noHole bool) error {
+	f := n.exp.f
+	if !noHole && f.PunchHole(off, length) == nil {
+		return nil
+	}
+	if zr, ok := f.(ZeroRanger); ok && zr.ZeroRange(off, length) == nil {
+		return nil
+	}
+	for length > 0 {
+		k := min(length, int64(len(oneZeroBlock4k)))
+		if _, err := f.WriteAt(oneZeroBlock4k[:k], off); err != nil {
+			return err
+		}
+		off += k
+		length -= k
+	}
+	return nil
+}
+
+// read replies with [off, off+length). Data goes from the
+// file to the socket by sendRange, after its header; with
+// structured replies, holes go as hole chunks, and are not
+// read at all.
+func (n *nbdConn) read(req *nbdRequest, off, length int64) error {
+	f := n.exp.f
+	if !n.structured {
+		if err := n.simpleReply(req.Cookie, nil); err != nil {
+			return err
+		}
+		return n.send(off, length)
+	}
+	exts, err := rangeExtents(f, off, off+length)
+	if err != nil {
+		return n.errorReply(req, err)
+	}
+	if len(exts) == 0 {
+		return n.chunk(req.Cookie, nbdReplyTypeNone)
+	}
+	for i, e := range exts {
+		flags := uint16(0)
+		if i == len(exts)-1 {
+			flags = nbdReplyFlagDone
+		}
+		if e.Hole {
+			if err = n.chunkHeader(req.Cookie, flags, nbdReplyTypeOffsetHole, 12); err != nil {
+				return err
+			}
+			if err = n.put(uint64(e.Offset), uint32(e.Length)); err != nil {
+				return err
+			}
+			continue
+		}
+		if err = n.chunkHeader(req.Cookie, flags, nbdReplyTypeOffsetData, 8+uint32(e.Length)); err != nil {
+			return err
+		}
+		if err = n.put(uint64(e.Offset)); err != nil {
+			return err
+		}
+		if err = n.send(e.Offset, e.Length); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// send flushes what is buffered, then sends [off, off+length)
+// of the file. Having promised the client the bytes, failing
+// to send them all leaves the connection unusable.
+func (n *nbdConn) send(off, length int64) error {
+	if err := n.w.Flush(); err != nil {
+		return err
+	}
+	_, err := sendRange(n.conn, n.exp.f, off, length)
+	return err
+}
+
+// blockStatus replies with the extents of [off, off+length),
+// or just the first with NBD_CMD_FLAG_REQ_ONE.
+func (n *nbdConn) blockStatus(req *nbdRequest, off, length int64) error {
+	exts, err := rangeExtents(n.exp.f, off, off+length)
+	if err != nil {
+		return n.errorReply(req, err)
+	}
+	// a descriptor's length is 32 bits.
+	const maxDesc = 1<<32 - 4096
+	endx := off + length
+	desc := binary.BigEndian.AppendUint32(nil, nbdAllocID)
+	for _, e := range exts {
+		beg, end := max(e.Offset, off), min(e.End(), endx)
+		var state uint32
+		if e.Hole {
+			state = nbdStateHole | nbdStateZero
+		}
+		for ; beg < end; beg += min(end-beg, maxDesc) {
+			desc = binary.BigEndian.AppendUint32(desc, uint32(min(end-beg, maxDesc)))
+			desc = binary.BigEndian.AppendUint32(desc, state)
+			if req.Flags&nbdCmdFlagReqOne != 0 {
+				return n.chunk(req.Cookie, nbdReplyTypeBlockStat, desc)
+			}
+		}
+	}
+	return n.chunk(req.Cookie, nbdReplyTypeBlockStat, desc)
+}
+
+// chunk sends the one and only chunk of a structured reply.
+func (n *nbdConn) chunk(cookie uint64, typ uint16, payload ...[]byte) error {
+	length := 0
+	for _, p := range payload {
+		length += len(p)
+	}
+	if err := n.chunkHeader(cookie, nbdReplyFlagDone, typ, uint32(length)); err != nil {
+		return err
+	}
+	for _, p := range payload {
+		if _, err := n.w.Write(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (n *nbdConn) chunkHeader(cookie uint64, flags, typ uint16, length uint32) error {
+	return n.put(uint32(nbdStructRep), flags, typ, cookie, length)
+}
+
+func (n *nbdConn) simpleReply(cookie uint64, err error) error {
+	return n.put(uint32(nbdSimpleRep), nbdErrno(err), cookie)
+}
+
+// errorReply replies to req with err, which may be nil. A
+// READ or BLOCK_STATUS gets an error chunk when replies are
+// structured.
+func (n *nbdConn) errorReply(req *nbdRequest, err error) error {
+	if err != nil {
+		optHooks(n.s.opts).log.Debug("sparsified: nbd request failed", "type", req.Type,
+			"offset", req.Offset, "length", req.Length, "err", err)
+	}
+	if err == nil || !n.structured || (req.Type != nbdCmdRead && req.Type != nbdCmdBlockStatus) {
+		return n.simpleReply(req.Cookie, err)
+	}
+	msg := err.Error()
+	if len(msg) > 4096 {
+		msg = msg[:4096]
+	}
+	p := binary.BigEndian.AppendUint32(nil, nbdErrno(err))
+	p = binary.BigEndian.AppendUint16(p, uint16(len(msg)))
+	return n.chunk(req.Cookie, nbdReplyTypeError, p, []byte(msg))
+}
+
+// nbdErrno maps err onto the errors NBD has: the Linux
+// errnos EPERM, EIO, ENOMEM, EINVAL, ENOSPC, EOVERFLOW and
+// ENOTSUP, whatever the server's OS calls them.
+func nbdErrno(err error) uint32 {
+	if err == nil {
+		return 0
+	}
+	if errors.Is(err, ErrNotSupported) {
+		return 95
+	}
+	var errno syscall.Errno
+	if errors.As(err, &errno) {
+		switch errno {
+		case syscall.EPERM, syscall.EACCES, syscall.EROFS:
+			return 1
+		case syscall.ENOMEM:
+			return 12
+		case syscall.EINVAL:
+			return 22
+		case syscall.ENOSPC, syscall.EDQUOT:
+			return 28
+		case syscall.EOVERFLOW, syscall.EFBIG:
+			return 75
+		}
+	}
+	return 5
+}
@@ -0,0 +1,342 @@
+package sparsified
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// nbdClient is just enough of an NBD client to test with.
+type nbdClient struct {
+	t      *testing.T
+	c      net.Conn
+	r      *bufio.Reader
+	cookie uint64
+	size   int64
+	flags  uint16
+}
+
+type nbdChunk struct {
+	typ     uint16
+	payload []byte
+}
+
+func (c *nbdClient) put(vs ...any) {
+	for _, v := range vs {
+		panicOn(binary.Write(c.c, binary.BigEndian, v))
+	}
+}
+
+func (c *nbdClient) get(vs ...any) {
+	for _, v := range vs {
+		panicOn(binary.Read(c.r, binary.BigEndian, v))
+	}
+}
+
+// option sends an option and returns the replies to it, up
+// to the ACK or an error.
+func (c *nbdClient) option(opt uint32, data []byte) (reps []nbdChunk, errType uint32) {
+	c.put(uint64(nbdOptMagic), opt, uint32(len(data)))
+	_, err := c.c.Write(data)
+	panicOn(err)
+	for {
+		var magic uint64
+		var ropt, typ, length uint32
+		c.get(&magic, &ropt, &typ, &length)
+		if magic != nbdRepMagic || ropt != opt {
+			c.t.Fatalf("option %v: reply magic %#x for option %v", opt, magic, ropt)
+		}
+		p := make([]byte, length)
+		_, err = io.ReadFull(c.r, p)
+		panicOn(err)
+		switch {
+		case typ == nbdRepAck:
+			return reps, 0
+		case typ&(1<<31) != 0:
+			return reps, typ
+		}
+		reps = append(reps, nbdChunk{typ: uint16(typ), payload: p})
+	}
+}
+
+func nbdName(s string) []byte {
+	return append(binary.BigEndian.AppendUint32(nil, uint32(len(s))), s...)
+}
+
+// dialNBD connects to export name, asking for structured
+// replies and base:allocation if structured is set.
+func dialNBD(t *testing.T, network, addr, name string, structured bool) *nbdClient {
+	conn, err := net.Dial(network, addr)
+	panicOn(err)
+	t.Cleanup(func() { conn.Close() })
+	c := &nbdClient{t: t, c: conn, r: bufio.NewReader(conn)}
+	var magic, optMagic uint64
+	var hflags uint16
+	c.get(&magic, &optMagic, &hflags)
+	if magic != nbdMagic || optMagic != nbdOptMagic || hflags&nbdFlagFixedNewstyle == 0 {
+		t.Fatalf("greeting %#x %#x %#x", magic, optMagic, hflags)
+	}
+	c.put(uint32(nbdFlagFixedNewstyle | nbdFlagNoZeroes))
+	if structured {
+		if _, e := c.option(nbdOptStructuredReply, nil); e != 0 {
+			t.Fatalf("structured replies: %#x", e)
+		}
+		q := append(nbdName(name), binary.BigEndian.AppendUint32(nil, 1)...)
+		reps, e := c.option(nbdOptSetMetaContext, append(q, nbdName(nbdAllocContext)...))
+		if e != 0 || len(reps) != 1 || string(reps[0].payload[4:]) != nbdAllocContext {
+			t.Fatalf("set meta context: %#x %+v", e, reps)
+		}
+	}
+	reps, e := c.option(nbdOptGo, append(nbdName(name), 0, 0))
+	if e != 0 {
+		t.Fatalf("go: %#x", e)
+	}
+	for _, r := range reps {
+		if r.typ == nbdRepInfo && binary.BigEndian.Uint16(r.payload) == nbdInfoExport {
+			c.size = int64(binary.BigEndian.Uint64(r.payload[2:]))
+			c.flags = binary.BigEndian.Uint16(r.payload[10:])
+		}
+	}
+	return c
+}
+
+// cmd sends a request and returns the error of the reply,
+// and the read data or chunks.
+func (c *nbdClient) cmd(typ, flags uint16, off int64, length uint32, payload []byte) (errno uint32, data []byte, chunks []nbdChunk) {
+	c.cookie++
+	c.put(&nbdRequest{Magic: nbdReqMagic, Flags: flags, Type: typ, Cookie: c.cookie, Offset: uint64(off), Length: length})
+	_, err := c.c.Write(payload)
+	panicOn(err)
+	for {
+		var magic uint32
+		c.get(&magic)
+		switch magic {
+		case nbdSimpleRep:
+			var cookie uint64
+			c.get(&errno, &cookie)
+			if cookie != c.cookie {
+				c.t.Fatalf("cookie %v, want %v", cookie, c.cookie)
+			}
+			if typ == nbdCmdRead && errno == 0 {
+				data = make([]byte, length)
+				_, err = io.ReadFull(c.r, data)
+				panicOn(err)
+			}
+			return errno, data, nil
+		case nbdStructRep:
+			var rflags, rtyp uint16
+			var cookie uint64
+			var n uint32
+			c.get(&rflags, &rtyp, &cookie, &n)
+			p := make([]byte, n)
+			_, err = io.ReadFull(c.r, p)
+			panicOn(err)
+			if rtyp == nbdReplyTypeError {
+				errno = binary.BigEndian.Uint32(p)
+			}
+			chunks = append(chunks, nbdChunk{typ: rtyp, payload: p})
+			if rflags&nbdReplyFlagDone != 0 {
+				return errno, nil, chunks
+			}
+		default:
+			c.t.Fatalf("reply magic %#x", magic)
+		}
+	}
+}
+
+func TestNBD(t *testing.T) {
+	dir := t.TempDir()
+	sz, spans := testSpans()
+	fd := makeTestSparse(t, filepath.Join(dir, "disk.img"), sz, spans)
+	defer fd.Close()
+	f := NewOSFile(fd)
+	ro := NewMemSparseFile("ro", 4096)
+	panicOn(ro.Truncate(1 << 20))
+
+	srv := NewNBDServer(nil)
+	srv.Export("disk", f, false)
+	srv.Export("ro", ro, true)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	panicOn(err)
+	unix, err := net.Listen("unix", filepath.Join(dir, "nbd.sock"))
+	panicOn(err)
+	served := make(chan error, 2)
+	for _, l := range []net.Listener{tcp, unix} {
+		go func() { served <- srv.Serve(ctx, l) }()
+	}
+
+	c := dialNBD(t, "unix", unix.Addr().String(), "disk", true)
+	if c.size != sz || c.flags&nbdFlagSendTrim == 0 || c.flags&nbdFlagReadOnly != 0 {
+		t.Fatalf("size %v flags %#x", c.size, c.flags)
+	}
+
+	// write, and read it back as one data chunk.
+	p := make([]byte, 8192)
+	rand.New(rand.NewSource(6)).Read(p)
+	const at = 1 << 20
+	if e, _, _ := c.cmd(nbdCmdWrite, nbdCmdFlagFUA, at, 8192, p); e != 0 {
+		t.Fatalf("write: errno %v", e)
+	}
+	e, _, chunks := c.cmd(nbdCmdRead, 0, at, 8192, nil)
+	if e != 0 || len(chunks) != 1 || chunks[0].typ != nbdReplyTypeOffsetData || !bytes.Equal(chunks[0].payload[8:], p) {
+		t.Fatalf("read back: errno %v, %v chunks", e, len(chunks))
+	}
+
+	// TRIM and WRITE_ZEROES punch holes; NO_HOLE zeros do not.
+	if e, _, _ = c.cmd(nbdCmdTrim, 0, at, 4096, nil); e != 0 {
+		t.Fatalf("trim: errno %v", e)
+	}
+	if e, _, _ = c.cmd(nbdCmdWriteZeroes, 0, at+4096, 4096, nil); e != 0 {
+		t.Fatalf("write zeroes: errno %v", e)
+	}
+	before, _ := storageOf(f)
+	if e, _, _ = c.cmd(nbdCmdWriteZeroes, nbdCmdFlagNoHole, 0, 4096, nil); e != 0 {
+		t.Fatalf("write zeroes, no hole: errno %v", e)
+	}
+	if after, _ := storageOf(f); after < before {
+		t.Fatalf("NO_HOLE zeros were punched: %v bytes before, %v after", before, after)
+	}
+	data, err := DataExtents(fd)
+	panicOn(err)
+	for _, d := range data {
+		if d.Offset < at+8192 && at < d.End() {
+			t.Fatalf("trimmed range is data: %+v", data)
+		}
+	}
+	e, _, chunks = c.cmd(nbdCmdRead, 0, at, 8192, nil)
+	if e != 0 || len(chunks) != 1 || chunks[0].typ != nbdReplyTypeOffsetHole {
+		t.Fatalf("read of a hole: errno %v, chunks %+v", e, chunks)
+	}
+
+	// a read across a hole into data: a hole chunk, then the
+	// data, sent from the file.
+	e, _, chunks = c.cmd(nbdCmdRead, 0, 3<<20-8192, 16384, nil)
+	want := make([]byte, 16384)
+	_, err = fd.ReadAt(want, 3<<20-8192)
+	panicOn(err)
+	if e != 0 || len(chunks) != 2 || chunks[0].typ != nbdReplyTypeOffsetHole || chunks[1].typ != nbdReplyTypeOffsetData {
+		t.Fatalf("read across a hole: errno %v, chunks %+v", e, chunks)
+	}
+	hole := binary.BigEndian.Uint32(chunks[0].payload[8:])
+	if !isZero(want[:hole]) || !bytes.Equal(chunks[1].payload[8:], want[hole:]) ||
+		binary.BigEndian.Uint64(chunks[1].payload) != uint64(3<<20-8192)+uint64(hole) {
+		t.Fatalf("read across a hole: %v hole bytes, then the wrong data", hole)
+	}
+
+	// block status is the extent map.
+	exts, err := f.Extents()
+	panicOn(err)
+	e, _, chunks = c.cmd(nbdCmdBlockStatus, 0, 0, uint32(sz), nil)
+	if e != 0 || len(chunks) != 1 || chunks[0].typ != nbdReplyTypeBlockStat {
+		t.Fatalf("block status: errno %v, chunks %+v", e, chunks)
+	}
+	desc := chunks[0].payload[4:]
+	if len(desc) != 8*len(exts) {
+		t.Fatalf("%v descriptors for extents %+v", len(desc)/8, exts)
+	}
+	for i, x := range exts {
+		n, state := binary.BigEndian.Uint32(desc[8*i:]), binary.BigEndian.Uint32(desc[8*i+4:])
+		if int64(n) != x.Length || (state&nbdStateHole != 0) != x.Hole {
+			t.Fatalf("descriptor %v is %v/%v, extent %+v", i, n, state, x)
+		}
+	}
+	_, _, chunks = c.cmd(nbdCmdBlockStatus, nbdCmdFlagReqOne, 0, uint32(sz), nil)
+	if len(chunks[0].payload) != 12 {
+		t.Fatalf("REQ_ONE gave %v descriptors", (len(chunks[0].payload)-4)/8)
+	}
+
+	// out of bounds, then a flush; the connection lives on.
+	if e, _, _ = c.cmd(nbdCmdRead, 0, sz-10, 20, nil); e != 22 {
+		t.Fatalf("read past the end: errno %v", e)
+	}
+	if e, _, _ = c.cmd(nbdCmdWrite, 0, sz, 1, []byte{1}); e != 28 {
+		t.Fatalf("write past the end: errno %v", e)
+	}
+	if e, _, _ = c.cmd(nbdCmdFlush, 0, 0, 0, nil); e != 0 {
+		t.Fatalf("flush: errno %v", e)
+	}
+
+	// over TCP, simple replies, a read-only export.
+	r := dialNBD(t, "tcp", tcp.Addr().String(), "ro", false)
+	if r.size != 1<<20 || r.flags&nbdFlagReadOnly == 0 {
+		t.Fatalf("read-only size %v flags %#x", r.size, r.flags)
+	}
+	if e, _, _ = r.cmd(nbdCmdWrite, 0, 0, 1, []byte{1}); e != 1 {
+		t.Fatalf("write to read-only: errno %v", e)
+	}
+	if e, _, _ = r.cmd(nbdCmdBlockStatus, 0, 0, 4096, nil); e != 22 {
+		t.Fatalf("block status without the context: errno %v", e)
+	}
+	e, got, _ := r.cmd(nbdCmdRead, 0, 4096, 4096, nil)
+	if e != 0 || len(got) != 4096 || !isZero(got) {
+		t.Fatalf("simple read: errno %v, %v bytes", e, len(got))
+	}
+	if reps, e := dialNBDOptions(t, tcp.Addr().String(), nbdOptList); e != 0 || len(reps) != 2 {
+		t.Fatalf("list: %#x %+v", e, reps)
+	}
+
+	r.put(&nbdRequest{Magic: nbdReqMagic, Type: nbdCmdDisc})
+	if _, err = r.r.ReadByte(); err != io.EOF {
+		t.Fatalf("after disconnect: %v", err)
+	}
+	cancel()
+	for range 2 {
+		if err = <-served; !errors.Is(err, context.Canceled) {
+			t.Fatalf("serve: %v", err)
+		}
+	}
+	if _, err = os.Stat(filepath.Join(dir, "nbd.sock")); err == nil {
+		t.Fatalf("unix socket left behind")
+	}
+}
+
+// dialNBDOptions connects and sends one option, no export.
+func dialNBDOptions(t *testing.T, addr string, opt uint32) ([]nbdChunk, uint32) {
+	conn, err := net.Dial("tcp", addr)
+	panicOn(err)
+	defer conn.Close()
+	c := &nbdClient{t: t, c: conn, r: bufio.NewReader(conn)}
+	var greeting [18]byte
+	_, err = io.ReadFull(c.r, greeting[:])
+	panicOn(err)
+	c.put(uint32(nbdFlagFixedNewstyle))
+	reps, e := c.option(opt, nil)
+	c.option(nbdOptAbort, nil)
+	return reps, e
+}
+
+// closing the listener under Serve hangs up on idle clients
+// too, rather than waiting for them.
+func TestNBDListenerClosed(t *testing.T) {
+	srv := NewNBDServer(nil)
+	srv.Export("", NewMemSparseFile("disk", 4096), false)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	panicOn(err)
+	served := make(chan error, 1)
+	go func() { served <- srv.Serve(context.Background(), l) }()
+
+	c := dialNBD(t, "tcp", l.Addr().String(), "", false)
+	l.Close()
+	select {
+	case err = <-served:
+		if err == nil {
+			t.Fatalf("serve returned nil after its listener was closed")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("serve still waiting on an idle client")
+	}
+	if _, err = c.r.ReadByte(); err != io.EOF {
+		t.Fatalf("idle client not hung up on: %v", err)
+	}
+}
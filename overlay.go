@@ -0,0 +1,509 @@
+package sparsified
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// Copy-on-write overlays.
+//
+// An Overlay is a read-only base file seen through a
+// writable delta. Each block is in one of three states,
+// kept two bits a block in a metadata file:
+//
+//	0            ovlHeader, in a 4KB block of its own
+//	4096 + i/4   the state of block i, in bits 2*(i%4) and up
+//
+// The state says where block i reads from: the base (the
+// zero value, so that a new overlay is all base), the same
+// block of the delta, or nowhere, as zeros. The delta is a
+// sparse file of the overlay's size with holes wherever the
+// overlay is not in the delta state.
+
+const (
+	ovlMagic     = "SPRSOVL1"
+	ovlVersion   = 1
+	ovlHeaderLen = 4096
+
+	ovlBase  = 0
+	ovlDelta = 1
+	ovlZero  = 2
+)
+
+// ErrBaseChanged is returned by OpenOverlay when the base
+// file is not the one the overlay was made on.
+var ErrBaseChanged = fmt.Errorf("the base file of the overlay has changed.")
+
+type ovlHeader struct {
+	Magic     [8]byte
+	Version   uint32
+	BlockSize uint32
+	Size      uint64
+
+	// Base reads as zeros from BaseLimit on: the overlay may
+	// have been truncated below the base size, then grown.
+	BaseLimit uint64
+
+	// BaseSize and BaseModTime identify the base.
+	BaseSize    uint64
+	BaseModTime int64
+}
+
+// Overlay is a SparseFile combining a read-only base with a
+// writable delta, as a copy-on-write disk image does. Reads
+// fall through to the base wherever the overlay has not been
+// written; writes go to the delta, copying up the rest of any
+// block they only partly cover; punched blocks, and blocks
+// written with zeros, are marked to read as zeros, without
+// touching either file. It is safe for concurrent use by
+// writers of different blocks.
+//
+// The block states are all kept in memory, 2 bits a block:
+// 64MB for a 1TB overlay of 4KB blocks. CollapseRange and
+// InsertRange return an error matching ErrNotSupported.
+type Overlay struct {
+	base, delta, meta SparseFile
+	bs                int64
+
+	mu     sync.Mutex
+	hdr    ovlHeader
+	states []byte
+}
+
+var _ SparseFile = &Overlay{}
+
+// NewOverlay starts a new overlay on base, the same size as
+// base and reading the same, truncating delta and meta.
+// blockSize is the unit of copy-up: a power of two from 512
+// bytes to 1MB, and 0 means 4096.
+func NewOverlay(base, delta, meta SparseFile, blockSize int64) (o *Overlay, err error) {
+	defer func() { err = opError("overlay", meta.Name(), 0, 0, err) }()
+	if blockSize == 0 {
+		blockSize = 4096
+	}
+	if blockSize < 512 || blockSize > copyChunk || blockSize&(blockSize-1) != 0 {
+		return nil, fmt.Errorf("NewOverlay: block size %v is not a power of two from 512 to %v", blockSize, copyChunk)
+	}
+	fi, err := base.Stat()
+	if err != nil {
+		return nil, err
+	}
+	o = &Overlay{base: base, delta: delta, meta: meta, bs: blockSize}
+	o.hdr = ovlHeader{
+		Version:     ovlVersion,
+		BlockSize:   uint32(blockSize),
+		Size:        uint64(fi.Size()),
+		BaseLimit:   uint64(fi.Size()),
+		BaseSize:    uint64(fi.Size()),
+		BaseModTime: fi.ModTime().UnixNano(),
+	}
+	copy(o.hdr.Magic[:], ovlMagic)
+	o.states = make([]byte, ceilDiv(o.nblocks(fi.Size()), 4))
+	for _, f := range []SparseFile{delta, meta} {
+		if err = f.Truncate(0); err != nil {
+			return nil, err
+		}
+	}
+	if err = delta.Truncate(fi.Size()); err != nil {
+		return nil, err
+	}
+	if err = meta.Truncate(ovlHeaderLen + int64(len(o.states))); err != nil {
+		return nil, err
+	}
+	return o, o.writeHeader()
+}
+
+// OpenOverlay reopens the overlay kept in delta and meta, on
+// base. It fails with ErrBaseChanged if base has a different
+// size or modification time from when the overlay was made.
+func OpenOverlay(base, delta, meta SparseFile) (o *Overlay, err error) {
+	defer func() { err = opError("overlay", meta.Name(), 0, 0, err) }()
+	o = &Overlay{base: base, delta: delta, meta: meta}
+	if err = readLE(meta, 0, &o.hdr); err != nil {
+		return nil, fmt.Errorf("OpenOverlay: reading header: %w", err)
+	}
+	if string(o.hdr.Magic[:]) != ovlMagic {
+		return nil, fmt.Errorf("OpenOverlay: not an overlay (magic %q)", o.hdr.Magic[:])
+	}
+	if o.hdr.Version != ovlVersion {
+		return nil, fmt.Errorf("OpenOverlay: version %v is not supported", o.hdr.Version)
+	}
+	o.bs = int64(o.hdr.BlockSize)
+	if o.bs < 512 || o.bs > copyChunk || o.bs&(o.bs-1) != 0 {
+		return nil, fmt.Errorf("OpenOverlay: corrupt header: block size %v", o.bs)
+	}
+	fi, err := base.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if fi.Size() != int64(o.hdr.BaseSize) || fi.ModTime().UnixNano() != o.hdr.BaseModTime {
+		return nil, ErrBaseChanged
+	}
+	o.states = make([]byte, ceilDiv(o.nblocks(int64(o.hdr.Size)), 4))
+	if _, err = meta.ReadAt(o.states, ovlHeaderLen); err != nil && err != io.EOF {
+		return nil, fmt.Errorf("OpenOverlay: reading block states: %w", err)
+	}
+	return o, nil
+}
+
+func (o *Overlay) nblocks(size int64) int64 {
+	return ceilDiv(size, o.bs)
+}
+
+func (o *Overlay) writeHeader() error {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, &o.hdr)
+	_, err := o.meta.WriteAt(buf.Bytes(), 0)
+	return err
+}
+
+// state returns the state of block i. The caller holds o.mu.
+func (o *Overlay) state(i int64) int {
+	if i/4 >= int64(len(o.states)) {
+		return ovlBase
+	}
+	return int(o.states[i/4]>>(2*(i%4))) & 3
+}
+
+// setStates sets blocks [beg, end) to state s, in memory and
+// in meta. The caller holds o.mu.
+func (o *Overlay) setStates(beg, end int64, s int) error {
+	if beg >= end {
+		return nil
+	}
+	for i := beg; i < end; i++ {
+		sh := 2 * (i % 4)
+		o.states[i/4] = o.states[i/4]&^(3<<sh) | byte(s)<<sh
+	}
+	_, err := o.meta.WriteAt(o.states[beg/4:(end-1)/4+1], ovlHeaderLen+beg/4)
+	return err
+}
+
+// Size returns the size of the overlay.
+func (o *Overlay) Size() int64 {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return int64(o.hdr.Size)
+}
+
+// Name returns the name of the delta.
+func (o *Overlay) Name() string {
+	return o.delta.Name()
+}
+
+// readBlock reads the n bytes of block i into p.
+func (o *Overlay) readBlock(i int64, p []byte) error {
+	o.mu.Lock()
+	s, limit := o.state(i), int64(o.hdr.BaseLimit)
+	o.mu.Unlock()
+	off := i * o.bs
+	var from io.ReaderAt
+	switch s {
+	case ovlDelta:
+		from = o.delta
+	case ovlBase:
+		if off < limit {
+			from = o.base
+			p = p[:min(int64(len(p)), limit-off)]
+		}
+	}
+	m := 0
+	if from != nil {
+		var err error
+		if m, err = from.ReadAt(p, off); err != nil && err != io.EOF {
+			return err
+		}
+	}
+	clear(p[m:])
+	return nil
+}
+
+// ReadAt reads from wherever each block is.
+func (o *Overlay) ReadAt(p []byte, off int64) (n int, err error) {
+	if off < 0 {
+		return 0, opError("readat", o.Name(), off, int64(len(p)), os.ErrInvalid)
+	}
+	endx := min(off+int64(len(p)), o.Size())
+	blk := make([]byte, o.bs)
+	for off < endx {
+		i, bo := off/o.bs, off%o.bs
+		k := min(o.bs-bo, endx-off)
+		if bo == 0 && k == o.bs {
+			err = o.readBlock(i, p[n:n+int(k)])
+		} else {
+			err = o.readBlock(i, blk[:bo+k])
+			copy(p[n:], blk[bo:bo+k])
+		}
+		if err != nil {
+			return n, err
+		}
+		n += int(k)
+		off += k
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// WriteAt writes p to the delta. A block written with zeros
+// is marked as such instead.
+func (o *Overlay) WriteAt(p []byte, off int64) (n int, err error) {
+	if off < 0 {
+		return 0, opError("writeat", o.Name(), off, int64(len(p)), os.ErrInvalid)
+	}
+	endx := off + int64(len(p))
+	if err = o.grow(endx); err != nil {
+		return 0, err
+	}
+	blk := make([]byte, o.bs)
+	for off < endx {
+		i, bo := off/o.bs, off%o.bs
+		k := min(o.bs-bo, endx-off)
+		b := p[n : n+int(k)]
+		if bo != 0 || k != o.bs {
+			// copy up the rest of the block.
+			if err = o.readBlock(i, blk); err != nil {
+				return n, err
+			}
+			copy(blk[bo:], b)
+			b = blk
+		}
+		if err = o.putBlock(i, b); err != nil {
+			return n, err
+		}
+		n += int(k)
+		off += k
+	}
+	return n, nil
+}
+
+// putBlock writes the whole of block i, clipped to the size.
+func (o *Overlay) putBlock(i int64, b []byte) error {
+	off := i * o.bs
+	b = b[:max(min(int64(len(b)), o.Size()-off), 0)]
+	if isZero(b) {
+		return o.zeroBlocks(i, i+1)
+	}
+	// data first: a crash before the state is written
+	// leaves the block as it was.
+	if _, err := o.delta.WriteAt(b, off); err != nil {
+		return err
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.setStates(i, i+1, ovlDelta)
+}
+
+// zeroBlocks marks blocks [beg, end) as zeros, and frees any
+// delta they had.
+func (o *Overlay) zeroBlocks(beg, end int64) error {
+	o.mu.Lock()
+	err := o.setStates(beg, end, ovlZero)
+	size := int64(o.hdr.Size)
+	o.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if off, endx := beg*o.bs, min(end*o.bs, size); off < endx {
+		if perr := o.delta.PunchHole(off, endx-off); perr != nil {
+			// harmless: the blocks no longer read from the delta.
+			optHooks(nil).log.Debug("sparsified: overlay punch failed", "path", o.Name(), "err", perr)
+		}
+	}
+	return nil
+}
+
+// grow extends the overlay to at least size.
+func (o *Overlay) grow(size int64) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if size <= int64(o.hdr.Size) {
+		return nil
+	}
+	return o.setSize(size)
+}
+
+// setSize records size, and sizes delta and meta to match.
+// The caller holds o.mu.
+func (o *Overlay) setSize(size int64) error {
+	nstates := ceilDiv(o.nblocks(size), 4)
+	if nstates < int64(len(o.states)) {
+		o.states = o.states[:nstates]
+	} else {
+		o.states = append(o.states, make([]byte, nstates-int64(len(o.states)))...)
+	}
+	// bits of blocks past the end go back to 0, the base,
+	// which reads zeros from BaseLimit on.
+	if rem := o.nblocks(size) % 4; rem != 0 {
+		o.states[nstates-1] &= byte(1)<<(2*rem) - 1
+	}
+	o.hdr.Size = uint64(size)
+	o.hdr.BaseLimit = min(o.hdr.BaseLimit, uint64(size))
+	if err := o.delta.Truncate(size); err != nil {
+		return err
+	}
+	if err := o.meta.Truncate(ovlHeaderLen + nstates); err != nil {
+		return err
+	}
+	if nstates > 0 {
+		if _, err := o.meta.WriteAt(o.states[nstates-1:], ovlHeaderLen+nstates-1); err != nil {
+			return err
+		}
+	}
+	return o.writeHeader()
+}
+
+// Truncate changes the size of the overlay. Shrinking into
+// a block copies it up, so that growing again reads zeros
+// past the old end.
+func (o *Overlay) Truncate(size int64) (err error) {
+	defer func() { err = opError("truncate", o.Name(), size, 0, err) }()
+	if size < 0 {
+		return os.ErrInvalid
+	}
+	if size < o.Size() && size%o.bs != 0 {
+		i := size / o.bs
+		blk := make([]byte, o.bs)
+		if err = o.readBlock(i, blk); err != nil {
+			return err
+		}
+		clear(blk[size%o.bs:])
+		if err = o.putBlock(i, blk); err != nil {
+			return err
+		}
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.setSize(size)
+}
+
+// PunchHole marks the whole blocks in the range as zeros,
+// and writes zeros over the rest.
+func (o *Overlay) PunchHole(off, length int64) (err error) {
+	defer func() { err = opError("punchhole", o.Name(), off, length, err) }()
+	if off < 0 || length <= 0 {
+		return os.ErrInvalid
+	}
+	size := o.Size()
+	endx := min(off+length, size)
+	first, last := ceilDiv(off, o.bs), endx/o.bs
+	if endx == size {
+		last = o.nblocks(size)
+	}
+	zeroOut := func(beg, end int64) error {
+		for beg < end {
+			n := min(end-beg, int64(len(oneZeroBlock4k)))
+			if _, err := o.WriteAt(oneZeroBlock4k[:n], beg); err != nil {
+				return err
+			}
+			beg += n
+		}
+		return nil
+	}
+	if first >= last {
+		return zeroOut(off, endx)
+	}
+	if err = zeroOut(off, first*o.bs); err != nil {
+		return err
+	}
+	if err = o.zeroBlocks(first, last); err != nil {
+		return err
+	}
+	return zeroOut(min(last*o.bs, endx), endx)
+}
+
+// Extents returns the hole map of the overlay: that of the
+// base where it shows through, data where the delta is used,
+// and holes where blocks were zeroed.
+func (o *Overlay) Extents() (exts []Extent, err error) {
+	bexts, err := o.base.Extents()
+	if err != nil {
+		return nil, err
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	size, limit := int64(o.hdr.Size), int64(o.hdr.BaseLimit)
+	add := func(beg, end int64, hole bool) {
+		if beg >= end {
+			return
+		}
+		if k := len(exts) - 1; k >= 0 && exts[k].Hole == hole && exts[k].End() == beg {
+			exts[k].Length = end - exts[k].Offset
+			return
+		}
+		exts = append(exts, Extent{Offset: beg, Length: end - beg, Hole: hole})
+	}
+	nb, bx := o.nblocks(size), 0
+	for i := int64(0); i < nb; {
+		// a run of blocks in one state; whole bytes of base
+		// blocks at a time.
+		s, j := o.state(i), i+1
+		if i%4 == 0 && o.states[i/4] == 0 {
+			for j = i + 4; j < nb && o.states[j/4] == 0; j += 4 {
+			}
+		}
+		for ; j < nb && o.state(j) == s; j++ {
+		}
+		beg, end := i*o.bs, min(j*o.bs, size)
+		switch s {
+		case ovlDelta:
+			add(beg, end, false)
+		case ovlZero:
+			add(beg, end, true)
+		default:
+			for ; bx < len(bexts) && bexts[bx].End() <= beg; bx++ {
+			}
+			off, bend := beg, max(min(end, limit), beg)
+			for k := bx; k < len(bexts) && bexts[k].Offset < bend; k++ {
+				e := bexts[k]
+				add(off, min(e.End(), bend), e.Hole)
+				off = min(e.End(), bend)
+			}
+			add(off, end, true)
+		}
+		i = j
+	}
+	return exts, nil
+}
+
+func (o *Overlay) CollapseRange(off, length int64) error {
+	return opError("collapserange", o.Name(), off, length, ErrNotSupported)
+}
+
+func (o *Overlay) InsertRange(off, length int64) error {
+	return opError("insertrange", o.Name(), off, length, ErrNotSupported)
+}
+
+// Sync syncs the delta, then the block states, so that no
+// state points at delta data that is not on disk.
+func (o *Overlay) Sync() error {
+	if err := o.delta.Sync(); err != nil {
+		return err
+	}
+	return o.meta.Sync()
+}
+
+// Stat returns the FileInfo of the delta, but with the size
+// of the overlay.
+func (o *Overlay) Stat() (os.FileInfo, error) {
+	fi, err := o.delta.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return &sizedFileInfo{FileInfo: fi, size: o.Size()}, nil
+}
+
+// Commit writes the overlay, base and delta merged, to dst
+// as a new base, keeping the holes: it is Copy from the
+// overlay. The overlay itself is left as it is.
+func (o *Overlay) Commit(ctx context.Context, dst SparseFile, opts *Options) (err error) {
+	defer func() { err = opError("commit", dst.Name(), 0, 0, err) }()
+	_, err = Copy(ctx, dst, o, opts)
+	return err
+}
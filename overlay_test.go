@@ -0,0 +1,166 @@
+package sparsified
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestOverlay(t *testing.T) {
+	dir := t.TempDir()
+	sz, spans := testSpans()
+	base := makeTestSparse(t, filepath.Join(dir, "golden.img"), sz, spans)
+	defer base.Close()
+	open := func(name string) SparseFile {
+		fd, err := os.OpenFile(filepath.Join(dir, name), os.O_RDWR|os.O_CREATE, 0644)
+		panicOn(err)
+		t.Cleanup(func() { fd.Close() })
+		return NewOSFile(fd)
+	}
+	delta, meta := open("vm1.delta"), open("vm1.meta")
+	o, err := NewOverlay(NewOSFile(base), delta, meta, 0)
+	panicOn(err)
+
+	// a fresh overlay reads as the base, holes and all.
+	want := readAll(t, NewOSFile(base))
+	if !bytes.Equal(readAll(t, o), want) {
+		t.Fatalf("fresh overlay does not read as the base")
+	}
+	bexts, err := Extents(base)
+	panicOn(err)
+	exts, err := o.Extents()
+	panicOn(err)
+	if len(exts) != len(bexts) {
+		t.Fatalf("fresh overlay extents %+v, want %+v", exts, bexts)
+	}
+
+	// a partial write copies up its block; a punch over base
+	// data zeros it; the base is untouched.
+	_, err = o.WriteAt([]byte("hello"), 3<<20+10)
+	panicOn(err)
+	copy(want[3<<20+10:], "hello")
+	panicOn(o.PunchHole(0, 4096))
+	clear(want[:4096])
+	panicOn(o.PunchHole(8<<20+100, 200))
+	clear(want[8<<20+100 : 8<<20+300])
+	if !bytes.Equal(readAll(t, o), want) {
+		t.Fatalf("overlay content after writes")
+	}
+	if ddata, _ := DataExtents(delta.(*OSFile).File); dataBytes(ddata) > 2*4096 {
+		t.Fatalf("delta holds %v bytes, want the two copied-up blocks", dataBytes(ddata))
+	}
+	if bytes.Equal(readAll(t, NewOSFile(base)), want) {
+		t.Fatalf("base was written")
+	}
+	exts, err = o.Extents()
+	panicOn(err)
+	for _, e := range exts {
+		if !e.Hole && e.Offset < 4096 {
+			t.Fatalf("punched block is data: %+v", exts)
+		}
+	}
+
+	// reopen.
+	panicOn(o.Sync())
+	o, err = OpenOverlay(NewOSFile(base), delta, meta)
+	panicOn(err)
+	if !bytes.Equal(readAll(t, o), want) {
+		t.Fatalf("reopened overlay content")
+	}
+
+	// commit to a new base, keeping the holes.
+	out, err := os.Create(filepath.Join(dir, "golden2.img"))
+	panicOn(err)
+	defer out.Close()
+	panicOn(o.Commit(context.Background(), NewOSFile(out), nil))
+	if !bytes.Equal(readAll(t, NewOSFile(out)), want) {
+		t.Fatalf("committed content")
+	}
+	odata, err := DataExtents(out)
+	panicOn(err)
+	if dataBytes(odata) >= dataBytes(bexts) {
+		t.Fatalf("commit has %v bytes of data, base %v", dataBytes(odata), dataBytes(bexts))
+	}
+
+	// a changed base is refused.
+	_, err = base.WriteAt([]byte("x"), sz)
+	panicOn(err)
+	if _, err = OpenOverlay(NewOSFile(base), delta, meta); !errors.Is(err, ErrBaseChanged) {
+		t.Fatalf("open on a changed base: %v", err)
+	}
+}
+
+// TestOverlayModel checks unaligned writes, punches and
+// truncates against a MemSparseFile doing the same.
+func TestOverlayModel(t *testing.T) {
+	rng := rand.New(rand.NewSource(5))
+	model := NewMemSparseFile("model", 4096)
+	base := NewMemSparseFile("base", 4096)
+	for _, off := range []int64{0, 20 << 10, 50<<10 + 7} {
+		p := make([]byte, 9000)
+		rng.Read(p)
+		_, err := base.WriteAt(p, off)
+		panicOn(err)
+		_, err = model.WriteAt(p, off)
+		panicOn(err)
+	}
+	delta, meta := NewMemSparseFile("delta", 4096), NewMemSparseFile("meta", 4096)
+	o, err := NewOverlay(base, delta, meta, 1024)
+	panicOn(err)
+	for step := range 300 {
+		off := rng.Int63n(64 << 10)
+		n := rng.Int63n(10000) + 1
+		switch rng.Intn(4) {
+		case 0, 1:
+			p := make([]byte, n)
+			rng.Read(p)
+			if rng.Intn(3) == 0 {
+				clear(p)
+			}
+			_, err = model.WriteAt(p, off)
+			panicOn(err)
+			_, err = o.WriteAt(p, off)
+			panicOn(err)
+		case 2:
+			if off < model.Size() {
+				panicOn(model.PunchHole(off, n))
+				panicOn(o.PunchHole(off, n))
+			}
+		case 3:
+			panicOn(model.Truncate(off))
+			panicOn(o.Truncate(off))
+		}
+		if o.Size() != model.Size() {
+			t.Fatalf("step %v: size %v, want %v", step, o.Size(), model.Size())
+		}
+		got := readAll(t, o)
+		if !bytes.Equal(got, readAll(t, model)) {
+			t.Fatalf("step %v: content differs", step)
+		}
+		// the extents cover the file, and holes read zeros.
+		exts, err := o.Extents()
+		panicOn(err)
+		var at int64
+		for _, e := range exts {
+			if e.Offset != at {
+				t.Fatalf("step %v: extents %+v do not tile", step, exts)
+			}
+			if e.Hole && !isZero(got[e.Offset:e.End()]) {
+				t.Fatalf("step %v: hole %+v has data", step, e)
+			}
+			at = e.End()
+		}
+		if at != o.Size() {
+			t.Fatalf("step %v: extents end at %v, size %v", step, at, o.Size())
+		}
+		if step%50 == 0 {
+			if o, err = OpenOverlay(base, delta, meta); err != nil {
+				t.Fatalf("step %v: reopen: %v", step, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package sparsified
+
+import (
+	"os"
+	"syscall"
+)
+
+// Preallocate reserves storage for [off, off+length) of fd,
+// as fallocate(2) does. With keepSize the file size is left
+// alone, even if the range goes past EOF (FALLOC_FL_KEEP_SIZE);
+// otherwise the file grows to cover the range. Both modes
+// work the same on Linux and Darwin; see osPreallocate.
+//
+// Filesystems may allocate less than asked without saying
+// so, so rather than trusting the syscall Preallocate
+// measures: allocated is how many bytes of the range have
+// storage behind them afterwards (blocks that already had
+// some count too). That is exact where FIEMAP works, and
+// otherwise estimated from the change in st_blocks. If it
+// is less than length, the error matches ErrShortAlloc; if
+// the syscall failed outright, ENOSPC (which matches it too)
+// or EFBIG (ErrFileTooLarge) say, that errno is returned,
+// along with what did get allocated. Errors are always a
+// *SparseOpError.
+func Preallocate(fd *os.File, off, length int64, keepSize bool) (allocated int64, err error) {
+	return preallocate(defaultHooks(), fd, off, length, keepSize)
+}
+
+func preallocate(h hooks, fd *os.File, off, length int64, keepSize bool) (allocated int64, err error) {
+	defer func() { err = opError("preallocate", fd.Name(), off, length, err) }()
+	if off < 0 || length <= 0 {
+		return 0, syscall.EINVAL
+	}
+	endx := off + length
+	before, blocks0, exact, err := allocIn(h, fd, off, endx)
+	if err != nil {
+		return 0, err
+	}
+	perr := osPreallocate(h, fd, off, length, keepSize)
+	after, blocks1, _, err := allocIn(h, fd, off, endx)
+	if err != nil {
+		return 0, err
+	}
+	if exact {
+		allocated = after
+	} else {
+		allocated = min(length, before+max(blocks1-blocks0, 0))
+	}
+	if perr != nil {
+		return allocated, perr
+	}
+	if allocated < length {
+		h.log.Debug("sparsified: short preallocation", "path", fd.Name(),
+			"offset", off, "length", length, "allocated", allocated, "exact", exact)
+		return allocated, ErrShortAlloc
+	}
+	return allocated, nil
+}
+
+// allocIn returns how many bytes of [off, endx) have storage,
+// and the total storage of fd. With FIEMAP the former is exact
+// and counts preallocated (unwritten) extents, including any
+// past EOF. Without it, only the data extents are seen, and
+// exact is false.
+func allocIn(h hooks, fd *os.File, off, endx int64) (inRange, total int64, exact bool, err error) {
+	fi, err := fd.Stat()
+	if err != nil {
+		return
+	}
+	total = statAllocated(fi)
+	overlap := func(beg, end int64) int64 {
+		return max(min(end, endx)-max(beg, off), 0)
+	}
+	aexts, ferr := allocatedExtents(h, fd, true)
+	if ferr == nil {
+		for _, e := range aexts {
+			inRange += overlap(e.Logical, e.End())
+		}
+		return inRange, total, true, nil
+	}
+	exts, err := extents(h, fd)
+	if err != nil {
+		return
+	}
+	for _, e := range onlyData(exts) {
+		inRange += overlap(e.Offset, e.End())
+	}
+	return inRange, total, false, nil
+}
+
+// fillHoles writes zeros over the holes in [off, endx), which
+// must lie within the file. It is the only way to allocate a
+// hole where there is no fallocate(2).
+func fillHoles(h hooks, fd *os.File, off, endx int64) error {
+	exts, err := extents(h, fd)
+	if err != nil {
+		return err
+	}
+	for _, e := range exts {
+		if !e.Hole {
+			continue
+		}
+		for beg, end := max(e.Offset, off), min(e.End(), endx); beg < end; {
+			n := min(int64(len(oneZeroBlock4k)), end-beg)
+			_, err := h.do("writeat", fd, beg, n, func() (int64, error) {
+				k, err := fd.WriteAt(oneZeroBlock4k[:n], beg)
+				return int64(k), err
+			})
+			if err != nil {
+				return err
+			}
+			beg += n
+		}
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+package sparsified
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPreallocate(t *testing.T) {
+	dir := t.TempDir()
+	open := func(name string) *os.File {
+		fd, err := os.Create(filepath.Join(dir, name))
+		panicOn(err)
+		t.Cleanup(func() { fd.Close() })
+		return fd
+	}
+	size := func(fd *os.File) int64 {
+		sz, err := fileSizeFromFile(fd)
+		panicOn(err)
+		return sz
+	}
+
+	fd := open("keep.img")
+	got, err := Preallocate(fd, 0, 1<<20, true)
+	if errors.Is(err, errors.ErrUnsupported) {
+		t.Skipf("no preallocation here: %v", err)
+	}
+	panicOn(err)
+	if got != 1<<20 || size(fd) != 0 {
+		t.Fatalf("keepSize: allocated %v, size %v", got, size(fd))
+	}
+
+	fd = open("extend.img")
+	got, err = Preallocate(fd, 100, 5000, false)
+	panicOn(err)
+	if got != 5000 || size(fd) != 5100 {
+		t.Fatalf("extend: allocated %v, size %v", got, size(fd))
+	}
+
+	// already allocated blocks count as allocated.
+	_, err = fd.WriteAt([]byte("data"), 1<<20)
+	panicOn(err)
+	got, err = Preallocate(fd, 0, 2<<20, true)
+	panicOn(err)
+	if got != 2<<20 || size(fd) != 1<<20+4 {
+		t.Fatalf("over data: allocated %v, size %v", got, size(fd))
+	}
+
+	if _, err = Preallocate(fd, -1, 10, true); err == nil {
+		t.Fatalf("negative offset accepted")
+	}
+
+	// the legacy fallocate now measures too.
+	fd = open("legacy.img")
+	got, err = fallocate(fd, 0, 0, 64<<10)
+	panicOn(err)
+	if got != 64<<10 {
+		t.Fatalf("fallocate: allocated %v", got)
+	}
+
+	// and so does OSFile.Allocate.
+	got, err = NewOSFile(open("osfile.img")).Allocate(4096, 8192)
+	panicOn(err)
+	if got != 8192 {
+		t.Fatalf("Allocate: allocated %v", got)
+	}
+}
@@ -0,0 +1,194 @@
+package sparsified
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+// Options tunes the long running operations: Copy, Sparsify,
+// Hash, and the image conversions. A nil *Options is fine
+// everywhere and means the defaults.
+type Options struct {
+	// Progress, if set, is called from the operation's
+	// goroutine at most every ProgressInterval, and once
+	// more when the operation ends, successfully or not.
+	Progress ProgressFunc
+
+	// ProgressInterval defaults to one second.
+	ProgressInterval time.Duration
+
+	// ResumeAt restarts an interrupted Copy, VMDKToRaw or
+	// VHDToRaw at this offset: the destination is not
+	// truncated, and nothing before ResumeAt is written
+	// again. Use the Offset of the last Progress report
+	// from the interrupted run.
+	ResumeAt int64
+
+	// Workers is how many goroutines Copy copies data
+	// extents with. 0 or 1 copies serially.
+	Workers int
+
+	// Engine selects how Copy, Hash and Sparsify do their
+	// I/O. The zero value is EngineSyscall.
+	Engine Engine
+
+	// SpaceMargin is the free space Copy, VMDKToRaw and
+	// VHDToRaw must leave on the destination's filesystem,
+	// or they fail up front with a NoSpaceError rather than
+	// with ENOSPC halfway through. 0 means the data only has
+	// to fit, DefaultSpaceMargin leaves room for others, and a
+	// negative value skips the check. See CheckFillable.
+	SpaceMargin int64
+
+	// FrameSize is how many bytes of data RawToArchive
+	// compresses into each independently readable frame;
+	// it defaults to 1MB, and is capped at 64MB.
+	FrameSize int64
+
+	// Logger and Trace override SetLogger and SetTrace for
+	// this operation, and for the OSFiles it works on.
+	Logger *slog.Logger
+	Trace  TraceFunc
+}
+
+// ProgressFunc receives progress reports.
+type ProgressFunc func(Progress)
+
+// Progress is a snapshot of a long running operation.
+// Operations walk a file from the front, so Offset is
+// also the number of bytes scanned so far.
+type Progress struct {
+	Op string
+
+	// Size is the apparent size being scanned, and
+	// TotalData how much of it is data.
+	Size      int64
+	TotalData int64
+
+	// Offset is where the operation has got to: everything
+	// before it is done, nothing after it has been touched.
+	Offset int64
+
+	// Data is the data bytes processed so far,
+	// Holes the hole bytes skipped over.
+	Data  int64
+	Holes int64
+
+	Elapsed time.Duration
+
+	// ETA estimates the time remaining from the rate at
+	// which data (not holes) has gone by. Zero if unknown.
+	ETA time.Duration
+
+	// Done is set on the final report; Err is the
+	// operation's error, if any, on that report.
+	Done bool
+	Err  error
+}
+
+// progress does the bookkeeping for one operation.
+type progress struct {
+	ctx   context.Context
+	fn    ProgressFunc
+	every time.Duration
+	start time.Time
+	last  time.Time
+	p     Progress
+}
+
+func newProgress(ctx context.Context, op string, opts *Options, size, totalData int64) *progress {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	pr := &progress{
+		ctx:   ctx,
+		every: time.Second,
+		start: time.Now(),
+		p:     Progress{Op: op, Size: size, TotalData: totalData},
+	}
+	if opts != nil {
+		pr.fn = opts.Progress
+		if opts.ProgressInterval > 0 {
+			pr.every = opts.ProgressInterval
+		}
+	}
+	pr.last = pr.start
+	return pr
+}
+
+func (pr *progress) resume(off int64) {
+	pr.p.Offset = off
+}
+
+// data records n data bytes processed ending at off+n,
+// and returns the context's error, if any.
+func (pr *progress) data(off, n int64) error {
+	pr.p.Data += n
+	pr.p.Offset = off + n
+	return pr.tick()
+}
+
+// hole records a skipped hole ending at off+n.
+func (pr *progress) hole(off, n int64) error {
+	pr.p.Holes += n
+	pr.p.Offset = off + n
+	return pr.tick()
+}
+
+func (pr *progress) tick() error {
+	if pr.fn != nil {
+		if now := time.Now(); now.Sub(pr.last) >= pr.every {
+			pr.last = now
+			pr.fn(pr.snapshot())
+		}
+	}
+	return pr.ctx.Err()
+}
+
+func (pr *progress) snapshot() Progress {
+	p := pr.p
+	p.Elapsed = time.Since(pr.start)
+	if p.Data > 0 && p.TotalData > p.Data {
+		p.ETA = time.Duration(float64(p.Elapsed) * float64(p.TotalData-p.Data) / float64(p.Data))
+	}
+	return p
+}
+
+// done sends the final report and passes err through.
+func (pr *progress) done(err error) error {
+	if pr.fn != nil {
+		p := pr.snapshot()
+		p.Done = true
+		p.Err = err
+		if err == nil {
+			p.ETA = 0
+		}
+		pr.fn(p)
+	}
+	return err
+}
+
+func resumeAt(opts *Options) int64 {
+	if opts == nil {
+		return 0
+	}
+	return opts.ResumeAt
+}
+
+func workers(opts *Options) int {
+	if opts == nil {
+		return 1
+	}
+	return opts.Workers
+}
+
+// dataBytes sums the lengths of the data extents.
+func dataBytes(exts []Extent) (n int64) {
+	for _, e := range exts {
+		if !e.Hole {
+			n += e.Length
+		}
+	}
+	return
+}
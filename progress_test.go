@@ -0,0 +1,154 @@
+package sparsified
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"testing"
+)
+
+// progressSrc returns an 8MB file with data in five places,
+// so that operations over it take several chunks.
+func progressSrc() *MemSparseFile {
+	src := NewMemSparseFile("src", 4096)
+	panicOn(src.Truncate(8 << 20))
+	for i, off := range []int64{0, 1 << 20, 3<<20 + 4096, 5 << 20, 8<<20 - 100} {
+		_, err := src.WriteAt(bytes.Repeat([]byte{byte(i + 1)}, 1<<20-5000), off)
+		panicOn(err)
+	}
+	return src
+}
+
+func sameExtents(a, b []Extent) bool {
+	a, b = onlyData(a), onlyData(b)
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// a Copy canceled part way leaves dst recoverable,
+// and ResumeAt finishes it.
+func TestCopyCancelAndResume(t *testing.T) {
+	src := progressSrc()
+	dst := NewMemSparseFile("dst", 4096)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var last Progress
+	reports := 0
+	opts := &Options{
+		ProgressInterval: 1, // every chunk.
+		Progress: func(p Progress) {
+			reports++
+			last = p
+			if p.Offset >= 3<<20 {
+				cancel()
+			}
+		},
+	}
+	_, err := Copy(ctx, dst, src, opts)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("want context.Canceled, got %v", err)
+	}
+	if !last.Done || !errors.Is(last.Err, context.Canceled) {
+		t.Fatalf("final report should be Done with the error: %+v", last)
+	}
+	if last.Offset <= 0 || last.Offset >= src.Size() {
+		t.Fatalf("canceled at offset %v", last.Offset)
+	}
+	if dst.Size() != src.Size() {
+		t.Fatalf("canceled dst has size %v, want %v", dst.Size(), src.Size())
+	}
+	want := readAll(t, src)
+	got := readAll(t, dst)
+	if !bytes.Equal(got[:last.Offset], want[:last.Offset]) {
+		t.Fatalf("dst differs from src before the reported offset %v", last.Offset)
+	}
+	if !isZero(got[last.Offset:]) {
+		t.Fatalf("dst has data after the reported offset %v", last.Offset)
+	}
+
+	resume := &Options{ResumeAt: last.Offset, Progress: func(p Progress) { last = p }}
+	_, err = Copy(context.Background(), dst, src, resume)
+	panicOn(err)
+	if !last.Done || last.Err != nil || last.Offset != src.Size() {
+		t.Fatalf("final report after resume: %+v", last)
+	}
+	if !bytes.Equal(readAll(t, dst), want) {
+		t.Fatalf("content differs after resume")
+	}
+	sexts, err := src.Extents()
+	panicOn(err)
+	dexts, err := dst.Extents()
+	panicOn(err)
+	if !sameExtents(sexts, dexts) {
+		t.Fatalf("extents differ after resume:\n src %+v\n dst %+v", sexts, dexts)
+	}
+	if reports < 3 {
+		t.Fatalf("only %v progress reports", reports)
+	}
+}
+
+func TestSparsifyAndHash(t *testing.T) {
+	src := progressSrc()
+	want := readAll(t, src)
+	sexts, err := src.Extents()
+	panicOn(err)
+	for _, eng := range testEngines {
+		for name, dense := range testBackends(t) {
+			// write every byte, zeros included, as a naive copy would.
+			_, err := dense.WriteAt(want, 0)
+			panicOn(err)
+
+			var last Progress
+			opts := &Options{Engine: eng, Progress: func(p Progress) { last = p }}
+			punched, err := Sparsify(context.Background(), dense, opts)
+			panicOn(err)
+			// EmulatedFile already reports zero blocks as holes,
+			// so there is nothing left for Sparsify to find.
+			if punched <= 0 && name != "emulated" {
+				t.Fatalf("%v %v: punched %v", name, eng, punched)
+			}
+			if !last.Done || last.Op != "sparsify" {
+				t.Fatalf("%v %v: final report: %+v", name, eng, last)
+			}
+			if !bytes.Equal(readAll(t, dense), want) {
+				t.Fatalf("%v %v: Sparsify changed the content", name, eng)
+			}
+			dexts, err := dense.Extents()
+			panicOn(err)
+			if !sameExtents(sexts, dexts) {
+				t.Fatalf("%v %v: extents differ after Sparsify:\n src %+v\n got %+v", name, eng, sexts, dexts)
+			}
+
+			sum, err := Hash(context.Background(), dense, &Options{Engine: eng})
+			panicOn(err)
+			if h := sha256.Sum256(want); !bytes.Equal(sum, h[:]) {
+				t.Fatalf("%v %v: Hash %x, want %x", name, eng, sum, h)
+			}
+		}
+	}
+
+	dense := NewMemSparseFile("dense", 4096)
+	_, err = dense.WriteAt(want, 0)
+	panicOn(err)
+	before := dense.Allocated()
+	punched, err := Sparsify(context.Background(), dense, nil)
+	panicOn(err)
+	if dense.Allocated() != before-punched {
+		t.Fatalf("punched %v, allocated %v -> %v", punched, before, dense.Allocated())
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err = Hash(ctx, dense, nil); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Hash with a canceled context: %v", err)
+	}
+}
@@ -0,0 +1,636 @@
+package sparsified
+
+import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Remote sparse files.
+//
+// A RemoteServer lets clients work on the files under one
+// directory of its host, over a framed protocol on any
+// net.Conn. Both sides prove they hold the shared secret
+// first:
+//
+//	server: "SPRSRPC1", 32-byte nonce S
+//	client: 32-byte nonce C, HMAC-SHA256(secret, "client" S C)
+//	server: 0, HMAC-SHA256(secret, "server" S C); or 1 and hang up
+//
+// Then the client sends requests and the server answers each
+// in turn, little-endian:
+//
+//	request:  uint32 length of the rest, uint8 op, uint32 file,
+//	          int64 offset, int64 length, payload
+//	response: uint32 length of the rest, uint8 status, payload
+//
+// An error response carries the errno (0 if none), an error
+// kind for the sentinel errors that should survive the trip,
+// and the message. Nothing is encrypted: use a TLS conn, or a
+// trusted network.
+
+const (
+	remoteMagic    = "SPRSRPC1"
+	remoteNonceLen = 32
+	remoteReqLen   = 1 + 4 + 8 + 8
+	remoteMaxFrame = 64 << 20
+
+	// an extent is sent as offset, length and a hole flag;
+	// a response holds as many as fit in a frame.
+	remoteExtentLen  = 8 + 8 + 1
+	remoteMaxExtents = (remoteMaxFrame - 1) / remoteExtentLen
+
+	remoteOK  = 0
+	remoteErr = 1
+)
+
+// remote operations.
+const (
+	ropOpen = iota + 1
+	ropClose
+	ropStat
+	ropExtents
+	ropRead
+	ropWrite
+	ropTruncate
+	ropSync
+	ropPunch
+	ropCollapse
+	ropInsert
+)
+
+// error kinds, for errors.Is on the client.
+var remoteKinds = []error{
+	nil,
+	io.EOF,
+	ErrNotSupported,
+	ErrUnaligned,
+	ErrBeyondEOF,
+	fs.ErrNotExist,
+	fs.ErrExist,
+	fs.ErrPermission,
+	fs.ErrInvalid,
+	fs.ErrClosed,
+}
+
+// ErrAuth is returned by NewRemoteClient when the server,
+// or the client, does not know the shared secret.
+var ErrAuth = fmt.Errorf("remote authentication failed.")
+
+// RemoteError is an error that happened on the server. It
+// matches, with errors.Is, the errno and the package's own
+// sentinel errors it matched there.
+type RemoteError struct {
+	Msg   string
+	Errno syscall.Errno
+	Kind  error
+}
+
+func (e *RemoteError) Error() string {
+	return "remote: " + e.Msg
+}
+
+func (e *RemoteError) Unwrap() []error {
+	var errs []error
+	if e.Errno != 0 {
+		errs = append(errs, e.Errno)
+	}
+	if e.Kind != nil {
+		errs = append(errs, e.Kind)
+	}
+	return errs
+}
+
+func remoteMAC(secret []byte, who string, s, c []byte) []byte {
+	m := hmac.New(sha256.New, secret)
+	m.Write([]byte(who))
+	m.Write(s)
+	m.Write(c)
+	return m.Sum(nil)
+}
+
+// RemoteServer serves the files under a directory to
+// RemoteClients. Names cannot reach outside the directory.
+type RemoteServer struct {
+	root   *os.Root
+	secret []byte
+	opts   *Options
+}
+
+// NewRemoteServer serves the files under dir to clients that
+// know secret. Only the Logger and Trace of opts are used.
+func NewRemoteServer(dir string, secret []byte, opts *Options) (s *RemoteServer, err error) {
+	if len(secret) == 0 {
+		return nil, fmt.Errorf("NewRemoteServer: empty secret")
+	}
+	root, err := os.OpenRoot(dir)
+	if err != nil {
+		return nil, err
+	}
+	return &RemoteServer{root: root, secret: secret, opts: opts}, nil
+}
+
+// Close closes the server's directory; connections being
+// served go on with the files they have open.
+func (s *RemoteServer) Close() error {
+	return s.root.Close()
+}
+
+// Serve accepts connections on l and serves each on its own
+// goroutine, until ctx is done or Accept fails. It closes l,
+// and every connection, before it returns.
+func (s *RemoteServer) Serve(ctx context.Context, l net.Listener) error {
+	return serveListener(ctx, l, "remote", s.opts, s.ServeConn)
+}
+
+// ServeConn authenticates the client on c, then serves its
+// requests until it hangs up or ctx is done. It closes c,
+// and the files the client left open. A clean hang-up
+// returns nil.
+func (s *RemoteServer) ServeConn(ctx context.Context, c net.Conn) error {
+	defer c.Close()
+	stop := context.AfterFunc(ctx, func() { c.Close() })
+	defer stop()
+	r, w := bufio.NewReader(c), bufio.NewWriter(c)
+
+	nonce := make([]byte, remoteNonceLen)
+	rand.Read(nonce)
+	w.WriteString(remoteMagic)
+	w.Write(nonce)
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	hello := make([]byte, remoteNonceLen+sha256.Size)
+	if _, err := io.ReadFull(r, hello); err != nil {
+		return err
+	}
+	cnonce := hello[:remoteNonceLen]
+	if !hmac.Equal(hello[remoteNonceLen:], remoteMAC(s.secret, "client", nonce, cnonce)) {
+		w.WriteByte(remoteErr)
+		w.Flush()
+		return ErrAuth
+	}
+	w.WriteByte(remoteOK)
+	w.Write(remoteMAC(s.secret, "server", nonce, cnonce))
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	files := map[uint32]*OSFile{}
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	var next uint32
+	hdr := make([]byte, 4+remoteReqLen)
+	for {
+		if _, err := io.ReadFull(r, hdr[:4]); err != nil {
+			if err == io.EOF {
+				err = nil
+			}
+			return err
+		}
+		n := binary.LittleEndian.Uint32(hdr)
+		if n < remoteReqLen || n > remoteMaxFrame {
+			return fmt.Errorf("remote: bad request length %v", n)
+		}
+		if _, err := io.ReadFull(r, hdr[4:]); err != nil {
+			return err
+		}
+		op, fid := hdr[4], binary.LittleEndian.Uint32(hdr[5:])
+		off, length := int64(binary.LittleEndian.Uint64(hdr[9:])), int64(binary.LittleEndian.Uint64(hdr[17:]))
+		payload := make([]byte, n-remoteReqLen)
+		if _, err := io.ReadFull(r, payload); err != nil {
+			return err
+		}
+
+		var resp []byte
+		var err error
+		f := files[fid]
+		switch {
+		case op == ropOpen:
+			flag := os.O_RDWR
+			if off != 0 {
+				flag |= os.O_CREATE
+			}
+			var fd *os.File
+			if fd, err = s.root.OpenFile(string(payload), flag, 0644); err == nil {
+				next++
+				files[next] = withHooks(NewOSFile(fd), s.opts).(*OSFile)
+				resp = binary.LittleEndian.AppendUint32(nil, next)
+			}
+		case f == nil:
+			err = os.ErrClosed
+		default:
+			resp, err = s.do(f, op, off, length, payload)
+			if op == ropClose {
+				delete(files, fid)
+			}
+		}
+		if err = writeRemoteResp(w, resp, err); err != nil {
+			return err
+		}
+	}
+}
+
+// do carries out op on f.
+func (s *RemoteServer) do(f *OSFile, op byte, off, length int64, payload []byte) (resp []byte, err error) {
+	switch op {
+	case ropClose:
+		err = f.Close()
+	case ropStat:
+		var fi os.FileInfo
+		if fi, err = f.Stat(); err == nil {
+			resp = binary.LittleEndian.AppendUint64(nil, uint64(fi.Size()))
+			resp = binary.LittleEndian.AppendUint32(resp, uint32(fi.Mode()))
+			resp = binary.LittleEndian.AppendUint64(resp, uint64(fi.ModTime().UnixNano()))
+		}
+	case ropExtents:
+		// at most length extents, from off on.
+		if off < 0 || length <= 0 || length > remoteMaxExtents {
+			return nil, fs.ErrInvalid
+		}
+		var fi os.FileInfo
+		if fi, err = f.Stat(); err != nil {
+			break
+		}
+		var exts []Extent
+		if exts, err = rangeExtents(f, min(off, fi.Size()), fi.Size()); err == nil {
+			for _, e := range exts[:min(int64(len(exts)), length)] {
+				resp = binary.LittleEndian.AppendUint64(resp, uint64(e.Offset))
+				resp = binary.LittleEndian.AppendUint64(resp, uint64(e.Length))
+				hole := byte(0)
+				if e.Hole {
+					hole = 1
+				}
+				resp = append(resp, hole)
+			}
+		}
+	case ropRead:
+		if length < 0 || length > copyChunk {
+			return nil, fs.ErrInvalid
+		}
+		resp = make([]byte, length)
+		var n int
+		n, err = f.ReadAt(resp, off)
+		if resp = resp[:n]; err == io.EOF {
+			err = nil // a short read says so.
+		}
+	case ropWrite:
+		var n int
+		n, err = f.WriteAt(payload, off)
+		resp = binary.LittleEndian.AppendUint64(nil, uint64(n))
+	case ropTruncate:
+		err = f.Truncate(off)
+	case ropSync:
+		err = f.Sync()
+	case ropPunch:
+		err = f.PunchHole(off, length)
+	case ropCollapse:
+		err = f.CollapseRange(off, length)
+	case ropInsert:
+		err = f.InsertRange(off, length)
+	default:
+		err = fmt.Errorf("remote: unknown operation %v", op)
+	}
+	return resp, err
+}
+
+func writeRemoteResp(w *bufio.Writer, resp []byte, err error) error {
+	if err != nil {
+		var errno syscall.Errno
+		errors.As(err, &errno)
+		kind := 0
+		for k := 1; k < len(remoteKinds); k++ {
+			if errors.Is(err, remoteKinds[k]) {
+				kind = k
+				break
+			}
+		}
+		resp = binary.LittleEndian.AppendUint32(nil, uint32(errno))
+		resp = append(resp, byte(kind))
+		resp = append(resp, err.Error()...)
+	}
+	status := byte(remoteOK)
+	if err != nil {
+		status = remoteErr
+	}
+	var h [5]byte
+	binary.LittleEndian.PutUint32(h[:], uint32(1+len(resp)))
+	h[4] = status
+	w.Write(h[:])
+	w.Write(resp)
+	return w.Flush()
+}
+
+// RemoteClient is a connection to a RemoteServer. It is safe
+// for concurrent use; requests go one at a time.
+type RemoteClient struct {
+	mu  sync.Mutex
+	c   net.Conn
+	r   *bufio.Reader
+	w   *bufio.Writer
+	err error // the connection is broken.
+}
+
+// NewRemoteClient authenticates with the server on c, which
+// may be a *tls.Conn, by the shared secret.
+func NewRemoteClient(c net.Conn, secret []byte) (rc *RemoteClient, err error) {
+	rc = &RemoteClient{c: c, r: bufio.NewReader(c), w: bufio.NewWriter(c)}
+	hello := make([]byte, len(remoteMagic)+remoteNonceLen)
+	if _, err = io.ReadFull(rc.r, hello); err != nil {
+		return nil, err
+	}
+	if string(hello[:len(remoteMagic)]) != remoteMagic {
+		return nil, fmt.Errorf("NewRemoteClient: not a sparsified remote server (magic %q)", hello[:len(remoteMagic)])
+	}
+	snonce := hello[len(remoteMagic):]
+	cnonce := make([]byte, remoteNonceLen)
+	rand.Read(cnonce)
+	rc.w.Write(cnonce)
+	rc.w.Write(remoteMAC(secret, "client", snonce, cnonce))
+	if err = rc.w.Flush(); err != nil {
+		return nil, err
+	}
+	status, err := rc.r.ReadByte()
+	if err != nil || status != remoteOK {
+		return nil, ErrAuth
+	}
+	mac := make([]byte, sha256.Size)
+	if _, err = io.ReadFull(rc.r, mac); err != nil {
+		return nil, err
+	}
+	if !hmac.Equal(mac, remoteMAC(secret, "server", snonce, cnonce)) {
+		return nil, ErrAuth
+	}
+	return rc, nil
+}
+
+// DialRemote connects to a RemoteServer over TCP.
+func DialRemote(ctx context.Context, addr string, secret []byte) (*RemoteClient, error) {
+	var d net.Dialer
+	c, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	rc, err := NewRemoteClient(c, secret)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	return rc, nil
+}
+
+// Close hangs up; the server closes any files left open.
+func (rc *RemoteClient) Close() error {
+	return rc.c.Close()
+}
+
+// call makes one request and returns the payload of the
+// response.
+func (rc *RemoteClient) call(op byte, fid uint32, off, length int64, payload []byte) ([]byte, error) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if rc.err != nil {
+		return nil, rc.err
+	}
+	resp, err := rc.roundTrip(op, fid, off, length, payload)
+	var re *RemoteError
+	if err != nil && !errors.As(err, &re) {
+		// out of step with the server for good.
+		rc.err = err
+		rc.c.Close()
+	}
+	return resp, err
+}
+
+func (rc *RemoteClient) roundTrip(op byte, fid uint32, off, length int64, payload []byte) ([]byte, error) {
+	if len(payload) > remoteMaxFrame-remoteReqLen {
+		return nil, fs.ErrInvalid
+	}
+	h := binary.LittleEndian.AppendUint32(nil, uint32(remoteReqLen+len(payload)))
+	h = append(h, op)
+	h = binary.LittleEndian.AppendUint32(h, fid)
+	h = binary.LittleEndian.AppendUint64(h, uint64(off))
+	h = binary.LittleEndian.AppendUint64(h, uint64(length))
+	rc.w.Write(h)
+	rc.w.Write(payload)
+	if err := rc.w.Flush(); err != nil {
+		return nil, err
+	}
+	var rh [5]byte
+	if _, err := io.ReadFull(rc.r, rh[:]); err != nil {
+		return nil, err
+	}
+	n := binary.LittleEndian.Uint32(rh[:])
+	if n < 1 || n > remoteMaxFrame {
+		return nil, fmt.Errorf("remote: bad response length %v", n)
+	}
+	resp := make([]byte, n-1)
+	if _, err := io.ReadFull(rc.r, resp); err != nil {
+		return nil, err
+	}
+	if rh[4] == remoteOK {
+		return resp, nil
+	}
+	if len(resp) < 5 {
+		return nil, fmt.Errorf("remote: short error response")
+	}
+	re := &RemoteError{Errno: syscall.Errno(binary.LittleEndian.Uint32(resp)), Msg: string(resp[5:])}
+	if k := int(resp[4]); k < len(remoteKinds) {
+		re.Kind = remoteKinds[k]
+	}
+	return nil, re
+}
+
+// Open opens the file name, relative to the server's
+// directory, for reading and writing; create makes it if it
+// does not exist.
+func (rc *RemoteClient) Open(name string, create bool) (f *RemoteFile, err error) {
+	defer func() { err = opError("open", name, 0, 0, err) }()
+	flag := int64(0)
+	if create {
+		flag = 1
+	}
+	resp, err := rc.call(ropOpen, 0, flag, 0, []byte(name))
+	if err != nil {
+		return nil, err
+	}
+	if len(resp) != 4 {
+		return nil, fmt.Errorf("remote: bad open response")
+	}
+	return &RemoteFile{rc: rc, fid: binary.LittleEndian.Uint32(resp), name: name}, nil
+}
+
+// RemoteFile is a SparseFile on a RemoteServer.
+type RemoteFile struct {
+	rc   *RemoteClient
+	fid  uint32
+	name string
+}
+
+var _ SparseFile = &RemoteFile{}
+
+// Name returns the name the file was opened with.
+func (f *RemoteFile) Name() string {
+	return f.name
+}
+
+// Close closes the file on the server.
+func (f *RemoteFile) Close() error {
+	_, err := f.rc.call(ropClose, f.fid, 0, 0, nil)
+	return opError("close", f.name, 0, 0, err)
+}
+
+// ReadAt reads a chunk at a time.
+func (f *RemoteFile) ReadAt(p []byte, off int64) (n int, err error) {
+	defer func() {
+		if err != io.EOF {
+			err = opError("readat", f.name, off, int64(len(p)), err)
+		}
+	}()
+	for n < len(p) {
+		k := min(len(p)-n, copyChunk)
+		resp, err := f.rc.call(ropRead, f.fid, off+int64(n), int64(k), nil)
+		if err != nil {
+			return n, err
+		}
+		n += copy(p[n:n+k], resp)
+		if len(resp) < k {
+			return n, io.EOF
+		}
+	}
+	return n, nil
+}
+
+// WriteAt writes a chunk at a time.
+func (f *RemoteFile) WriteAt(p []byte, off int64) (n int, err error) {
+	defer func() { err = opError("writeat", f.name, off, int64(len(p)), err) }()
+	for n < len(p) {
+		k := min(len(p)-n, copyChunk)
+		resp, err := f.rc.call(ropWrite, f.fid, off+int64(n), 0, p[n:n+k])
+		if err != nil {
+			return n, err
+		}
+		if len(resp) != 8 {
+			return n, fmt.Errorf("remote: bad write response")
+		}
+		w := binary.LittleEndian.Uint64(resp)
+		if w > uint64(k) {
+			return n, fmt.Errorf("remote: bad write response")
+		}
+		n += int(w)
+		if int(w) < k {
+			// the server says why when it can; not to
+			// would have us loop forever.
+			return n, io.ErrShortWrite
+		}
+	}
+	return n, nil
+}
+
+// Truncate, Sync, PunchHole, CollapseRange and InsertRange
+// are those of the file on the server.
+func (f *RemoteFile) Truncate(size int64) error {
+	_, err := f.rc.call(ropTruncate, f.fid, size, 0, nil)
+	return opError("truncate", f.name, size, 0, err)
+}
+
+func (f *RemoteFile) Sync() error {
+	_, err := f.rc.call(ropSync, f.fid, 0, 0, nil)
+	return opError("sync", f.name, 0, 0, err)
+}
+
+func (f *RemoteFile) PunchHole(off, length int64) error {
+	_, err := f.rc.call(ropPunch, f.fid, off, length, nil)
+	return opError("punchhole", f.name, off, length, err)
+}
+
+func (f *RemoteFile) CollapseRange(off, length int64) error {
+	_, err := f.rc.call(ropCollapse, f.fid, off, length, nil)
+	return opError("collapserange", f.name, off, length, err)
+}
+
+func (f *RemoteFile) InsertRange(off, length int64) error {
+	_, err := f.rc.call(ropInsert, f.fid, off, length, nil)
+	return opError("insertrange", f.name, off, length, err)
+}
+
+// Extents returns the hole map the server sees.
+func (f *RemoteFile) Extents() (exts []Extent, err error) {
+	return f.extents(remoteMaxExtents)
+}
+
+// extents asks for the map a page of at most page extents
+// at a time, each starting where the last ended, so that no
+// file has too many for a frame.
+func (f *RemoteFile) extents(page int) (exts []Extent, err error) {
+	defer func() { err = opError("extents", f.name, 0, 0, err) }()
+	off := int64(0)
+	for {
+		resp, err := f.rc.call(ropExtents, f.fid, off, int64(page), nil)
+		if err != nil {
+			return nil, err
+		}
+		if len(resp)%remoteExtentLen != 0 || len(resp) > page*remoteExtentLen {
+			return nil, fmt.Errorf("remote: bad extents response")
+		}
+		for b := resp; len(b) > 0; b = b[remoteExtentLen:] {
+			exts = append(exts, Extent{
+				Offset: int64(binary.LittleEndian.Uint64(b)),
+				Length: int64(binary.LittleEndian.Uint64(b[8:])),
+				Hole:   b[16] != 0,
+			})
+		}
+		if len(resp) < page*remoteExtentLen {
+			return exts, nil
+		}
+		off = exts[len(exts)-1].End()
+	}
+}
+
+// Stat returns the size, mode and modification time of the
+// file on the server.
+func (f *RemoteFile) Stat() (fi os.FileInfo, err error) {
+	defer func() { err = opError("stat", f.name, 0, 0, err) }()
+	resp, err := f.rc.call(ropStat, f.fid, 0, 0, nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(resp) != 20 {
+		return nil, fmt.Errorf("remote: bad stat response")
+	}
+	return &remoteFileInfo{
+		name:    f.name,
+		size:    int64(binary.LittleEndian.Uint64(resp)),
+		mode:    os.FileMode(binary.LittleEndian.Uint32(resp[8:])),
+		modTime: time.Unix(0, int64(binary.LittleEndian.Uint64(resp[12:]))),
+	}, nil
+}
+
+type remoteFileInfo struct {
+	name    string
+	size    int64
+	mode    os.FileMode
+	modTime time.Time
+}
+
+func (fi *remoteFileInfo) Name() string       { return fi.name }
+func (fi *remoteFileInfo) Size() int64        { return fi.size }
+func (fi *remoteFileInfo) Mode() os.FileMode  { return fi.mode }
+func (fi *remoteFileInfo) ModTime() time.Time { return fi.modTime }
+func (fi *remoteFileInfo) IsDir() bool        { return false }
+func (fi *remoteFileInfo) Sys() any           { return nil }
@@ -0,0 +1,141 @@
+package sparsified
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestRemote(t *testing.T) {
+	dir := t.TempDir()
+	sz, spans := testSpans()
+	src := makeTestSparse(t, filepath.Join(dir, "src.img"), sz, spans)
+	defer src.Close()
+	served := filepath.Join(dir, "served")
+	panicOn(os.Mkdir(served, 0755))
+
+	secret := []byte("backup agents only")
+	srv, err := NewRemoteServer(served, secret, nil)
+	panicOn(err)
+	defer srv.Close()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	panicOn(err)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- srv.Serve(ctx, l) }()
+
+	if _, err = DialRemote(ctx, l.Addr().String(), []byte("guess")); !errors.Is(err, ErrAuth) {
+		t.Fatalf("wrong secret: %v", err)
+	}
+	rc, err := DialRemote(ctx, l.Addr().String(), secret)
+	panicOn(err)
+	defer rc.Close()
+	if _, err = rc.Open("../src.img", false); err == nil {
+		t.Fatalf("opened a file outside the directory")
+	}
+	if _, err = rc.Open("missing.img", false); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("open of a missing file: %v", err)
+	}
+
+	// copy up to the server, holes and all, and back.
+	rf, err := rc.Open("vol.img", true)
+	panicOn(err)
+	_, err = Copy(context.Background(), rf, NewOSFile(src), nil)
+	panicOn(err)
+	local, err := os.Open(filepath.Join(served, "vol.img"))
+	panicOn(err)
+	defer local.Close()
+	sameContentAndHoles(t, src, local)
+	back, err := os.Create(filepath.Join(dir, "back.img"))
+	panicOn(err)
+	defer back.Close()
+	_, err = Copy(context.Background(), NewOSFile(back), rf, nil)
+	panicOn(err)
+	sameContentAndHoles(t, src, back)
+
+	// the range operations, against the same done locally.
+	model := NewMemSparseFile("model", 4096)
+	_, err = Copy(context.Background(), model, NewOSFile(src), nil)
+	panicOn(err)
+	both := func(op func(f SparseFile) error) {
+		t.Helper()
+		panicOn(op(model))
+		panicOn(op(rf))
+	}
+	both(func(f SparseFile) error { return f.PunchHole(0, 4096) })
+	both(func(f SparseFile) error { return f.CollapseRange(1<<20, 1<<20) })
+	both(func(f SparseFile) error { return f.InsertRange(4<<20, 2<<20) })
+	both(func(f SparseFile) error { return f.Truncate(sz + 100) })
+	panicOn(rf.Sync())
+	fi, err := rf.Stat()
+	panicOn(err)
+	if fi.Size() != model.Size() || !bytes.Equal(readAll(t, rf), readAll(t, model)) {
+		t.Fatalf("remote file differs from the model, size %v vs %v", fi.Size(), model.Size())
+	}
+
+	// the extent map comes the same a few at a time.
+	exts, err := rf.Extents()
+	panicOn(err)
+	paged, err := rf.extents(2)
+	panicOn(err)
+	if len(exts) < 3 || !slices.Equal(paged, exts) {
+		t.Fatalf("extents paged by 2: %+v, want %+v", paged, exts)
+	}
+
+	// errors keep their identity.
+	err = rf.CollapseRange(100, 4096)
+	var se *SparseOpError
+	if !errors.Is(err, syscall.EINVAL) || !errors.As(err, &se) || se.Op != "collapserange" {
+		t.Fatalf("unaligned collapse: %v", err)
+	}
+	if _, err = rf.ReadAt(make([]byte, 10), fi.Size()-5); err != io.EOF {
+		t.Fatalf("read past EOF: %v", err)
+	}
+	panicOn(rf.Close())
+	if err = rf.Sync(); !errors.Is(err, fs.ErrClosed) {
+		t.Fatalf("sync after close: %v", err)
+	}
+
+	cancel()
+	if err = <-done; !errors.Is(err, context.Canceled) {
+		t.Fatalf("serve: %v", err)
+	}
+}
+
+// closing the listener under Serve hangs up on idle clients
+// too, rather than waiting for them.
+func TestRemoteListenerClosed(t *testing.T) {
+	secret := []byte("s")
+	srv, err := NewRemoteServer(t.TempDir(), secret, nil)
+	panicOn(err)
+	defer srv.Close()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	panicOn(err)
+	served := make(chan error, 1)
+	go func() { served <- srv.Serve(context.Background(), l) }()
+
+	rc, err := DialRemote(context.Background(), l.Addr().String(), secret)
+	panicOn(err)
+	defer rc.Close()
+	l.Close()
+	select {
+	case err = <-served:
+		if err == nil {
+			t.Fatalf("serve returned nil after its listener was closed")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("serve still waiting on an idle client")
+	}
+	if _, err = rc.Open("f", true); err == nil {
+		t.Fatalf("idle client not hung up on")
+	}
+}
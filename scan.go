@@ -0,0 +1,252 @@
+package sparsified
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// ScanOptions tunes ScanTree. A nil *ScanOptions
+// scans everything, with GOMAXPROCS workers.
+type ScanOptions struct {
+	// Include, if not empty, limits the scan to the regular
+	// files matching one of these globs. Exclude skips files
+	// and whole directories matching one of its globs. A glob
+	// matches if it matches either the base name or the slash
+	// separated path relative to the root (see path.Match),
+	// so "*.img" and "vm/*/disk.img" both work.
+	Include []string
+	Exclude []string
+
+	// Workers is how many files are examined at once.
+	Workers int
+
+	// SameDevice keeps the scan on the root's filesystem,
+	// like du -x.
+	SameDevice bool
+}
+
+// FileUsage is what ScanTree found about one regular file.
+type FileUsage struct {
+	// Path is relative to the root, slash separated.
+	Path string
+
+	// Apparent is the size, Allocated the bytes of storage
+	// actually used (st_blocks * 512), and Holes the total
+	// length of the holes reported by SEEK_HOLE.
+	Apparent  int64
+	Allocated int64
+	Holes     int64
+
+	// Sparse is set when the file has holes.
+	Sparse bool
+}
+
+// DirUsage totals the files in a directory, and in all of the
+// directories below it.
+type DirUsage struct {
+	Path        string
+	Files       int
+	SparseFiles int
+	Apparent    int64
+	Allocated   int64
+	Holes       int64
+}
+
+func (d *DirUsage) add(f *FileUsage) {
+	d.Files++
+	if f.Sparse {
+		d.SparseFiles++
+	}
+	d.Apparent += f.Apparent
+	d.Allocated += f.Allocated
+	d.Holes += f.Holes
+}
+
+// ScanReport is the result of ScanTree. Files and Dirs are
+// sorted by path; Total is the same as the Dirs entry for ".".
+type ScanReport struct {
+	Root  string
+	Files []FileUsage
+	Dirs  []DirUsage
+	Total DirUsage
+
+	// Errors has the files and directories that could not be
+	// examined, say for lack of permission. They are left out
+	// of the totals; the scan carries on without them.
+	Errors []error
+}
+
+// ScanTree walks the tree under root and reports, for every
+// regular file, and summed per directory and in total, its
+// apparent size against the storage it actually takes, and
+// how much of it is holes. It does the job of comparing
+// `du --apparent-size` with `du`, but per file, and with the
+// holes found by SEEK_HOLE rather than inferred.
+//
+// Symbolic links are not followed. An error is only returned
+// if root itself cannot be scanned; see ScanReport.Errors.
+func ScanTree(root string, opts *ScanOptions) (rep *ScanReport, err error) {
+	defer func() { err = opError("scantree", root, 0, 0, err) }()
+	if opts == nil {
+		opts = &ScanOptions{}
+	}
+	for _, g := range append(opts.Include, opts.Exclude...) {
+		if _, err = path.Match(g, ""); err != nil {
+			return nil, fmt.Errorf("ScanTree: bad glob %q: %w", g, err)
+		}
+	}
+	rootInfo, err := os.Stat(root)
+	if err != nil {
+		return nil, err
+	}
+	if !rootInfo.IsDir() {
+		return nil, syscall.ENOTDIR
+	}
+	rootDev, _ := statDev(rootInfo)
+
+	rep = &ScanReport{Root: root}
+	var mu sync.Mutex
+	fail := func(err error) {
+		mu.Lock()
+		rep.Errors = append(rep.Errors, opError("scantree", root, 0, 0, err))
+		mu.Unlock()
+	}
+
+	workers := opts.Workers
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	todo := make(chan FileUsage)
+	var wg sync.WaitGroup
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for fu := range todo {
+				if err := scanFile(root, &fu); err != nil {
+					fail(err)
+					continue
+				}
+				mu.Lock()
+				rep.Files = append(rep.Files, fu)
+				mu.Unlock()
+			}
+		}()
+	}
+
+	dirs := map[string]*DirUsage{".": {Path: "."}}
+	fsys := os.DirFS(root)
+	werr := fs.WalkDir(fsys, ".", func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if p == "." {
+				return err
+			}
+			fail(err)
+			return nil
+		}
+		if p != "." && scanMatch(opts.Exclude, p) {
+			if d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if opts.SameDevice && p != "." {
+			fi, err := d.Info()
+			if err != nil {
+				fail(err)
+				return nil
+			}
+			if dev, ok := statDev(fi); ok && dev != rootDev {
+				if d.IsDir() {
+					return fs.SkipDir
+				}
+				return nil
+			}
+		}
+		if d.IsDir() {
+			dirs[p] = &DirUsage{Path: p}
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		if len(opts.Include) > 0 && !scanMatch(opts.Include, p) {
+			return nil
+		}
+		todo <- FileUsage{Path: p}
+		return nil
+	})
+	close(todo)
+	wg.Wait()
+	if werr != nil {
+		return nil, werr
+	}
+
+	sort.Slice(rep.Files, func(i, j int) bool { return rep.Files[i].Path < rep.Files[j].Path })
+	for i := range rep.Files {
+		f := &rep.Files[i]
+		for dir := path.Dir(f.Path); ; dir = path.Dir(dir) {
+			dirs[dir].add(f)
+			if dir == "." {
+				break
+			}
+		}
+	}
+	for _, d := range dirs {
+		rep.Dirs = append(rep.Dirs, *d)
+	}
+	sort.Slice(rep.Dirs, func(i, j int) bool { return rep.Dirs[i].Path < rep.Dirs[j].Path })
+	rep.Total = *dirs["."]
+	return rep, nil
+}
+
+// scanFile fills in fu, whose Path is set.
+func scanFile(root string, fu *FileUsage) (err error) {
+	name := filepath.Join(root, filepath.FromSlash(fu.Path))
+	defer func() { err = opError("scan", name, 0, 0, err) }()
+	fd, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+	fi, err := fd.Stat()
+	if err != nil {
+		return err
+	}
+	fu.Apparent = fi.Size()
+	fu.Allocated = statAllocated(fi)
+	exts, err := Extents(fd)
+	if err != nil {
+		return err
+	}
+	for _, e := range exts {
+		if e.Hole {
+			fu.Holes += e.Length
+		}
+	}
+	fu.Sparse = fu.Holes > 0
+	return nil
+}
+
+// scanMatch reports whether p, a slash separated relative
+// path, matches one of globs by its base name or in full.
+func scanMatch(globs []string, p string) bool {
+	base := p[strings.LastIndexByte(p, '/')+1:]
+	for _, g := range globs {
+		if ok, _ := path.Match(g, base); ok {
+			return true
+		}
+		if ok, _ := path.Match(g, p); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,74 @@
+package sparsified
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestScanTree(t *testing.T) {
+	root := t.TempDir()
+	mk := func(rel string, size int64, data []int64) {
+		p := filepath.Join(root, filepath.FromSlash(rel))
+		panicOn(os.MkdirAll(filepath.Dir(p), 0755))
+		fd, err := os.Create(p)
+		panicOn(err)
+		defer fd.Close()
+		panicOn(fd.Truncate(size))
+		for _, off := range data {
+			_, err = fd.WriteAt(bytes.Repeat([]byte{1}, 4096), off)
+			panicOn(err)
+		}
+	}
+	mk("a/sparse.img", 1<<20, []int64{0})
+	mk("a/b/dense.dat", 64<<10, []int64{0, 4096, 8192, 12288, 16384, 20480, 24576, 28672,
+		32768, 36864, 40960, 45056, 49152, 53248, 57344, 61440})
+	mk("c/other.img", 1<<20, []int64{512 << 10})
+	mk("top.txt", 4096, []int64{0})
+
+	rep, err := ScanTree(root, &ScanOptions{Workers: 3})
+	panicOn(err)
+	if len(rep.Errors) > 0 {
+		t.Fatalf("errors: %v", rep.Errors)
+	}
+	if len(rep.Files) != 4 || rep.Files[0].Path != "a/b/dense.dat" || rep.Files[3].Path != "top.txt" {
+		t.Fatalf("files: %+v", rep.Files)
+	}
+	sp := rep.Files[1]
+	if sp.Path != "a/sparse.img" || !sp.Sparse || sp.Apparent != 1<<20 || sp.Holes != 1<<20-4096 {
+		t.Fatalf("sparse.img: %+v", sp)
+	}
+	if sp.Allocated >= sp.Apparent {
+		t.Fatalf("sparse.img allocated %v of %v", sp.Allocated, sp.Apparent)
+	}
+	if rep.Files[0].Sparse || rep.Files[0].Holes != 0 {
+		t.Fatalf("dense.dat: %+v", rep.Files[0])
+	}
+	if rep.Total.Files != 4 || rep.Total.SparseFiles != 2 ||
+		rep.Total.Apparent != 1<<20+64<<10+1<<20+4096 {
+		t.Fatalf("total: %+v", rep.Total)
+	}
+	var a *DirUsage
+	for i := range rep.Dirs {
+		if rep.Dirs[i].Path == "a" {
+			a = &rep.Dirs[i]
+		}
+	}
+	if a == nil || a.Files != 2 || a.SparseFiles != 1 || a.Apparent != 1<<20+64<<10 {
+		t.Fatalf("dir a: %+v", a)
+	}
+
+	rep, err = ScanTree(root, &ScanOptions{Include: []string{"*.img"}, Exclude: []string{"c"}, SameDevice: true})
+	panicOn(err)
+	if len(rep.Files) != 1 || rep.Files[0].Path != "a/sparse.img" || rep.Total.Files != 1 {
+		t.Fatalf("include *.img, exclude c: %+v", rep.Files)
+	}
+
+	if _, err = ScanTree(filepath.Join(root, "nope"), nil); err == nil {
+		t.Fatalf("scanning a missing root should fail")
+	}
+	if _, err = ScanTree(root, &ScanOptions{Exclude: []string{"["}}); err == nil {
+		t.Fatalf("a bad glob should fail")
+	}
+}
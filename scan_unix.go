@@ -0,0 +1,43 @@
+//go:build linux || darwin
+
+package sparsified
+
+import (
+	"io/fs"
+	"os"
+	"syscall"
+)
+
+// statAllocated returns the bytes of storage fi's file uses.
+func statAllocated(fi fs.FileInfo) int64 {
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return st.Blocks * 512
+	}
+	return fi.Size()
+}
+
+// statDev returns the device fi's file lives on.
+func statDev(fi fs.FileInfo) (dev uint64, ok bool) {
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return uint64(st.Dev), true
+	}
+	return 0, false
+}
+
+// statBlockSize returns the filesystem's preferred block size.
+func statBlockSize(fi fs.FileInfo) int64 {
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok && st.Blksize > 0 {
+		return int64(st.Blksize)
+	}
+	return 4096
+}
+
+// statfsAvail returns the bytes free on fd's filesystem
+// for unprivileged users, as df reports them.
+func statfsAvail(fd *os.File) (int64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Fstatfs(int(fd.Fd()), &st); err != nil {
+		return 0, err
+	}
+	return int64(st.Bavail) * int64(st.Bsize), nil
+}
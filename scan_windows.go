@@ -0,0 +1,28 @@
+//go:build windows
+
+package sparsified
+
+import (
+	"io/fs"
+	"os"
+)
+
+// statAllocated would need GetCompressedFileSize;
+// until then, assume everything is allocated.
+func statAllocated(fi fs.FileInfo) int64 {
+	return fi.Size()
+}
+
+// statDev is not known, so SameDevice has no effect.
+func statDev(fi fs.FileInfo) (dev uint64, ok bool) {
+	return 0, false
+}
+
+func statBlockSize(fi fs.FileInfo) int64 {
+	return 4096
+}
+
+// statfsAvail would need GetDiskFreeSpaceEx.
+func statfsAvail(fd *os.File) (int64, error) {
+	return 0, ErrNotSupported
+}
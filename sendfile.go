@@ -0,0 +1,48 @@
+package sparsified
+
+import (
+	"errors"
+	"io"
+	"syscall"
+)
+
+// sendRange writes the n bytes of f at off to w. When f is an
+// *OSFile and w a socket (a *net.TCPConn or *net.UnixConn),
+// the kernel moves them from the page cache to the socket,
+// with sendfile(2) on Linux, and they never reach user space;
+// otherwise, or if the kernel will not, they are copied
+// through a buffer. If f ends early, it is io.ErrUnexpectedEOF.
+func sendRange(w io.Writer, f SparseFile, off, n int64) (written int64, err error) {
+	if o, ok := f.(*OSFile); ok {
+		if sc, ok := w.(syscall.Conn); ok {
+			written, err = sendfile(sc, o, off, n)
+			if !errors.Is(err, ErrNotSupported) {
+				return written, err
+			}
+		}
+	}
+	m, err := io.CopyN(w, io.NewSectionReader(f, off+written, n-written), n-written)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return written + m, err
+}
+
+// rangeExtents returns the extents of f within [off, endx),
+// endx being at most the size. For an *OSFile only that
+// range is looked at.
+func rangeExtents(f SparseFile, off, endx int64) (exts []Extent, err error) {
+	if o, ok := f.(*OSFile); ok {
+		return extentsIn(o.hooks(), o.File, off, endx)
+	}
+	all, err := f.Extents()
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range all {
+		if beg, end := max(e.Offset, off), min(e.End(), endx); beg < end {
+			exts = append(exts, Extent{Offset: beg, Length: end - beg, Hole: e.Hole})
+		}
+	}
+	return exts, nil
+}
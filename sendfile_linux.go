@@ -0,0 +1,60 @@
+//go:build linux
+
+package sparsified
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// sendfile sends n bytes of f at off to the socket sc with
+// sendfile(2), waiting for the socket as need be. It returns
+// an error matching ErrNotSupported if nothing could be sent
+// that way, so that the caller copies instead.
+func sendfile(sc syscall.Conn, f *OSFile, off, n int64) (written int64, err error) {
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return 0, ErrNotSupported
+	}
+	h, src := f.hooks(), int(f.Fd())
+	werr := rc.Write(func(fd uintptr) bool {
+		for written < n {
+			k, e := h.do("sendfile", f.File, off+written, n-written, func() (int64, error) {
+				pos := off + written
+				k, e := unix.Sendfile(int(fd), src, &pos, int(min(n-written, 1<<30)))
+				return int64(k), e
+			})
+			written += max(k, 0)
+			switch {
+			case e == unix.EAGAIN:
+				return false // wait until the socket can take more.
+			case e == unix.EINTR:
+			case e != nil:
+				err = e
+				return true
+			case k == 0:
+				err = io.ErrUnexpectedEOF
+				return true
+			}
+		}
+		return true
+	})
+	if err == nil {
+		err = werr
+	}
+	if written == 0 && (err == unix.EINVAL || err == unix.ENOSYS || err == unix.EOPNOTSUPP) {
+		return 0, ErrNotSupported
+	}
+	return written, err
+}
+
+// reopenFile opens fd again, read only, as a new open file
+// with a file position of its own, so that net/http can
+// sendfile(2) from it while others use fd.
+func reopenFile(fd *os.File) (*os.File, error) {
+	return os.Open(fmt.Sprintf("/proc/self/fd/%d", fd.Fd()))
+}
@@ -0,0 +1,17 @@
+//go:build !linux
+
+package sparsified
+
+import (
+	"os"
+	"syscall"
+)
+
+// sendfile is only done on Linux; elsewhere sendRange copies.
+func sendfile(sc syscall.Conn, f *OSFile, off, n int64) (int64, error) {
+	return 0, ErrNotSupported
+}
+
+func reopenFile(fd *os.File) (*os.File, error) {
+	return nil, ErrNotSupported
+}
@@ -0,0 +1,120 @@
+package sparsified
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync/atomic"
+	"testing"
+)
+
+func TestSendRange(t *testing.T) {
+	dir := t.TempDir()
+	fd, err := os.Create(filepath.Join(dir, "data"))
+	panicOn(err)
+	defer fd.Close()
+	want := make([]byte, 3<<20)
+	rand.New(rand.NewSource(7)).Read(want)
+	_, err = fd.WriteAt(want, 0)
+	panicOn(err)
+	var sends atomic.Int64
+	f := &OSFile{File: fd, Trace: func(ev TraceEvent) {
+		if ev.Op == "sendfile" {
+			sends.Add(1)
+		}
+	}}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	panicOn(err)
+	defer l.Close()
+	recv := func(c net.Conn, n int) chan []byte {
+		got := make(chan []byte, 1)
+		go func() {
+			b := make([]byte, n)
+			_, err := io.ReadFull(c, b)
+			panicOn(err)
+			got <- b
+		}()
+		return got
+	}
+	check := func(what string, w net.Conn, r net.Conn, off, n int64) {
+		t.Helper()
+		got := recv(r, int(n))
+		m, err := sendRange(w, f, off, n)
+		panicOn(err)
+		if m != n || !bytes.Equal(<-got, want[off:off+n]) {
+			t.Fatalf("%v: sent %v bytes, or the wrong ones", what, m)
+		}
+	}
+
+	// to a socket, by the kernel on Linux; bigger than the
+	// socket buffer, so it has to wait for the reader.
+	client, err := net.Dial("tcp", l.Addr().String())
+	panicOn(err)
+	defer client.Close()
+	server, err := l.Accept()
+	panicOn(err)
+	defer server.Close()
+	check("tcp", server, client, 100, 3<<20-200)
+	if runtime.GOOS == "linux" && sends.Load() == 0 {
+		t.Fatalf("no sendfile(2) to a TCP socket")
+	}
+
+	// not a socket: copied, with the same result.
+	sends.Store(0)
+	pw, pr := net.Pipe()
+	check("pipe", pw, pr, 4096, 1<<20)
+	if sends.Load() != 0 {
+		t.Fatalf("sendfile(2) to a pipe")
+	}
+
+	// past the end, either way.
+	go io.Copy(io.Discard, client)
+	go io.Copy(io.Discard, pr)
+	for _, w := range []net.Conn{server, pw} {
+		if _, err = sendRange(w, f, 3<<20-10, 20); !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Fatalf("sending past the end: %v", err)
+		}
+	}
+}
+
+func TestHTTPHandlerNoChecksum(t *testing.T) {
+	dir := t.TempDir()
+	sz, spans := testSpans()
+	src := makeTestSparse(t, filepath.Join(dir, "src.img"), sz, spans)
+	defer src.Close()
+	want := readAll(t, NewOSFile(src))
+	ts := httptest.NewServer(NewHTTPHandler(NewOSFile(src), nil))
+	defer ts.Close()
+
+	// a plain range request gets a Content-Length, and no
+	// trailer, so that net/http can sendfile(2) the body from
+	// a second open of the file.
+	if runtime.GOOS == "linux" {
+		fd, err := reopenFile(src)
+		panicOn(err)
+		fd.Close()
+	}
+	req, err := http.NewRequest(http.MethodGet, ts.URL, nil)
+	panicOn(err)
+	req.Header.Set("Range", "bytes=3145728-3276799")
+	resp, err := http.DefaultClient.Do(req)
+	panicOn(err)
+	defer resp.Body.Close()
+	got, err := io.ReadAll(resp.Body)
+	panicOn(err)
+	if resp.StatusCode != http.StatusPartialContent || resp.ContentLength != 131072 ||
+		!bytes.Equal(got, want[3<<20:3<<20+131072]) {
+		t.Fatalf("range: %v, length %v", resp.Status, resp.ContentLength)
+	}
+	if resp.Trailer.Get(sumTrailer) != "" {
+		t.Fatalf("checksum trailer nobody asked for")
+	}
+}
@@ -0,0 +1,40 @@
+package sparsified
+
+import (
+	"context"
+	"net"
+	"sync"
+)
+
+// serveListener accepts connections on l and hands each to
+// serve on its own goroutine, until ctx is done or Accept
+// fails. It closes l, and cancels the context of every
+// connection before waiting for them, so that idle clients
+// cannot hold it up. what names the server in the log.
+func serveListener(ctx context.Context, l net.Listener, what string, opts *Options, serve func(context.Context, net.Conn) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	var wg sync.WaitGroup
+	defer func() {
+		cancel()
+		wg.Wait()
+	}()
+	stop := context.AfterFunc(ctx, func() { l.Close() })
+	defer stop()
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			l.Close()
+			return err
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := serve(ctx, c); err != nil {
+				optHooks(opts).log.Debug("sparsified: "+what+" connection ended", "remote", c.RemoteAddr(), "err", err)
+			}
+		}()
+	}
+}
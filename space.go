@@ -0,0 +1,205 @@
+package sparsified
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"syscall"
+)
+
+// DefaultSpaceMargin is a sensible Options.SpaceMargin for
+// filesystems shared with other writers. It is not applied
+// unless asked for: a zero SpaceMargin only needs the
+// writes to fit.
+const DefaultSpaceMargin = 64 << 20
+
+// NoSpaceError says a set of writes would not fit in the
+// free space of the filesystem. CheckFillable returns it
+// inside a *SparseOpError with Errno ENOSPC, so errors.Is
+// matches syscall.ENOSPC and ErrShortAlloc, and errors.As
+// finds the numbers.
+type NoSpaceError struct {
+	// Need is the bytes the writes would newly allocate,
+	// Avail what the filesystem has free for unprivileged
+	// users, and Margin what was to be kept free.
+	Need   int64
+	Avail  int64
+	Margin int64
+}
+
+func (e *NoSpaceError) Error() string {
+	return fmt.Sprintf("writes would allocate %v bytes, but only %v are free, less a margin of %v",
+		e.Need, e.Avail, e.Margin)
+}
+
+// Is matches syscall.ENOSPC.
+func (e *NoSpaceError) Is(target error) bool {
+	return target == syscall.ENOSPC
+}
+
+// CheckFillable works out how many bytes writing the ranges
+// of f would newly allocate: the parts of them over holes or
+// past EOF, in whole blocks. (The Hole field of ranges is
+// ignored, and overlaps count once.) It then checks that
+// this fits in the free space of f's filesystem, keeping
+// Options.SpaceMargin free, and fails up front if not.
+//
+// Files without a filesystem behind them, such as a
+// MemSparseFile, are not checked; nor is anything with a
+// negative Options.SpaceMargin. need is returned regardless.
+//
+// Filesystems that share blocks (reflinks) or compress may
+// need less than this, never more.
+func CheckFillable(f SparseFile, ranges []Extent, opts *Options) (need int64, err error) {
+	defer func() { err = opError("checkfillable", f.Name(), 0, 0, err) }()
+	need, err = fillNeed(f, ranges)
+	if err != nil {
+		return 0, err
+	}
+	return need, checkSpace(f, need, 0, opts)
+}
+
+// fillNeed is the measuring part of CheckFillable.
+func fillNeed(f SparseFile, ranges []Extent) (need int64, err error) {
+	size, err := sparseSize(f)
+	if err != nil {
+		return 0, err
+	}
+	exts, err := f.Extents()
+	if err != nil {
+		return 0, err
+	}
+	bs := blockSizeOf(f)
+	// everything past EOF is one big hole.
+	holes := []Extent{{Offset: size, Length: maxMemFileSize - size, Hole: true}}
+	for _, e := range exts {
+		if e.Hole {
+			holes = append(holes, e)
+		}
+	}
+	for _, r := range blockRanges(ranges, bs) {
+		for _, h := range holes {
+			// blocks wholly inside the hole; a partial block at
+			// either end is a data block, already allocated,
+			// unless the hole runs to EOF.
+			beg, end := max(ceilDiv(h.Offset, bs), r.Offset), min(h.End()/bs, r.End())
+			if h.End() == size {
+				end = min(ceilDiv(size, bs), r.End())
+			}
+			if beg < end {
+				need += (end - beg) * bs
+			}
+		}
+	}
+	return need, nil
+}
+
+// blockRanges turns ranges into sorted, merged ranges of
+// block numbers, covering every block they touch.
+func blockRanges(ranges []Extent, bs int64) (blocks []Extent) {
+	for _, r := range ranges {
+		if r.Length > 0 && r.Offset >= 0 {
+			beg := r.Offset / bs
+			blocks = append(blocks, Extent{Offset: beg, Length: ceilDiv(r.End(), bs) - beg})
+		}
+	}
+	slices.SortFunc(blocks, func(a, b Extent) int { return int(a.Offset - b.Offset) })
+	merged := blocks[:0]
+	for _, b := range blocks {
+		if k := len(merged) - 1; k >= 0 && b.Offset <= merged[k].End() {
+			merged[k].Length = max(merged[k].End(), b.End()) - merged[k].Offset
+			continue
+		}
+		merged = append(merged, b)
+	}
+	return merged
+}
+
+// checkSpace fails with a *NoSpaceError if need bytes do not
+// fit in the free space of f's filesystem, counting freed
+// bytes that are about to be released as free too.
+func checkSpace(f SparseFile, need, freed int64, opts *Options) error {
+	var margin int64
+	if opts != nil {
+		margin = opts.SpaceMargin
+	}
+	fd := osFileOf(f)
+	if margin < 0 || fd == nil || need == 0 {
+		return nil
+	}
+	avail, err := statfsAvail(fd)
+	if err != nil {
+		// no statfs, no check.
+		optHooks(opts).log.Debug("sparsified: cannot check free space", "path", f.Name(), "err", err)
+		return nil
+	}
+	if need > avail+freed-margin {
+		return &SparseOpError{Op: "checkfillable", Path: f.Name(), Errno: syscall.ENOSPC,
+			Err: &NoSpaceError{Need: need, Avail: avail + freed, Margin: margin}}
+	}
+	return nil
+}
+
+// ensureSpace is the check Copy and the image imports make
+// before writing the data ranges into dst; holes in ranges
+// are skipped. Starting afresh (resume 0), they truncate dst
+// first, which frees whatever it holds and leaves all of the
+// ranges to be allocated; when resuming, only what lies in
+// the holes of dst past resume.
+func ensureSpace(dst SparseFile, ranges []Extent, resume int64, opts *Options) error {
+	if opts != nil && opts.SpaceMargin < 0 {
+		return nil
+	}
+	var todo []Extent
+	for _, r := range ranges {
+		if r.Hole {
+			continue
+		}
+		if beg := max(r.Offset, resume); beg < r.End() {
+			todo = append(todo, Extent{Offset: beg, Length: r.End() - beg})
+		}
+	}
+	if resume > 0 {
+		need, err := fillNeed(dst, todo)
+		if err != nil {
+			return err
+		}
+		return checkSpace(dst, need, 0, opts)
+	}
+	bs := blockSizeOf(dst)
+	var need int64
+	for _, b := range blockRanges(todo, bs) {
+		need += b.Length * bs
+	}
+	freed, _ := storageOf(dst)
+	return checkSpace(dst, need, freed, opts)
+}
+
+// osFileOf returns the *os.File behind f, if there is one.
+func osFileOf(f SparseFile) *os.File {
+	switch f := f.(type) {
+	case *OSFile:
+		return f.File
+	case *EmulatedFile:
+		return f.File
+	case *FaultFile:
+		return osFileOf(f.SparseFile)
+	}
+	return nil
+}
+
+// blockSizeOf returns the block size f allocates in.
+func blockSizeOf(f SparseFile) int64 {
+	switch f := f.(type) {
+	case *MemSparseFile:
+		return f.bs
+	case *EmulatedFile:
+		return f.BlockSize
+	case *FaultFile:
+		return blockSizeOf(f.SparseFile)
+	}
+	if fi, err := f.Stat(); err == nil && fi.Sys() != nil {
+		return statBlockSize(fi)
+	}
+	return 4096
+}
@@ -0,0 +1,114 @@
+package sparsified
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"math"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestCheckFillable(t *testing.T) {
+	// a MemSparseFile: [data 4K][hole 8K][data 4K], size 16K.
+	m := NewMemSparseFile("mem.img", 4096)
+	_, err := m.WriteAt([]byte("a"), 0)
+	panicOn(err)
+	_, err = m.WriteAt([]byte("b"), 12288)
+	panicOn(err)
+	for _, c := range []struct {
+		ranges []Extent
+		want   int64
+	}{
+		{nil, 0},
+		{[]Extent{{Offset: 0, Length: 4096}}, 0},
+		{[]Extent{{Offset: 100, Length: 5000}}, 4096},
+		{[]Extent{{Offset: 0, Length: 16384}}, 8192},
+		// overlaps count once.
+		{[]Extent{{Offset: 4096, Length: 4096}, {Offset: 4000, Length: 200}, {Offset: 6000, Length: 5000}}, 8192},
+		// past EOF is all new.
+		{[]Extent{{Offset: 16384, Length: 1}, {Offset: 1 << 20, Length: 8192}}, 12288},
+	} {
+		need, err := CheckFillable(m, c.ranges, nil)
+		panicOn(err)
+		if need != c.want {
+			t.Fatalf("ranges %+v: need %v, want %v", c.ranges, need, c.want)
+		}
+	}
+
+	// a real file, against a margin nobody has.
+	fd, err := os.Create(filepath.Join(t.TempDir(), "f.img"))
+	panicOn(err)
+	defer fd.Close()
+	f := NewOSFile(fd)
+	panicOn(f.Truncate(1 << 20))
+	big := []Extent{{Offset: 0, Length: 1 << 20}}
+	need, err := CheckFillable(f, big, nil)
+	if errors.Is(err, ErrNotSupported) {
+		t.Skipf("no statfs: %v", err)
+	}
+	panicOn(err)
+	if need != 1<<20 {
+		t.Fatalf("empty 1MB file: need %v", need)
+	}
+	_, err = CheckFillable(f, big, &Options{SpaceMargin: math.MaxInt64 / 2})
+	var nse *NoSpaceError
+	if !errors.As(err, &nse) || !errors.Is(err, syscall.ENOSPC) || !errors.Is(err, ErrShortAlloc) {
+		t.Fatalf("huge margin: %v", err)
+	}
+	if nse.Need != 1<<20 || nse.Margin != math.MaxInt64/2 {
+		t.Fatalf("NoSpaceError %+v", nse)
+	}
+	if _, err = CheckFillable(f, big, &Options{SpaceMargin: -1}); err != nil {
+		t.Fatalf("negative margin still checked: %v", err)
+	}
+
+	// no margin unless asked: writes 32MB short of filling
+	// the filesystem fit, but not with DefaultSpaceMargin.
+	avail, err := statfsAvail(fd)
+	panicOn(err)
+	if avail < 128<<20 {
+		t.Skipf("only %v bytes free", avail)
+	}
+	most := []Extent{{Offset: 0, Length: (avail - 32<<20) / 4096 * 4096}}
+	if _, err = CheckFillable(f, most, nil); err != nil {
+		t.Fatalf("zero margin: %v", err)
+	}
+	if _, err = CheckFillable(f, most, &Options{SpaceMargin: DefaultSpaceMargin}); !errors.As(err, &nse) {
+		t.Fatalf("default margin: %v", err)
+	}
+}
+
+func TestCopyNoSpace(t *testing.T) {
+	src := NewMemSparseFile("src.img", 4096)
+	_, err := src.WriteAt(bytes.Repeat([]byte("x"), 64<<10), 1<<20)
+	panicOn(err)
+
+	fd, err := os.Create(filepath.Join(t.TempDir(), "dst.img"))
+	panicOn(err)
+	defer fd.Close()
+	_, err = fd.Write([]byte("precious"))
+	panicOn(err)
+	dst := NewOSFile(fd)
+
+	_, err = Copy(context.Background(), dst, src, &Options{SpaceMargin: math.MaxInt64 / 2})
+	if errors.Is(err, ErrNotSupported) || err == nil {
+		t.Skipf("no free space check here: %v", err)
+	}
+	if !errors.Is(err, syscall.ENOSPC) {
+		t.Fatalf("copy with a huge margin: %v", err)
+	}
+	// failed up front: dst untouched.
+	if got := readAll(t, dst); string(got) != "precious" {
+		t.Fatalf("dst changed to %v bytes", len(got))
+	}
+
+	// with no margin it goes through.
+	_, err = Copy(context.Background(), dst, src, nil)
+	panicOn(err)
+	if !bytes.Equal(readAll(t, dst), readAll(t, src)) {
+		t.Fatalf("copy differs")
+	}
+}
@@ -0,0 +1,218 @@
+package sparsified
+
+import (
+	"io"
+	"log/slog"
+	"os"
+	"time"
+)
+
+// SparseFile is what the higher level operations in this
+// package (Copy, image conversion, ...) need from a file.
+// Three backends are provided:
+//
+//   - OSFile wraps an *os.File and uses the kernel:
+//     SEEK_DATA/SEEK_HOLE and fallocate(2) (or fcntl(2) on Darwin).
+//   - MemSparseFile keeps the blocks in memory.
+//   - EmulatedFile wraps an *os.File but does everything
+//     in userspace, so it works on any filesystem.
+//
+// Range operations follow the Linux fallocate(2) rules;
+// see MemSparseFile for the details.
+type SparseFile interface {
+	io.ReaderAt
+	io.WriterAt
+
+	// Name is used in error messages and image descriptors.
+	Name() string
+	Truncate(size int64) error
+
+	// Extents returns the hole map covering [0, size).
+	Extents() ([]Extent, error)
+
+	PunchHole(off, length int64) error
+	CollapseRange(off, length int64) error
+	InsertRange(off, length int64) error
+	Sync() error
+	Stat() (os.FileInfo, error)
+}
+
+// RangeCopier is optionally implemented by a SparseFile that
+// can copy from src without a round trip through userspace,
+// as copy_file_range(2) does. Like the syscall, it may copy
+// fewer than n bytes; callers loop, and fall back to
+// ReadAt/WriteAt on errors.ErrUnsupported.
+type RangeCopier interface {
+	CopyRangeFrom(src SparseFile, srcOff, dstOff, n int64) (int64, error)
+}
+
+// Allocator is optionally implemented by a SparseFile that can
+// preallocate blocks, as fallocate(2) with mode 0 does. It
+// returns the number of bytes allocated, and ErrShortAlloc
+// if that was less than length.
+type Allocator interface {
+	Allocate(off, length int64) (allocated int64, err error)
+}
+
+// ZeroRanger is optionally implemented by a SparseFile that
+// can zero a range as fallocate(2) with FALLOC_FL_ZERO_RANGE
+// (and no KEEP_SIZE) does: the range reads back as zeros,
+// without writing them, and the file grows if need be.
+type ZeroRanger interface {
+	ZeroRange(off, length int64) error
+}
+
+var (
+	_ ZeroRanger = &OSFile{}
+	_ ZeroRanger = &MemSparseFile{}
+	_ ZeroRanger = &EmulatedFile{}
+)
+
+var (
+	_ SparseFile = &OSFile{}
+	_ SparseFile = &MemSparseFile{}
+	_ SparseFile = &EmulatedFile{}
+)
+
+// OSFile is the SparseFile backed by the kernel.
+// Collapse and insert are only available on Linux;
+// elsewhere they return an error matching ErrNotSupported.
+type OSFile struct {
+	*os.File
+
+	// Logger and Trace, if set, override SetLogger and
+	// SetTrace for this file.
+	Logger *slog.Logger
+	Trace  TraceFunc
+}
+
+// NewOSFile wraps fd.
+func NewOSFile(fd *os.File) *OSFile {
+	return &OSFile{File: fd}
+}
+
+func (f *OSFile) hooks() hooks {
+	return newHooks(f.Logger, f.Trace)
+}
+
+// ReadAt, WriteAt, Truncate and Sync are those of the
+// *os.File, traced, with errors as *SparseOpError. ReadAt
+// still returns a bare io.EOF.
+
+func (f *OSFile) ReadAt(p []byte, off int64) (int, error) {
+	n, err := f.hooks().do("readat", f.File, off, int64(len(p)), func() (int64, error) {
+		n, err := f.File.ReadAt(p, off)
+		return int64(n), err
+	})
+	if err == io.EOF {
+		return int(n), err
+	}
+	return int(n), opError("readat", f.Name(), off, int64(len(p)), err)
+}
+
+func (f *OSFile) WriteAt(p []byte, off int64) (int, error) {
+	n, err := f.hooks().do("writeat", f.File, off, int64(len(p)), func() (int64, error) {
+		n, err := f.File.WriteAt(p, off)
+		return int64(n), err
+	})
+	return int(n), opError("writeat", f.Name(), off, int64(len(p)), err)
+}
+
+func (f *OSFile) Truncate(size int64) error {
+	_, err := f.hooks().do("truncate", f.File, size, 0, func() (int64, error) {
+		return 0, f.File.Truncate(size)
+	})
+	return opError("truncate", f.Name(), size, 0, err)
+}
+
+func (f *OSFile) Sync() error {
+	_, err := f.hooks().do("sync", f.File, 0, 0, func() (int64, error) {
+		return 0, f.File.Sync()
+	})
+	return opError("sync", f.Name(), 0, 0, err)
+}
+
+// Extents returns the kernel's hole map of the file.
+func (f *OSFile) Extents() ([]Extent, error) {
+	return extents(f.hooks(), f.File)
+}
+
+// PunchHole deallocates [off, off+length), keeping the size.
+func (f *OSFile) PunchHole(off, length int64) error {
+	return osPunchHole(f.hooks(), f.File, off, length)
+}
+
+// CollapseRange removes [off, off+length) from the file.
+func (f *OSFile) CollapseRange(off, length int64) error {
+	return osCollapseRange(f.hooks(), f.File, off, length)
+}
+
+// InsertRange inserts a hole of length bytes at off.
+func (f *OSFile) InsertRange(off, length int64) error {
+	return osInsertRange(f.hooks(), f.File, off, length)
+}
+
+// ZeroRange zeroes [off, off+length), extending the file
+// if need be. Only Linux has this; elsewhere it returns
+// an error matching ErrNotSupported.
+func (f *OSFile) ZeroRange(off, length int64) error {
+	return osZeroRange(f.hooks(), f.File, off, length)
+}
+
+// CopyRangeFrom uses copy_file_range(2) when src is also
+// an *OSFile, on Linux. Otherwise it returns an error
+// matching ErrNotSupported.
+func (f *OSFile) CopyRangeFrom(src SparseFile, srcOff, dstOff, n int64) (int64, error) {
+	s, ok := src.(*OSFile)
+	if !ok {
+		return 0, opError("copyrange", f.Name(), dstOff, n, ErrNotSupported)
+	}
+	return osCopyRange(f.hooks(), f.File, s.File, srcOff, dstOff, n)
+}
+
+// Allocate preallocates [off, off+length), extending
+// the file if need be; see Preallocate.
+func (f *OSFile) Allocate(off, length int64) (int64, error) {
+	return preallocate(f.hooks(), f.File, off, length, false)
+}
+
+// Sync is a no-op for a MemSparseFile.
+func (m *MemSparseFile) Sync() error {
+	return nil
+}
+
+// Stat returns a FileInfo for a MemSparseFile.
+func (m *MemSparseFile) Stat() (os.FileInfo, error) {
+	return &memFileInfo{name: m.name, size: m.Size()}, nil
+}
+
+type memFileInfo struct {
+	name string
+	size int64
+}
+
+func (fi *memFileInfo) Name() string       { return fi.name }
+func (fi *memFileInfo) Size() int64        { return fi.size }
+func (fi *memFileInfo) Mode() os.FileMode  { return 0644 }
+func (fi *memFileInfo) ModTime() time.Time { return time.Time{} }
+func (fi *memFileInfo) IsDir() bool        { return false }
+func (fi *memFileInfo) Sys() any           { return nil }
+
+// sparseSize returns the apparent size of f.
+func sparseSize(f SparseFile) (int64, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return -1, err
+	}
+	return fi.Size(), nil
+}
+
+// onlyData filters exts down to the data extents.
+func onlyData(exts []Extent) (data []Extent) {
+	for _, e := range exts {
+		if !e.Hole {
+			data = append(data, e)
+		}
+	}
+	return
+}
@@ -0,0 +1,117 @@
+package sparsified
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testBackends returns a fresh, empty file for each backend.
+func testBackends(t *testing.T) map[string]SparseFile {
+	dir := t.TempDir()
+	open := func(name string) *os.File {
+		fd, err := os.Create(filepath.Join(dir, name))
+		panicOn(err)
+		t.Cleanup(func() { fd.Close() })
+		return fd
+	}
+	return map[string]SparseFile{
+		"os":       NewOSFile(open("os.img")),
+		"mem":      NewMemSparseFile("mem.img", 4096),
+		"emulated": NewEmulatedFile(open("emulated.img"), 4096),
+	}
+}
+
+func readAll(t *testing.T, f SparseFile) []byte {
+	t.Helper()
+	sz, err := sparseSize(f)
+	panicOn(err)
+	b, err := io.ReadAll(io.NewSectionReader(f, 0, sz))
+	panicOn(err)
+	return b
+}
+
+// every backend should agree on content and holes after
+// the same sequence of range operations.
+func TestSparseFileBackendsAgree(t *testing.T) {
+	const bs = 4096
+	for name, f := range testBackends(t) {
+		t.Run(name, func(t *testing.T) {
+			panicOn(f.Truncate(16 * bs))
+			for _, blk := range []int64{1, 2, 3, 8, 9, 15} {
+				_, err := f.WriteAt(bytes.Repeat([]byte{byte(blk)}, bs), blk*bs)
+				panicOn(err)
+			}
+			want := readAll(t, f)
+
+			panicOn(f.PunchHole(2*bs, bs))
+			copy(want[2*bs:3*bs], make([]byte, bs))
+
+			err := f.CollapseRange(4*bs, 2*bs)
+			if errors.Is(err, errors.ErrUnsupported) {
+				t.Skipf("%v: no collapse range here", name)
+			}
+			panicOn(err)
+			want = append(want[:4*bs], want[6*bs:]...)
+
+			panicOn(f.InsertRange(bs, bs))
+			want = append(want[:bs], append(make([]byte, bs), want[bs:]...)...)
+
+			if got := readAll(t, f); !bytes.Equal(got, want) {
+				t.Fatalf("%v: content differs from the expected", name)
+			}
+			exts, err := f.Extents()
+			panicOn(err)
+			// data: block 2 (was 1), block 4 (was 3),
+			// blocks 7..8 (were 8..9 after the collapse+insert), block 15.
+			wantData := []Extent{
+				{Offset: 2 * bs, Length: bs},
+				{Offset: 4 * bs, Length: bs},
+				{Offset: 7 * bs, Length: 2 * bs},
+				{Offset: 14 * bs, Length: bs},
+			}
+			got := onlyData(exts)
+			if len(got) != len(wantData) {
+				t.Fatalf("%v: data extents: want %+v\n got %+v", name, wantData, got)
+			}
+			for i := range got {
+				if got[i] != wantData[i] {
+					t.Fatalf("%v: data extents: want %+v\n got %+v", name, wantData, got)
+				}
+			}
+		})
+	}
+}
+
+// Copy between any two backends preserves content and holes.
+func TestCopyAcrossBackends(t *testing.T) {
+	src := NewMemSparseFile("src", 4096)
+	panicOn(src.Truncate(1 << 20))
+	_, err := src.WriteAt([]byte("at the start"), 0)
+	panicOn(err)
+	_, err = src.WriteAt(bytes.Repeat([]byte("x"), 10000), 300000)
+	panicOn(err)
+	want := readAll(t, src)
+	wantExts, err := src.Extents()
+	panicOn(err)
+
+	for name, dst := range testBackends(t) {
+		n, err := Copy(context.Background(), dst, src, nil)
+		panicOn(err)
+		if n != 4096+3*4096 {
+			t.Fatalf("%v: copied %v data bytes", name, n)
+		}
+		if !bytes.Equal(readAll(t, dst), want) {
+			t.Fatalf("%v: content differs after Copy", name)
+		}
+		exts, err := dst.Extents()
+		panicOn(err)
+		if len(exts) != len(wantExts) {
+			t.Fatalf("%v: extents: want %+v\n got %+v", name, wantExts, exts)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package sparsified
+
+import "context"
+
+// sparsifyBlock is the granularity at which Sparsify
+// looks for zeros. It matches the usual filesystem block.
+const sparsifyBlock = 4096
+
+// Sparsify punches a hole over every all-zero, 4KB aligned
+// block inside the data extents of f, turning a dense file
+// (say, one copied without hole support) back into a sparse
+// one. The content never changes. It returns the number of
+// bytes punched.
+//
+// If ctx is canceled, Sparsify stops between chunks and
+// returns ctx.Err(). Since punching zeros does not change
+// what the file reads as, f is always consistent, and
+// Sparsify can simply be run again.
+func Sparsify(ctx context.Context, f SparseFile, opts *Options) (punched int64, err error) {
+	defer func() { err = opError("sparsify", f.Name(), 0, 0, err) }()
+	f = withHooks(f, opts)
+	size, err := sparseSize(f)
+	if err != nil {
+		return 0, err
+	}
+	exts, err := f.Extents()
+	if err != nil {
+		return 0, err
+	}
+	pr := newProgress(ctx, "sparsify", opts, size, dataBytes(exts))
+	ring := newBulk(opts, f)
+	if ring != nil {
+		defer ring.close()
+	}
+	punched, err = sparsifyExtents(pr, f, size, exts, ring)
+	return punched, pr.done(err)
+}
+
+func sparsifyExtents(pr *progress, f SparseFile, size int64, exts []Extent, ring *uring) (punched int64, err error) {
+	const bs = sparsifyBlock
+	buf := make([]byte, copyChunk)
+	var holes []Extent
+	for _, e := range exts {
+		if e.Hole {
+			if err = pr.hole(e.Offset, e.Length); err != nil {
+				return
+			}
+			continue
+		}
+		// only whole blocks can be freed; the partial ones
+		// at either end of the extent are left alone, except
+		// at EOF where a punch frees the partial last block.
+		beg := ceilDiv(e.Offset, bs) * bs
+		for off := beg; off < e.End(); {
+			k := min(int64(len(buf)), e.End()-off)
+			if err = readChunk(f, buf[:k], off, ring); err != nil {
+				return
+			}
+			holes = holes[:0]
+			for b := int64(0); b < k; b += bs {
+				blk := buf[b:min(b+bs, k)]
+				whole := int64(len(blk)) == bs || off+k == size
+				if !whole || !isZero(blk) {
+					continue
+				}
+				if n := len(holes) - 1; n >= 0 && holes[n].End() == off+b {
+					holes[n].Length += int64(len(blk))
+				} else {
+					holes = append(holes, Extent{Offset: off + b, Length: int64(len(blk)), Hole: true})
+				}
+			}
+			if ring != nil {
+				err = bulkPunchHoles(ring, f, holes)
+			} else {
+				for _, h := range holes {
+					if err = f.PunchHole(h.Offset, h.Length); err != nil {
+						break
+					}
+				}
+			}
+			if err != nil {
+				return
+			}
+			for _, h := range holes {
+				punched += h.Length
+			}
+			if err = pr.data(off, k); err != nil {
+				return
+			}
+			off += k
+		}
+	}
+	return
+}
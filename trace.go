@@ -0,0 +1,140 @@
+package sparsified
+
+import (
+	"log/slog"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// TraceEvent describes one syscall this package made on a
+// file, for feeding into a tracing system.
+type TraceEvent struct {
+	// Op is the operation: "punchhole", "zerorange",
+	// "collapserange", "insertrange" and "fallocate" for the
+	// fallocate(2) modes, "preallocate" for Darwin's
+	// F_PREALLOCATE, "copyrange", "seekdata", "seekhole",
+	// "fiemap", "readat", "writeat", "truncate", "sync",
+	// "sendfile", and "uring read", "uring write" and "uring
+	// punchhole" for io_uring submissions.
+	Op string
+
+	Fd     uintptr
+	Path   string
+	Offset int64
+	Length int64
+
+	Duration time.Duration
+
+	// Result is what the call returned where that means
+	// something: bytes moved, or the offset seeked to.
+	Result int64
+	Err    error
+}
+
+// TraceFunc receives a TraceEvent after each syscall. It is
+// called from the goroutine that made the call, which may
+// be one of several Copy workers, so it must be safe for
+// concurrent use, and should be quick.
+type TraceFunc func(TraceEvent)
+
+var (
+	globalLogger atomic.Pointer[slog.Logger]
+	globalTrace  atomic.Pointer[TraceFunc]
+)
+
+var silentLogger = slog.New(slog.DiscardHandler)
+
+// SetLogger sets the logger for the whole package, for where
+// no Options.Logger or OSFile.Logger says otherwise. The
+// package logs at Debug level only, about fallbacks and
+// other things that are not errors. The default, and what
+// a nil l restores, is to log nothing.
+func SetLogger(l *slog.Logger) {
+	globalLogger.Store(l)
+}
+
+// SetTrace sets the trace hook for the whole package, for
+// where no Options.Trace or OSFile.Trace says otherwise.
+// nil, the default, turns tracing off.
+func SetTrace(fn TraceFunc) {
+	if fn == nil {
+		globalTrace.Store(nil)
+		return
+	}
+	globalTrace.Store(&fn)
+}
+
+// hooks are the logger and trace function in effect
+// for an operation.
+type hooks struct {
+	log   *slog.Logger
+	trace TraceFunc
+}
+
+// newHooks fills in what log and trace leave unset
+// from the package-wide settings.
+func newHooks(log *slog.Logger, trace TraceFunc) hooks {
+	if log == nil {
+		log = globalLogger.Load()
+		if log == nil {
+			log = silentLogger
+		}
+	}
+	if trace == nil {
+		if p := globalTrace.Load(); p != nil {
+			trace = *p
+		}
+	}
+	return hooks{log: log, trace: trace}
+}
+
+// defaultHooks are the package-wide settings.
+func defaultHooks() hooks {
+	return newHooks(nil, nil)
+}
+
+// optHooks are the hooks for an operation run with opts.
+func optHooks(opts *Options) hooks {
+	if opts == nil {
+		return defaultHooks()
+	}
+	return newHooks(opts.Logger, opts.Trace)
+}
+
+// do makes the syscall in call and traces it.
+func (h hooks) do(op string, fd *os.File, off, length int64, call func() (int64, error)) (int64, error) {
+	if h.trace == nil {
+		return call()
+	}
+	t0 := time.Now()
+	res, err := call()
+	h.trace(TraceEvent{
+		Op:       op,
+		Fd:       fd.Fd(),
+		Path:     fd.Name(),
+		Offset:   off,
+		Length:   length,
+		Duration: time.Since(t0),
+		Result:   res,
+		Err:      err,
+	})
+	return res, err
+}
+
+// withHooks gives f the hooks of opts, if f is an *OSFile
+// and opts sets any; otherwise f is returned as it is.
+func withHooks(f SparseFile, opts *Options) SparseFile {
+	o, ok := f.(*OSFile)
+	if !ok || opts == nil || (opts.Logger == nil && opts.Trace == nil) {
+		return f
+	}
+	cp := *o
+	if opts.Logger != nil {
+		cp.Logger = opts.Logger
+	}
+	if opts.Trace != nil {
+		cp.Trace = opts.Trace
+	}
+	return &cp
+}
@@ -0,0 +1,136 @@
+package sparsified
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// traceLog collects trace events.
+type traceLog struct {
+	mu  sync.Mutex
+	evs []TraceEvent
+}
+
+func (tl *traceLog) fn(e TraceEvent) {
+	tl.mu.Lock()
+	tl.evs = append(tl.evs, e)
+	tl.mu.Unlock()
+}
+
+func (tl *traceLog) ops() map[string]int {
+	tl.mu.Lock()
+	defer tl.mu.Unlock()
+	m := make(map[string]int)
+	for _, e := range tl.evs {
+		m[e.Op]++
+	}
+	return m
+}
+
+func TestTrace(t *testing.T) {
+	dir := t.TempDir()
+	fd, err := os.Create(filepath.Join(dir, "traced.img"))
+	panicOn(err)
+	defer fd.Close()
+
+	var global, local traceLog
+	SetTrace(global.fn)
+	defer SetTrace(nil)
+
+	f := NewOSFile(fd)
+	_, err = f.WriteAt(bytes.Repeat([]byte{1}, 64<<10), 0)
+	panicOn(err)
+	if err = f.PunchHole(4096, 4096); err != nil {
+		t.Skipf("no hole punching here: %v", err)
+	}
+	_, err = f.Extents()
+	panicOn(err)
+
+	got := global.ops()
+	if got["writeat"] != 1 || got["punchhole"] != 1 || got["seekdata"] == 0 || got["seekhole"] == 0 {
+		t.Fatalf("global trace saw %v", got)
+	}
+	for _, e := range global.evs {
+		if e.Op == "punchhole" {
+			if e.Offset != 4096 || e.Length != 4096 || e.Path != fd.Name() || e.Fd != fd.Fd() || e.Err != nil {
+				t.Fatalf("punchhole event: %+v", e)
+			}
+		}
+	}
+
+	// per file beats global.
+	nglobal := len(global.evs)
+	f.Trace = local.fn
+	f.PunchHole(-1, 10)
+	if len(global.evs) != nglobal || local.ops()["punchhole"] != 1 || local.evs[0].Err == nil {
+		t.Fatalf("per-file trace: local %+v", local.evs)
+	}
+	f.Trace = nil
+
+	// and per call beats both, for the files of the call.
+	for _, engine := range testEngines {
+		var call traceLog
+		dfd, err := os.Create(filepath.Join(dir, "copy-"+engine.String()+".img"))
+		panicOn(err)
+		nglobal = len(global.evs)
+		_, err = Copy(context.Background(), NewOSFile(dfd), f, &Options{Trace: call.fn, Engine: engine})
+		dfd.Close()
+		panicOn(err)
+		got = call.ops()
+		if got["truncate"] == 0 || got["sync"] != 1 {
+			t.Fatalf("%v: copy traced %v", engine, got)
+		}
+		if engine == EngineIOUring {
+			if r, err := newURing(); err == nil {
+				r.close()
+				if got["uring read"] == 0 || got["uring write"] == 0 {
+					t.Fatalf("io_uring copy traced %v", got)
+				}
+			}
+		}
+		if len(global.evs) != nglobal {
+			t.Fatalf("%v: copy went to the global trace", engine)
+		}
+	}
+}
+
+func TestLogger(t *testing.T) {
+	var buf bytes.Buffer
+	log := slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+
+	fd, err := os.Create(filepath.Join(t.TempDir(), "dst.img"))
+	panicOn(err)
+	defer fd.Close()
+	src := NewMemSparseFile("src.img", 4096)
+	_, err = src.WriteAt([]byte("data"), 0)
+	panicOn(err)
+
+	// an OSFile cannot copy_file_range from memory, which is
+	// worth a debug line, once.
+	_, err = Copy(context.Background(), NewOSFile(fd), src, &Options{Logger: log})
+	panicOn(err)
+	if n := strings.Count(buf.String(), "copying by hand"); n != 1 {
+		t.Fatalf("want one fallback message, got %q", buf.String())
+	}
+
+	// the default is silence; a global logger hears it.
+	buf.Reset()
+	_, err = Copy(context.Background(), NewOSFile(fd), src, nil)
+	panicOn(err)
+	if buf.Len() != 0 {
+		t.Fatalf("default logger said %q", buf.String())
+	}
+	SetLogger(log)
+	defer SetLogger(nil)
+	_, err = Copy(context.Background(), NewOSFile(fd), src, nil)
+	panicOn(err)
+	if !strings.Contains(buf.String(), "copying by hand") {
+		t.Fatalf("global logger heard nothing")
+	}
+}
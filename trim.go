@@ -0,0 +1,162 @@
+package sparsified
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// TrimEOFPrealloc releases the storage allocated past the
+// end of f, such as XFS speculative EOF preallocation or
+// fallocate(2) with FALLOC_FL_KEEP_SIZE, keeping the size
+// and content as they are. It returns the bytes of storage
+// reclaimed. f must be open for writing.
+//
+// Files without anything past EOF are not touched at all.
+// Otherwise TrimEOFPrealloc tries, until nothing is left:
+// punching a hole over the blocks past EOF (XFS frees them;
+// ext4 ignores punches past EOF), then truncating to the
+// current size, which both ext4 and XFS take as the cue to
+// free everything past it.
+//
+// The truncate makes it unsafe on a file that something
+// else is appending to: an append landing between reading
+// the size and truncating would be cut off.
+func TrimEOFPrealloc(f *os.File) (reclaimed int64, err error) {
+	defer func() { err = opError("trim", f.Name(), 0, 0, err) }()
+	h := defaultHooks()
+	size, before, post, err := eofPrealloc(f, true)
+	if err != nil || post == 0 {
+		return 0, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	eof := ceilDiv(size, statBlockSize(fi)) * statBlockSize(fi)
+	endx := eof + post
+	if aexts, err := allocatedExtents(h, f, true); err == nil && len(aexts) > 0 {
+		// the extents past EOF need not start right at it.
+		endx = max(endx, aexts[len(aexts)-1].End())
+	}
+	// a punch that fails (EOPNOTSUPP, say) is no matter;
+	// the truncate is the one that counts on ext4.
+	if perr := osPunchHole(h, f, eof, endx-eof); perr != nil {
+		h.log.Debug("sparsified: punching past EOF failed, will truncate", "path", f.Name(), "err", perr)
+	}
+	if _, _, post, err = eofPrealloc(f, true); err != nil {
+		return 0, err
+	}
+	if post > 0 {
+		_, err = h.do("truncate", f, size, 0, func() (int64, error) {
+			return 0, f.Truncate(size)
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+	fi, err = f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return max(before-statAllocated(fi), 0), nil
+}
+
+// eofPrealloc returns the size of f, its allocated storage,
+// and how much of that is past EOF. sync is as for
+// allocatedExtents.
+func eofPrealloc(f *os.File, sync bool) (size, allocated, post int64, err error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return
+	}
+	size = fi.Size()
+	allocated = statAllocated(fi)
+	post, _, err = postEOF(f, size, allocated, statBlockSize(fi), sync)
+	return
+}
+
+// TrimOptions tunes TrimTree.
+type TrimOptions struct {
+	// ScanOptions chooses the files, as for ScanTree.
+	ScanOptions
+
+	// DryRun only measures what could be reclaimed.
+	DryRun bool
+}
+
+// TrimmedFile is a file that had storage past EOF.
+type TrimmedFile struct {
+	Path string // relative to the root, slash separated.
+
+	// PostEOF is what was found past EOF; Reclaimed what
+	// trimming actually freed (zero on a dry run).
+	PostEOF   int64
+	Reclaimed int64
+}
+
+// TrimReport is the result of TrimTree.
+type TrimReport struct {
+	Files     []TrimmedFile
+	PostEOF   int64
+	Reclaimed int64
+
+	// Errors has the files that could not be scanned,
+	// opened for writing, or trimmed.
+	Errors []error
+}
+
+// TrimTree runs TrimEOFPrealloc on every regular file under
+// root chosen by opts, to reclaim the space that speculative
+// preallocation holds on to across a volume without running
+// xfs_fsr. Files with nothing past EOF are left alone (and
+// out of the report). The same caveat as TrimEOFPrealloc
+// applies: do not run it on files being appended to.
+func TrimTree(root string, opts *TrimOptions) (rep *TrimReport, err error) {
+	defer func() { err = opError("trimtree", root, 0, 0, err) }()
+	if opts == nil {
+		opts = &TrimOptions{}
+	}
+	scan, err := ScanTree(root, &opts.ScanOptions)
+	if err != nil {
+		return nil, err
+	}
+	rep = &TrimReport{Errors: scan.Errors}
+	for _, fu := range scan.Files {
+		tf, err := trimFile(filepath.Join(root, filepath.FromSlash(fu.Path)), opts.DryRun)
+		if err != nil {
+			rep.Errors = append(rep.Errors, err)
+			continue
+		}
+		if tf.PostEOF == 0 {
+			continue
+		}
+		tf.Path = fu.Path
+		rep.Files = append(rep.Files, tf)
+		rep.PostEOF += tf.PostEOF
+		rep.Reclaimed += tf.Reclaimed
+	}
+	return rep, nil
+}
+
+func trimFile(path string, dryRun bool) (tf TrimmedFile, err error) {
+	defer func() { err = opError("trim", path, 0, 0, err) }()
+	// measure read-only first, so that files with nothing
+	// to trim need not be writable. A dry run leaves dirty
+	// pages to be written back in their own time.
+	fd, err := os.Open(path)
+	if err != nil {
+		return tf, err
+	}
+	_, _, tf.PostEOF, err = eofPrealloc(fd, !dryRun)
+	fd.Close()
+	if err != nil || tf.PostEOF == 0 || dryRun {
+		return tf, err
+	}
+	fd, err = os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return tf, err
+	}
+	defer fd.Close()
+	tf.Reclaimed, err = TrimEOFPrealloc(fd)
+	return tf, err
+}
@@ -0,0 +1,82 @@
+package sparsified
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// preallocFile makes a 10000 byte file with 1MB of
+// KEEP_SIZE preallocation past its end.
+func preallocFile(t *testing.T, path string) *os.File {
+	fd, err := os.Create(path)
+	panicOn(err)
+	t.Cleanup(func() { fd.Close() })
+	_, err = fd.WriteAt(bytes.Repeat([]byte("data"), 2500), 0)
+	panicOn(err)
+	if err = unix.Fallocate(int(fd.Fd()), unix.FALLOC_FL_KEEP_SIZE, 1<<20, 1<<20); err != nil {
+		t.Skipf("no fallocate here: %v", err)
+	}
+	if _, err = AllocatedExtents(fd); err != nil {
+		t.Skipf("no FIEMAP here: %v", err)
+	}
+	return fd
+}
+
+func TestTrimEOFPrealloc(t *testing.T) {
+	fd := preallocFile(t, filepath.Join(t.TempDir(), "prealloc.img"))
+	_, _, post, err := eofPrealloc(fd, false)
+	panicOn(err)
+	if post != 1<<20 {
+		t.Fatalf("found %v bytes past EOF, want %v", post, 1<<20)
+	}
+
+	reclaimed, err := TrimEOFPrealloc(fd)
+	panicOn(err)
+	if reclaimed < 1<<20 {
+		t.Fatalf("reclaimed %v bytes, want at least %v", reclaimed, 1<<20)
+	}
+	fi, err := fd.Stat()
+	panicOn(err)
+	if fi.Size() != 10000 {
+		t.Fatalf("size changed to %v", fi.Size())
+	}
+	got := make([]byte, 10000)
+	_, err = fd.ReadAt(got, 0)
+	panicOn(err)
+	if !bytes.Equal(got, bytes.Repeat([]byte("data"), 2500)) {
+		t.Fatalf("content changed")
+	}
+	if reclaimed, err = TrimEOFPrealloc(fd); err != nil || reclaimed != 0 {
+		t.Fatalf("second trim: reclaimed %v, err %v", reclaimed, err)
+	}
+}
+
+func TestTrimTree(t *testing.T) {
+	root := t.TempDir()
+	preallocFile(t, filepath.Join(root, "a.img"))
+	panicOn(os.MkdirAll(filepath.Join(root, "sub"), 0755))
+	preallocFile(t, filepath.Join(root, "sub", "b.img"))
+	panicOn(os.WriteFile(filepath.Join(root, "plain.txt"), []byte("hello"), 0644))
+
+	rep, err := TrimTree(root, &TrimOptions{DryRun: true})
+	panicOn(err)
+	if len(rep.Files) != 2 || rep.PostEOF != 2<<20 || rep.Reclaimed != 0 || len(rep.Errors) > 0 {
+		t.Fatalf("dry run: %+v", rep)
+	}
+
+	rep, err = TrimTree(root, &TrimOptions{ScanOptions: ScanOptions{Exclude: []string{"sub"}}})
+	panicOn(err)
+	if len(rep.Files) != 1 || rep.Files[0].Path != "a.img" || rep.Reclaimed < 1<<20 {
+		t.Fatalf("trim excluding sub: %+v", rep)
+	}
+
+	rep, err = TrimTree(root, nil)
+	panicOn(err)
+	if len(rep.Files) != 1 || rep.Files[0].Path != "sub/b.img" || rep.Reclaimed < 1<<20 {
+		t.Fatalf("trim: %+v", rep)
+	}
+}
@@ -0,0 +1,327 @@
+package sparsified
+
+import (
+	"errors"
+	"os"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// A minimal io_uring(7), done with raw syscalls so as not to
+// need cgo or liburing. It only does what the bulk paths use:
+// READ, WRITE and FALLOCATE, submitted in batches, each batch
+// waited for before the next.
+
+const (
+	uringEntries = 64
+
+	uringOffSQRing = 0
+	uringOffCQRing = 0x8000000
+	uringOffSQEs   = 0x10000000
+
+	uringEnterGetEvents = 1
+
+	uringFeatSingleMmap = 1 << 0
+	uringFeatRWCurPos   = 1 << 3 // 5.6, along with the ops below.
+
+	uringOpFallocate = 17
+	uringOpRead      = 22
+	uringOpWrite     = 23
+)
+
+type uringSQOffsets struct {
+	Head, Tail, RingMask, RingEntries, Flags, Dropped, Array, Resv1 uint32
+	UserAddr                                                        uint64
+}
+
+type uringCQOffsets struct {
+	Head, Tail, RingMask, RingEntries, Overflow, Cqes, Flags, Resv1 uint32
+	UserAddr                                                        uint64
+}
+
+type uringParams struct {
+	SQEntries, CQEntries, Flags, SQThreadCPU, SQThreadIdle, Features, WQFd uint32
+	Resv                                                                   [3]uint32
+	SQOff                                                                  uringSQOffsets
+	CQOff                                                                  uringCQOffsets
+}
+
+type uringSQE struct {
+	Opcode      uint8
+	Flags       uint8
+	IOPrio      uint16
+	Fd          int32
+	Off         uint64
+	Addr        uint64
+	Len         uint32
+	OpFlags     uint32
+	UserData    uint64
+	BufIndex    uint16
+	Personality uint16
+	SpliceFdIn  int32
+	Addr3       uint64
+	Pad         uint64
+}
+
+type uringCQE struct {
+	UserData uint64
+	Res      int32
+	Flags    uint32
+}
+
+// uring is one ring. It is not safe for concurrent use;
+// each goroutine doing bulk I/O gets its own.
+type uring struct {
+	fd     int
+	sqRing []byte
+	cqRing []byte // aliases sqRing with IORING_FEAT_SINGLE_MMAP.
+	sqeMem []byte
+
+	sqHead, sqTail, sqMask *uint32
+	sqArray                []uint32
+	sqes                   []uringSQE
+	cqHead, cqTail, cqMask *uint32
+	cqes                   []uringCQE
+
+	h hooks // set by newBulk.
+
+	// err is set once io_uring_enter has failed: SQEs may be
+	// left unsubmitted in the ring, so it is not used again.
+	err error
+}
+
+// uringOrphans keeps the batches whose ops a failed ring may
+// still be doing, so that their buffers are never reused.
+var uringOrphans struct {
+	sync.Mutex
+	batches [][]bulkOp
+}
+
+// newURing sets up a ring. Any failure, be it ENOSYS from an
+// old kernel, EPERM from seccomp or io_uring_disabled, or a
+// kernel before 5.6 lacking the ops we need, comes back as
+// an error wrapping errors.ErrUnsupported.
+func newURing() (r *uring, err error) {
+	var p uringParams
+	fd, _, errno := unix.Syscall(unix.SYS_IO_URING_SETUP, uringEntries, uintptr(unsafe.Pointer(&p)), 0)
+	if errno != 0 {
+		return nil, &os.SyscallError{Syscall: "io_uring_setup", Err: errors.Join(errno, errors.ErrUnsupported)}
+	}
+	r = &uring{fd: int(fd)}
+	defer func() {
+		if err != nil {
+			r.close()
+		}
+	}()
+	need := uint32(uringFeatSingleMmap | uringFeatRWCurPos)
+	if p.Features&need != need {
+		return nil, &os.SyscallError{Syscall: "io_uring_setup", Err: errors.ErrUnsupported}
+	}
+
+	sqSize := int(p.SQOff.Array + p.SQEntries*4)
+	cqSize := int(p.CQOff.Cqes + p.CQEntries*uint32(unsafe.Sizeof(uringCQE{})))
+	r.sqRing, err = unix.Mmap(r.fd, uringOffSQRing, max(sqSize, cqSize),
+		unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED|unix.MAP_POPULATE)
+	if err != nil {
+		return nil, &os.SyscallError{Syscall: "mmap", Err: err}
+	}
+	r.cqRing = r.sqRing
+	r.sqeMem, err = unix.Mmap(r.fd, uringOffSQEs, int(p.SQEntries)*int(unsafe.Sizeof(uringSQE{})),
+		unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED|unix.MAP_POPULATE)
+	if err != nil {
+		return nil, &os.SyscallError{Syscall: "mmap", Err: err}
+	}
+
+	u32 := func(ring []byte, off uint32) *uint32 { return (*uint32)(unsafe.Pointer(&ring[off])) }
+	r.sqHead = u32(r.sqRing, p.SQOff.Head)
+	r.sqTail = u32(r.sqRing, p.SQOff.Tail)
+	r.sqMask = u32(r.sqRing, p.SQOff.RingMask)
+	r.sqArray = unsafe.Slice(u32(r.sqRing, p.SQOff.Array), p.SQEntries)
+	r.sqes = unsafe.Slice((*uringSQE)(unsafe.Pointer(&r.sqeMem[0])), p.SQEntries)
+	r.cqHead = u32(r.cqRing, p.CQOff.Head)
+	r.cqTail = u32(r.cqRing, p.CQOff.Tail)
+	r.cqMask = u32(r.cqRing, p.CQOff.RingMask)
+	r.cqes = unsafe.Slice((*uringCQE)(unsafe.Pointer(&r.cqRing[p.CQOff.Cqes])), p.CQEntries)
+	return r, nil
+}
+
+func (r *uring) close() {
+	if r.sqeMem != nil {
+		unix.Munmap(r.sqeMem)
+	}
+	if r.sqRing != nil {
+		unix.Munmap(r.sqRing)
+	}
+	unix.Close(r.fd)
+}
+
+// do runs ops, uringEntries at a time, and sets each op's res.
+// Reads and writes that come up short are finished with
+// pread/pwrite. It returns the first op's error, if any.
+func (r *uring) do(ops []bulkOp) (err error) {
+	if r.err != nil {
+		return r.err
+	}
+	for len(ops) > 0 {
+		n := min(len(ops), len(r.sqes))
+		batch := ops[:n]
+		tail := atomic.LoadUint32(r.sqTail)
+		mask := *r.sqMask
+		for i := range batch {
+			op := &batch[i]
+			idx := (tail + uint32(i)) & mask
+			sqe := &r.sqes[idx]
+			*sqe = uringSQE{Fd: int32(op.fd), Off: uint64(op.off), UserData: uint64(i)}
+			switch op.kind {
+			case bulkRead, bulkWrite:
+				sqe.Opcode = uringOpRead
+				if op.kind == bulkWrite {
+					sqe.Opcode = uringOpWrite
+				}
+				if len(op.buf) > 0 {
+					sqe.Addr = uint64(uintptr(unsafe.Pointer(&op.buf[0])))
+				}
+				sqe.Len = uint32(len(op.buf))
+			case bulkPunch:
+				sqe.Opcode = uringOpFallocate
+				sqe.Addr = uint64(op.n)
+				sqe.Len = unix.FALLOC_FL_PUNCH_HOLE | unix.FALLOC_FL_KEEP_SIZE
+			}
+			r.sqArray[idx] = idx
+		}
+		atomic.StoreUint32(r.sqTail, tail+uint32(n))
+
+		var t0 time.Time
+		if r.h.trace != nil {
+			t0 = time.Now()
+		}
+		submitted, reaped := 0, 0
+		for reaped < n {
+			ret, _, errno := unix.Syscall6(unix.SYS_IO_URING_ENTER, uintptr(r.fd),
+				uintptr(n-submitted), 1, uringEnterGetEvents, 0, 0)
+			if errno == syscall.EINTR || errno == syscall.EAGAIN || errno == syscall.EBUSY {
+				continue
+			}
+			if errno != 0 {
+				err = &os.SyscallError{Syscall: "io_uring_enter", Err: errno}
+				r.poison(batch, submitted-reaped, err)
+				return err
+			}
+			// the kernel may take fewer SQEs than offered.
+			submitted += int(ret)
+			reaped += r.reap(batch)
+		}
+		runtime.KeepAlive(batch)
+
+		for i := range batch {
+			e := batch[i].finish()
+			if e != nil && err == nil {
+				err = e
+			}
+			if r.h.trace != nil {
+				// ops complete together, so each gets the batch's time.
+				r.h.trace(batch[i].event(time.Since(t0), e))
+			}
+		}
+		ops = ops[n:]
+	}
+	return
+}
+
+// reap records the results in the completion queue, and
+// returns how many there were.
+func (r *uring) reap(batch []bulkOp) (n int) {
+	head := atomic.LoadUint32(r.cqHead)
+	ctail := atomic.LoadUint32(r.cqTail)
+	for ; head != ctail; head++ {
+		cqe := &r.cqes[head&*r.cqMask]
+		batch[cqe.UserData].res = cqe.Res
+		n++
+	}
+	atomic.StoreUint32(r.cqHead, head)
+	return
+}
+
+// poison gives up on the ring after io_uring_enter failed
+// with err. The ops in flight may still be reading into, or
+// writing from, their buffers: poison waits for them, and
+// should it fail to, leaves the batch in uringOrphans.
+func (r *uring) poison(batch []bulkOp, inFlight int, err error) {
+	r.err = err
+	for inFlight > 0 {
+		_, _, errno := unix.Syscall6(unix.SYS_IO_URING_ENTER, uintptr(r.fd),
+			0, uintptr(inFlight), uringEnterGetEvents, 0, 0)
+		if errno == syscall.EINTR || errno == syscall.EAGAIN || errno == syscall.EBUSY {
+			continue
+		}
+		if errno != 0 {
+			uringOrphans.Lock()
+			uringOrphans.batches = append(uringOrphans.batches, batch)
+			uringOrphans.Unlock()
+			return
+		}
+		inFlight -= r.reap(batch)
+	}
+}
+
+func (op *bulkOp) length() int64 {
+	if op.kind == bulkPunch {
+		return op.n
+	}
+	return int64(len(op.buf))
+}
+
+func (op *bulkOp) err(err error) error {
+	return opError(op.kind.String(), op.name, op.off, op.length(), err)
+}
+
+func (op *bulkOp) event(d time.Duration, err error) TraceEvent {
+	return TraceEvent{
+		Op:       "uring " + op.kind.String(),
+		Fd:       uintptr(op.fd),
+		Path:     op.name,
+		Offset:   op.off,
+		Length:   op.length(),
+		Duration: d,
+		Result:   int64(op.res),
+		Err:      err,
+	}
+}
+
+// finish turns res into an error, completing short
+// transfers synchronously.
+func (op *bulkOp) finish() error {
+	if op.res < 0 {
+		return op.err(syscall.Errno(-op.res))
+	}
+	if op.kind == bulkPunch || int(op.res) == len(op.buf) {
+		return nil
+	}
+	got := int(op.res)
+	for got < len(op.buf) {
+		var k int
+		var err error
+		if op.kind == bulkRead {
+			k, err = unix.Pread(op.fd, op.buf[got:], op.off+int64(got))
+			if k == 0 && err == nil {
+				// EOF, which callers treat as zeros.
+				clear(op.buf[got:])
+				break
+			}
+		} else {
+			k, err = unix.Pwrite(op.fd, op.buf[got:], op.off+int64(got))
+		}
+		if err != nil {
+			return op.err(err)
+		}
+		got += k
+	}
+	op.res = int32(got)
+	return nil
+}
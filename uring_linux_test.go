@@ -0,0 +1,36 @@
+package sparsified
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+// a ring whose io_uring_enter fails is not used again, as it
+// may hold SQEs that were never submitted.
+func TestURingPoisoned(t *testing.T) {
+	r, err := newURing()
+	if err != nil {
+		t.Skipf("no io_uring here: %v", err)
+	}
+	defer r.close()
+
+	fd, err := os.Create(filepath.Join(t.TempDir(), "ring.img"))
+	panicOn(err)
+	defer fd.Close()
+	f := NewOSFile(fd)
+	panicOn(f.Truncate(1 << 20))
+
+	ringFd := r.fd
+	r.fd = -1
+	err = bulkReadAt(r, f, make([]byte, 4*bulkSeg), 0)
+	r.fd = ringFd
+	if !errors.Is(err, syscall.EBADF) {
+		t.Fatalf("enter on a bad fd: %v", err)
+	}
+	if err = bulkReadAt(r, f, make([]byte, 4096), 0); !errors.Is(err, syscall.EBADF) {
+		t.Fatalf("ring used again after it failed: %v", err)
+	}
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+
+package sparsified
+
+import "errors"
+
+// uring is Linux only; elsewhere the bulk paths
+// always use the syscall engine.
+type uring struct{ h hooks }
+
+func newURing() (*uring, error) { return nil, errors.ErrUnsupported }
+
+func (r *uring) close() {}
+
+func (r *uring) do(ops []bulkOp) error { return errors.ErrUnsupported }
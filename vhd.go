@@ -0,0 +1,371 @@
+package sparsified
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"time"
+)
+
+// VHD dynamic disk support.
+//
+// Reference: Microsoft "Virtual Hard Disk Image Format Specification"
+// version 1.0 (2006). All fields are big endian.
+//
+// A dynamic VHD is laid out as:
+//
+//	0       copy of the footer (512 bytes)
+//	512     dynamic disk header (1024 bytes)
+//	1536    block allocation table (BAT): one uint32 sector
+//	        offset per 2MB block, 0xFFFFFFFF = unallocated
+//	...     blocks: a sector bitmap followed by 2MB of data
+//	end-512 footer
+//
+// Unallocated blocks read as zeros; they are the holes
+// of the raw file. We only store a block if it overlaps
+// a data extent of the raw file.
+
+const (
+	vhdSector       = 512
+	vhdBlockSize    = 2 << 20
+	vhdUnallocated  = 0xFFFFFFFF
+	vhdDiskDynamic  = 3
+	vhdHeaderOffset = 512
+	vhdBATOffset    = 1536
+
+	// limits on what a header may ask of VHDToRaw.
+	vhdMaxSize      = 1 << 62
+	vhdMaxBlockSize = 256 << 20
+)
+
+var vhdEpoch = time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// vhdFooter is the hard disk footer. 512 bytes.
+type vhdFooter struct {
+	Cookie             [8]byte
+	Features           uint32
+	FileFormatVersion  uint32
+	DataOffset         uint64
+	TimeStamp          uint32
+	CreatorApplication [4]byte
+	CreatorVersion     uint32
+	CreatorHostOS      uint32
+	OriginalSize       uint64
+	CurrentSize        uint64
+	Cylinders          uint16
+	Heads              uint8
+	SectorsPerTrack    uint8
+	DiskType           uint32
+	Checksum           uint32
+	UniqueId           [16]byte
+	SavedState         uint8
+	Reserved           [427]byte
+}
+
+// vhdDynamicHeader is the dynamic disk header. 1024 bytes.
+type vhdDynamicHeader struct {
+	Cookie            [8]byte
+	DataOffset        uint64
+	TableOffset       uint64
+	HeaderVersion     uint32
+	MaxTableEntries   uint32
+	BlockSize         uint32
+	Checksum          uint32
+	ParentUniqueId    [16]byte
+	ParentTimeStamp   uint32
+	Reserved1         uint32
+	ParentUnicodeName [512]byte
+	ParentLocators    [8][24]byte
+	Reserved2         [256]byte
+}
+
+// vhdChecksum is the one's complement of the byte sum,
+// computed with the checksum field itself zeroed.
+func vhdChecksum(b []byte) (sum uint32) {
+	for _, c := range b {
+		sum += uint32(c)
+	}
+	return ^sum
+}
+
+// vhdGeometry computes the CHS geometry from the
+// algorithm in appendix A of the specification.
+func vhdGeometry(size int64) (cyl uint16, heads, spt uint8) {
+	total := size / vhdSector
+	if total > 65535*16*255 {
+		total = 65535 * 16 * 255
+	}
+	var h, s, cth int64
+	if total >= 65535*16*63 {
+		s = 255
+		h = 16
+		cth = total / s
+	} else {
+		s = 17
+		cth = total / s
+		h = (cth + 1023) / 1024
+		if h < 4 {
+			h = 4
+		}
+		if cth >= h*1024 || h > 16 {
+			s = 31
+			h = 16
+			cth = total / s
+		}
+		if cth >= h*1024 {
+			s = 63
+			h = 16
+			cth = total / s
+		}
+	}
+	return uint16(cth / h), uint8(h), uint8(s)
+}
+
+func beBytes(data any) []byte {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, data)
+	return buf.Bytes()
+}
+
+// RawToVHD writes src, a raw (possibly sparse) disk image,
+// to dst as a dynamic VHD. Holes in src spanning whole
+// 2MB blocks are not allocated in the image. The virtual
+// size is the size of src rounded up to a 512 byte sector.
+//
+// Like RawToVMDK, dst is written strictly sequentially,
+// and Options.ResumeAt is ignored.
+func RawToVHD(ctx context.Context, dst io.Writer, src SparseFile, opts *Options) (err error) {
+	defer func() { err = opError("vhd export", src.Name(), 0, 0, err) }()
+	src = withHooks(src, opts)
+	size, err := sparseSize(src)
+	if err != nil {
+		return err
+	}
+	exts, err := src.Extents()
+	if err != nil {
+		return err
+	}
+	data := onlyData(exts)
+	pr := newProgress(ctx, "vhd export", opts, size, dataBytes(exts))
+	defer func() { err = pr.done(err) }()
+	vsize := ceilDiv(size, vhdSector) * vhdSector
+	used := grainsWithData(data, size, vhdBlockSize)
+	nblock := int64(len(used))
+
+	batBytes := ceilDiv(nblock*4, vhdSector) * vhdSector
+	bitmapBytes := ceilDiv(vhdBlockSize/vhdSector/8, vhdSector) * vhdSector
+	bat := make([]uint32, batBytes/4)
+	for i := range bat {
+		bat[i] = vhdUnallocated
+	}
+	next := int64(vhdBATOffset) + batBytes
+	for b, ok := range used {
+		if ok {
+			bat[b] = uint32(next / vhdSector)
+			next += bitmapBytes + vhdBlockSize
+		}
+	}
+	if next/vhdSector > vhdUnallocated-1 {
+		return fmt.Errorf("RawToVHD: image would exceed the 2TB limit of 32-bit BAT entries")
+	}
+
+	ft := &vhdFooter{
+		Features:          2, // reserved bit, always set.
+		FileFormatVersion: 0x00010000,
+		DataOffset:        vhdHeaderOffset,
+		TimeStamp:         uint32(time.Since(vhdEpoch) / time.Second),
+		CreatorVersion:    0x00010000,
+		CreatorHostOS:     0x5769326B, // "Wi2k"
+		OriginalSize:      uint64(vsize),
+		CurrentSize:       uint64(vsize),
+		DiskType:          vhdDiskDynamic,
+	}
+	copy(ft.Cookie[:], "conectix")
+	copy(ft.CreatorApplication[:], "spfd")
+	ft.Cylinders, ft.Heads, ft.SectorsPerTrack = vhdGeometry(vsize)
+	rand.Read(ft.UniqueId[:])
+	ft.Checksum = vhdChecksum(beBytes(ft))
+	footer := beBytes(ft)
+
+	dh := &vhdDynamicHeader{
+		DataOffset:      0xFFFFFFFFFFFFFFFF,
+		TableOffset:     vhdBATOffset,
+		HeaderVersion:   0x00010000,
+		MaxTableEntries: uint32(nblock),
+		BlockSize:       vhdBlockSize,
+	}
+	copy(dh.Cookie[:], "cxsparse")
+	dh.Checksum = vhdChecksum(beBytes(dh))
+
+	w := bufio.NewWriterSize(dst, 1<<20)
+	put := func(p []byte) {
+		if err == nil {
+			_, err = w.Write(p)
+		}
+	}
+	put(footer)
+	put(beBytes(dh))
+	put(beBytes(bat))
+
+	// every sector of an allocated block is present.
+	bitmap := bytes.Repeat([]byte{0xFF}, int(bitmapBytes))
+	block := make([]byte, vhdBlockSize)
+	for b, ok := range used {
+		if err != nil {
+			break
+		}
+		off := int64(b) * vhdBlockSize
+		if !ok {
+			err = pr.hole(off, min(vhdBlockSize, size-off))
+			continue
+		}
+		clear(block)
+		_, rerr := src.ReadAt(block, off)
+		if rerr != nil && rerr != io.EOF {
+			return rerr
+		}
+		put(bitmap)
+		put(block)
+		if err == nil {
+			err = pr.data(off, min(vhdBlockSize, size-off))
+		}
+	}
+	put(footer)
+	if err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+// VHDToRaw restores a dynamic VHD from src into dst as a
+// raw disk image. dst is truncated first. Unallocated
+// blocks, sectors absent from a block's bitmap, and any
+// all-zero 4KB blocks are left as holes in dst.
+//
+// Differencing disks are not supported, since they
+// need their parent.
+//
+// Cancellation and Options.ResumeAt work as for VMDKToRaw.
+func VHDToRaw(ctx context.Context, dst SparseFile, src io.ReaderAt, opts *Options) (err error) {
+	defer func() { err = opError("vhd import", dst.Name(), 0, 0, err) }()
+	dst = withHooks(dst, opts)
+	ft := &vhdFooter{}
+	if err = readBE(src, 0, ft); err != nil {
+		return fmt.Errorf("VHDToRaw: reading footer: %w", err)
+	}
+	if string(ft.Cookie[:]) != "conectix" {
+		return fmt.Errorf("VHDToRaw: not a VHD (cookie %q)", ft.Cookie[:])
+	}
+	if ft.DiskType != vhdDiskDynamic {
+		return fmt.Errorf("VHDToRaw: disk type %v is not dynamic (3)", ft.DiskType)
+	}
+	sum := ft.Checksum
+	ft.Checksum = 0
+	if vhdChecksum(beBytes(ft)) != sum {
+		return fmt.Errorf("VHDToRaw: footer checksum mismatch")
+	}
+	dh := &vhdDynamicHeader{}
+	if err = readBE(src, int64(ft.DataOffset), dh); err != nil {
+		return fmt.Errorf("VHDToRaw: reading dynamic header: %w", err)
+	}
+	if string(dh.Cookie[:]) != "cxsparse" {
+		return fmt.Errorf("VHDToRaw: bad dynamic header cookie %q", dh.Cookie[:])
+	}
+	bs := int64(dh.BlockSize)
+	if bs == 0 || bs%vhdSector != 0 || bs > vhdMaxBlockSize {
+		return fmt.Errorf("VHDToRaw: bad block size %v", bs)
+	}
+	if ft.CurrentSize > vhdMaxSize {
+		return fmt.Errorf("VHDToRaw: bad disk size %v", ft.CurrentSize)
+	}
+	size := int64(ft.CurrentSize)
+	// only the entries up to size are used, and they must
+	// be in src before we make room for them.
+	nblock := ceilDiv(size, bs)
+	if int64(dh.MaxTableEntries) < nblock {
+		return fmt.Errorf("VHDToRaw: a BAT of %v entries does not cover a %v byte disk", dh.MaxTableEntries, size)
+	}
+	if dh.TableOffset > vhdMaxSize || !within(src, int64(dh.TableOffset), nblock*4) {
+		return fmt.Errorf("VHDToRaw: a BAT of %v entries at %v does not fit in the image", nblock, dh.TableOffset)
+	}
+	bat := make([]uint32, nblock)
+	if err = readBE(src, int64(dh.TableOffset), bat); err != nil {
+		return fmt.Errorf("VHDToRaw: reading BAT: %w", err)
+	}
+
+	var blocks []Extent
+	for b, sector := range bat {
+		if off := int64(b) * bs; off < size && sector != vhdUnallocated {
+			blocks = append(blocks, Extent{Offset: off, Length: min(bs, size-off)})
+		}
+	}
+	resume := resumeAt(opts)
+	if err = ensureSpace(dst, blocks, resume, opts); err != nil {
+		return err
+	}
+
+	pr := newProgress(ctx, "vhd import", opts, size, dataBytes(blocks))
+	defer func() { err = pr.done(err) }()
+	if resume == 0 {
+		if err = dst.Truncate(0); err != nil {
+			return err
+		}
+	}
+	if err = dst.Truncate(size); err != nil {
+		return err
+	}
+	pr.resume(resume)
+
+	spb := bs / vhdSector // sectors per block
+	bitmapBytes := ceilDiv(ceilDiv(spb, 8), vhdSector) * vhdSector
+	bitmap := make([]byte, bitmapBytes)
+	block := make([]byte, bs)
+	for b, sector := range bat {
+		off := int64(b) * bs
+		if off >= size {
+			break
+		}
+		n := min(bs, size-off)
+		if off+n <= resume {
+			continue
+		}
+		if sector == vhdUnallocated {
+			if err = pr.hole(off, n); err != nil {
+				return err
+			}
+			continue
+		}
+		at := int64(sector) * vhdSector
+		if _, err = src.ReadAt(bitmap, at); err != nil {
+			return fmt.Errorf("VHDToRaw: reading bitmap of block %v: %w", b, err)
+		}
+		if _, err = src.ReadAt(block, at+bitmapBytes); err != nil {
+			return fmt.Errorf("VHDToRaw: reading block %v: %w", b, err)
+		}
+		for s := int64(0); s < spb; s++ {
+			if bitmap[s/8]&(0x80>>(s%8)) == 0 {
+				clear(block[s*vhdSector : (s+1)*vhdSector])
+			}
+		}
+		if err = writeAtSparse(dst, block[:n], off); err != nil {
+			return err
+		}
+		if err = pr.data(off, n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readBE reads big-endian data from r at off.
+func readBE(r io.ReaderAt, off int64, data any) error {
+	buf := make([]byte, binary.Size(data))
+	if _, err := r.ReadAt(buf, off); err != nil {
+		return err
+	}
+	return binary.Read(bytes.NewReader(buf), binary.BigEndian, data)
+}
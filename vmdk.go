@@ -0,0 +1,428 @@
+package sparsified
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+)
+
+// VMDK monolithicSparse support.
+//
+// Reference: VMware Virtual Disk Format 1.1,
+// https://www.vmware.com/app/vmdk/?src=vmdk
+// (also qemu's block/vmdk.c is very readable).
+//
+// A monolithicSparse image is a single file:
+//
+//	sector 0         SparseExtentHeader (little endian)
+//	sector 1..       embedded text descriptor
+//	gdOffset         grain directory: one uint32 sector offset per grain table
+//	gdOffset+...     grain tables: 512 uint32 sector offsets per table, 0 = unallocated
+//	overHead         grains, 64KB each, in any order
+//
+// Unallocated grains read as zeros, so they are exactly
+// the holes of the raw file. We only store a grain
+// if it overlaps a data extent of the raw file.
+
+const (
+	vmdkMagic          = 0x564d444b // "KDMV" on disk.
+	vmdkSector         = 512
+	vmdkGrainSectors   = 128 // 64KB grains, the VMware default.
+	vmdkGrainSize      = vmdkGrainSectors * vmdkSector
+	vmdkNumGTEsPerGT   = 512
+	vmdkDescSectors    = 20
+	vmdkFlagNewline    = 1 << 0
+	vmdkFlagRedundant  = 1 << 1
+	vmdkFlagCompressed = 1 << 16
+
+	// limits on what a header may ask of VMDKToRaw: 2^53
+	// sectors keeps byte offsets within an int64; qemu
+	// allows no more than 512 entries per grain table.
+	vmdkMaxSectors      = 1 << 53
+	vmdkMaxGrainSectors = 1 << 17 // 64MB.
+	vmdkMaxDescSectors  = 2048    // 1MB.
+)
+
+// vmdkHeader is the on-disk SparseExtentHeader. Packed, 512 bytes.
+type vmdkHeader struct {
+	MagicNumber        uint32
+	Version            uint32
+	Flags              uint32
+	Capacity           uint64 // in sectors
+	GrainSize          uint64 // in sectors
+	DescriptorOffset   uint64 // in sectors
+	DescriptorSize     uint64 // in sectors
+	NumGTEsPerGT       uint32
+	RgdOffset          uint64 // in sectors
+	GdOffset           uint64 // in sectors
+	OverHead           uint64 // in sectors
+	UncleanShutdown    uint8
+	SingleEndLineChar  uint8
+	NonEndLineChar     uint8
+	DoubleEndLineChar1 uint8
+	DoubleEndLineChar2 uint8
+	CompressAlgorithm  uint16
+	Pad                [433]uint8
+}
+
+func ceilDiv(a, b int64) int64 {
+	return (a + b - 1) / b
+}
+
+// grainsWithData returns, for each grain of size grainSz
+// covering [0, size), whether it overlaps any data extent.
+func grainsWithData(data []Extent, size, grainSz int64) []bool {
+	used := make([]bool, ceilDiv(size, grainSz))
+	for _, e := range data {
+		for g := e.Offset / grainSz; g*grainSz < e.End(); g++ {
+			used[g] = true
+		}
+	}
+	return used
+}
+
+// RawToVMDK writes src, a raw (possibly sparse) disk image,
+// to dst as a VMDK monolithicSparse image. Holes in src
+// that span whole 64KB grains are not allocated in the
+// image. The image capacity is the size of src rounded up
+// to a 512 byte sector.
+//
+// The image is written strictly sequentially, so dst
+// can be a pipe or network connection. For the same reason
+// Options.ResumeAt is ignored; a canceled export has to be
+// started over.
+func RawToVMDK(ctx context.Context, dst io.Writer, src SparseFile, opts *Options) (err error) {
+	defer func() { err = opError("vmdk export", src.Name(), 0, 0, err) }()
+	src = withHooks(src, opts)
+	size, err := sparseSize(src)
+	if err != nil {
+		return err
+	}
+	exts, err := src.Extents()
+	if err != nil {
+		return err
+	}
+	data := onlyData(exts)
+	pr := newProgress(ctx, "vmdk export", opts, size, dataBytes(exts))
+	defer func() { err = pr.done(err) }()
+	capacity := ceilDiv(size, vmdkSector) // in sectors
+	used := grainsWithData(data, size, vmdkGrainSize)
+	numGrains := int64(len(used))
+	numGTs := ceilDiv(numGrains, vmdkNumGTEsPerGT)
+
+	gdOffset := int64(1 + vmdkDescSectors)
+	gdSectors := ceilDiv(numGTs*4, vmdkSector)
+	gtOffset := gdOffset + gdSectors
+	gtSectors := int64(vmdkNumGTEsPerGT * 4 / vmdkSector)
+	overHead := ceilDiv(gtOffset+numGTs*gtSectors, vmdkGrainSectors) * vmdkGrainSectors
+
+	hdr := &vmdkHeader{
+		MagicNumber:        vmdkMagic,
+		Version:            1,
+		Flags:              vmdkFlagNewline,
+		Capacity:           uint64(capacity),
+		GrainSize:          vmdkGrainSectors,
+		DescriptorOffset:   1,
+		DescriptorSize:     vmdkDescSectors,
+		NumGTEsPerGT:       vmdkNumGTEsPerGT,
+		GdOffset:           uint64(gdOffset),
+		OverHead:           uint64(overHead),
+		SingleEndLineChar:  '\n',
+		NonEndLineChar:     ' ',
+		DoubleEndLineChar1: '\r',
+		DoubleEndLineChar2: '\n',
+	}
+
+	// grain directory and tables, laid out contiguously.
+	gd := make([]uint32, numGTs)
+	for i := range gd {
+		gd[i] = uint32(gtOffset + int64(i)*gtSectors)
+	}
+	gt := make([]uint32, numGTs*vmdkNumGTEsPerGT)
+	next := overHead
+	for g, ok := range used {
+		if ok {
+			gt[g] = uint32(next)
+			next += vmdkGrainSectors
+		}
+	}
+	if next > 1<<32-1 {
+		return fmt.Errorf("RawToVMDK: image would exceed the 2TB limit of 32-bit grain table entries")
+	}
+
+	w := bufio.NewWriterSize(dst, vmdkGrainSize)
+	pos := int64(0) // bytes written, to pad to sector offsets.
+	put := func(p []byte) {
+		if err != nil {
+			return
+		}
+		var n int
+		n, err = w.Write(p)
+		pos += int64(n)
+	}
+	padTo := func(sector int64) {
+		for pos < sector*vmdkSector && err == nil {
+			n := min(sector*vmdkSector-pos, int64(len(oneZeroBlock4k)))
+			put(oneZeroBlock4k[:n])
+		}
+	}
+
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, hdr)
+	put(buf.Bytes())
+
+	desc := vmdkDescriptor(capacity, src.Name())
+	if len(desc) > vmdkDescSectors*vmdkSector {
+		return fmt.Errorf("RawToVMDK: descriptor too long (%v bytes)", len(desc))
+	}
+	put([]byte(desc))
+	padTo(gdOffset)
+
+	buf.Reset()
+	binary.Write(&buf, binary.LittleEndian, gd)
+	put(buf.Bytes())
+	padTo(gtOffset)
+
+	buf.Reset()
+	binary.Write(&buf, binary.LittleEndian, gt)
+	put(buf.Bytes())
+	padTo(overHead)
+
+	grain := make([]byte, vmdkGrainSize)
+	for g, ok := range used {
+		if err != nil {
+			break
+		}
+		off := int64(g) * vmdkGrainSize
+		if !ok {
+			err = pr.hole(off, min(vmdkGrainSize, size-off))
+			continue
+		}
+		clear(grain)
+		_, rerr := src.ReadAt(grain, off)
+		if rerr != nil && rerr != io.EOF {
+			return rerr
+		}
+		put(grain)
+		if err == nil {
+			err = pr.data(off, min(vmdkGrainSize, size-off))
+		}
+	}
+	if err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+// vmdkDescriptor returns the embedded text descriptor.
+func vmdkDescriptor(capacity int64, name string) string {
+	cyl := capacity / (16 * 63)
+	if cyl > 16383 {
+		cyl = 16383
+	}
+	base := name[strings.LastIndexByte(name, '/')+1:]
+	return fmt.Sprintf(`# Disk DescriptorFile
+version=1
+CID=fffffffe
+parentCID=ffffffff
+createType="monolithicSparse"
+
+# Extent description
+RW %v SPARSE "%v"
+
+# The Disk Data Base
+#DDB
+
+ddb.virtualHWVersion = "4"
+ddb.geometry.cylinders = "%v"
+ddb.geometry.heads = "16"
+ddb.geometry.sectors = "63"
+ddb.adapterType = "ide"
+`, capacity, base, cyl)
+}
+
+// VMDKToRaw restores a VMDK monolithicSparse image from src
+// into dst as a raw disk image. dst is truncated first.
+// Unallocated grains, and any all-zero 4KB blocks within
+// allocated grains, are left as holes in dst.
+//
+// Compressed (streamOptimized) images are not supported.
+//
+// If ctx is canceled, VMDKToRaw stops between grains and
+// returns ctx.Err(), with dst in the same state Copy leaves
+// it in: full size, restored up to the Offset of the final
+// Progress report, holes after it. Options.ResumeAt resumes.
+func VMDKToRaw(ctx context.Context, dst SparseFile, src io.ReaderAt, opts *Options) (err error) {
+	defer func() { err = opError("vmdk import", dst.Name(), 0, 0, err) }()
+	dst = withHooks(dst, opts)
+	hdr := &vmdkHeader{}
+	sec := make([]byte, vmdkSector)
+	if _, err = src.ReadAt(sec, 0); err != nil {
+		return fmt.Errorf("VMDKToRaw: reading header: %w", err)
+	}
+	binary.Read(bytes.NewReader(sec), binary.LittleEndian, hdr)
+	if hdr.MagicNumber != vmdkMagic {
+		return fmt.Errorf("VMDKToRaw: not a VMDK sparse extent (magic 0x%x)", hdr.MagicNumber)
+	}
+	if hdr.Flags&vmdkFlagCompressed != 0 {
+		return fmt.Errorf("VMDKToRaw: compressed grains are not supported")
+	}
+	if hdr.GrainSize == 0 || hdr.GrainSize > vmdkMaxGrainSectors ||
+		hdr.NumGTEsPerGT == 0 || hdr.NumGTEsPerGT > vmdkNumGTEsPerGT ||
+		hdr.Capacity > vmdkMaxSectors || hdr.GdOffset > vmdkMaxSectors || hdr.RgdOffset > vmdkMaxSectors ||
+		hdr.DescriptorOffset > vmdkMaxSectors || hdr.DescriptorSize > vmdkMaxDescSectors {
+		return fmt.Errorf("VMDKToRaw: corrupt header: capacity=%v grainSize=%v numGTEsPerGT=%v gdOffset=%v rgdOffset=%v descriptor=%v+%v",
+			hdr.Capacity, hdr.GrainSize, hdr.NumGTEsPerGT, hdr.GdOffset, hdr.RgdOffset, hdr.DescriptorOffset, hdr.DescriptorSize)
+	}
+	if hdr.DescriptorSize > 0 {
+		desc := make([]byte, hdr.DescriptorSize*vmdkSector)
+		if _, err = src.ReadAt(desc, int64(hdr.DescriptorOffset)*vmdkSector); err != nil {
+			return fmt.Errorf("VMDKToRaw: reading descriptor: %w", err)
+		}
+		if i := bytes.Index(desc, []byte("createType=")); i >= 0 &&
+			!bytes.HasPrefix(desc[i:], []byte(`createType="monolithicSparse"`)) {
+			return fmt.Errorf("VMDKToRaw: only monolithicSparse images are supported")
+		}
+	}
+
+	gdOffset := int64(hdr.GdOffset)
+	if hdr.Flags&vmdkFlagRedundant != 0 && hdr.RgdOffset != 0 {
+		// GdOffset may be the -1 "at end of stream" marker
+		// in this case, the redundant copy is reliable.
+		gdOffset = int64(hdr.RgdOffset)
+	}
+	capacity := int64(hdr.Capacity) * vmdkSector
+	grainSz := int64(hdr.GrainSize) * vmdkSector
+	numGrains := ceilDiv(capacity, grainSz)
+	nGTE := int64(hdr.NumGTEsPerGT)
+	numGTs := ceilDiv(numGrains, nGTE)
+
+	// the grain directory must be in src before we make room
+	// for it; each table is checked as it is read.
+	if !within(src, gdOffset*vmdkSector, numGTs*4) {
+		return fmt.Errorf("VMDKToRaw: corrupt header: a grain directory of %v entries at sector %v does not fit in the image",
+			numGTs, gdOffset)
+	}
+	gd := make([]uint32, numGTs)
+	if err = readLE(src, gdOffset*vmdkSector, gd); err != nil {
+		return fmt.Errorf("VMDKToRaw: reading grain directory: %w", err)
+	}
+
+	// read every grain table up front, to know what will be
+	// written before we start.
+	// tables shared between directory entries would let a
+	// small image claim any number of grains.
+	gts := make([][]uint32, numGTs)
+	seen := make(map[uint32]bool)
+	var grains []Extent
+	var total int64
+	for i, gtSector := range gd {
+		if gtSector == 0 {
+			continue
+		}
+		if seen[gtSector] {
+			return fmt.Errorf("VMDKToRaw: corrupt grain directory: table %v is at sector %v too", i, gtSector)
+		}
+		seen[gtSector] = true
+		gts[i] = make([]uint32, nGTE)
+		if err = readLE(src, int64(gtSector)*vmdkSector, gts[i]); err != nil {
+			return fmt.Errorf("VMDKToRaw: reading grain table %v: %w", i, err)
+		}
+		for j, grainSector := range gts[i] {
+			off := (int64(i)*nGTE + int64(j)) * grainSz
+			if off < capacity && grainSector > 1 {
+				grains = append(grains, Extent{Offset: off, Length: min(grainSz, capacity-off)})
+				total += min(grainSz, capacity-off)
+			}
+		}
+	}
+	resume := resumeAt(opts)
+	if err = ensureSpace(dst, grains, resume, opts); err != nil {
+		return err
+	}
+
+	pr := newProgress(ctx, "vmdk import", opts, capacity, total)
+	defer func() { err = pr.done(err) }()
+	if resume == 0 {
+		if err = dst.Truncate(0); err != nil {
+			return err
+		}
+	}
+	if err = dst.Truncate(capacity); err != nil {
+		return err
+	}
+	pr.resume(resume)
+
+	grain := make([]byte, grainSz)
+	for i, gt := range gts {
+		tblOff := int64(i) * nGTE * grainSz
+		tblLen := min(nGTE*grainSz, capacity-tblOff)
+		if tblOff+tblLen <= resume {
+			continue
+		}
+		if gt == nil {
+			// whole table unallocated.
+			if err = pr.hole(tblOff, tblLen); err != nil {
+				return err
+			}
+			continue
+		}
+		for j, grainSector := range gt {
+			g := int64(i)*nGTE + int64(j)
+			if g >= numGrains {
+				break
+			}
+			off := g * grainSz
+			n := min(grainSz, capacity-off)
+			if off+n <= resume {
+				continue
+			}
+			if grainSector <= 1 {
+				// 0: unallocated; 1: explicitly zeroed. Both are holes.
+				if err = pr.hole(off, n); err != nil {
+					return err
+				}
+				continue
+			}
+			if _, err = src.ReadAt(grain[:n], int64(grainSector)*vmdkSector); err != nil {
+				return fmt.Errorf("VMDKToRaw: reading grain %v: %w", g, err)
+			}
+			if err = writeAtSparse(dst, grain[:n], off); err != nil {
+				return err
+			}
+			if err = pr.data(off, n); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// within says whether r has n bytes at off, by reading the
+// last of them, so that sizes from a header can be checked
+// against the image before anything is allocated for them.
+func within(r io.ReaderAt, off, n int64) bool {
+	if off < 0 || n < 0 || off > math.MaxInt64-n {
+		return false
+	}
+	if n == 0 {
+		return true
+	}
+	var b [1]byte
+	_, err := r.ReadAt(b[:], off+n-1)
+	return err == nil
+}
+
+// readLE reads little-endian data from r at off.
+func readLE(r io.ReaderAt, off int64, data any) error {
+	buf := make([]byte, binary.Size(data))
+	if _, err := r.ReadAt(buf, off); err != nil {
+		return err
+	}
+	return binary.Read(bytes.NewReader(buf), binary.LittleEndian, data)
+}
@@ -0,0 +1,305 @@
+package sparsified
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// AllocSample is one measurement of a file's footprint.
+type AllocSample struct {
+	Time time.Time `json:"time"`
+
+	// Apparent is the size, Allocated the storage used,
+	// and Holes the bytes of holes within the size.
+	Apparent  int64 `json:"apparent"`
+	Allocated int64 `json:"allocated"`
+	Holes     int64 `json:"holes"`
+
+	// PostEOF is the storage allocated past the last block
+	// of the file: speculative preallocation on XFS, or
+	// fallocate(2) with FALLOC_FL_KEEP_SIZE. It comes from
+	// FIEMAP where available (PostEOFExact), and is
+	// otherwise estimated from the allocation accounting.
+	PostEOF      int64 `json:"post_eof"`
+	PostEOFExact bool  `json:"post_eof_exact"`
+
+	blockSize int64
+	holes     []Extent
+}
+
+// SampleAlloc measures the file at path. It does not force
+// the file's dirty pages out, as AllocatedExtents does, so
+// that sampling often costs no I/O and leaves delayed
+// allocation to happen as it would have.
+func SampleAlloc(path string) (s AllocSample, err error) {
+	defer func() { err = opError("sample", path, 0, 0, err) }()
+	fd, err := os.Open(path)
+	if err != nil {
+		return s, err
+	}
+	defer fd.Close()
+	fi, err := fd.Stat()
+	if err != nil {
+		return s, err
+	}
+	s.Time = time.Now()
+	s.Apparent = fi.Size()
+	s.Allocated = statAllocated(fi)
+	s.blockSize = statBlockSize(fi)
+	exts, err := Extents(fd)
+	if err != nil {
+		return s, err
+	}
+	for _, e := range exts {
+		if e.Hole {
+			s.Holes += e.Length
+			s.holes = append(s.holes, e)
+		}
+	}
+	s.PostEOF, s.PostEOFExact, err = postEOF(fd, s.Apparent, s.Allocated, s.blockSize, false)
+	return
+}
+
+// beyondSize reports whether more is allocated
+// than the size, rounded up to a block, needs.
+func (s *AllocSample) beyondSize() bool {
+	return s.Allocated > ceilDiv(s.Apparent, s.blockSize)*s.blockSize
+}
+
+// filledSince returns how many bytes that were holes
+// in prev are data in s.
+func (s *AllocSample) filledSince(prev *AllocSample) (n int64) {
+	for _, h := range prev.holes {
+		data := Extent{Offset: h.Offset, Length: min(h.End(), s.Apparent) - h.Offset}
+		if data.Length <= 0 {
+			continue
+		}
+		// what is left of h once s's holes are taken out.
+		n += data.Length
+		for _, sh := range s.holes {
+			if beg, endx := max(sh.Offset, data.Offset), min(sh.End(), data.End()); beg < endx {
+				n -= endx - beg
+			}
+		}
+	}
+	return
+}
+
+// AllocEventKind says what changed about a watched file.
+type AllocEventKind int
+
+const (
+	// AllocBeyondSize: the file now uses more storage than
+	// its size needs. AllocWithinSize: it no longer does.
+	AllocBeyondSize AllocEventKind = iota + 1
+	AllocWithinSize
+
+	// PreallocAppeared and PreallocGone track storage
+	// allocated past EOF.
+	PreallocAppeared
+	PreallocGone
+
+	// HolesFilled: some holes have become data; see Filled.
+	HolesFilled
+
+	// WatchError: the file could not be sampled (reported
+	// once until it can be again), or the JSON-lines sink
+	// could not be written; see Err. Watching carries on.
+	WatchError
+)
+
+var allocEventNames = map[AllocEventKind]string{
+	AllocBeyondSize:  "alloc_beyond_size",
+	AllocWithinSize:  "alloc_within_size",
+	PreallocAppeared: "prealloc_appeared",
+	PreallocGone:     "prealloc_gone",
+	HolesFilled:      "holes_filled",
+	WatchError:       "error",
+}
+
+func (k AllocEventKind) String() string {
+	if s, ok := allocEventNames[k]; ok {
+		return s
+	}
+	return fmt.Sprintf("AllocEventKind(%d)", int(k))
+}
+
+func (k AllocEventKind) MarshalText() ([]byte, error) {
+	return []byte(k.String()), nil
+}
+
+// AllocEvent is emitted by a Watcher. Sample is the
+// measurement that triggered it, Prev the one before.
+type AllocEvent struct {
+	Kind   AllocEventKind `json:"kind"`
+	Path   string         `json:"path"`
+	Sample AllocSample    `json:"sample"`
+	Prev   AllocSample    `json:"prev"`
+	Filled int64          `json:"filled,omitempty"`
+	Err    string         `json:"err,omitempty"`
+}
+
+// WatchOptions tunes Watch. A nil *WatchOptions is fine.
+type WatchOptions struct {
+	// JSONLines, if set, also gets every event,
+	// as one JSON object per line.
+	JSONLines io.Writer
+
+	// Buffer is the capacity of Events; default 16. When
+	// it is full, the watcher waits rather than drop events.
+	Buffer int
+}
+
+// Watcher samples a file periodically; see Watch.
+type Watcher struct {
+	// Events delivers the events, and is closed by Close.
+	Events <-chan AllocEvent
+
+	path   string
+	every  time.Duration
+	events chan AllocEvent
+	sink   io.Writer
+	quit   chan struct{}
+	wg     sync.WaitGroup
+	once   sync.Once
+}
+
+// Watch samples the file at path every interval (see
+// SampleAlloc), and emits an AllocEvent whenever:
+//
+//   - allocation grows beyond the apparent size, or
+//     falls back within it;
+//   - storage past EOF appears or disappears;
+//   - holes get filled.
+//
+// The conditions are reported on transitions only, with the
+// first sample compared against an empty file, so anything
+// already true at the start is reported straight away.
+// Watch fails if the first sample does, or if interval is
+// not positive.
+func Watch(path string, interval time.Duration, opts *WatchOptions) (*Watcher, error) {
+	if interval <= 0 {
+		return nil, opError("watch", path, 0, 0, syscall.EINVAL)
+	}
+	first, err := SampleAlloc(path)
+	if err != nil {
+		return nil, err
+	}
+	if opts == nil {
+		opts = &WatchOptions{}
+	}
+	buf := opts.Buffer
+	if buf <= 0 {
+		buf = 16
+	}
+	w := &Watcher{
+		path:   path,
+		every:  interval,
+		events: make(chan AllocEvent, buf),
+		sink:   opts.JSONLines,
+		quit:   make(chan struct{}),
+	}
+	w.Events = w.events
+	w.wg.Add(1)
+	go w.run(first)
+	return w, nil
+}
+
+// Close stops the watcher and closes Events.
+func (w *Watcher) Close() error {
+	w.once.Do(func() {
+		close(w.quit)
+		w.wg.Wait()
+		close(w.events)
+	})
+	return nil
+}
+
+func (w *Watcher) run(cur AllocSample) {
+	defer w.wg.Done()
+	prev := AllocSample{blockSize: cur.blockSize}
+	tick := time.NewTicker(w.every)
+	defer tick.Stop()
+	for {
+		if !w.compare(&prev, &cur) {
+			return
+		}
+		prev = cur
+		select {
+		case <-w.quit:
+			return
+		case <-tick.C:
+		}
+		s, err := SampleAlloc(w.path)
+		if err != nil && !w.emit(AllocEvent{Kind: WatchError, Err: err.Error(), Prev: prev}) {
+			return
+		}
+		// then quietly retry until the file is back.
+		for err != nil {
+			select {
+			case <-w.quit:
+				return
+			case <-tick.C:
+			}
+			s, err = SampleAlloc(w.path)
+		}
+		cur = s
+	}
+}
+
+// compare emits the events between prev and cur. It returns
+// false if the watcher was closed meanwhile.
+func (w *Watcher) compare(prev, cur *AllocSample) bool {
+	ev := func(k AllocEventKind) AllocEvent {
+		return AllocEvent{Kind: k, Sample: *cur, Prev: *prev}
+	}
+	var evs []AllocEvent
+	if b0, b1 := prev.beyondSize(), cur.beyondSize(); b1 && !b0 {
+		evs = append(evs, ev(AllocBeyondSize))
+	} else if b0 && !b1 {
+		evs = append(evs, ev(AllocWithinSize))
+	}
+	if prev.PostEOF == 0 && cur.PostEOF > 0 {
+		evs = append(evs, ev(PreallocAppeared))
+	} else if prev.PostEOF > 0 && cur.PostEOF == 0 {
+		evs = append(evs, ev(PreallocGone))
+	}
+	if !prev.Time.IsZero() {
+		if n := cur.filledSince(prev); n > 0 {
+			e := ev(HolesFilled)
+			e.Filled = n
+			evs = append(evs, e)
+		}
+	}
+	for _, e := range evs {
+		if !w.emit(e) {
+			return false
+		}
+	}
+	return true
+}
+
+func (w *Watcher) emit(e AllocEvent) bool {
+	e.Path = w.path
+	if w.sink != nil {
+		b, _ := json.Marshal(e)
+		if _, err := w.sink.Write(append(b, '\n')); err != nil {
+			// report it once, then give up on the sink.
+			w.sink = nil
+			if !w.emit(AllocEvent{Kind: WatchError, Err: fmt.Sprintf("writing JSON lines: %v", err), Sample: e.Sample, Prev: e.Prev}) {
+				return false
+			}
+		}
+	}
+	select {
+	case w.events <- e:
+		return true
+	case <-w.quit:
+		return false
+	}
+}
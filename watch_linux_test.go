@@ -0,0 +1,103 @@
+package sparsified
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestWatchAllocation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "watched.img")
+	fd, err := os.Create(path)
+	panicOn(err)
+	defer fd.Close()
+	_, err = fd.WriteAt(bytes.Repeat([]byte{1}, 8192), 0)
+	panicOn(err)
+	panicOn(fd.Truncate(64 << 10))
+	if _, err := AllocatedExtents(fd); err != nil {
+		t.Skipf("no FIEMAP here: %v", err)
+	}
+
+	var sink bytes.Buffer
+	w, err := Watch(path, 5*time.Millisecond, &WatchOptions{JSONLines: &sink})
+	panicOn(err)
+	defer w.Close()
+
+	// events of one sample arrive together, in no set order.
+	seen := map[AllocEventKind]AllocEvent{}
+	waitFor := func(want AllocEventKind) AllocEvent {
+		t.Helper()
+		timeout := time.After(5 * time.Second)
+		for {
+			if e, ok := seen[want]; ok {
+				delete(seen, want)
+				return e
+			}
+			select {
+			case e := <-w.Events:
+				if e.Kind == WatchError {
+					t.Fatalf("watch error: %v", e.Err)
+				}
+				seen[e.Kind] = e
+			case <-timeout:
+				t.Fatalf("no %v event", want)
+			}
+		}
+	}
+
+	// preallocate past EOF, as XFS does speculatively.
+	panicOn(unix.Fallocate(int(fd.Fd()), unix.FALLOC_FL_KEEP_SIZE, 64<<10, 1<<20))
+	e := waitFor(PreallocAppeared)
+	if !e.Sample.PostEOFExact || e.Sample.PostEOF < 1<<20-64<<10 {
+		t.Fatalf("post-EOF preallocation: %+v", e.Sample)
+	}
+	waitFor(AllocBeyondSize)
+
+	_, err = fd.WriteAt(bytes.Repeat([]byte{2}, 4096), 16<<10)
+	panicOn(err)
+	if e = waitFor(HolesFilled); e.Filled != 4096 {
+		t.Fatalf("filled %v bytes, want 4096", e.Filled)
+	}
+
+	// truncating to the same size drops it again.
+	panicOn(fd.Truncate(64 << 10))
+	waitFor(PreallocGone)
+	waitFor(AllocWithinSize)
+
+	w.Close()
+	if _, ok := <-w.Events; ok {
+		t.Fatalf("Events not closed")
+	}
+	kinds := map[string]bool{}
+	sc := bufio.NewScanner(&sink)
+	for sc.Scan() {
+		var ev struct{ Kind string }
+		panicOn(json.Unmarshal(sc.Bytes(), &ev))
+		kinds[ev.Kind] = true
+	}
+	for _, k := range []string{"prealloc_appeared", "alloc_beyond_size", "holes_filled", "prealloc_gone", "alloc_within_size"} {
+		if !kinds[k] {
+			t.Fatalf("JSON lines lack %v: %v", k, sink.String())
+		}
+	}
+}
+
+func TestWatchBadInterval(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "watched.img")
+	panicOn(os.WriteFile(path, []byte("x"), 0644))
+	for _, every := range []time.Duration{0, -time.Second} {
+		w, err := Watch(path, every, nil)
+		var se *SparseOpError
+		if w != nil || !errors.As(err, &se) || !errors.Is(err, syscall.EINVAL) {
+			t.Fatalf("interval %v: %v, %v", every, w, err)
+		}
+	}
+}